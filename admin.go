@@ -89,6 +89,9 @@ func getAdminCommands() []*cli.Command {
 		GetStore().Wrap(resetCmd()),
 		GetStore().Wrap(isSetup()),
 		GetStore().Wrap(userCmd()),
+		GetStore().Wrap(migrateCmd()),
+		GetStore().Wrap(cryptoCmd()),
+		keysCmd(),
 	}
 }
 
@@ -356,6 +359,12 @@ func userCmd() *cli.Command {
 			*overridePasswordCmd(),
 			*testEMail(),
 			*testLoginCmd(),
+			*apiKeyCmd(),
+			*twoFactorCmd(),
+			*unlockUserCmd(),
+			*groupCmd(),
+			*inviteCmd(),
+			*migrateUserIDsCmd(),
 		},
 	}
 }
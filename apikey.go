@@ -0,0 +1,499 @@
+package teak
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	echo "github.com/labstack/echo/v4"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/urfave/cli.v1"
+)
+
+//APIKey - a long lived key used by programs to access the APIs on behalf of an
+//user. Only the hash of the key is stored. The access level of a request made
+//with the key is the lower of the key's level and the owner's level
+type APIKey struct {
+	ID        string    `json:"id" db:"id"`
+	UserID    string    `json:"userID" db:"user_id"`
+	Name      string    `json:"name" db:"name"`
+	Hash      string    `json:"-" db:"hash"`
+	Auth      AuthLevel `json:"auth" db:"auth"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+	ExpiresAt time.Time `json:"expiresAt" db:"expires_at"`
+}
+
+//apiKeyPrefix - prefix of the API keys, makes the keys easy to identify
+const apiKeyPrefix = "tk_"
+
+//APIKeyStorage - optional interface of user storages that store API keys
+type APIKeyStorage interface {
+	//CreateAPIKey - stores an API key
+	CreateAPIKey(gtx context.Context, key *APIKey) (err error)
+
+	//GetAPIKey - gets the API key with given hash
+	GetAPIKey(gtx context.Context, keyHash string) (key *APIKey, err error)
+
+	//GetAPIKeys - gets all the API keys of an user
+	GetAPIKeys(gtx context.Context, userID string) (keys []*APIKey, err error)
+
+	//DeleteAPIKey - deletes the API key with given ID that belongs to the user
+	DeleteAPIKey(gtx context.Context, userID, keyID string) (err error)
+}
+
+//GetAPIKeyStorage - gives the user storage if it supports API keys
+func GetAPIKeyStorage() (storage APIKeyStorage, err error) {
+	storage, ok := unwrapUserStorage(GetUserStorage()).(APIKeyStorage)
+	if !ok {
+		return storage, errors.New(
+			"User storage does not support API keys")
+	}
+	return &metricAPIKeyStorage{storage}, err
+}
+
+//IsExpired - tells if the key is expired, keys with zero expiry time never
+//expire
+func (key *APIKey) IsExpired() bool {
+	return !key.ExpiresAt.IsZero() && time.Now().After(key.ExpiresAt)
+}
+
+//NewAPIKey - creates a new API key for the user and stores it. The key itself
+//is returned only from here, it can not be retrieved later
+func NewAPIKey(
+	gtx context.Context,
+	userID, name string,
+	level AuthLevel,
+	validity time.Duration) (key string, apiKey *APIKey, err error) {
+	if name == "" {
+		return key, apiKey, errors.New("Name is required for API key")
+	}
+	secret, err := randomToken()
+	if err != nil {
+		return key, apiKey, err
+	}
+	key = apiKeyPrefix + secret
+	apiKey = &APIKey{
+		ID:        uuid.NewV4().String(),
+		UserID:    userID,
+		Name:      name,
+		Hash:      HashToken(key),
+		Auth:      level,
+		CreatedAt: time.Now(),
+	}
+	if validity > 0 {
+		apiKey.ExpiresAt = apiKey.CreatedAt.Add(validity)
+	}
+	storage, err := GetAPIKeyStorage()
+	if err != nil {
+		return key, apiKey, err
+	}
+	err = storage.CreateAPIKey(gtx, apiKey)
+	return key, apiKey, err
+}
+
+//apiKeyFromRequest - gives the API key from 'X-API-Key' header or from
+//'Authorization: ApiKey <key>' header
+func apiKeyFromRequest(req *http.Request) string {
+	if key := req.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	header := req.Header.Get(echo.HeaderAuthorization)
+	if strings.HasPrefix(header, "ApiKey ") {
+		return strings.TrimSpace(header[len("ApiKey "):])
+	}
+	return ""
+}
+
+//apiKeyToken - validates the API key and gives a token with the claims of the
+//key owner, so that rest of the request handling does not have to know about
+//API keys. The key ID is part of the user name so that it gets audited
+func apiKeyToken(gtx context.Context, key string) (
+	token *jwt.Token, err error) {
+	storage, err := GetAPIKeyStorage()
+	if err != nil {
+		return token, err
+	}
+	apiKey, err := storage.GetAPIKey(gtx, HashToken(key))
+	if err != nil {
+		return token, err
+	}
+	if apiKey.IsExpired() {
+		return token, errors.New("API key is expired")
+	}
+	owner, err := GetUserStorage().GetUser(gtx, apiKey.UserID)
+	if err != nil {
+		return token, err
+	}
+	if owner.State != Active {
+		return token, errors.New("Owner of the API key is not active")
+	}
+	level := apiKey.Auth
+	if owner.Auth > level {
+		level = owner.Auth
+	}
+	groups, err := userGroups(gtx, owner.UserID)
+	if err != nil {
+		return token, err
+	}
+	token = &jwt.Token{
+		Header: map[string]interface{}{},
+		Claims: jwt.MapClaims{
+			"userID": owner.UserID,
+			"userName": fmt.Sprintf("%s %s [api key %s]",
+				owner.FirstName, owner.LastName, apiKey.ID),
+			"userType": "apikey",
+			"access":   float64(level),
+			"apiKeyID": apiKey.ID,
+			"groups":   groups,
+		},
+		Valid: true,
+	}
+	return token, err
+}
+
+//apiKeyOwner - gives the user whose keys are managed by the request, which is
+//the user given in URL for admin endpoints and the logged in user otherwise
+func apiKeyOwner(ctx echo.Context) (userID string, session Session, err error) {
+	session, err = RetrieveSessionInfo(ctx)
+	if err != nil {
+		return userID, session, err
+	}
+	if session.UserType == "apikey" {
+		//A leaked key should not be able to create or manage other keys
+		err = errors.New("API keys can not be managed using an API key")
+		return userID, session, err
+	}
+	userID = ctx.Param("userID")
+	if userID == "" {
+		userID = session.UserID
+	}
+	return userID, session, err
+}
+
+func createAPIKey(ctx echo.Context) (err error) {
+	status, msg := DefMS("Create API key")
+	params := struct {
+		Name      string     `json:"name"`
+		Auth      *AuthLevel `json:"auth"`
+		ValidDays int        `json:"validDays"`
+	}{}
+	var data M
+	var apiKey *APIKey
+	userID, session, err := apiKeyOwner(ctx)
+	if err != nil {
+		msg = "Not allowed to create API key"
+		status = http.StatusForbidden
+	}
+	if err == nil {
+		if err = ctx.Bind(&params); err != nil {
+			msg = "Failed to read API key parameters"
+			status = http.StatusBadRequest
+		}
+	}
+	gtx := ctx.Request().Context()
+	if err == nil {
+		var owner *User
+		owner, err = GetUserStorage().GetUser(gtx, userID)
+		level := session.Role
+		if err == nil {
+			if owner.Auth > level {
+				level = owner.Auth
+			}
+			//Key acts as its owner, so creating a key for a more privileged
+			//user would be impersonation. Key can not be more privileged than
+			//its owner or its creator
+			if owner.Auth < session.Role && owner.UserID != session.UserID {
+				err = errors.New(
+					"API key can not be created for a more privileged user")
+				msg = err.Error()
+				status = http.StatusForbidden
+			} else if params.Auth != nil && *params.Auth < level {
+				err = errors.New("API key can not have higher access level")
+				msg = err.Error()
+				status = http.StatusForbidden
+			} else if params.Auth != nil {
+				level = *params.Auth
+			}
+		} else {
+			msg = "Failed to find the owner of API key"
+			status = http.StatusBadRequest
+		}
+		if err == nil {
+			var key string
+			validity := time.Duration(params.ValidDays) * 24 * time.Hour
+			key, apiKey, err = NewAPIKey(
+				gtx, userID, params.Name, level, validity)
+			if err != nil {
+				msg = "Failed to create API key"
+				status = http.StatusInternalServerError
+			} else {
+				data = M{
+					"key":    key,
+					"apiKey": apiKey,
+				}
+			}
+		}
+	}
+	err = AuditedSendX(ctx, apiKey, &Result{
+		Status: status,
+		Op:     "apikey_create",
+		Msg:    msg,
+		OK:     err == nil,
+		Data:   data,
+		Err:    ErrString(err),
+	})
+	return LogError("t.uman.apikey", err)
+}
+
+func getAPIKeys(ctx echo.Context) (err error) {
+	status, msg := DefMS("Get API keys")
+	var keys []*APIKey
+	userID, _, err := apiKeyOwner(ctx)
+	if err != nil {
+		msg = "Not allowed to list API keys"
+		status = http.StatusForbidden
+	} else {
+		var storage APIKeyStorage
+		storage, err = GetAPIKeyStorage()
+		if err == nil {
+			keys, err = storage.GetAPIKeys(ctx.Request().Context(), userID)
+		}
+		if err != nil {
+			msg = "Failed to retrieve API keys"
+			status = http.StatusInternalServerError
+		}
+	}
+	err = SendAndAuditOnErr(ctx, &Result{
+		Status: status,
+		Op:     "apikey_list",
+		Msg:    msg,
+		OK:     err == nil,
+		Data:   keys,
+		Err:    ErrString(err),
+	})
+	return LogError("t.uman.apikey", err)
+}
+
+func deleteAPIKey(ctx echo.Context) (err error) {
+	status, msg := DefMS("Revoke API key")
+	keyID := ctx.Param("keyID")
+	userID, _, err := apiKeyOwner(ctx)
+	if err != nil {
+		msg = "Not allowed to revoke API key"
+		status = http.StatusForbidden
+	} else {
+		var storage APIKeyStorage
+		storage, err = GetAPIKeyStorage()
+		if err == nil {
+			err = storage.DeleteAPIKey(
+				ctx.Request().Context(), userID, keyID)
+		}
+		if err != nil {
+			msg = "Failed to revoke API key"
+			status = http.StatusInternalServerError
+		}
+	}
+	err = AuditedSend(ctx, &Result{
+		Status: status,
+		Op:     "apikey_revoke",
+		Msg:    msg,
+		OK:     err == nil,
+		Data: M{
+			"userID": userID,
+			"keyID":  keyID,
+		},
+		Err: ErrString(err),
+	})
+	return LogError("t.uman.apikey", err)
+}
+
+func getAPIKeyEndpoints() []*Endpoint {
+	return []*Endpoint{
+		{
+			Method:    echo.POST,
+			URL:       "uman/apikey",
+			Access:    Monitor,
+			Category:  "user management",
+			Func:      createAPIKey,
+			Sensitive: true,
+			Comment:   "Create an API key for the logged in user",
+		},
+		{
+			Method:   echo.GET,
+			URL:      "uman/apikey",
+			Access:   Monitor,
+			Category: "user management",
+			Func:     getAPIKeys,
+			Comment:  "List API keys of the logged in user",
+		},
+		{
+			Method:    echo.DELETE,
+			URL:       "uman/apikey/:keyID",
+			Access:    Monitor,
+			Category:  "user management",
+			Func:      deleteAPIKey,
+			Sensitive: true,
+			Comment:   "Revoke an API key of the logged in user",
+		},
+		{
+			Method:    echo.POST,
+			URL:       "uman/user/:userID/apikey",
+			Access:    Admin,
+			Category:  "user management",
+			Func:      createAPIKey,
+			Sensitive: true,
+			Comment:   "Create an API key for an user",
+		},
+		{
+			Method:   echo.GET,
+			URL:      "uman/user/:userID/apikey",
+			Access:   Admin,
+			Category: "user management",
+			Func:     getAPIKeys,
+			Comment:  "List API keys of an user",
+		},
+		{
+			Method:    echo.DELETE,
+			URL:       "uman/user/:userID/apikey/:keyID",
+			Access:    Admin,
+			Category:  "user management",
+			Func:      deleteAPIKey,
+			Sensitive: true,
+			Comment:   "Revoke an API key of an user",
+		},
+	}
+}
+
+func apiKeyCmd() *cli.Command {
+	userFlag := cli.StringFlag{
+		Name:  "user",
+		Usage: "ID of the user who owns the key",
+	}
+	return &cli.Command{
+		Name:  "apikey",
+		Usage: "Manage API keys of users",
+		Subcommands: []cli.Command{
+			{
+				Name:  "create",
+				Usage: "Create an API key",
+				Flags: []cli.Flag{
+					userFlag,
+					cli.StringFlag{
+						Name:  "name",
+						Usage: "Name that identifies the key",
+					},
+					cli.StringFlag{
+						Name: "role",
+						Usage: "Role of the key, one of: " +
+							"'admin', 'normal', 'monitor'. Owner's role " +
+							"if not given",
+					},
+					cli.IntFlag{
+						Name:  "days",
+						Usage: "Number of days the key is valid, 0 for ever",
+					},
+				},
+				Action: func(ctx *cli.Context) (err error) {
+					ag := NewArgGetter(ctx)
+					userID := ResolveUserID(context.TODO(),
+						ag.GetRequiredString("user"))
+					name := ag.GetRequiredString("name")
+					roleStr := ag.GetOptionalString("role")
+					days := ag.GetOptionalInt("days")
+					if err = ag.Err; err != nil {
+						return err
+					}
+					gtx := context.TODO()
+					owner, err := GetUserStorage().GetUser(gtx, userID)
+					if err != nil {
+						return err
+					}
+					level := owner.Auth
+					if roleStr != "" && toRole(roleStr) > level {
+						level = toRole(roleStr)
+					}
+					key, apiKey, err := NewAPIKey(gtx, userID, name, level,
+						time.Duration(days)*24*time.Hour)
+					if err != nil {
+						return LogErrorX("t.uman.apikey",
+							"Failed to create API key", err)
+					}
+					fmt.Printf("ID:  %s\nKey: %s\n", apiKey.ID, key)
+					fmt.Println("Store the key safely, it can not be shown again")
+					return err
+				},
+			},
+			{
+				Name:  "list",
+				Usage: "List API keys of an user",
+				Flags: []cli.Flag{userFlag},
+				Action: func(ctx *cli.Context) (err error) {
+					ag := NewArgGetter(ctx)
+					userID := ResolveUserID(context.TODO(),
+						ag.GetRequiredString("user"))
+					if err = ag.Err; err != nil {
+						return err
+					}
+					storage, err := GetAPIKeyStorage()
+					if err != nil {
+						return err
+					}
+					keys, err := storage.GetAPIKeys(context.TODO(), userID)
+					if err != nil {
+						return err
+					}
+					tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+					fmt.Fprintln(tw, "ID\tNAME\tROLE\tCREATED\tEXPIRES")
+					for _, key := range keys {
+						expiry := "never"
+						if !key.ExpiresAt.IsZero() {
+							expiry = key.ExpiresAt.Format(time.RFC3339)
+						}
+						fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+							key.ID,
+							key.Name,
+							key.Auth,
+							key.CreatedAt.Format(time.RFC3339),
+							expiry)
+					}
+					return tw.Flush()
+				},
+			},
+			{
+				Name:  "revoke",
+				Usage: "Revoke an API key",
+				Flags: []cli.Flag{
+					userFlag,
+					cli.StringFlag{
+						Name:  "key",
+						Usage: "ID of the key",
+					},
+				},
+				Action: func(ctx *cli.Context) (err error) {
+					ag := NewArgGetter(ctx)
+					userID := ResolveUserID(context.TODO(),
+						ag.GetRequiredString("user"))
+					keyID := ag.GetRequiredString("key")
+					if err = ag.Err; err != nil {
+						return err
+					}
+					storage, err := GetAPIKeyStorage()
+					if err != nil {
+						return err
+					}
+					err = storage.DeleteAPIKey(context.TODO(), userID, keyID)
+					if err == nil {
+						Info("t.uman.apikey", "API key %s revoked", keyID)
+					}
+					return err
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,122 @@
+package teak
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	echo "github.com/labstack/echo/v4"
+)
+
+//callAuthenticated - passes the request through the JWT middleware, gives the
+//session seen by the handler and the status of the response
+func callAuthenticated(req *http.Request) (session Session, status int) {
+	rec := httptest.NewRecorder()
+	ctx := echo.New().NewContext(req, rec)
+	err := jwtMiddleware(func(ctx echo.Context) (err error) {
+		session, err = RetrieveSessionInfo(ctx)
+		return ctx.NoContent(http.StatusOK)
+	})(ctx)
+	status = rec.Code
+	if he, ok := err.(*echo.HTTPError); ok {
+		status = he.Code
+	}
+	return session, status
+}
+
+//createTestUser - creates an active user with given name and auth level,
+//gives the ID of the user
+func createTestUser(t *testing.T,
+	storage *testUserStorage, name string, level AuthLevel) (userID string) {
+	userID, err := storage.CreateUser(context.Background(), &User{
+		UserID:    name,
+		Email:     name + "@example.com",
+		FirstName: "Test",
+		LastName:  name,
+		Auth:      level,
+		State:     Active,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create user %s: %v", name, err)
+	}
+	return userID
+}
+
+func TestAPIKeyAccess(t *testing.T) {
+	storage, restore := useTestStorage(nil)
+	defer restore()
+	gtx := context.Background()
+	userID := createTestUser(t, storage, "admin", Admin)
+	owner := storage.users[userID]
+
+	key, apiKey, err := NewAPIKey(gtx, userID, "ci", Monitor, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create API key: %v", err)
+	}
+	if !strings.HasPrefix(key, apiKeyPrefix) ||
+		storage.apiKeys[HashToken(key)] == nil {
+		t.Fatalf("Expected only the hash of the key to be stored")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-API-Key", key)
+	session, status := callAuthenticated(req)
+	if status != http.StatusOK {
+		t.Fatalf("Expected API key to be accepted, status %d", status)
+	}
+	if session.UserID != userID || session.UserType != "apikey" ||
+		session.Role != Monitor ||
+		!strings.Contains(session.UserName, apiKey.ID) {
+		t.Errorf("Unexpected session for API key %+v", session)
+	}
+
+	//Key does not get more access than its owner has now
+	owner.Auth = Normal
+	key2, _, _ := NewAPIKey(gtx, userID, "deploy", Super, 0)
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(echo.HeaderAuthorization, "ApiKey "+key2)
+	if session, _ = callAuthenticated(req); session.Role != Normal {
+		t.Errorf("Expected key to be limited to owner level, got %s",
+			session.Role)
+	}
+
+	owner.State = Disabled
+	if _, status = callAuthenticated(req); status != http.StatusUnauthorized {
+		t.Errorf("Expected key of disabled user to be rejected, status %d",
+			status)
+	}
+	owner.State = Active
+
+	storage.apiKeys[HashToken(key2)].ExpiresAt = time.Now().Add(-time.Minute)
+	if _, status = callAuthenticated(req); status != http.StatusUnauthorized {
+		t.Errorf("Expected expired key to be rejected, status %d", status)
+	}
+	req.Header.Set(echo.HeaderAuthorization, "ApiKey tk_unknown")
+	if _, status = callAuthenticated(req); status != http.StatusUnauthorized {
+		t.Errorf("Expected unknown key to be rejected, status %d", status)
+	}
+}
+
+func TestAPIKeyCannotManageKeys(t *testing.T) {
+	storage, restore := useTestStorage(nil)
+	defer restore()
+	userID := createTestUser(t, storage, "admin", Admin)
+	key, _, err := NewAPIKey(context.Background(), userID, "ci", Admin, 0)
+	if err != nil {
+		t.Fatalf("Failed to create API key: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/",
+		strings.NewReader(`{"name": "more"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set("X-API-Key", key)
+	rec := httptest.NewRecorder()
+	ctx := echo.New().NewContext(req, rec)
+	jwtMiddleware(createAPIKey)(ctx)
+	if rec.Code != http.StatusForbidden || len(storage.apiKeys) != 1 {
+		t.Errorf("Expected key creation with API key to be forbidden, "+
+			"status %d", rec.Code)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"time"
 
 	"gopkg.in/urfave/cli.v1"
 )
@@ -14,16 +15,21 @@ import (
 //module. Some config callbacks include - initialize, setup, reset etc
 type ModuleConfigFunc func(gtx context.Context, app *App) (err error)
 
-//Module - represents an application module
+//Module - represents an application module. Start is called before the
+//server starts serving, background work started there should end when the
+//context given to it is done. Stop is called after the server has stopped
 type Module struct {
 	Name         string              `json:"name" db:"name"`
 	Description  string              `json:"desc" db:"desc"`
 	Endpoints    []*Endpoint         `json:"endpoints" db:"endpoints"`
 	ItemHandlers []StoredItemHandler `json:"itemHandlers" db:"item_handlers"`
 	Commands     []*cli.Command
+	Migrations   []*Migration
 	Initialize   ModuleConfigFunc
 	Setup        ModuleConfigFunc
 	Reset        ModuleConfigFunc
+	Start        ModuleConfigFunc
+	Stop         ModuleConfigFunc
 }
 
 //App - the application itself
@@ -32,8 +38,12 @@ type App struct {
 	modules    []*Module
 	apiRoot    string
 	apiVersion int
+	gtx        context.Context
 }
 
+//execApp - the application being executed, Serve starts and stops its modules
+var execApp *App
+
 //FromAppDir - gives a absolute path from a path relative to
 //app directory
 func (app *App) FromAppDir(relPath string) (abs string) {
@@ -94,8 +104,57 @@ func (app *App) Exec(gtx context.Context, args []string) (err error) {
 		AddEndpoints(module.Endpoints...)
 	}
 	if err == nil {
+		app.gtx = gtx
+		execApp = app
 		InitServer(app.apiRoot, app.apiVersion)
 		err = app.Run(args)
+		//Commands may have logged audit events that are not yet written
+		stop := time.Duration(GetServerConfig().StopTimeoutSecs) * time.Second
+		ctx, done := context.WithTimeout(context.Background(), stop)
+		LogErrorX("t.app", "Failed to write audit events",
+			FlushAuditEvents(ctx))
+		done()
+	}
+	return err
+}
+
+//Start - runs the start hooks of the modules in the order they were added. If
+//a module fails to start, the modules started before it are stopped
+func (app *App) Start(gtx context.Context) (err error) {
+	for i, module := range app.modules {
+		if module.Start == nil {
+			continue
+		}
+		if err = module.Start(gtx, app); err != nil {
+			LogErrorX("t.app.start", "Failed to start module %s", err,
+				module.Name)
+			app.stopModules(gtx, app.modules[:i])
+			return err
+		}
+		Info("t.app.start", "Started module %s", module.Name)
+	}
+	return err
+}
+
+//Stop - runs the stop hooks of the modules in the reverse order of start. All
+//the modules are stopped even if some of them fail
+func (app *App) Stop(gtx context.Context) (err error) {
+	return app.stopModules(gtx, app.modules)
+}
+
+func (app *App) stopModules(gtx context.Context, modules []*Module) (
+	err error) {
+	for i := len(modules) - 1; i >= 0; i-- {
+		module := modules[i]
+		if module.Stop == nil {
+			continue
+		}
+		if serr := module.Stop(gtx, app); serr != nil {
+			err = LogErrorX("t.app.stop", "Failed to stop module %s", serr,
+				module.Name)
+			continue
+		}
+		Info("t.app.stop", "Stopped module %s", module.Name)
 	}
 	return err
 }
@@ -111,10 +170,10 @@ func NewApp(
 	uStorage UserStorage,
 	genStorage DataStorage) (app *App) {
 
-	dataStorage = genStorage
+	dataStorage = withDataMetrics(genStorage)
 	authenticator = authtr
 	authorizer = authzr
-	userStorage = uStorage
+	userStorage = withUserMetrics(uStorage)
 	// if err := dataStorage.Init(); err != nil {
 	// 	Fatal("t.app.dataStore", "Failed to initilize application store")
 	// }
@@ -176,7 +235,15 @@ func NewApp(
 		Name:        "Core",
 		Description: "teak Core module",
 		Endpoints: MergeEnpoints(
+			getAuthEndpoints(),
 			getUserManagementEndpoints(),
+			getAPIKeyEndpoints(),
+			getTwoFactorEndpoints(),
+			getLockoutEndpoints(),
+			getForgotPasswordEndpoints(),
+			getGroupEndpoints(),
+			getImpersonationEndpoints(),
+			getInviteEndpoints(),
 			getDataEndpoints(),
 			getAdminEndpoints(),
 		),
@@ -190,8 +257,11 @@ func NewApp(
 			// return dataStorage.Init()
 			return nil
 		},
-		Initialize: func(gtx context.Context, app *App) error {
-			return dataStorage.Init(gtx, nil)
+		Initialize: func(gtx context.Context, app *App) (err error) {
+			if err = dataStorage.Init(gtx, nil); err == nil {
+				err = GetAuditor().CreateIndices()
+			}
+			return err
 		},
 		Reset: func(gtx context.Context, app *App) error {
 			return dataStorage.Reset(gtx)
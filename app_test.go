@@ -0,0 +1,71 @@
+package teak
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+//hookedModules - creates modules that record their start and stop in calls,
+//the module named by failStart fails to start and failStop fails to stop
+func hookedModules(calls *[]string, failStart, failStop string,
+	names ...string) []*Module {
+	modules := make([]*Module, 0, len(names))
+	for _, name := range names {
+		name := name
+		modules = append(modules, &Module{
+			Name: name,
+			Start: func(gtx context.Context, app *App) (err error) {
+				*calls = append(*calls, "start "+name)
+				if name == failStart {
+					err = errors.New("start failed")
+				}
+				return err
+			},
+			Stop: func(gtx context.Context, app *App) (err error) {
+				*calls = append(*calls, "stop "+name)
+				if name == failStop {
+					err = errors.New("stop failed")
+				}
+				return err
+			},
+		})
+	}
+	return modules
+}
+
+func TestModuleHooks(t *testing.T) {
+	gtx := context.Background()
+	calls := []string{}
+	app := &App{modules: hookedModules(&calls, "", "b", "a", "b", "c")}
+	//Modules without hooks are skipped
+	app.AddModule(&Module{Name: "plain"})
+	if err := app.Start(gtx); err != nil {
+		t.Fatalf("Failed to start modules: %v", err)
+	}
+	if err := app.Stop(gtx); err == nil {
+		t.Errorf("Expected failure to stop a module to be reported")
+	}
+	expected := []string{
+		"start a", "start b", "start c", "stop c", "stop b", "stop a",
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Expected calls %v, got %v", expected, calls)
+	}
+}
+
+func TestModuleStartFailure(t *testing.T) {
+	calls := []string{}
+	app := &App{modules: hookedModules(&calls, "c", "", "a", "b", "c", "d")}
+	if err := app.Start(context.Background()); err == nil {
+		t.Fatalf("Expected failure to start a module to be reported")
+	}
+	//Only the modules that were started are stopped
+	expected := []string{
+		"start a", "start b", "start c", "stop b", "stop a",
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Expected calls %v, got %v", expected, calls)
+	}
+}
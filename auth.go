@@ -3,10 +3,11 @@ package teak
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
 	echo "github.com/labstack/echo/v4"
 )
 
@@ -55,10 +56,15 @@ var Disabled UserState = "disabled"
 //Flagged - user account is flagged by a user
 var Flagged UserState = "flagged"
 
+//ErrEmailExists - returned by user storage when an user is created or updated
+//with an email that another user has
+var ErrEmailExists = errors.New("User with given email already exists")
+
 //User - represents an user
 type User struct {
-	UserID     string      `json:"userID" db:"userID"`
+	UserID     string      `json:"userID" db:"id" bson:"userid"`
 	Email      string      `json:"email" db:"email"`
+	EmailIndex string      `json:"-" db:"email_index"`
 	Auth       AuthLevel   `json:"auth" db:"auth"`
 	FirstName  string      `json:"firstName" db:"first_name"`
 	LastName   string      `json:"lastName" db:"last_name"`
@@ -75,7 +81,7 @@ type User struct {
 	Props      interface{} `json:"props,omitempty" db:"props,omitempty"`
 }
 
-//Group - group of users
+//Group - group of users, members are identified by their user IDs
 type Group struct {
 	Name  string   `json:"name" db:"name"`
 	Users []string `json:"users" db:"users"`
@@ -98,6 +104,17 @@ func (a AuthLevel) String() string {
 	return "Unknown"
 }
 
+//ParseAuthLevel - gives the auth level for its string representation, the
+//comparison is case insensitive
+func ParseAuthLevel(str string) (level AuthLevel, err error) {
+	for level = Super; level <= Public; level++ {
+		if strings.EqualFold(level.String(), str) {
+			return level, err
+		}
+	}
+	return Public, fmt.Errorf("Invalid auth level '%s'", str)
+}
+
 //UserStorage - interface representing strategy to store and manage user
 //information
 type UserStorage interface {
@@ -202,9 +219,9 @@ func GetUserIDPassword(params map[string]interface{}) (
 	userID string, password string, err error) {
 	var aok, bok bool
 	userID, aok = params["userID"].(string)
-	//UserID is the SHA1 hash of the userID provided
+	//Stored identifier is derived from the userID provided
 	if aok {
-		userID = Hash(userID)
+		userID = ResolveUserID(context.TODO(), userID)
 	}
 	password, bok = params["password"].(string)
 	if !aok || !bok {
@@ -224,6 +241,38 @@ func getAuthEndpoints() []*Endpoint {
 			Access:   Public,
 			Comment:  "Login to application",
 		},
+		{
+			Method:   echo.POST,
+			URL:      "token/refresh",
+			Category: "security",
+			Func:     refreshToken,
+			Access:   Public,
+			Comment:  "Get new access token using a refresh token",
+		},
+		{
+			Method:   echo.POST,
+			URL:      "logout",
+			Category: "security",
+			Func:     logout,
+			Access:   Monitor,
+			Comment:  "Logout, revokes the access token and refresh tokens",
+		},
+		{
+			Method:   echo.GET,
+			URL:      "oidc/login",
+			Category: "security",
+			Func:     oidcLogin,
+			Access:   Public,
+			Comment:  "Start login with OpenID Connect provider",
+		},
+		{
+			Method:   echo.GET,
+			URL:      "oidc/callback",
+			Category: "security",
+			Func:     oidcCallback,
+			Access:   Public,
+			Comment:  "Complete login with OpenID Connect provider",
+		},
 	}
 }
 
@@ -235,33 +284,54 @@ func login(ctx echo.Context) (err error) {
 	status := http.StatusOK
 	var data map[string]interface{}
 	userID := ""
+	idHash := ""
 	name := "" //user name is used for auditing
+	failed := false
 	creds := make(map[string]string)
+	gtx := ctx.Request().Context()
 	err = ctx.Bind(&creds)
 	if err == nil {
-		var user *User
 		userID = creds["userID"]
+		idHash = ResolveUserID(gtx, userID)
 		name = userID
-		user, err = DoLogin(ctx.Request().Context(), userID, creds["password"])
+		//Errors from the counter are logged, they should not block logins
+		wait, cerr := checkAttempt(gtx, idHash, ctx.RealIP())
+		if cerr == ErrTooManyAttempts {
+			ctx.Set("userID", idHash)
+			ctx.Set("userName", name)
+			countLogin("login", cerr)
+			return throttled(ctx, "login", wait)
+		}
+		var user *User
+		user, err = lockedUser(gtx, idHash)
+		if err != nil {
+			msg = "Failed to check user account state"
+			status = http.StatusInternalServerError
+		} else if user != nil {
+			name = user.FirstName + " " + user.LastName
+			msg = "Login failed"
+			status = http.StatusUnauthorized
+			err = errors.New("User account is locked")
+			failed = true
+		}
+	} else {
+		msg = "Failed to read credentials from request"
+		status = http.StatusBadRequest
+	}
+	if err == nil {
+		var user *User
+		user, err = DoLogin(gtx, userID, creds["password"])
 		if err == nil {
 			if user.State == Active {
-				token := jwt.New(jwt.SigningMethodHS256)
-				claims := token.Claims.(jwt.MapClaims)
 				name = user.FirstName + " " + user.LastName
-				claims["userID"] = user.UserID
-				claims["exp"] = time.Now().Add(time.Hour * 24 * 7).Unix()
-				claims["access"] = user.Auth
-				claims["userName"] = name
-				claims["userType"] = "normal"
-				var signed string
-				key := GetJWTKey()
-				signed, err = token.SignedString(key)
-				if err == nil {
-					data = make(map[string]interface{})
-					data["token"] = signed
-					data["user"] = user
-				} else {
-					msg = "Failed to sign token"
+				if IsLegacyUserID(user.UserID) {
+					//Plain user ID is only known at login, so users who are
+					//not migrated by the CLI are migrated here
+					user.UserID, _ = MigrateUserID(gtx, user.UserID, userID)
+					idHash = user.UserID
+				}
+				data, msg, err = loginTokens(gtx, user)
+				if err != nil {
 					status = http.StatusInternalServerError
 				}
 			} else {
@@ -272,17 +342,30 @@ func login(ctx echo.Context) (err error) {
 				err = errors.New(msg)
 			}
 		} else {
+			loginFailed(gtx, idHash, ctx.RealIP())
 			msg = "Login failed"
 			status = http.StatusUnauthorized
+			failed = true
 		}
-	} else {
-		msg = "Failed to read credentials from request"
-		status = http.StatusBadRequest
 	}
-	//SHA1 encoded to avoid storing email in db
-	ctx.Set("userID", Hash(userID))
+	//Hashed to avoid storing email in db
+	ctx.Set("userID", idHash)
 	ctx.Set("userName", name)
-	AuditedSend(ctx, &Result{
+	countLogin("login", err)
+	if failed {
+		//Locked accounts and wrong passwords get the same response, the
+		//actual reason is only audited
+		ctx.JSON(status, &Result{
+			Status: status,
+			Op:     "login",
+			Msg:    msg,
+			Err:    errLoginFailed.Error(),
+		})
+		logCtxEvent(ctx, "login", false, ErrString(err), nil)
+		return LogError("Net:Sec:API", err)
+	}
+	//Tokens should not end up in the audit log
+	AuditedSendSecret(ctx, &Result{
 		Status: status,
 		Op:     "login",
 		Msg:    msg,
@@ -292,3 +375,52 @@ func login(ctx echo.Context) (err error) {
 	})
 	return LogError("Net:Sec:API", err)
 }
+
+//errLoginFailed - error sent for wrong credentials and locked accounts, so
+//that the response does not tell which one it is
+var errLoginFailed = errors.New("Invalid user ID or password")
+
+//lockedUser - gives the user if the account is locked and the lock period is
+//not over yet. Locked accounts are rejected before checking the password so
+//that the response does not tell whether the password is correct
+func lockedUser(gtx context.Context, userID string) (user *User, err error) {
+	user, err = GetUserStorage().GetUser(gtx, userID)
+	if err != nil {
+		//Unknown users are handled by the authenticator
+		return nil, nil
+	}
+	if err = unlockIfExpired(gtx, user); err != nil {
+		return nil, err
+	}
+	if user.State != Locked {
+		return nil, err
+	}
+	return user, err
+}
+
+//loginTokens - gives the tokens for the user who is authenticated with
+//password, or a 2FA challenge if the user has to provide a TOTP code
+func loginTokens(gtx context.Context, user *User) (
+	data M, msg string, err error) {
+	tf, required, err := needsTwoFactor(gtx, user)
+	if err != nil {
+		return data, "Failed to retrieve 2FA details", err
+	}
+	if required {
+		data, err = newChallenge(user, tf.Enabled)
+		if err != nil {
+			return data, "Failed to create 2FA challenge", err
+		}
+		return data, "Two factor authentication required", err
+	}
+	//With 2FA the failures are cleared only after the second step
+	loginSucceeded(gtx, user.UserID)
+	data, expired, err := sessionTokens(gtx, user)
+	if err != nil {
+		return data, "Failed to issue tokens", err
+	}
+	if expired {
+		return data, "Password expired, reset the password to continue", err
+	}
+	return data, "Login successful", err
+}
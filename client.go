@@ -3,9 +3,11 @@ package teak
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -30,6 +32,9 @@ func NewResultReader(r *http.Response) (reader *ResultReader) {
 		reader.Err = fmt.Errorf("Not logged in. URL: %s", url)
 	} else if r.StatusCode == http.StatusForbidden {
 		reader.Err = fmt.Errorf("Unauthorized access. URL: %s", url)
+	} else if r.StatusCode == http.StatusTooManyRequests {
+		reader.Err = fmt.Errorf("Too many requests, retry after %s seconds",
+			r.Header.Get("Retry-After"))
 	} else {
 		defer r.Body.Close()
 		reader.RawData, reader.Err = ioutil.ReadAll(r.Body)
@@ -86,13 +91,36 @@ func (rr *ResultReader) Finish() (err error) {
 //Client - client for orek service
 type Client struct {
 	http.Client
-	Address    string
-	VersionStr string
-	BaseURL    string
-	Token      string
-	User       *User
+	Address      string
+	VersionStr   string
+	BaseURL      string
+	Token        string
+	APIKey       string
+	Challenge    string
+	RefreshToken string
+	ExpiresAt    time.Time
+	User         *User
+	mutex        sync.Mutex
 }
 
+//tokenResult - tokens given by login and token refresh endpoints
+type tokenResult struct {
+	Token        string    `json:"token"`
+	RefreshToken string    `json:"refreshToken"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+	User         *User     `json:"user"`
+	Challenge    string    `json:"challenge"`
+	Expired      bool      `json:"passwordExpired"`
+}
+
+//ErrTwoFactorRequired - returned by Client.Login when the user has to provide
+//a TOTP code, use Client.LoginTwoFactor to complete the login
+var ErrTwoFactorRequired = errors.New("Two factor authentication required")
+
+//ErrPasswordExpired - returned by Client.Login and Client.LoginTwoFactor when
+//the password is expired. Only Client.ResetPassword can be called after that
+var ErrPasswordExpired = errors.New("Password expired")
+
 //NewClient - creates a new rest client
 func NewClient(address, appName, versionStr string) *Client {
 	return &Client{
@@ -108,6 +136,23 @@ func NewClient(address, appName, versionStr string) *Client {
 	}
 }
 
+//NewAPIKeyClient - creates a new rest client that uses an API key instead of
+//logging in
+func NewAPIKeyClient(address, appName, versionStr, apiKey string) *Client {
+	client := NewClient(address, appName, versionStr)
+	client.APIKey = apiKey
+	return client
+}
+
+//authorize - adds API key or the access token to the request
+func (client *Client) authorize(req *http.Request) {
+	if client.APIKey != "" {
+		req.Header.Set("X-API-Key", client.APIKey)
+		return
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", client.Token))
+}
+
 //Get - performs a get request
 func (client *Client) Get(
 	access AuthLevel,
@@ -115,10 +160,14 @@ func (client *Client) Get(
 	var req *http.Request
 	var resp *http.Response
 	var err error
+	if err = client.ensureFresh(); err != nil {
+		return &ResultReader{
+			Err: err,
+		}
+	}
 	apiURL := client.CreateURL(access, urlArgs...)
 	req, err = http.NewRequest("GET", apiURL, nil)
-	authHeader := fmt.Sprintf("Bearer %s", client.Token)
-	req.Header.Add("Authorization", authHeader)
+	client.authorize(req)
 	resp, err = client.Do(req)
 	if err == nil {
 		rr = NewResultReader(resp)
@@ -137,10 +186,14 @@ func (client *Client) Delete(
 	var req *http.Request
 	var resp *http.Response
 	var err error
+	if err = client.ensureFresh(); err != nil {
+		return &ResultReader{
+			Err: err,
+		}
+	}
 	apiURL := client.CreateURL(access, urlArgs...)
 	req, err = http.NewRequest("DELETE", apiURL, nil)
-	authHeader := fmt.Sprintf("Bearer %s", client.Token)
-	req.Header.Add("Authorization", authHeader)
+	client.authorize(req)
 	resp, err = client.Do(req)
 	if err == nil {
 		rr = NewResultReader(resp)
@@ -202,33 +255,160 @@ func (client *Client) CreateURL(
 
 //Login - login to a teak based service with userID and password. If successful
 //client will have the session information and can perform REST calls that needs
-//authentication
+//authentication. The access token is refreshed automatically before it expires
 func (client *Client) Login(userID, password string) (err error) {
 	data := make(map[string]string)
 	data["userID"] = userID
 	data["password"] = password
-	loginResult := struct {
-		Token string `json:"token"`
-		User  *User  `json:"user"`
-	}{}
-	rr := client.Post(data, Public, "login")
+	var loginResult tokenResult
+	rr := client.send("POST", Public, data, "login")
 	err = rr.Read(&loginResult)
 	if err == nil {
-		client.Token = loginResult.Token
-		client.User = loginResult.User
+		client.mutex.Lock()
+		defer client.mutex.Unlock()
+		client.setTokens(&loginResult)
+		if client.Challenge != "" {
+			err = ErrTwoFactorRequired
+		} else if loginResult.Expired {
+			err = ErrPasswordExpired
+		}
+	}
+	return err
+}
+
+//LoginTwoFactor - completes the login started with Client.Login using a TOTP
+//code or a recovery code
+func (client *Client) LoginTwoFactor(code, recoveryCode string) (err error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	data := map[string]string{
+		"challenge":    client.Challenge,
+		"code":         code,
+		"recoveryCode": recoveryCode,
+	}
+	var res tokenResult
+	err = client.send("POST", Public, data, "login", "2fa").Read(&res)
+	if err == nil {
+		client.setTokens(&res)
+		if res.Expired {
+			err = ErrPasswordExpired
+		}
+	}
+	return err
+}
+
+//ResetPassword - changes the password of the logged in user. When the
+//password was expired the user has to login again after this
+func (client *Client) ResetPassword(oldPwd, newPwd string) (err error) {
+	data := map[string]string{
+		"oldPassword": oldPwd,
+		"newPassword": newPwd,
+	}
+	return client.Put(data, Monitor, "uman", "user", "password").Finish()
+}
+
+//Impersonate - gives a client that acts as the user with given ID, the logged
+//in user has to be a super user. The returned client has no refresh token, a
+//new one has to be obtained once the token expires
+func (client *Client) Impersonate(userID, reason string, durationMins int) (
+	imp *Client, err error) {
+	data := M{
+		"reason":       reason,
+		"durationMins": durationMins,
+	}
+	var res tokenResult
+	err = client.Post(data, Super, "uman", "user", userID, "impersonate").
+		Read(&res)
+	if err == nil {
+		imp = &Client{
+			Client:     http.Client{Timeout: client.Timeout},
+			Address:    client.Address,
+			VersionStr: client.VersionStr,
+			BaseURL:    client.BaseURL,
+		}
+		imp.setTokens(&res)
+	}
+	return imp, err
+}
+
+//Refresh - gets a new access token using the refresh token
+func (client *Client) Refresh() (err error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.refresh()
+}
+
+//Logout - revokes the access token and the refresh token of the client. If
+//all is true all the sessions of the user are ended
+func (client *Client) Logout(all bool) (err error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	data := M{
+		"refreshToken": client.RefreshToken,
+		"all":          all,
+	}
+	err = client.send("POST", Monitor, data, "logout").Finish()
+	if err == nil {
+		client.setTokens(&tokenResult{})
+	}
+	return err
+}
+
+//setTokens - updates session information, caller should hold the lock
+func (client *Client) setTokens(res *tokenResult) {
+	client.Token = res.Token
+	client.RefreshToken = res.RefreshToken
+	client.ExpiresAt = res.ExpiresAt
+	client.User = res.User
+	client.Challenge = res.Challenge
+}
+
+//refresh - gets new tokens from server, caller should hold the lock
+func (client *Client) refresh() (err error) {
+	var res tokenResult
+	data := map[string]string{
+		"refreshToken": client.RefreshToken,
+	}
+	err = client.send("POST", Public, data, "token", "refresh").Read(&res)
+	if err == nil {
+		client.setTokens(&res)
 	}
 	return err
 }
 
+//ensureFresh - refreshes the access token if it is about to expire
+func (client *Client) ensureFresh() (err error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.RefreshToken == "" || client.ExpiresAt.IsZero() ||
+		time.Until(client.ExpiresAt) > 30*time.Second {
+		return err
+	}
+	return client.refresh()
+}
+
 func (client *Client) do(req *http.Request) (
 	resp *http.Response, err error) {
-	authHeader := fmt.Sprintf("Bearer %s", client.Token)
-	req.Header.Add("Authorization", authHeader)
+	client.authorize(req)
 	resp, err = client.Do(req)
 	return resp, err
 }
 
 func (client *Client) putOrPost(
+	method string,
+	access AuthLevel,
+	content interface{},
+	urlArgs ...string) (rr *ResultReader) {
+	if err := client.ensureFresh(); err != nil {
+		return &ResultReader{
+			Err: err,
+		}
+	}
+	return client.send(method, access, content, urlArgs...)
+}
+
+//send - sends content as JSON, access token is not refreshed
+func (client *Client) send(
 	method string,
 	access AuthLevel,
 	content interface{},
@@ -239,8 +419,7 @@ func (client *Client) putOrPost(
 	data, err = json.Marshal(content)
 	apiURL := client.CreateURL(access, urlArgs...)
 	req, err := http.NewRequest(method, apiURL, bytes.NewBuffer(data))
-	authHeader := fmt.Sprintf("Bearer %s", client.Token)
-	req.Header.Add("Authorization", authHeader)
+	client.authorize(req)
 	req.Header.Set("Content-Type", "application/json")
 	resp, err = client.Do(req)
 	if err == nil {
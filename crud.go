@@ -1,12 +1,12 @@
 package teak
 
 import (
-	"errors"
 	"fmt"
 	"net/http"
 	"time"
 
 	echo "github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
 )
 
 func getDataEndpoints() []*Endpoint {
@@ -16,7 +16,7 @@ func getDataEndpoints() []*Endpoint {
 			URL:      "gen/:dataType",
 			Access:   Normal,
 			Category: "generic",
-			Func:     createObject,
+			Func:     withPermission(OpCreate, createObject),
 			Comment:  "Create a resource of given type",
 		},
 		{
@@ -24,7 +24,7 @@ func getDataEndpoints() []*Endpoint {
 			URL:      "gen/:dataType",
 			Access:   Normal,
 			Category: "generic",
-			Func:     updateObject,
+			Func:     withPermission(OpUpdate, updateObject),
 			Comment:  "Update a resource of given type",
 		},
 		{
@@ -32,7 +32,7 @@ func getDataEndpoints() []*Endpoint {
 			URL:      "gen/:dataType/:id",
 			Access:   Normal,
 			Category: "generic",
-			Func:     deleteObject,
+			Func:     withPermission(OpDelete, deleteObject),
 			Comment:  "Delete a resource of given type",
 		},
 		{
@@ -40,7 +40,7 @@ func getDataEndpoints() []*Endpoint {
 			URL:      "gen/:dataType/:id",
 			Access:   Monitor,
 			Category: "generic",
-			Func:     retrieveOne,
+			Func:     withPermission(OpRead, retrieveOne),
 			Comment:  "retrieve a resource of given type",
 		},
 		{
@@ -48,7 +48,7 @@ func getDataEndpoints() []*Endpoint {
 			URL:      "gen/:dataType/list",
 			Access:   Monitor,
 			Category: "generic",
-			Func:     retrieve,
+			Func:     withPermission(OpList, retrieve),
 			Comment:  "Retrieve a resource sub-list of given type",
 		},
 		{
@@ -56,7 +56,7 @@ func getDataEndpoints() []*Endpoint {
 			URL:      "gen/:dataType/count",
 			Access:   Monitor,
 			Category: "generic",
-			Func:     countObjects,
+			Func:     withPermission(OpList, countObjects),
 			Comment:  "Get count of items of data type",
 		},
 		{
@@ -64,7 +64,7 @@ func getDataEndpoints() []*Endpoint {
 			URL:      "gen/:dataType",
 			Access:   Monitor,
 			Category: "generic",
-			Func:     retrieveWithCount,
+			Func:     withPermission(OpList, retrieveWithCount),
 			Comment:  "Retrieve a resource sub-list of a type with total count",
 		},
 		{
@@ -72,7 +72,7 @@ func getDataEndpoints() []*Endpoint {
 			URL:      "gen/:dataType/fspec",
 			Access:   Monitor,
 			Category: "generic",
-			Func:     getFilterValues,
+			Func:     withPermission(OpList, getFilterValues),
 			Comment:  "Get possible values for filter",
 		},
 		{
@@ -80,7 +80,7 @@ func getDataEndpoints() []*Endpoint {
 			URL:      "gen/:dataType/fvals/:field",
 			Access:   Monitor,
 			Category: "generic",
-			Func:     getFilterValuesX,
+			Func:     withPermission(OpList, getFilterValuesX),
 			Comment:  "Get possible values for filter",
 		},
 		{
@@ -88,7 +88,7 @@ func getDataEndpoints() []*Endpoint {
 			URL:      "gen/:dataType/fvals/",
 			Access:   Monitor,
 			Category: "generic",
-			Func:     getFilterValuesX,
+			Func:     withPermission(OpList, getFilterValuesX),
 			Comment:  "Get possible values for filter without field",
 		},
 	}
@@ -105,8 +105,146 @@ type StoredItemHandler interface {
 	PropNames() []string
 }
 
+//Operation - an operation on a data type through the generic CRUD endpoints
+type Operation string
+
+const (
+	//OpCreate - creating an item
+	OpCreate Operation = "create"
+
+	//OpRead - retrieving an item by its key
+	OpRead Operation = "read"
+
+	//OpUpdate - updating an item
+	OpUpdate Operation = "update"
+
+	//OpDelete - deleting an item
+	OpDelete Operation = "delete"
+
+	//OpList - retrieving, counting and filtering multiple items
+	OpList Operation = "list"
+)
+
+//Permission - access required to perform an operation on a data type. If
+//Groups is given the user has to be member of one of the groups as well
+type Permission struct {
+	Access AuthLevel `json:"access"`
+	Groups []string  `json:"groups,omitempty"`
+}
+
+//PermissionProvider - can be implemented by a StoredItemHandler to declare the
+//permission required for each operation. Operations that are not declared and
+//data types whose handlers do not implement it use the access level of the
+//generic endpoint. A permission can only be stricter than that level, since
+//the level of the endpoint is checked first
+type PermissionProvider interface {
+	Permissions() map[Operation]Permission
+}
+
+//Ownership - fields of a data type that tell who created a record and with
+//which users it is shared. SharedField is a list of user IDs, it can be empty
+//if records are not shared
+type Ownership struct {
+	OwnerField  string `json:"ownerField"`
+	SharedField string `json:"sharedField"`
+}
+
+//OwnershipProvider - can be implemented by a StoredItemHandler to enable
+//ownership mode for the data type. Users below Admin level can then only see
+//and modify the records they created or the ones shared with them, Admin and
+//above see everything
+type OwnershipProvider interface {
+	Ownership() Ownership
+}
+
 var siHandlers = make(map[string]StoredItemHandler)
 
+//defaultPermissions - access levels of the generic endpoints
+var defaultPermissions = map[Operation]Permission{
+	OpCreate: {Access: Normal},
+	OpRead:   {Access: Monitor},
+	OpUpdate: {Access: Normal},
+	OpDelete: {Access: Normal},
+	OpList:   {Access: Monitor},
+}
+
+//GetPermission - gives the permission required to perform the operation on
+//the data type
+func GetPermission(dtype string, op Operation) (perm Permission) {
+	perm = defaultPermissions[op]
+	if pp, ok := siHandlers[dtype].(PermissionProvider); ok {
+		if declared, found := pp.Permissions()[op]; found {
+			perm = declared
+		}
+	}
+	return perm
+}
+
+//ownerFilter - restricts the filter to the records owned by or shared with the
+//user if the data type is in ownership mode and the user is below Admin level.
+//A nil filter is replaced with an empty one when restricted
+func ownerFilter(ctx echo.Context, dtype string, filter *Filter) *Filter {
+	op, ok := siHandlers[dtype].(OwnershipProvider)
+	if !ok {
+		return filter
+	}
+	session, err := RetrieveSessionInfo(ctx)
+	if err == nil && session.Role <= Admin {
+		return filter
+	}
+	if filter == nil {
+		filter = &Filter{}
+	}
+	ownership := op.Ownership()
+	filter.Owner = &OwnerFilter{
+		OwnerField:  ownership.OwnerField,
+		SharedField: ownership.SharedField,
+		UserID:      session.UserID,
+	}
+	return filter
+}
+
+//withPermission - checks if the user can perform the operation on the data
+//type given in the URL before the actual handler touches the data storage.
+//Only the data types with a registered handler can be used, otherwise any
+//table or collection could be read, including the ones with secrets. Apps
+//that used the generic endpoints for types without a handler have to register
+//a StoredItemHandler for them. Denied requests are audited
+func withPermission(op Operation, next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) (err error) {
+		dtype := ctx.Param("dataType")
+		perm := GetPermission(dtype, op)
+		session, err := RetrieveSessionInfo(ctx)
+		if _, found := siHandlers[dtype]; !found {
+			err = fmt.Errorf("Unknown data type '%s'", dtype)
+		}
+		if err == nil && session.Role > perm.Access {
+			err = fmt.Errorf("Operation '%s' on '%s' requires %s access",
+				op, dtype, perm.Access)
+		}
+		if err == nil && len(perm.Groups) != 0 &&
+			session.Role != Super && !session.InGroup(perm.Groups...) {
+			err = fmt.Errorf("Operation '%s' on '%s' requires membership "+
+				"in one of the groups %v", op, dtype, perm.Groups)
+		}
+		if err == nil {
+			return next(ctx)
+		}
+		err = AuditedSend(ctx, &Result{
+			Status: http.StatusForbidden,
+			Op:     dtype + "_" + string(op) + "_denied",
+			Msg:    "Insufficient privileges",
+			OK:     false,
+			Data: M{
+				"dataType":  dtype,
+				"operation": op,
+			},
+			Err: ErrString(err),
+		})
+		return LogError("t.crud.api", err)
+	}
+}
+
 //GetItemHandler - get the item handler for given data type
 func GetItemHandler(dtype string) StoredItemHandler {
 	return siHandlers[dtype]
@@ -168,7 +306,16 @@ func updateObject(ctx echo.Context) (err error) {
 			Err:    ErrString(err),
 		})
 	}()
+	//Get the data type handler for updating the modification info:
+	handler := siHandlers[dtype]
+	if handler == nil {
+		err = fmt.Errorf("Failed to find handler for data type '%s'", dtype)
+		status = http.StatusBadRequest
+		return err
+	}
+
 	//Get the updated object from request
+	data = handler.CreateInstance("")
 	err = ctx.Bind(data)
 	if err != nil {
 		err = fmt.Errorf("Failed to retrive updated object for type '%s'",
@@ -177,24 +324,19 @@ func updateObject(ctx echo.Context) (err error) {
 		return err
 	}
 
-	//Get the data type handler for updating the modification info:
-	handler := siHandlers[dtype]
-	if handler == nil {
-		err = fmt.Errorf("Failed to find handler for data type '%s'", dtype)
-		status = http.StatusBadRequest
-		return err
-	}
-
 	//Update the modification  info:
 	handler.SetModInfo(data, time.Now(), GetString(ctx, "userID"))
 	//Get the identifier for the item
 	key := handler.GetKey(data)
 	//And update...
-	err = dataStorage.Update(
-		ctx.Request().Context(), dtype, handler.UniqueKeyField(), key, data)
+	err = dataStorage.Update(ctx.Request().Context(), dtype,
+		handler.UniqueKeyField(), key, ownerFilter(ctx, dtype, nil), data)
 
-	if err != nil {
-		msg = fmt.Sprintf("Failed to create item of type '%s' in data store",
+	if errors.Cause(err) == ErrNotFound {
+		msg = fmt.Sprintf("Could not find item of type '%s'", dtype)
+		status = http.StatusNotFound
+	} else if err != nil {
+		msg = fmt.Sprintf("Failed to update item of type '%s' in data store",
 			dtype)
 		status = http.StatusInternalServerError
 	}
@@ -226,9 +368,12 @@ func deleteObject(ctx echo.Context) (err error) {
 		return err
 	}
 
-	err = dataStorage.Delete(
-		ctx.Request().Context(), dtype, handler.UniqueKeyField(), id)
-	if err != nil {
+	err = dataStorage.Delete(ctx.Request().Context(), dtype,
+		handler.UniqueKeyField(), id, ownerFilter(ctx, dtype, nil))
+	if errors.Cause(err) == ErrNotFound {
+		msg = fmt.Sprintf("Could not find %s to delete", dtype)
+		status = http.StatusNotFound
+	} else if err != nil {
 		msg = fmt.Sprintf("Failed to delete %s from database", dtype)
 		status = http.StatusInternalServerError
 	}
@@ -261,10 +406,13 @@ func retrieveOne(ctx echo.Context) (err error) {
 		return err
 	}
 	data = handler.CreateInstance("")
-	err = dataStorage.RetrieveOne(
-		ctx.Request().Context(), dtype, handler.UniqueKeyField(), id, &data)
+	err = dataStorage.RetrieveOne(ctx.Request().Context(), dtype,
+		handler.UniqueKeyField(), id, ownerFilter(ctx, dtype, nil), &data)
 
-	if err != nil {
+	if errors.Cause(err) == ErrNotFound {
+		msg = fmt.Sprintf("Could not find %s with ID %s", dtype, id)
+		status = http.StatusNotFound
+	} else if err != nil {
 		msg = fmt.Sprintf(
 			"Failed to retrieve %s from database, entity with ID %s",
 			dtype,
@@ -291,7 +439,7 @@ func retrieve(ctx echo.Context) (err error) {
 				sortField,
 				offset,
 				limit,
-				&filter,
+				ownerFilter(ctx, dtype, &filter),
 				&data)
 			if err != nil {
 				msg = fmt.Sprintf("Failed to retrieve %s from database", dtype)
@@ -335,7 +483,7 @@ func retrieveWithCount(ctx echo.Context) (err error) {
 				sortField,
 				offset,
 				limit,
-				&filter,
+				ownerFilter(ctx, dtype, &filter),
 				&data)
 			if err != nil {
 				msg = fmt.Sprintf("Failed to retrieve %s from database", dtype)
@@ -373,8 +521,8 @@ func countObjects(ctx echo.Context) (err error) {
 		var filter Filter
 		err = LoadJSONFromArgs(ctx, "filter", &filter)
 		if err == nil {
-			count, err = dataStorage.Count(
-				ctx.Request().Context(), dtype, &filter)
+			count, err = dataStorage.Count(ctx.Request().Context(),
+				dtype, ownerFilter(ctx, dtype, &filter))
 			if err != nil {
 				msg = fmt.Sprintf("Failed to retrieve %s from database", dtype)
 				status = http.StatusInternalServerError
@@ -399,12 +547,19 @@ func countObjects(ctx echo.Context) (err error) {
 	return LogError("S:Entity", err)
 }
 
+//getFilterValues - gives the filter values from all the records of the data
+//type, so it is denied when the user can only see own records. Such users
+//can use 'fvals' endpoint, which supports ownership
 func getFilterValues(ctx echo.Context) (err error) {
 	dtype := ctx.Param("dataType")
 	status, msg := defaultSM("Filter Values of", dtype)
 	var fspec []*FilterSpec
 	var values M
-	if len(dtype) != 0 {
+	if ownerFilter(ctx, dtype, nil) != nil {
+		msg = "Filter values of all records are not accessible"
+		status = http.StatusForbidden
+		err = errors.New(msg)
+	} else if len(dtype) != 0 {
 		err = LoadJSONFromArgs(ctx, "fspec", &fspec)
 		if err == nil {
 			values, err = dataStorage.GetFilterValues(
@@ -440,8 +595,8 @@ func getFilterValuesX(ctx echo.Context) (err error) {
 		err1 := LoadJSONFromArgs(ctx, "fspec", &fspec)
 		err2 := LoadJSONFromArgs(ctx, "filter", &filter)
 		if !HasError("V:Generic", err1, err2) {
-			values, err = dataStorage.GetFilterValuesX(
-				ctx.Request().Context(), dtype, field, fspec, &filter)
+			values, err = dataStorage.GetFilterValuesX(ctx.Request().Context(),
+				dtype, field, fspec, ownerFilter(ctx, dtype, &filter))
 		} else {
 			msg = "Failed to load filter description from URL"
 			err = errors.New(msg)
@@ -0,0 +1,152 @@
+package teak
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	echo "github.com/labstack/echo/v4"
+)
+
+//callWithPermission - calls the handler guarded by withPermission as the user
+//with given auth level, tells if the handler was reached
+func callWithPermission(
+	dtype string, op Operation, role AuthLevel) (reached bool, status int) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	ctx := echo.New().NewContext(req, rec)
+	ctx.SetParamNames("dataType")
+	ctx.SetParamValues(dtype)
+	ctx.Set("token", &jwt.Token{
+		Valid: true,
+		Claims: jwt.MapClaims{
+			"userID":   "u1",
+			"userName": "Test User",
+			"userType": "normal",
+			"access":   float64(role),
+		},
+	})
+	withPermission(op, func(ctx echo.Context) error {
+		reached = true
+		return nil
+	})(ctx)
+	return reached, rec.Code
+}
+
+func TestGenericUserPermissions(t *testing.T) {
+	prev := siHandlers
+	siHandlers = map[string]StoredItemHandler{"teakUser": &UserHandler{}}
+	defer func() { siHandlers = prev }()
+	cases := []struct {
+		dtype   string
+		op      Operation
+		role    AuthLevel
+		allowed bool
+	}{
+		{"teakUser", OpDelete, Normal, false},
+		{"teakUser", OpDelete, Admin, false},
+		{"teakUser", OpDelete, Super, true},
+		{"teakUser", OpUpdate, Admin, false},
+		{"teakUser", OpList, Normal, false},
+		{"teakUser", OpList, Admin, true},
+		{"teakUser", OpRead, Admin, true},
+		{"teak_secret", OpList, Super, false},
+	}
+	for _, c := range cases {
+		reached, status := callWithPermission(c.dtype, c.op, c.role)
+		if reached != c.allowed {
+			t.Errorf("%s %s as %s: expected allowed %v, got %v",
+				c.op, c.dtype, c.role, c.allowed, reached)
+		}
+		if !c.allowed && status != http.StatusForbidden {
+			t.Errorf("%s %s as %s: expected status 403, got %d",
+				c.op, c.dtype, c.role, status)
+		}
+	}
+}
+
+//noteHandler - handler for a data type in ownership mode
+type noteHandler struct{}
+
+func (nh *noteHandler) DataType() string {
+	return "note"
+}
+
+func (nh *noteHandler) UniqueKeyField() string {
+	return "id"
+}
+
+func (nh *noteHandler) GetKey(item interface{}) interface{} {
+	return item.(M)["id"]
+}
+
+func (nh *noteHandler) SetModInfo(item interface{}, at time.Time, by string) {
+}
+
+func (nh *noteHandler) CreateInstance(by string) interface{} {
+	return M{"createdBy": by}
+}
+
+func (nh *noteHandler) PropNames() []string {
+	return []string{"id", "createdBy", "sharedWith"}
+}
+
+func (nh *noteHandler) Ownership() Ownership {
+	return Ownership{OwnerField: "createdBy", SharedField: "sharedWith"}
+}
+
+func TestOwnerFilter(t *testing.T) {
+	prev := siHandlers
+	siHandlers = map[string]StoredItemHandler{
+		"note":     &noteHandler{},
+		"teakUser": &UserHandler{},
+	}
+	defer func() { siHandlers = prev }()
+	ownerOf := func(dtype string, role AuthLevel, in *Filter) *Filter {
+		ctx := echo.New().NewContext(
+			httptest.NewRequest(http.MethodGet, "/", nil),
+			httptest.NewRecorder())
+		ctx.Set("token", &jwt.Token{Valid: true, Claims: jwt.MapClaims{
+			"userID":   "u1",
+			"userName": "Test User",
+			"userType": "normal",
+			"access":   float64(role),
+		}})
+		return ownerFilter(ctx, dtype, in)
+	}
+
+	filter := ownerOf("note", Normal, nil)
+	expected := OwnerFilter{
+		OwnerField:  "createdBy",
+		SharedField: "sharedWith",
+		UserID:      "u1",
+	}
+	if filter == nil || filter.Owner == nil || *filter.Owner != expected {
+		t.Fatalf("Expected normal user to be limited to own notes, got %+v",
+			filter)
+	}
+	in := &Filter{Props: map[string]Matcher{}}
+	if filter = ownerOf("note", Monitor, in); filter != in ||
+		filter.Owner == nil {
+		t.Errorf("Expected owner restriction to be added to given filter")
+	}
+	for _, role := range []AuthLevel{Admin, Super} {
+		if filter = ownerOf("note", role, nil); filter != nil {
+			t.Errorf("Expected %s to see all notes, got %+v", role, filter)
+		}
+	}
+	if filter = ownerOf("teakUser", Normal, nil); filter != nil {
+		t.Errorf("Expected no ownership without provider, got %+v", filter)
+	}
+
+	//Owner restriction can not be given by the client
+	filter = &Filter{}
+	err := json.Unmarshal(
+		[]byte(`{"owner": {"ownerField": "x", "userID": "u2"}}`), filter)
+	if err != nil || filter.Owner != nil {
+		t.Errorf("Expected owner filter to be ignored in requests: %v", err)
+	}
+}
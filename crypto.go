@@ -1,12 +1,13 @@
 package teak
 
 import (
-	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -25,12 +26,6 @@ func removeBase64Padding(value string) string {
 	return strings.Replace(value, "=", "", -1)
 }
 
-func pad(src []byte) []byte {
-	padding := aes.BlockSize - len(src)%aes.BlockSize
-	padtext := bytes.Repeat([]byte{byte(padding)}, padding)
-	return append(src, padtext...)
-}
-
 func unpad(src []byte) ([]byte, error) {
 	length := len(src)
 	unpadding := int(src[length-1])
@@ -41,29 +36,77 @@ func unpad(src []byte) ([]byte, error) {
 	return src[:(length - unpadding)], nil
 }
 
-//Encrypt - encrypts input text with given key using AES algo
-func Encrypt(key []byte, text string) (encrypted string, err error) {
-	defer LogErrorX("t.encrypt", "Failed to perform encryption", err)
-	var block cipher.Block
-	block, err = aes.NewCipher(key)
+//keyIDSep - separates the key ID prefix from the encrypted data. It is not
+//part of base64 URL alphabet, so the values encrypted with AES-CFB before
+//AES-GCM was introduced are the ones without it
+const keyIDSep = "$"
+
+//KeyID - gives an ID for the key that is derived from the key itself, used as
+//prefix when encrypting with a key that has no configured ID
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+//splitKeyID - gives the key ID prefix and the encrypted data, found is false
+//for legacy AES-CFB values
+func splitKeyID(text string) (keyID, data string, found bool) {
+	if idx := strings.Index(text, keyIDSep); idx >= 0 {
+		return text[:idx], text[idx+len(keyIDSep):], true
+	}
+	return keyID, text, false
+}
+
+//encryptGCM - encrypts the text using AES-GCM and prefixes the key ID
+func encryptGCM(keyID string, key []byte, text string) (
+	encrypted string, err error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return encrypted, err
 	}
-	msg := pad([]byte(text))
-	ciphertext := make([]byte, aes.BlockSize+len(msg))
-	iv := ciphertext[:aes.BlockSize]
-	if _, err = io.ReadFull(rand.Reader, iv); err == nil {
-		cfb := cipher.NewCFBEncrypter(block, iv)
-		cfb.XORKeyStream(ciphertext[aes.BlockSize:], []byte(msg))
-		encrypted = removeBase64Padding(
-			base64.URLEncoding.EncodeToString(ciphertext))
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return encrypted, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return encrypted, err
 	}
+	sealed := gcm.Seal(nonce, nonce, []byte(text), nil)
+	encrypted = keyID + keyIDSep + removeBase64Padding(
+		base64.URLEncoding.EncodeToString(sealed))
 	return encrypted, err
 }
 
-//Decrypt - decrypts input text with given key using AES algo
-func Decrypt(key []byte, text string) (decrypted string, err error) {
-	defer LogErrorX("t.crypto", "Failed to decrypt string", err)
+//decryptGCM - decrypts AES-GCM encrypted data, data should not have the key
+//ID prefix
+func decryptGCM(key []byte, data string) (decrypted string, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return decrypted, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return decrypted, err
+	}
+	sealed, err := base64.URLEncoding.DecodeString(addBase64Padding(data))
+	if err != nil {
+		return decrypted, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return decrypted, errors.New("Encrypted data is too short")
+	}
+	nonce, sealed := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	msg, err := gcm.Open(nil, nonce, sealed, nil)
+	if err == nil {
+		decrypted = string(msg)
+	}
+	return decrypted, err
+}
+
+//decryptCFB - decrypts values encrypted with AES-CFB, which was used before
+//AES-GCM. Such values have no integrity check
+func decryptCFB(key []byte, text string) (decrypted string, err error) {
 	var block cipher.Block
 	block, err = aes.NewCipher(key)
 	if err != nil {
@@ -74,13 +117,16 @@ func Decrypt(key []byte, text string) (decrypted string, err error) {
 	if err != nil {
 		return decrypted, err
 	}
-	if (len(decodedMsg) % aes.BlockSize) != 0 {
+	if len(decodedMsg) == 0 || (len(decodedMsg)%aes.BlockSize) != 0 {
 		err = errors.New(
 			"Blocksize must be multipe of decoded message length")
 		return decrypted, err
 	}
 	iv := decodedMsg[:aes.BlockSize]
 	msg := decodedMsg[aes.BlockSize:]
+	if len(msg) == 0 {
+		return decrypted, errors.New("Encrypted data is too short")
+	}
 	cfb := cipher.NewCFBDecrypter(block, iv)
 	cfb.XORKeyStream(msg, msg)
 	var unpadMsg []byte
@@ -91,6 +137,24 @@ func Decrypt(key []byte, text string) (decrypted string, err error) {
 	return decrypted, err
 }
 
+//Encrypt - encrypts input text with given key using AES-GCM, the result is
+//prefixed with the ID of the key given by KeyID
+func Encrypt(key []byte, text string) (encrypted string, err error) {
+	encrypted, err = encryptGCM(KeyID(key), key, text)
+	return encrypted, LogErrorX("t.crypto", "Failed to perform encryption", err)
+}
+
+//Decrypt - decrypts input text with given key. Text encrypted with AES-CFB by
+//earlier versions is also decrypted
+func Decrypt(key []byte, text string) (decrypted string, err error) {
+	if _, data, found := splitKeyID(text); found {
+		decrypted, err = decryptGCM(key, data)
+	} else {
+		decrypted, err = decryptCFB(key, text)
+	}
+	return decrypted, LogErrorX("t.crypto", "Failed to decrypt string", err)
+}
+
 //EncryptStr - AES encrypts input text with given key string
 func EncryptStr(key string, text string) (encrypted string, err error) {
 	encrypted, err = Encrypt([]byte(key), text)
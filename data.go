@@ -2,6 +2,7 @@ package teak
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"reflect"
 	"strconv"
@@ -166,8 +167,23 @@ type Filter struct {
 	Dates    map[string]DateRange   `json:"dates" db:"dates"`
 	Lists    map[string]Matcher     `json:"lists" db:"lists"`
 	Searches map[string]Matcher     `json:"searches" db:"searches"`
+	Owner    *OwnerFilter           `json:"-" db:"-"`
 }
 
+//OwnerFilter - selects only the records owned by or shared with the user. It
+//is set by the generic CRUD endpoints and is never read from requests. The
+//shared field is a list of IDs of users with whom the record is shared, if it
+//is empty records are not shared
+type OwnerFilter struct {
+	OwnerField  string `json:"ownerField"`
+	SharedField string `json:"sharedField"`
+	UserID      string `json:"userID"`
+}
+
+//ErrNotFound - returned by data storage when no record is matched by the key
+//and the filter
+var ErrNotFound = errors.New("Could not find a matching record")
+
 //FilterSpecList - alias for array of filter specs
 type FilterSpecList []*FilterSpec
 
@@ -177,7 +193,8 @@ type FilterVal struct {
 	Count int    `json:"count" db:"count"`
 }
 
-//DataStorage - defines a data storage
+//DataStorage - defines a data storage. Update, Delete and RetrieveOne select
+//the record by the key, if a filter is given the record has to match it as well
 type DataStorage interface {
 	Name() string
 	Count(
@@ -193,17 +210,20 @@ type DataStorage interface {
 		dataType string,
 		keyField string,
 		key interface{},
+		filter *Filter,
 		data interface{}) error
 	Delete(
 		gtx context.Context,
 		dataType string,
 		keyField string,
-		key interface{}) error
+		key interface{},
+		filter *Filter) error
 	RetrieveOne(
 		gtx context.Context,
 		dataType string,
 		keyField string,
 		key interface{},
+		filter *Filter,
 		data interface{}) error
 	Retrieve(
 		gtx context.Context,
@@ -237,6 +257,7 @@ type DataStorage interface {
 	Init(gtx context.Context, params M) error
 	Reset(gtx context.Context) error
 	Destroy(gtx context.Context) error
+	Close(gtx context.Context) error
 	Wrap(cmd *cli.Command) *cli.Command
 }
 
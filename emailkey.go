@@ -0,0 +1,315 @@
+package teak
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gopkg.in/urfave/cli.v1"
+)
+
+//legacyEmailKeyID - ID of the key given by 'emailKey' config, which was the
+//only email key before key rotation was introduced
+const legacyEmailKeyID = "default"
+
+//EmailKeyConfig - keys used for encrypting emails, read from 'emailKeys' key
+//of the app config. Emails are encrypted with the key whose ID is Current,
+//all the keys are used for decryption. Legacy is the ID of the key that
+//decrypts the emails encrypted with AES-CFB by earlier versions. The key from
+//'emailKey' config is added with ID 'default' and is the default for both.
+//IndexKey is the key for the email index, it is not rotated since the index
+//of every user would have to be recomputed. The 'default' key is used if it
+//is not given
+type EmailKeyConfig struct {
+	Current  string            `json:"current"`
+	Legacy   string            `json:"legacy"`
+	IndexKey string            `json:"indexKey"`
+	Keys     map[string]string `json:"keys"`
+}
+
+//EmailStorage - optional interface of user storages that keep an index of
+//emails, needed for finding users by email and for rotating the email key
+type EmailStorage interface {
+	//SetEmails - updates encrypted email and email index of given users. Used
+	//when the email key is rotated
+	SetEmails(gtx context.Context, users []*User) (err error)
+
+	//GetUserByEmail - gets the user with given email using the email index
+	GetUserByEmail(gtx context.Context, email string) (user *User, err error)
+}
+
+//GetEmailStorage - gives the user storage if it supports the email index
+func GetEmailStorage() (storage EmailStorage, err error) {
+	storage, ok := unwrapUserStorage(GetUserStorage()).(EmailStorage)
+	if !ok {
+		return storage, errors.New(
+			"User storage does not support the email index")
+	}
+	return &metricEmailStorage{storage}, err
+}
+
+//GetEmailKeys - gives the email key configuration after validating it
+func GetEmailKeys() (ek *EmailKeyConfig, err error) {
+	ek = &EmailKeyConfig{}
+	GetConfig("emailKeys", ek)
+	if ek.Keys == nil {
+		ek.Keys = make(map[string]string)
+	}
+	var emailKey string
+	if GetConfig("emailKey", &emailKey) && emailKey != "" {
+		if _, found := ek.Keys[legacyEmailKeyID]; !found {
+			ek.Keys[legacyEmailKeyID] = emailKey
+		}
+	}
+	if ek.Current == "" {
+		ek.Current = legacyEmailKeyID
+	}
+	if ek.Legacy == "" {
+		ek.Legacy = legacyEmailKeyID
+	}
+	if ek.IndexKey == "" {
+		ek.IndexKey = ek.Keys[legacyEmailKeyID]
+	}
+	if _, found := ek.Keys[ek.Current]; !found {
+		return ek, errors.New("Failed to read email configuration")
+	}
+	for id, key := range ek.Keys {
+		if id == "" || strings.Contains(id, keyIDSep) {
+			return ek, fmt.Errorf("Invalid email key ID '%s'", id)
+		}
+		switch len(key) {
+		case 16, 24, 32:
+		default:
+			return ek, fmt.Errorf(
+				"Email key '%s' should be 16, 24 or 32 bytes long", id)
+		}
+	}
+	return ek, err
+}
+
+//Encrypt - encrypts the email with the current key
+func (ek *EmailKeyConfig) Encrypt(email string) (encrypted string, err error) {
+	encrypted, err = encryptGCM(ek.Current, []byte(ek.Keys[ek.Current]), email)
+	return encrypted, LogErrorX("t.crypto", "Failed to encrypt email", err)
+}
+
+//key - gives the key with given ID. Values encrypted with Encrypt function
+//have the ID derived from the key instead of the configured one
+func (ek *EmailKeyConfig) key(keyID string) (key string, found bool) {
+	if key, found = ek.Keys[keyID]; found {
+		return key, found
+	}
+	for _, key = range ek.Keys {
+		if KeyID([]byte(key)) == keyID {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+//Decrypt - decrypts the email with the key identified by its prefix, emails
+//without prefix are decrypted with the legacy key
+func (ek *EmailKeyConfig) Decrypt(encrypted string) (email string, err error) {
+	keyID, data, found := splitKeyID(encrypted)
+	if !found {
+		key, ok := ek.Keys[ek.Legacy]
+		if !ok {
+			return email, fmt.Errorf("Unknown legacy email key '%s'", ek.Legacy)
+		}
+		email, err = decryptCFB([]byte(key), data)
+		return email, LogErrorX("t.crypto", "Failed to decrypt email", err)
+	}
+	key, ok := ek.key(keyID)
+	if !ok {
+		return email, fmt.Errorf("Unknown email key '%s'", keyID)
+	}
+	email, err = decryptGCM([]byte(key), data)
+	return email, LogErrorX("t.crypto", "Failed to decrypt email", err)
+}
+
+//IsCurrent - tells if the email is encrypted with the current key
+func (ek *EmailKeyConfig) IsCurrent(encrypted string) bool {
+	keyID, _, found := splitKeyID(encrypted)
+	return found && keyID == ek.Current
+}
+
+//Index - gives the blind index of the email, which is a HMAC of the
+//normalized email. Users can be found by email using it without decrypting
+//all the emails
+func (ek *EmailKeyConfig) Index(email string) (index string, err error) {
+	if ek.IndexKey == "" {
+		return index, errors.New("No key configured for email index")
+	}
+	mac := hmac.New(sha256.New, []byte(ek.IndexKey))
+	mac.Write([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(mac.Sum(nil)), err
+}
+
+//EmailIndex - gives the blind index of the email
+func EmailIndex(email string) (index string, err error) {
+	ek, err := GetEmailKeys()
+	if err != nil {
+		return index, err
+	}
+	return ek.Index(email)
+}
+
+//EncryptEmail - encrypts the email with the current email key
+func EncryptEmail(email string) (encrypted string, err error) {
+	ek, err := GetEmailKeys()
+	if err != nil {
+		return encrypted, err
+	}
+	return ek.Encrypt(email)
+}
+
+//DecryptEmail - decrypts the email encrypted with any of the email keys
+func DecryptEmail(encrypted string) (email string, err error) {
+	ek, err := GetEmailKeys()
+	if err != nil {
+		return email, err
+	}
+	return ek.Decrypt(encrypted)
+}
+
+//rotateEmailKey - re-encrypts emails of the users that are not encrypted with
+//the current key and sets the missing email indices, batchSize users are read
+//and updated at a time. TOTP secrets are re-encrypted as well if they are
+//encrypted with the email keys. Invites are not re-encrypted, older keys have
+//to be kept till they expire
+func rotateEmailKey(gtx context.Context, batchSize int64, dryRun bool) (
+	updated, secrets, total int64, err error) {
+	ek, err := GetEmailKeys()
+	if err != nil {
+		return updated, secrets, total, err
+	}
+	emails, err := GetEmailStorage()
+	if err != nil {
+		return updated, secrets, total, err
+	}
+	_, tfErr := GetTwoFactorStorage()
+	withSecrets := GetTwoFactorConfig().SecretKey == "" && tfErr == nil
+	storage := GetUserStorage()
+	for offset := int64(0); ; offset += batchSize {
+		users, err := storage.GetUsers(gtx, offset, batchSize, nil)
+		if err != nil {
+			return updated, secrets, total, err
+		}
+		changed := make([]*User, 0, len(users))
+		for _, user := range users {
+			if withSecrets {
+				rotated, err := rotateTOTPSecret(gtx, ek, user.UserID, dryRun)
+				if err != nil {
+					return updated, secrets, total, err
+				}
+				if rotated {
+					secrets++
+				}
+			}
+			if ek.IsCurrent(user.Email) && user.EmailIndex != "" {
+				continue
+			}
+			email, err := ek.Decrypt(user.Email)
+			if err != nil {
+				return updated, secrets, total, fmt.Errorf(
+					"Failed to decrypt email of user %s: %v", user.UserID, err)
+			}
+			if user.Email, err = ek.Encrypt(email); err != nil {
+				return updated, secrets, total, err
+			}
+			if user.EmailIndex, err = ek.Index(email); err != nil {
+				return updated, secrets, total, err
+			}
+			changed = append(changed, user)
+		}
+		if len(changed) != 0 && !dryRun {
+			if err = emails.SetEmails(gtx, changed); err != nil {
+				return updated, secrets, total, err
+			}
+		}
+		updated += int64(len(changed))
+		total += int64(len(users))
+		if int64(len(users)) < batchSize {
+			break
+		}
+	}
+	return updated, secrets, total, err
+}
+
+//rotateTOTPSecret - re-encrypts TOTP secret of the user with the current email
+//key if it is encrypted with another key
+func rotateTOTPSecret(
+	gtx context.Context,
+	ek *EmailKeyConfig,
+	userID string,
+	dryRun bool) (rotated bool, err error) {
+	storage, err := GetTwoFactorStorage()
+	if err != nil {
+		return rotated, err
+	}
+	tf, err := storage.GetTwoFactor(gtx, userID)
+	if err != nil || tf.Secret == "" || ek.IsCurrent(tf.Secret) {
+		return rotated, err
+	}
+	secret, err := ek.Decrypt(tf.Secret)
+	if err != nil {
+		return rotated, fmt.Errorf(
+			"Failed to decrypt 2FA secret of user %s: %v", userID, err)
+	}
+	if tf.Secret, err = ek.Encrypt(secret); err != nil {
+		return rotated, err
+	}
+	if !dryRun {
+		err = storage.SaveTwoFactor(gtx, tf)
+	}
+	return err == nil, err
+}
+
+func cryptoCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "crypto",
+		Usage: "Commands for managing encrypted data",
+		Subcommands: []cli.Command{
+			*rotateEmailKeyCmd(),
+		},
+	}
+}
+
+func rotateEmailKeyCmd() *cli.Command {
+	return &cli.Command{
+		Name: "rotate-email-key",
+		Usage: "Re-encrypt emails and 2FA secrets of users with the " +
+			"current key from 'emailKeys' config and index the emails " +
+			"that are not indexed",
+		Flags: []cli.Flag{
+			cli.IntFlag{
+				Name:  "batch-size",
+				Usage: "Number of users updated at a time",
+				Value: 100,
+			},
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Only report the number of emails to re-encrypt",
+			},
+		},
+		Action: func(ctx *cli.Context) (err error) {
+			batchSize := ctx.Int("batch-size")
+			if batchSize <= 0 {
+				return errors.New("Batch size should be positive")
+			}
+			updated, secrets, total, err := rotateEmailKey(
+				context.TODO(), int64(batchSize), ctx.Bool("dry-run"))
+			if err != nil {
+				return LogErrorX("t.crypto",
+					"Failed to rotate email key", err)
+			}
+			fmt.Printf("Updated: %d\nSecrets: %d\nTotal:   %d\n",
+				updated, secrets, total)
+			return err
+		},
+	}
+}
@@ -0,0 +1,155 @@
+package teak
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"strings"
+	"testing"
+)
+
+const (
+	testKey1 = "fedcba9876543210"
+	testKey2 = "abcdefghijklmnopqrstuvwxyz012345"
+)
+
+//encryptCFB - encrypts the way earlier versions did, with AES-CFB and without
+//key ID prefix
+func encryptCFB(t *testing.T, key, text string) string {
+	block, err := aes.NewCipher([]byte(key))
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+	padding := aes.BlockSize - len(text)%aes.BlockSize
+	msg := append([]byte(text), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	ciphertext := make([]byte, aes.BlockSize+len(msg))
+	iv := ciphertext[:aes.BlockSize]
+	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
+		t.Fatalf("Failed to create IV: %v", err)
+	}
+	cipher.NewCFBEncrypter(block, iv).XORKeyStream(
+		ciphertext[aes.BlockSize:], msg)
+	return removeBase64Padding(base64.URLEncoding.EncodeToString(ciphertext))
+}
+
+func TestEmailEncryption(t *testing.T) {
+	_, restore := useTestStorage(M{"emailKeys": M{
+		"current": "k1",
+		"keys":    M{"k1": testKey1, "k2": testKey2},
+	}})
+	defer restore()
+	ek, err := GetEmailKeys()
+	if err != nil {
+		t.Fatalf("Failed to read email keys: %v", err)
+	}
+	encrypted, err := ek.Encrypt("someone@example.com")
+	if err != nil || !strings.HasPrefix(encrypted, "k1"+keyIDSep) ||
+		!ek.IsCurrent(encrypted) {
+		t.Fatalf("Expected email encrypted with current key, got '%s': %v",
+			encrypted, err)
+	}
+	if email, err := ek.Decrypt(encrypted); err != nil ||
+		email != "someone@example.com" {
+		t.Errorf("Expected email to be decrypted, got '%s': %v", email, err)
+	}
+	//AES-GCM detects modified values
+	tampered := encrypted[:len(encrypted)-2] + "AA"
+	if tampered == encrypted {
+		tampered = encrypted[:len(encrypted)-2] + "BB"
+	}
+	if _, err = ek.Decrypt(tampered); err == nil {
+		t.Errorf("Expected modified email to be rejected")
+	}
+	legacy := encryptCFB(t, ek.Keys[legacyEmailKeyID], "old@example.com")
+	if email, err := ek.Decrypt(legacy); err != nil ||
+		email != "old@example.com" || ek.IsCurrent(legacy) {
+		t.Errorf("Expected legacy email to be decrypted, got '%s': %v",
+			email, err)
+	}
+	if _, err = ek.Decrypt("k3" + keyIDSep + "abcd"); err == nil {
+		t.Errorf("Expected email with unknown key to be rejected")
+	}
+
+	//Index does not depend on the encryption key or the case of the email
+	index, _ := ek.Index("someone@example.com")
+	ek.Current = "k2"
+	if other, _ := ek.Index(" Someone@Example.com"); other != index {
+		t.Errorf("Expected same index for same email")
+	}
+}
+
+func TestInvalidEmailKeys(t *testing.T) {
+	invalid := []M{
+		{"current": "k3", "keys": M{"k1": testKey1}},
+		{"current": "k1", "keys": M{"k1": "short"}},
+		{"current": "k$1", "keys": M{"k$1": testKey1}},
+	}
+	for _, cfg := range invalid {
+		_, restore := useTestStorage(M{"emailKeys": cfg})
+		if _, err := GetEmailKeys(); err == nil {
+			t.Errorf("Expected email keys %v to be rejected", cfg)
+		}
+		restore()
+	}
+}
+
+func TestRotateEmailKey(t *testing.T) {
+	storage, restore := useTestStorage(nil)
+	defer restore()
+	gtx := context.Background()
+	first := createTestUser(t, storage, "first", Normal)
+	second := createTestUser(t, storage, "second", Normal)
+	legacy := UserIDHash("legacy")
+	storage.users[legacy] = &User{
+		UserID: legacy,
+		Email: encryptCFB(
+			t, config["emailKey"].(string), "legacy@example.com"),
+	}
+	secret, _ := EncryptEmail("totp-secret")
+	storage.tfs[first] = &TwoFactor{UserID: first, Secret: secret}
+
+	config["emailKeys"] = M{
+		"current": "k2",
+		"keys":    M{"k1": testKey1, "k2": testKey2},
+	}
+	updated, secrets, total, err := rotateEmailKey(gtx, 2, true)
+	if err != nil || updated != 3 || secrets != 1 || total != 3 {
+		t.Fatalf("Unexpected dry run result %d, %d, %d: %v",
+			updated, secrets, total, err)
+	}
+	if storage.users[legacy].EmailIndex != "" ||
+		storage.tfs[first].Secret != secret {
+		t.Errorf("Expected no change in dry run")
+	}
+	if _, _, _, err = rotateEmailKey(gtx, 2, false); err != nil {
+		t.Fatalf("Failed to rotate email key: %v", err)
+	}
+	ek, _ := GetEmailKeys()
+	emails := map[string]string{
+		first:  "first@example.com",
+		second: "second@example.com",
+		legacy: "legacy@example.com",
+	}
+	for id, expected := range emails {
+		user := storage.users[id]
+		email, err := ek.Decrypt(user.Email)
+		index, _ := ek.Index(expected)
+		if !ek.IsCurrent(user.Email) || err != nil || email != expected ||
+			user.EmailIndex != index {
+			t.Errorf("Expected email '%s' to be re-encrypted and indexed, "+
+				"got '%s': %v", expected, email, err)
+		}
+	}
+	if !ek.IsCurrent(storage.tfs[first].Secret) {
+		t.Errorf("Expected 2FA secret to be re-encrypted")
+	}
+	updated, secrets, _, err = rotateEmailKey(gtx, 2, false)
+	if err != nil || updated != 0 || secrets != 0 {
+		t.Errorf("Expected nothing to rotate, got %d, %d: %v",
+			updated, secrets, err)
+	}
+}
@@ -0,0 +1,291 @@
+package teak
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	echo "github.com/labstack/echo/v4"
+)
+
+//PasswordResetToken - a single use token that is mailed to an user who forgot
+//the password. Only the hash of the token is stored
+type PasswordResetToken struct {
+	ID        string    `json:"id" db:"id"`
+	UserID    string    `json:"userID" db:"user_id"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+	ExpiresAt time.Time `json:"expiresAt" db:"expires_at"`
+}
+
+//PasswordResetStorage - optional interface of user storages that store
+//password reset tokens
+type PasswordResetStorage interface {
+	//SavePasswordResetToken - stores a password reset token, earlier reset
+	//tokens of the user are removed
+	SavePasswordResetToken(
+		gtx context.Context, token *PasswordResetToken) (err error)
+
+	//UsePasswordResetToken - removes the password reset token with given ID
+	//and returns it, a token can be used only once
+	UsePasswordResetToken(gtx context.Context, tokenID string) (
+		token *PasswordResetToken, err error)
+}
+
+//GetPasswordResetStorage - gives the user storage if it supports password
+//reset tokens
+func GetPasswordResetStorage() (storage PasswordResetStorage, err error) {
+	storage, ok := unwrapUserStorage(GetUserStorage()).(PasswordResetStorage)
+	if !ok {
+		return storage, errors.New(
+			"User storage does not support password reset")
+	}
+	return &metricPasswordResetStorage{storage}, err
+}
+
+//PasswordResetConfig - configuration for forgot password flow, read from
+//'passwordReset' key of the app config. Reset links are valid for TokenTTLMins.
+//Within WindowMins an user can request MaxPerUser links and an IP address
+//can make MaxPerIP requests
+type PasswordResetConfig struct {
+	TokenTTLMins int `json:"tokenTTLMins"`
+	MaxPerUser   int `json:"maxPerUser"`
+	MaxPerIP     int `json:"maxPerIP"`
+	WindowMins   int `json:"windowMins"`
+}
+
+//forgotMsg - response for every forgot password request, it should not tell
+//whether the user exists
+const forgotMsg = "If the account exists, a password reset link is sent " +
+	"to its email"
+
+//GetPasswordResetConfig - gives the forgot password configuration, defaults
+//are used for the values that are not configured
+func GetPasswordResetConfig() (rc PasswordResetConfig) {
+	GetConfig("passwordReset", &rc)
+	if rc.TokenTTLMins <= 0 {
+		rc.TokenTTLMins = 30
+	}
+	if rc.MaxPerUser <= 0 {
+		rc.MaxPerUser = 3
+	}
+	if rc.MaxPerIP <= 0 {
+		rc.MaxPerIP = 20
+	}
+	if rc.WindowMins <= 0 {
+		rc.WindowMins = 60
+	}
+	return rc
+}
+
+//getPasswordResetLink - gives the link to the page where the user can set a
+//new password using the token
+func getPasswordResetLink(token string) (link string) {
+	var host string
+	if !GetConfig("hostAddress", &host) {
+		host = "http://localhost:4200"
+	}
+	link = host + "/" + "reset-password?" + "token=" + url.QueryEscape(token)
+	return link
+}
+
+//SendPasswordResetMail - send mail with a link to reset the password to the
+//user's email
+func SendPasswordResetMail(user *User, token string) (err error) {
+	content := "Hi!,\n A password reset was requested for your account. " +
+		"Reset your password by clicking on below link\n" +
+		getPasswordResetLink(token) + "\n" +
+		"If you did not request it, you can ignore this mail"
+	subject := "Password reset"
+	var email string
+	email, err = DecryptEmail(user.Email)
+	if err == nil {
+		err = SendEmail(email, subject, content)
+	}
+	return LogError("t.uman.forgot", err)
+}
+
+//startPasswordReset - creates a reset token for the user and mails it. It is
+//silent about users that do not exist, are not allowed to reset or have asked
+//for too many links
+func startPasswordReset(gtx context.Context, userID string) (err error) {
+	rc := GetPasswordResetConfig()
+	window := time.Duration(rc.WindowMins) * time.Minute
+	requests, err := attemptCounter.Fail(gtx, "forgot:user:"+userID, window)
+	if err != nil || requests > rc.MaxPerUser {
+		return err
+	}
+	resets, err := GetPasswordResetStorage()
+	if err != nil {
+		return err
+	}
+	user, err := GetUserStorage().GetUser(gtx, userID)
+	if err != nil || (user.State != Active && user.State != Locked) {
+		return nil
+	}
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	err = resets.SavePasswordResetToken(gtx, &PasswordResetToken{
+		ID:        HashToken(token),
+		UserID:    userID,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Duration(rc.TokenTTLMins) * time.Minute),
+	})
+	if err == nil {
+		err = SendPasswordResetMail(user, token)
+	}
+	LogEvent("password_forgot", userID, user.FirstName+" "+user.LastName,
+		err == nil, ErrString(err), nil)
+	return err
+}
+
+func forgotPassword(ctx echo.Context) (err error) {
+	status, msg := http.StatusOK, forgotMsg
+	params := make(map[string]string)
+	err = ctx.Bind(&params)
+	if err != nil || params["userID"] == "" {
+		msg = "Failed to read user ID from request"
+		status = http.StatusBadRequest
+		err = errors.New(msg)
+	}
+	if err == nil {
+		rc := GetPasswordResetConfig()
+		window := time.Duration(rc.WindowMins) * time.Minute
+		var requests int
+		requests, err = attemptCounter.Fail(
+			ctx.Request().Context(), "forgot:ip:"+ctx.RealIP(), window)
+		if err == nil && requests > rc.MaxPerIP {
+			ctx.Set("userName", "N/A")
+			return throttled(ctx, "password_forgot_request", window)
+		} else if err != nil {
+			msg = "Failed to process password reset request"
+			status = http.StatusInternalServerError
+		}
+	}
+	if err == nil {
+		//Done in background so that the response time does not tell whether
+		//the user exists
+		userID := params["userID"]
+		go func() {
+			gtx := context.Background()
+			err := startPasswordReset(gtx, ResolveUserID(gtx, userID))
+			LogErrorX("t.uman.forgot", "Failed to start password reset", err)
+		}()
+	}
+	ctx.Set("userID", "")
+	ctx.Set("userName", "N/A")
+	err = AuditedSend(ctx, &Result{
+		Status: status,
+		Op:     "password_forgot_request",
+		Msg:    msg,
+		OK:     err == nil,
+		Data: M{
+			"ip": ctx.RealIP(),
+		},
+		Err: ErrString(err),
+	})
+	return LogError("t.uman.forgot", err)
+}
+
+func completePasswordReset(ctx echo.Context) (err error) {
+	status, msg := DefMS("Reset forgotten password")
+	params := make(map[string]string)
+	var data interface{}
+	var user *User
+	gtx := ctx.Request().Context()
+	storage := GetUserStorage()
+	resets, err := GetPasswordResetStorage()
+	if err != nil {
+		msg = "Password reset is not supported"
+		status = http.StatusNotImplemented
+	}
+	if err == nil {
+		err = ctx.Bind(&params)
+		if err != nil || params["token"] == "" {
+			msg = "Failed to read password reset parameters"
+			status = http.StatusBadRequest
+			err = errors.New(msg)
+		}
+	}
+	if err == nil {
+		//Obvious policy violations should not use up the token
+		policy := GetPasswordPolicy()
+		if err = policy.Check(params["password"], nil); err != nil {
+			status, msg, data = passwordFailure(err, "")
+		}
+	}
+	var rt *PasswordResetToken
+	if err == nil {
+		rt, err = resets.UsePasswordResetToken(gtx, HashToken(params["token"]))
+		if err == nil && time.Now().After(rt.ExpiresAt) {
+			err = errors.New("Password reset token expired")
+		}
+		if err == nil {
+			user, err = storage.GetUser(gtx, rt.UserID)
+		}
+		if err != nil {
+			msg = "Invalid or expired password reset link"
+			status = http.StatusBadRequest
+		}
+	}
+	if err == nil {
+		err = storage.SetPassword(gtx, rt.UserID, params["password"])
+		if err != nil {
+			status, msg, data = passwordFailure(err, "Failed to set password")
+			if _, ok := AsPolicyError(err); ok {
+				//Let the user try again with the same link
+				resets.SavePasswordResetToken(gtx, rt)
+			}
+		}
+	}
+	if err == nil {
+		//Existing sessions may belong to whoever knew the old password
+		err = revokeRefreshTokens(gtx, rt.UserID, "")
+		if err == nil && user.State == Locked {
+			err = UnlockUser(gtx, user)
+		}
+		if err != nil {
+			msg = "Password is reset, failed to end existing sessions"
+			status = http.StatusInternalServerError
+		}
+	}
+	if user != nil {
+		ctx.Set("userID", user.UserID)
+		ctx.Set("userName", user.FirstName+" "+user.LastName)
+	} else {
+		ctx.Set("userName", "N/A")
+	}
+	err = AuditedSend(ctx, &Result{
+		Status: status,
+		Op:     "password_forgot_reset",
+		Msg:    msg,
+		OK:     err == nil,
+		Data:   data,
+		Err:    ErrString(err),
+	})
+	return LogError("t.uman.forgot", err)
+}
+
+func getForgotPasswordEndpoints() []*Endpoint {
+	return []*Endpoint{
+		{
+			Method:   echo.POST,
+			URL:      "uman/password/forgot",
+			Access:   Public,
+			Category: "user management",
+			Func:     forgotPassword,
+			Comment:  "Request a password reset link by email",
+		},
+		{
+			Method:   echo.POST,
+			URL:      "uman/password/reset",
+			Access:   Public,
+			Category: "user management",
+			Func:     completePasswordReset,
+			Comment:  "Set a new password using the link sent by email",
+		},
+	}
+}
@@ -0,0 +1,130 @@
+package teak
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	echo "github.com/labstack/echo/v4"
+)
+
+//useTestAttemptCounter - sets a new in-memory attempt counter, the returned
+//function restores the previous one
+func useTestAttemptCounter() (restore func()) {
+	prev := attemptCounter
+	attemptCounter = NewMemAttemptCounter()
+	return func() { attemptCounter = prev }
+}
+
+//callPasswordReset - calls the handler that sets a new password using the
+//reset token
+func callPasswordReset(token, password string) (status int) {
+	body, _ := json.Marshal(M{"token": token, "password": password})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/uman/password/reset",
+		strings.NewReader(string(body)))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	completePasswordReset(echo.New().NewContext(req, rec))
+	return rec.Code
+}
+
+func TestStartPasswordReset(t *testing.T) {
+	storage, restore := useTestStorage(M{
+		"passwordReset": M{"maxPerUser": 2},
+	})
+	defer restore()
+	defer useTestAttemptCounter()()
+	gtx := context.Background()
+	userID := createTestUser(t, storage, "forgetful", Normal)
+
+	for i := 0; i < 3; i++ {
+		//Mail can not be sent in tests, the token is saved before that
+		startPasswordReset(gtx, userID)
+	}
+	if len(storage.resets) != 1 {
+		t.Fatalf("Expected only the latest reset token to be kept, got %d",
+			len(storage.resets))
+	}
+	var first *PasswordResetToken
+	for _, token := range storage.resets {
+		first = token
+	}
+	ttl := first.ExpiresAt.Sub(first.CreatedAt).Round(time.Second)
+	if first.UserID != userID || ttl != 30*time.Minute {
+		t.Errorf("Unexpected reset token %+v", first)
+	}
+	//Requests over the limit do not create new tokens
+	if _, err := storage.UsePasswordResetToken(gtx, first.ID); err != nil {
+		t.Fatalf("Failed to use reset token: %v", err)
+	}
+	startPasswordReset(gtx, userID)
+	if len(storage.resets) != 0 {
+		t.Errorf("Expected no reset token after the limit is reached")
+	}
+
+	disabled := createTestUser(t, storage, "disabled", Normal)
+	storage.users[disabled].State = Disabled
+	if err := startPasswordReset(gtx, disabled); err != nil ||
+		len(storage.resets) != 0 {
+		t.Errorf("Expected disabled user to be skipped silently: %v", err)
+	}
+	if err := startPasswordReset(gtx, "missing"); err != nil ||
+		len(storage.resets) != 0 {
+		t.Errorf("Expected missing user to be skipped silently: %v", err)
+	}
+}
+
+func TestCompletePasswordReset(t *testing.T) {
+	storage, restore := useTestStorage(M{
+		"passwordPolicy": M{"minLength": 10},
+	})
+	defer restore()
+	defer useTestAttemptCounter()()
+	gtx := context.Background()
+	userID := createTestUser(t, storage, "locked", Normal)
+	storage.users[userID].State = Locked
+	storage.SaveRefreshToken(gtx, &RefreshToken{ID: "r1", UserID: userID})
+	storage.SavePasswordResetToken(gtx, &PasswordResetToken{
+		ID:        HashToken("reset-token"),
+		UserID:    userID,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Minute),
+	})
+
+	if status := callPasswordReset("reset-token", "short"); status !=
+		http.StatusBadRequest || len(storage.resets) != 1 {
+		t.Errorf("Expected weak password to be rejected without using the "+
+			"token, status %d", status)
+	}
+	if status := callPasswordReset("reset-token", "long enough"); status !=
+		http.StatusOK {
+		t.Fatalf("Expected password to be reset, status %d", status)
+	}
+	if storage.pwds[userID] != "long enough" {
+		t.Errorf("Expected new password to be set")
+	}
+	if len(storage.refresh) != 0 {
+		t.Errorf("Expected existing sessions to be ended")
+	}
+	if storage.users[userID].State != Active {
+		t.Errorf("Expected locked user to be unlocked")
+	}
+	if status := callPasswordReset("reset-token", "another one"); status !=
+		http.StatusBadRequest {
+		t.Errorf("Expected used token to be rejected, status %d", status)
+	}
+
+	storage.SavePasswordResetToken(gtx, &PasswordResetToken{
+		ID:        HashToken("old-token"),
+		UserID:    userID,
+		ExpiresAt: time.Now().Add(-time.Minute),
+	})
+	if status := callPasswordReset("old-token", "another one"); status !=
+		http.StatusBadRequest {
+		t.Errorf("Expected expired token to be rejected, status %d", status)
+	}
+}
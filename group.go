@@ -0,0 +1,511 @@
+package teak
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+
+	echo "github.com/labstack/echo/v4"
+	"gopkg.in/urfave/cli.v1"
+)
+
+//groupNameRx - group names are used in URLs and JWT claims, so they are kept
+//simple
+var groupNameRx = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,100}$`)
+
+//ValidGroupName - checks if the given string can be used as a group name
+func ValidGroupName(name string) bool {
+	return groupNameRx.MatchString(name)
+}
+
+//GroupStorage - optional interface of user storages that store groups. Without
+//it users do not belong to any group
+type GroupStorage interface {
+	//CreateGroup - creates a group with given members
+	CreateGroup(gtx context.Context, group *Group) (err error)
+
+	//GetGroup - gets the group with given name along with its members
+	GetGroup(gtx context.Context, name string) (group *Group, err error)
+
+	//GetGroups - gets all the groups along with their members
+	GetGroups(gtx context.Context) (groups []*Group, err error)
+
+	//DeleteGroup - deletes the group with given name
+	DeleteGroup(gtx context.Context, name string) (err error)
+
+	//AddGroupMembers - adds the users to the group, users who are already
+	//members are ignored
+	AddGroupMembers(gtx context.Context, name string, userIDs []string) (
+		err error)
+
+	//RemoveGroupMembers - removes the users from the group
+	RemoveGroupMembers(gtx context.Context, name string, userIDs []string) (
+		err error)
+
+	//GetUserGroups - gives names of the groups the user is member of
+	GetUserGroups(gtx context.Context, userID string) (
+		groups []string, err error)
+}
+
+//GetGroupStorage - gives the user storage if it supports groups
+func GetGroupStorage() (storage GroupStorage, err error) {
+	storage, ok := unwrapUserStorage(GetUserStorage()).(GroupStorage)
+	if !ok {
+		return storage, errors.New("User storage does not support groups")
+	}
+	return &metricGroupStorage{storage}, err
+}
+
+//userGroups - gives names of the groups the user is member of, the user is
+//not member of any group if the user storage does not support groups
+func userGroups(gtx context.Context, userID string) (
+	groups []string, err error) {
+	storage, gerr := GetGroupStorage()
+	if gerr != nil {
+		return []string{}, err
+	}
+	return storage.GetUserGroups(gtx, userID)
+}
+
+//InGroup - tells if the session user is member of any of the given groups
+func (s *Session) InGroup(groups ...string) bool {
+	for _, group := range groups {
+		for _, member := range s.Groups {
+			if member == group {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//groupsFromClaim - reads group names from the 'groups' claim of a token. Once
+//the token is parsed from JSON the claim is a list of interface values
+func groupsFromClaim(claim interface{}) (groups []string) {
+	switch val := claim.(type) {
+	case []string:
+		groups = val
+	case []interface{}:
+		groups = make([]string, 0, len(val))
+		for _, item := range val {
+			if name, ok := item.(string); ok {
+				groups = append(groups, name)
+			}
+		}
+	}
+	return groups
+}
+
+//groupMiddleware - allows the request only if the user is member of one of the
+//given groups. Super users are not restricted by groups
+func groupMiddleware(groups []string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) (err error) {
+			session, err := RetrieveSessionInfo(ctx)
+			if err != nil {
+				return &echo.HTTPError{
+					Code:     http.StatusForbidden,
+					Message:  "Invalid JWT toke found, does not have user info",
+					Internal: err,
+				}
+			}
+			if session.Role != Super && !session.InGroup(groups...) {
+				return &echo.HTTPError{
+					Code:    http.StatusForbidden,
+					Message: "Not a member of groups required for the operation",
+				}
+			}
+			return next(ctx)
+		}
+	}
+}
+
+func createGroup(ctx echo.Context) (err error) {
+	status, msg := DefMS("Create group")
+	var group Group
+	err = ctx.Bind(&group)
+	if err != nil || !ValidGroupName(group.Name) {
+		msg = "Invalid group information given"
+		status = http.StatusBadRequest
+		err = errors.New(msg)
+	}
+	if err == nil {
+		if group.Users == nil {
+			group.Users = []string{}
+		}
+		var storage GroupStorage
+		storage, err = GetGroupStorage()
+		if err == nil {
+			err = storage.CreateGroup(ctx.Request().Context(), &group)
+		}
+		if err != nil {
+			msg = "Failed to create group"
+			status = http.StatusInternalServerError
+		}
+	}
+	err = AuditedSend(ctx, &Result{
+		Status: status,
+		Op:     "group_create",
+		Msg:    msg,
+		OK:     err == nil,
+		Data:   group,
+		Err:    ErrString(err),
+	})
+	return LogError("t.uman.group", err)
+}
+
+func getGroups(ctx echo.Context) (err error) {
+	status, msg := DefMS("Get groups")
+	var groups []*Group
+	storage, err := GetGroupStorage()
+	if err == nil {
+		groups, err = storage.GetGroups(ctx.Request().Context())
+	}
+	if err != nil {
+		msg = "Failed to retrieve groups"
+		status = http.StatusInternalServerError
+	}
+	err = SendAndAuditOnErr(ctx, &Result{
+		Status: status,
+		Op:     "group_multi_fetch",
+		Msg:    msg,
+		OK:     err == nil,
+		Data:   groups,
+		Err:    ErrString(err),
+	})
+	return LogError("t.uman.group", err)
+}
+
+func getGroup(ctx echo.Context) (err error) {
+	status, msg := DefMS("Get group")
+	var group *Group
+	storage, err := GetGroupStorage()
+	if err == nil {
+		group, err = storage.GetGroup(
+			ctx.Request().Context(), ctx.Param("name"))
+	}
+	if err != nil {
+		msg = "Failed to retrieve group"
+		status = http.StatusNotFound
+	}
+	err = SendAndAuditOnErr(ctx, &Result{
+		Status: status,
+		Op:     "group_fetch",
+		Msg:    msg,
+		OK:     err == nil,
+		Data:   group,
+		Err:    ErrString(err),
+	})
+	return LogError("t.uman.group", err)
+}
+
+func deleteGroup(ctx echo.Context) (err error) {
+	status, msg := DefMS("Delete group")
+	name := ctx.Param("name")
+	storage, err := GetGroupStorage()
+	if err == nil {
+		err = storage.DeleteGroup(ctx.Request().Context(), name)
+	}
+	if err != nil {
+		msg = "Failed to delete group"
+		status = http.StatusInternalServerError
+	}
+	err = AuditedSend(ctx, &Result{
+		Status: status,
+		Op:     "group_remove",
+		Msg:    msg,
+		OK:     err == nil,
+		Data: M{
+			"name": name,
+		},
+		Err: ErrString(err),
+	})
+	return LogError("t.uman.group", err)
+}
+
+func addGroupMembers(ctx echo.Context) (err error) {
+	status, msg := DefMS("Add group members")
+	name := ctx.Param("name")
+	var params struct {
+		Users []string `json:"users"`
+	}
+	err = ctx.Bind(&params)
+	if err != nil || len(params.Users) == 0 {
+		msg = "Failed to read users to add to the group"
+		status = http.StatusBadRequest
+		err = errors.New(msg)
+	}
+	if err == nil {
+		var storage GroupStorage
+		storage, err = GetGroupStorage()
+		if err == nil {
+			err = storage.AddGroupMembers(
+				ctx.Request().Context(), name, params.Users)
+		}
+		if err != nil {
+			msg = "Failed to add users to the group"
+			status = http.StatusInternalServerError
+		}
+	}
+	err = AuditedSend(ctx, &Result{
+		Status: status,
+		Op:     "group_members_add",
+		Msg:    msg,
+		OK:     err == nil,
+		Data: M{
+			"name":  name,
+			"users": params.Users,
+		},
+		Err: ErrString(err),
+	})
+	return LogError("t.uman.group", err)
+}
+
+func removeGroupMember(ctx echo.Context) (err error) {
+	status, msg := DefMS("Remove group member")
+	name := ctx.Param("name")
+	userID := ctx.Param("userID")
+	storage, err := GetGroupStorage()
+	if err == nil {
+		err = storage.RemoveGroupMembers(
+			ctx.Request().Context(), name, []string{userID})
+	}
+	if err != nil {
+		msg = "Failed to remove user from the group"
+		status = http.StatusInternalServerError
+	}
+	err = AuditedSend(ctx, &Result{
+		Status: status,
+		Op:     "group_member_remove",
+		Msg:    msg,
+		OK:     err == nil,
+		Data: M{
+			"name":   name,
+			"userID": userID,
+		},
+		Err: ErrString(err),
+	})
+	return LogError("t.uman.group", err)
+}
+
+func getUserGroups(ctx echo.Context) (err error) {
+	status, msg := DefMS("Get groups of user")
+	var groups []string
+	storage, err := GetGroupStorage()
+	if err == nil {
+		groups, err = storage.GetUserGroups(
+			ctx.Request().Context(), ctx.Param("userID"))
+	}
+	if err != nil {
+		msg = "Failed to retrieve groups of the user"
+		status = http.StatusInternalServerError
+	}
+	err = SendAndAuditOnErr(ctx, &Result{
+		Status: status,
+		Op:     "user_groups_fetch",
+		Msg:    msg,
+		OK:     err == nil,
+		Data:   groups,
+		Err:    ErrString(err),
+	})
+	return LogError("t.uman.group", err)
+}
+
+func getGroupEndpoints() []*Endpoint {
+	return []*Endpoint{
+		{
+			Method:   echo.POST,
+			URL:      "uman/group",
+			Access:   Admin,
+			Category: "user management",
+			Func:     createGroup,
+			Comment:  "Create a group",
+		},
+		{
+			Method:   echo.GET,
+			URL:      "uman/group",
+			Access:   Admin,
+			Category: "user management",
+			Func:     getGroups,
+			Comment:  "Get all groups",
+		},
+		{
+			Method:   echo.GET,
+			URL:      "uman/group/:name",
+			Access:   Admin,
+			Category: "user management",
+			Func:     getGroup,
+			Comment:  "Get a group with its members",
+		},
+		{
+			Method:   echo.DELETE,
+			URL:      "uman/group/:name",
+			Access:   Admin,
+			Category: "user management",
+			Func:     deleteGroup,
+			Comment:  "Delete a group",
+		},
+		{
+			Method:   echo.POST,
+			URL:      "uman/group/:name/members",
+			Access:   Admin,
+			Category: "user management",
+			Func:     addGroupMembers,
+			Comment:  "Add users to a group",
+		},
+		{
+			Method:   echo.DELETE,
+			URL:      "uman/group/:name/members/:userID",
+			Access:   Admin,
+			Category: "user management",
+			Func:     removeGroupMember,
+			Comment:  "Remove an user from a group",
+		},
+		{
+			Method:   echo.GET,
+			URL:      "uman/user/:userID/groups",
+			Access:   Admin,
+			Category: "user management",
+			Func:     getUserGroups,
+			Comment:  "Get groups of an user",
+		},
+	}
+}
+
+func groupCmd() *cli.Command {
+	nameFlag := cli.StringFlag{
+		Name:  "name",
+		Usage: "Name of the group",
+	}
+	usersFlag := cli.StringFlag{
+		Name:  "users",
+		Usage: "Comma separated IDs of the users",
+	}
+	toIDs := func(users string) (ids []string) {
+		ids = make([]string, 0, 10)
+		for _, user := range strings.Split(users, ",") {
+			if user = strings.TrimSpace(user); user != "" {
+				ids = append(ids, ResolveUserID(context.TODO(), user))
+			}
+		}
+		return ids
+	}
+	return &cli.Command{
+		Name:  "group",
+		Usage: "Manage user groups",
+		Subcommands: []cli.Command{
+			{
+				Name:  "create",
+				Usage: "Create a group",
+				Flags: []cli.Flag{nameFlag, usersFlag},
+				Action: func(ctx *cli.Context) (err error) {
+					ag := NewArgGetter(ctx)
+					name := ag.GetRequiredString("name")
+					users := ag.GetOptionalString("users")
+					if err = ag.Err; err != nil {
+						return err
+					}
+					if !ValidGroupName(name) {
+						return fmt.Errorf("Invalid group name '%s'", name)
+					}
+					storage, err := GetGroupStorage()
+					if err != nil {
+						return err
+					}
+					err = storage.CreateGroup(context.TODO(), &Group{
+						Name:  name,
+						Users: toIDs(users),
+					})
+					return LogErrorX("t.uman.group", "Failed to create group",
+						err)
+				},
+			},
+			{
+				Name:  "delete",
+				Usage: "Delete a group",
+				Flags: []cli.Flag{nameFlag},
+				Action: func(ctx *cli.Context) (err error) {
+					ag := NewArgGetter(ctx)
+					name := ag.GetRequiredString("name")
+					if err = ag.Err; err != nil {
+						return err
+					}
+					storage, err := GetGroupStorage()
+					if err != nil {
+						return err
+					}
+					err = storage.DeleteGroup(context.TODO(), name)
+					return LogErrorX("t.uman.group", "Failed to delete group",
+						err)
+				},
+			},
+			{
+				Name:  "list",
+				Usage: "List groups with number of members",
+				Action: func(ctx *cli.Context) (err error) {
+					storage, err := GetGroupStorage()
+					if err != nil {
+						return err
+					}
+					groups, err := storage.GetGroups(context.TODO())
+					if err != nil {
+						return err
+					}
+					tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+					fmt.Fprintln(tw, "NAME\tMEMBERS")
+					for _, group := range groups {
+						fmt.Fprintf(tw, "%s\t%d\n", group.Name, len(group.Users))
+					}
+					return tw.Flush()
+				},
+			},
+			{
+				Name:  "add",
+				Usage: "Add users to a group",
+				Flags: []cli.Flag{nameFlag, usersFlag},
+				Action: func(ctx *cli.Context) (err error) {
+					ag := NewArgGetter(ctx)
+					name := ag.GetRequiredString("name")
+					users := ag.GetRequiredString("users")
+					if err = ag.Err; err != nil {
+						return err
+					}
+					storage, err := GetGroupStorage()
+					if err != nil {
+						return err
+					}
+					err = storage.AddGroupMembers(
+						context.TODO(), name, toIDs(users))
+					return LogErrorX("t.uman.group",
+						"Failed to add users to group", err)
+				},
+			},
+			{
+				Name:  "remove",
+				Usage: "Remove users from a group",
+				Flags: []cli.Flag{nameFlag, usersFlag},
+				Action: func(ctx *cli.Context) (err error) {
+					ag := NewArgGetter(ctx)
+					name := ag.GetRequiredString("name")
+					users := ag.GetRequiredString("users")
+					if err = ag.Err; err != nil {
+						return err
+					}
+					storage, err := GetGroupStorage()
+					if err != nil {
+						return err
+					}
+					err = storage.RemoveGroupMembers(
+						context.TODO(), name, toIDs(users))
+					return LogErrorX("t.uman.group",
+						"Failed to remove users from group", err)
+				},
+			},
+		},
+	}
+}
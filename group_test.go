@@ -0,0 +1,113 @@
+package teak
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	echo "github.com/labstack/echo/v4"
+)
+
+func TestValidGroupName(t *testing.T) {
+	valid := []string{"admins", "team-1", "ops.eu_west"}
+	invalid := []string{
+		"", "with space", "a/b", "x,y", strings.Repeat("a", 101),
+	}
+	for _, name := range valid {
+		if !ValidGroupName(name) {
+			t.Errorf("Expected '%s' to be a valid group name", name)
+		}
+	}
+	for _, name := range invalid {
+		if ValidGroupName(name) {
+			t.Errorf("Expected '%s' to be an invalid group name", name)
+		}
+	}
+}
+
+//groupTestServer - server with an endpoint restricted to 'ops' group, the
+//requests are made with the given token
+func groupTestServer(token *jwt.Token) *echo.Echo {
+	e := echo.New()
+	grp := e.Group("", func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			ctx.Set("token", token)
+			return next(ctx)
+		}
+	})
+	ok := func(ctx echo.Context) error {
+		return ctx.NoContent(http.StatusOK)
+	}
+	configure(grp, "/", &Endpoint{
+		Method: echo.GET,
+		URL:    "deploy",
+		Access: Normal,
+		Groups: []string{"ops"},
+		Func:   ok,
+	})
+	configure(grp, "/", &Endpoint{
+		Method: echo.GET,
+		URL:    "status",
+		Access: Normal,
+		Func:   ok,
+	})
+	return e
+}
+
+func TestGroupRestrictedEndpoint(t *testing.T) {
+	storage, restore := useTestStorage(nil)
+	defer restore()
+	gtx := context.Background()
+	member := createTestUser(t, storage, "member", Normal)
+	other := createTestUser(t, storage, "other", Admin)
+	if err := storage.CreateGroup(gtx, &Group{
+		Name:  "ops",
+		Users: []string{member},
+	}); err != nil {
+		t.Fatalf("Failed to create group: %v", err)
+	}
+
+	//Groups are part of the issued token, once parsed the claim is a list of
+	//interface values
+	tokenOf := func(userID string) *jwt.Token {
+		user, _ := storage.GetUser(gtx, userID)
+		data, err := issueTokens(gtx, user, "")
+		if err != nil {
+			t.Fatalf("Failed to issue token: %v", err)
+		}
+		token, err := ParseToken(data["token"].(string))
+		if err != nil {
+			t.Fatalf("Failed to parse token: %v", err)
+		}
+		return token
+	}
+	superToken := &jwt.Token{Valid: true, Claims: jwt.MapClaims{
+		"userID":   "super",
+		"userName": "Super User",
+		"userType": "normal",
+		"access":   float64(Super),
+	}}
+	cases := []struct {
+		name   string
+		token  *jwt.Token
+		path   string
+		status int
+	}{
+		{"member", tokenOf(member), "/deploy", http.StatusOK},
+		{"non member", tokenOf(other), "/deploy", http.StatusForbidden},
+		{"super user", superToken, "/deploy", http.StatusOK},
+		{"unrestricted", tokenOf(other), "/status", http.StatusOK},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, c.path, nil)
+		groupTestServer(c.token).ServeHTTP(rec, req)
+		if rec.Code != c.status {
+			t.Errorf("%s: expected status %d for %s, got %d",
+				c.name, c.status, c.path, rec.Code)
+		}
+	}
+}
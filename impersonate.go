@@ -0,0 +1,168 @@
+package teak
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	echo "github.com/labstack/echo/v4"
+)
+
+//ImpersonationConfig - configuration for impersonation, read from
+//'impersonation' key of the app config. Tokens are valid for TTLMins unless
+//the super user asks for a different duration that is within MaxTTLMins
+type ImpersonationConfig struct {
+	TTLMins    int `json:"ttlMins"`
+	MaxTTLMins int `json:"maxTTLMins"`
+}
+
+//GetImpersonationConfig - gives the impersonation configuration, defaults are
+//used for the values that are not configured
+func GetImpersonationConfig() (ic ImpersonationConfig) {
+	GetConfig("impersonation", &ic)
+	if ic.TTLMins <= 0 {
+		ic.TTLMins = 15
+	}
+	if ic.MaxTTLMins <= 0 {
+		ic.MaxTTLMins = 60
+	}
+	if ic.TTLMins > ic.MaxTTLMins {
+		ic.TTLMins = ic.MaxTTLMins
+	}
+	return ic
+}
+
+//IsImpersonated - tells if the session belongs to a super user acting as
+//another user
+func (s *Session) IsImpersonated() bool {
+	return s.ImpersonatedBy != ""
+}
+
+//impersonationToken - creates an access token for the target user which
+//carries the identity of the super user who is impersonating. No refresh
+//token is given, so the session ends when the token expires
+func impersonationToken(gtx context.Context,
+	target *User, impersonator *Session, ttl time.Duration) (data M, err error) {
+	expiry := time.Now().Add(ttl)
+	claims, err := accessClaims(gtx, target, expiry)
+	if err != nil {
+		return data, err
+	}
+	claims["impersonatedBy"] = impersonator.UserID
+	claims["impersonatorName"] = impersonator.UserName
+	signed, err := SignToken(claims)
+	if err != nil {
+		return data, err
+	}
+	data = M{
+		"token":     signed,
+		"expiresAt": expiry,
+		"user":      target,
+	}
+	return data, err
+}
+
+//noImpersonation - rejects the request if it is made with an impersonation
+//token. Used for sensitive endpoints whose effects should only be caused by
+//the real user
+func noImpersonation(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) (err error) {
+		session, err := RetrieveSessionInfo(ctx)
+		if err == nil && !session.IsImpersonated() {
+			return next(ctx)
+		}
+		if err == nil {
+			err = errors.New("Operation not allowed while impersonating")
+		}
+		logCtxEvent(ctx, "impersonation_denied", false, err.Error(), M{
+			"method": ctx.Request().Method,
+			"path":   ctx.Path(),
+		})
+		return &echo.HTTPError{
+			Code:     http.StatusForbidden,
+			Message:  "Operation not allowed while impersonating",
+			Internal: err,
+		}
+	}
+}
+
+func impersonate(ctx echo.Context) (err error) {
+	status, msg := DefMS("Impersonate user")
+	gtx := ctx.Request().Context()
+	userID := ctx.Param("userID")
+	params := struct {
+		DurationMins int    `json:"durationMins"`
+		Reason       string `json:"reason"`
+	}{}
+	var data M
+	var target *User
+	session, err := RetrieveSessionInfo(ctx)
+	if err == nil {
+		err = ctx.Bind(&params)
+	}
+	if err != nil || params.Reason == "" {
+		msg = "A reason is required to impersonate an user"
+		status = http.StatusBadRequest
+		err = errors.New(msg)
+	}
+	if err == nil {
+		target, err = GetUserStorage().GetUser(gtx, userID)
+		if err != nil {
+			msg = "Failed to find the user to impersonate"
+			status = http.StatusBadRequest
+		} else if target.UserID == session.UserID || target.Auth == Super {
+			msg = "Super users can not be impersonated"
+			status = http.StatusForbidden
+			err = errors.New(msg)
+		} else if target.State != Active {
+			msg = "Only active users can be impersonated"
+			status = http.StatusBadRequest
+			err = errors.New(msg)
+		}
+	}
+	if err == nil {
+		ic := GetImpersonationConfig()
+		mins := ic.TTLMins
+		if params.DurationMins > 0 {
+			mins = params.DurationMins
+		}
+		if mins > ic.MaxTTLMins {
+			mins = ic.MaxTTLMins
+		}
+		data, err = impersonationToken(
+			gtx, target, &session, time.Duration(mins)*time.Minute)
+		if err != nil {
+			msg = "Failed to create impersonation token"
+			status = http.StatusInternalServerError
+		}
+	}
+	//The token is not logged, only what is needed to review the impersonation
+	err = AuditedSendX(ctx, M{
+		"userID":    userID,
+		"reason":    params.Reason,
+		"expiresAt": data["expiresAt"],
+	}, &Result{
+		Status: status,
+		Op:     "impersonate",
+		Msg:    msg,
+		OK:     err == nil,
+		Data:   data,
+		Err:    ErrString(err),
+	})
+	return LogError("t.uman.impersonate", err)
+}
+
+func getImpersonationEndpoints() []*Endpoint {
+	return []*Endpoint{
+		{
+			Method:    echo.POST,
+			URL:       "uman/user/:userID/impersonate",
+			Access:    Super,
+			Category:  "user management",
+			Func:      impersonate,
+			Comment:   "Get a short lived token to act as another user",
+			Sensitive: true,
+		},
+	}
+}
@@ -0,0 +1,193 @@
+package teak
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	echo "github.com/labstack/echo/v4"
+)
+
+//recordingAuditor - auditor that keeps the logged events in memory
+type recordingAuditor struct {
+	NoOpAuditor
+	sync.Mutex
+	events []*Event
+}
+
+func (ra *recordingAuditor) LogEvent(event *Event) {
+	ra.Lock()
+	defer ra.Unlock()
+	ra.events = append(ra.events, event)
+}
+
+//useRecordingAuditor - sets a recording auditor, the returned function
+//restores the previous one
+func useRecordingAuditor() (auditor *recordingAuditor, restore func()) {
+	prev := eventAuditor
+	auditor = &recordingAuditor{}
+	SetEventAuditor(auditor)
+	return auditor, func() { SetEventAuditor(prev) }
+}
+
+//callImpersonate - asks for an impersonation token for the target as the
+//super user with given ID
+func callImpersonate(superID, target string, params M) (
+	status int, data M) {
+	body, _ := json.Marshal(params)
+	req := httptest.NewRequest(http.MethodPost, "/",
+		strings.NewReader(string(body)))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	ctx := echo.New().NewContext(req, rec)
+	ctx.SetParamNames("userID")
+	ctx.SetParamValues(target)
+	ctx.Set("token", &jwt.Token{Valid: true, Claims: jwt.MapClaims{
+		"userID":   superID,
+		"userName": "Super User",
+		"userType": "normal",
+		"access":   float64(Super),
+	}})
+	impersonate(ctx)
+	res := struct {
+		Data M `json:"data"`
+	}{}
+	json.Unmarshal(rec.Body.Bytes(), &res)
+	return rec.Code, res.Data
+}
+
+func TestImpersonate(t *testing.T) {
+	storage, restore := useTestStorage(M{
+		"impersonation": M{"ttlMins": 10, "maxTTLMins": 30},
+	})
+	defer restore()
+	superID := createTestUser(t, storage, "root", Super)
+	target := createTestUser(t, storage, "target", Normal)
+	other := createTestUser(t, storage, "other", Super)
+
+	status, data := callImpersonate(superID, target, M{"reason": "support"})
+	if status != http.StatusOK {
+		t.Fatalf("Expected impersonation token, status %d", status)
+	}
+	if data["refreshToken"] != nil {
+		t.Errorf("Expected no refresh token for impersonation")
+	}
+	token, err := ParseToken(data["token"].(string))
+	if err != nil {
+		t.Fatalf("Failed to parse impersonation token: %v", err)
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	if claims["userID"] != target || claims["impersonatedBy"] != superID {
+		t.Errorf("Unexpected impersonation claims %v", claims)
+	}
+	ttl := time.Until(time.Unix(int64(claims["exp"].(float64)), 0))
+	if ttl > 10*time.Minute || ttl < 9*time.Minute {
+		t.Errorf("Expected configured TTL of 10 minutes, got %v", ttl)
+	}
+
+	//Requested duration is limited to the configured maximum
+	_, data = callImpersonate(superID, target, M{
+		"reason":       "support",
+		"durationMins": 600,
+	})
+	token, _ = ParseToken(data["token"].(string))
+	exp := int64(token.Claims.(jwt.MapClaims)["exp"].(float64))
+	if ttl = time.Until(time.Unix(exp, 0)); ttl > 30*time.Minute {
+		t.Errorf("Expected TTL to be limited to 30 minutes, got %v", ttl)
+	}
+
+	cases := []struct {
+		name   string
+		target string
+		params M
+		status int
+	}{
+		{"no reason", target, M{}, http.StatusBadRequest},
+		{"super user", other, M{"reason": "x"}, http.StatusForbidden},
+		{"self", superID, M{"reason": "x"}, http.StatusForbidden},
+		{"missing user", "missing", M{"reason": "x"}, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		if status, _ = callImpersonate(superID, c.target, c.params); status !=
+			c.status {
+			t.Errorf("%s: expected status %d, got %d", c.name, c.status, status)
+		}
+	}
+}
+
+func TestImpersonatedRequest(t *testing.T) {
+	storage, restore := useTestStorage(nil)
+	defer restore()
+	auditor, restoreAuditor := useRecordingAuditor()
+	defer restoreAuditor()
+	gtx := context.Background()
+	target, err := storage.GetUser(gtx, createTestUser(
+		t, storage, "target", Normal))
+	if err != nil {
+		t.Fatalf("Failed to get target user: %v", err)
+	}
+	data, err := impersonationToken(gtx, target, &Session{
+		UserID:   "root",
+		UserName: "Super User",
+	}, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create impersonation token: %v", err)
+	}
+
+	//Access level is read from the path, the prefix is empty in tests
+	call := func(path string, sensitive bool) (status int) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(echo.HeaderAuthorization,
+			"Bearer "+data["token"].(string))
+		rec := httptest.NewRecorder()
+		ctx := echo.New().NewContext(req, rec)
+		ctx.SetPath(path)
+		handler := func(ctx echo.Context) error {
+			return AuditedSend(ctx, &Result{
+				Status: http.StatusOK,
+				Op:     "test_op",
+				OK:     true,
+			})
+		}
+		if sensitive {
+			handler = noImpersonation(handler)
+		}
+		err := jwtMiddleware(authMiddleware(handler))(ctx)
+		status = rec.Code
+		if he, ok := err.(*echo.HTTPError); ok {
+			status = he.Code
+		}
+		return status
+	}
+	if status := call("r2/things", false); status != http.StatusOK {
+		t.Fatalf("Expected impersonated request to succeed, status %d",
+			status)
+	}
+	if status := call("r2/secrets", true); status != http.StatusForbidden {
+		t.Errorf("Expected sensitive request to be forbidden, status %d",
+			status)
+	}
+	if err = FlushAuditEvents(gtx); err != nil {
+		t.Fatalf("Failed to flush audit events: %v", err)
+	}
+
+	auditor.Lock()
+	defer auditor.Unlock()
+	if len(auditor.events) != 2 {
+		t.Fatalf("Expected 2 audit events, got %d", len(auditor.events))
+	}
+	for i, op := range []string{"test_op", "impersonation_denied"} {
+		event := auditor.events[i]
+		if event.Op != op || event.UserID != target.UserID ||
+			event.RealUserID != "root" ||
+			event.RealUserName != "Super User" {
+			t.Errorf("Unexpected audit event %+v", event)
+		}
+	}
+}
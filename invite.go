@@ -0,0 +1,552 @@
+package teak
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	echo "github.com/labstack/echo/v4"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/urfave/cli.v1"
+)
+
+//Invite - invitation for a person to create an account with given access
+//level and groups. Only the hash of the invite token is stored, the token is
+//sent to the invitee by email. Email is stored encrypted like user emails
+type Invite struct {
+	ID        string    `json:"id" db:"id"`
+	Hash      string    `json:"-" db:"hash"`
+	Email     string    `json:"email" db:"email"`
+	Auth      AuthLevel `json:"auth" db:"auth"`
+	Groups    []string  `json:"groups" db:"groups"`
+	CreatedBy string    `json:"createdBy" db:"created_by"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+	ExpiresAt time.Time `json:"expiresAt" db:"expires_at"`
+}
+
+//IsExpired - tells if the invite can no longer be accepted
+func (inv *Invite) IsExpired() bool {
+	return time.Now().After(inv.ExpiresAt)
+}
+
+//InviteStorage - optional interface of user storages that store invites
+type InviteStorage interface {
+	//CreateInvite - stores an invite
+	CreateInvite(gtx context.Context, invite *Invite) (err error)
+
+	//GetInvites - gets all the pending invites, latest first
+	GetInvites(gtx context.Context) (invites []*Invite, err error)
+
+	//DeleteInvite - deletes the invite with given ID
+	DeleteInvite(gtx context.Context, inviteID string) (err error)
+
+	//UseInvite - removes the invite with given token hash and returns it, an
+	//invite can be used only once
+	UseInvite(gtx context.Context, hash string) (invite *Invite, err error)
+}
+
+//GetInviteStorage - gives the user storage if it supports invites
+func GetInviteStorage() (storage InviteStorage, err error) {
+	storage, ok := unwrapUserStorage(GetUserStorage()).(InviteStorage)
+	if !ok {
+		return storage, errors.New("User storage does not support invites")
+	}
+	return &metricInviteStorage{storage}, err
+}
+
+//deleteInvite - deletes the invite with given ID
+func deleteInvite(gtx context.Context, inviteID string) (err error) {
+	storage, err := GetInviteStorage()
+	if err == nil {
+		err = storage.DeleteInvite(gtx, inviteID)
+	}
+	return err
+}
+
+//RegistrationConfig - configuration for creating accounts, read from
+//'registration' key of the app config. If Disabled is true, users can not
+//register by themselves or be created by OIDC login and have to be invited.
+//Invites are valid for InviteTTLHours
+type RegistrationConfig struct {
+	Disabled       bool `json:"disabled"`
+	InviteTTLHours int  `json:"inviteTTLHours"`
+}
+
+//GetRegistrationConfig - gives the registration configuration, defaults are
+//used for the values that are not configured
+func GetRegistrationConfig() (rc RegistrationConfig) {
+	GetConfig("registration", &rc)
+	if rc.InviteTTLHours <= 0 {
+		rc.InviteTTLHours = 72
+	}
+	return rc
+}
+
+//NewInvite - creates an invite for the email and stores it. The token that is
+//needed to accept the invite is returned only from here
+func NewInvite(
+	gtx context.Context,
+	email string,
+	level AuthLevel,
+	groups []string,
+	createdBy string,
+	validity time.Duration) (token string, invite *Invite, err error) {
+	if !strings.Contains(email, "@") {
+		return token, invite, fmt.Errorf("Invalid email '%s'", email)
+	}
+	if level < Super || level > Monitor {
+		return token, invite, fmt.Errorf("Invalid access level '%d'", level)
+	}
+	storage, err := GetInviteStorage()
+	if err != nil {
+		return token, invite, err
+	}
+	if len(groups) != 0 {
+		groupStorage, err := GetGroupStorage()
+		if err != nil {
+			return token, invite, err
+		}
+		for _, group := range groups {
+			if _, err = groupStorage.GetGroup(gtx, group); err != nil {
+				return token, invite, fmt.Errorf("Unknown group '%s'", group)
+			}
+		}
+	}
+	encrypted, err := EncryptEmail(email)
+	if err != nil {
+		return token, invite, err
+	}
+	token, err = randomToken()
+	if err != nil {
+		return token, invite, err
+	}
+	if groups == nil {
+		groups = []string{}
+	}
+	if validity <= 0 {
+		validity = time.Duration(GetRegistrationConfig().InviteTTLHours) *
+			time.Hour
+	}
+	invite = &Invite{
+		ID:        uuid.NewV4().String(),
+		Hash:      HashToken(token),
+		Email:     encrypted,
+		Auth:      level,
+		Groups:    groups,
+		CreatedBy: createdBy,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(validity),
+	}
+	err = storage.CreateInvite(gtx, invite)
+	return token, invite, err
+}
+
+//inviteEmail - gives the decrypted email of the invite
+func inviteEmail(invite *Invite) (email string, err error) {
+	return DecryptEmail(invite.Email)
+}
+
+//withInviteEmail - gives a copy of the invite with decrypted email so that
+//admins can see who is invited
+func withInviteEmail(invite *Invite) *Invite {
+	cpy := *invite
+	if email, err := inviteEmail(invite); err == nil {
+		cpy.Email = email
+	}
+	return &cpy
+}
+
+//getInviteLink - gives the link to the page where the invitee can create the
+//account using the token
+func getInviteLink(token string) (link string) {
+	var host string
+	if !GetConfig("hostAddress", &host) {
+		host = "http://localhost:4200"
+	}
+	link = host + "/" + "accept-invite?" + "token=" + url.QueryEscape(token)
+	return link
+}
+
+//SendInviteMail - sends mail with a link to accept the invite to the invitee
+func SendInviteMail(invite *Invite, token string) (err error) {
+	content := "Hi!,\n You are invited to create an account. " +
+		"Create your account by clicking on below link\n" +
+		getInviteLink(token) + "\n" +
+		"The link is valid till " + invite.ExpiresAt.Format(time.RFC1123)
+	subject := "Invitation"
+	email, err := inviteEmail(invite)
+	if err == nil {
+		err = SendEmail(email, subject, content)
+	}
+	return LogError("t.uman.invite", err)
+}
+
+func createInvite(ctx echo.Context) (err error) {
+	status, msg := DefMS("Create invite")
+	params := struct {
+		Email     string     `json:"email"`
+		Auth      *AuthLevel `json:"auth"`
+		Groups    []string   `json:"groups"`
+		ValidDays int        `json:"validDays"`
+	}{}
+	var invite *Invite
+	session, err := RetrieveSessionInfo(ctx)
+	if err == nil {
+		err = ctx.Bind(&params)
+	}
+	if err != nil {
+		msg = "Failed to read invite parameters"
+		status = http.StatusBadRequest
+	}
+	level := Normal
+	if params.Auth != nil {
+		level = *params.Auth
+	}
+	if err == nil && level < session.Role {
+		//Nobody can invite someone with more privileges than themselves
+		err = errors.New("Invitee can not have higher access level")
+		msg = err.Error()
+		status = http.StatusForbidden
+	}
+	if err == nil {
+		var token string
+		token, invite, err = NewInvite(
+			ctx.Request().Context(),
+			params.Email,
+			level,
+			params.Groups,
+			session.UserID,
+			time.Duration(params.ValidDays)*24*time.Hour)
+		if err != nil {
+			msg = "Failed to create invite"
+			status = http.StatusBadRequest
+		} else if err = SendInviteMail(invite, token); err != nil {
+			deleteInvite(ctx.Request().Context(), invite.ID)
+			msg = "Failed to send invite email"
+			status = http.StatusInternalServerError
+		}
+	}
+	//Audit log keeps the email encrypted like the rest of the stored data
+	var data *Invite
+	if invite != nil {
+		data = withInviteEmail(invite)
+	}
+	err = AuditedSendX(ctx, invite, &Result{
+		Status: status,
+		Op:     "invite_create",
+		Msg:    msg,
+		OK:     err == nil,
+		Data:   data,
+		Err:    ErrString(err),
+	})
+	return LogError("t.uman.invite", err)
+}
+
+func getInvites(ctx echo.Context) (err error) {
+	status, msg := DefMS("Get invites")
+	var invites []*Invite
+	storage, err := GetInviteStorage()
+	if err == nil {
+		invites, err = storage.GetInvites(ctx.Request().Context())
+	}
+	if err != nil {
+		msg = "Failed to retrieve invites"
+		status = http.StatusInternalServerError
+	}
+	for i, invite := range invites {
+		invites[i] = withInviteEmail(invite)
+	}
+	err = SendAndAuditOnErr(ctx, &Result{
+		Status: status,
+		Op:     "invite_list",
+		Msg:    msg,
+		OK:     err == nil,
+		Data:   invites,
+		Err:    ErrString(err),
+	})
+	return LogError("t.uman.invite", err)
+}
+
+func revokeInvite(ctx echo.Context) (err error) {
+	status, msg := DefMS("Revoke invite")
+	inviteID := ctx.Param("inviteID")
+	err = deleteInvite(ctx.Request().Context(), inviteID)
+	if err != nil {
+		msg = "Failed to revoke invite"
+		status = http.StatusNotFound
+	}
+	err = AuditedSend(ctx, &Result{
+		Status: status,
+		Op:     "invite_revoke",
+		Msg:    msg,
+		OK:     err == nil,
+		Data: M{
+			"inviteID": inviteID,
+		},
+		Err: ErrString(err),
+	})
+	return LogError("t.uman.invite", err)
+}
+
+func acceptInvite(ctx echo.Context) (err error) {
+	status, msg := DefMS("Accept invite")
+	params := struct {
+		Token    string `json:"token"`
+		User     User   `json:"user"`
+		Password string `json:"password"`
+	}{}
+	var data interface{}
+	var invite *Invite
+	var idHash string
+	gtx := ctx.Request().Context()
+	storage := GetUserStorage()
+	invites, err := GetInviteStorage()
+	if err != nil {
+		msg = "Invites are not supported"
+		status = http.StatusNotImplemented
+	}
+	if err == nil {
+		err = ctx.Bind(&params)
+		if err != nil || params.Token == "" {
+			msg = "Failed to read invite acceptance parameters"
+			status = http.StatusBadRequest
+			err = errors.New(msg)
+		}
+	}
+	if err == nil {
+		//Obvious policy violations should not use up the invite
+		policy := GetPasswordPolicy()
+		if err = policy.Check(params.Password, nil); err != nil {
+			status, msg, data = passwordFailure(err, "")
+		}
+	}
+	if err == nil {
+		invite, err = invites.UseInvite(gtx, HashToken(params.Token))
+		if err == nil && invite.IsExpired() {
+			err = errors.New("Invite expired")
+		}
+		if err != nil {
+			msg = "Invalid or expired invite"
+			status = http.StatusBadRequest
+		}
+	}
+	if err == nil {
+		user := params.User
+		user.Email, err = inviteEmail(invite)
+		user.Auth = invite.Auth
+		user.State = Active
+		user.VerfiedAt = time.Now()
+		user.CreatedBy = invite.CreatedBy
+		user.Props = M{
+			"creationMode": "invite",
+			"inviteID":     invite.ID,
+		}
+		if err == nil {
+			idHash, err = storage.CreateUser(gtx, &user)
+		}
+		if err != nil {
+			//Let the invitee try again, for example with another user ID
+			invites.CreateInvite(gtx, invite)
+			msg = "Failed to create account"
+			status = http.StatusBadRequest
+		}
+	}
+	if err == nil {
+		err = storage.SetPassword(gtx, idHash, params.Password)
+		if err != nil {
+			status, msg, data = passwordFailure(err, "Failed to set password")
+		}
+	}
+	if err == nil && len(invite.Groups) != 0 {
+		var groupStorage GroupStorage
+		groupStorage, err = GetGroupStorage()
+		for _, group := range invite.Groups {
+			if err != nil {
+				break
+			}
+			gerr := groupStorage.AddGroupMembers(gtx, group, []string{idHash})
+			if gerr != nil {
+				err = gerr
+			}
+		}
+		if err != nil {
+			msg = "Account created, failed to add it to some groups"
+			status = http.StatusInternalServerError
+		}
+	}
+	ctx.Set("userID", idHash)
+	ctx.Set("userName", params.User.FirstName+" "+params.User.LastName)
+	var inviteID string
+	if invite != nil {
+		inviteID = invite.ID
+	}
+	err = AuditedSendX(ctx, M{"inviteID": inviteID}, &Result{
+		Status: status,
+		Op:     "invite_accept",
+		Msg:    msg,
+		OK:     err == nil,
+		Data:   data,
+		Err:    ErrString(err),
+	})
+	return LogError("t.uman.invite", err)
+}
+
+func getInviteEndpoints() []*Endpoint {
+	return []*Endpoint{
+		{
+			Method:   echo.POST,
+			URL:      "uman/invite",
+			Access:   Admin,
+			Category: "user management",
+			Func:     createInvite,
+			Comment:  "Invite a person to create an account",
+		},
+		{
+			Method:   echo.GET,
+			URL:      "uman/invite",
+			Access:   Admin,
+			Category: "user management",
+			Func:     getInvites,
+			Comment:  "List pending invites",
+		},
+		{
+			Method:   echo.DELETE,
+			URL:      "uman/invite/:inviteID",
+			Access:   Admin,
+			Category: "user management",
+			Func:     revokeInvite,
+			Comment:  "Revoke an invite",
+		},
+		{
+			Method:   echo.POST,
+			URL:      "uman/invite/accept",
+			Access:   Public,
+			Category: "user management",
+			Func:     acceptInvite,
+			Comment:  "Create an account using an invite",
+		},
+	}
+}
+
+func inviteCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "invite",
+		Usage: "Manage invites for creating accounts",
+		Subcommands: []cli.Command{
+			{
+				Name:  "create",
+				Usage: "Invite a person and mail the invite link",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "email",
+						Usage: "Email of the invitee",
+					},
+					cli.StringFlag{
+						Name: "role",
+						Usage: "Role of the invitee, one of: " +
+							"'super', 'admin', 'normal', 'monitor'",
+					},
+					cli.StringFlag{
+						Name:  "groups",
+						Usage: "Comma separated groups to add the invitee to",
+					},
+					cli.IntFlag{
+						Name:  "days",
+						Usage: "Number of days the invite is valid",
+					},
+				},
+				Action: func(ctx *cli.Context) (err error) {
+					ag := NewArgGetter(ctx)
+					email := ag.GetRequiredString("email")
+					roleStr := ag.GetRequiredString("role")
+					groupStr := ag.GetOptionalString("groups")
+					days := ag.GetOptionalInt("days")
+					if err = ag.Err; err != nil {
+						return err
+					}
+					level, err := ParseAuthLevel(roleStr)
+					if err != nil {
+						return err
+					}
+					groups := make([]string, 0, 4)
+					for _, group := range strings.Split(groupStr, ",") {
+						if group = strings.TrimSpace(group); group != "" {
+							groups = append(groups, group)
+						}
+					}
+					gtx := context.TODO()
+					token, invite, err := NewInvite(gtx, email, level, groups,
+						"cli", time.Duration(days)*24*time.Hour)
+					if err != nil {
+						return LogErrorX("t.uman.invite",
+							"Failed to create invite", err)
+					}
+					if err = SendInviteMail(invite, token); err != nil {
+						deleteInvite(gtx, invite.ID)
+						return err
+					}
+					Info("t.uman.invite", "Invite %s sent to %s",
+						invite.ID, email)
+					return err
+				},
+			},
+			{
+				Name:  "list",
+				Usage: "List pending invites",
+				Action: func(ctx *cli.Context) (err error) {
+					storage, err := GetInviteStorage()
+					if err != nil {
+						return err
+					}
+					invites, err := storage.GetInvites(context.TODO())
+					if err != nil {
+						return err
+					}
+					tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+					fmt.Fprintln(tw, "ID\tEMAIL\tROLE\tGROUPS\tEXPIRES")
+					for _, invite := range invites {
+						expiry := invite.ExpiresAt.Format(time.RFC3339)
+						if invite.IsExpired() {
+							expiry += " (expired)"
+						}
+						fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+							invite.ID,
+							withInviteEmail(invite).Email,
+							invite.Auth,
+							strings.Join(invite.Groups, ","),
+							expiry)
+					}
+					return tw.Flush()
+				},
+			},
+			{
+				Name:  "revoke",
+				Usage: "Revoke an invite",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "id",
+						Usage: "ID of the invite",
+					},
+				},
+				Action: func(ctx *cli.Context) (err error) {
+					ag := NewArgGetter(ctx)
+					inviteID := ag.GetRequiredString("id")
+					if err = ag.Err; err != nil {
+						return err
+					}
+					err = deleteInvite(context.TODO(), inviteID)
+					if err == nil {
+						Info("t.uman.invite", "Invite %s revoked", inviteID)
+					}
+					return err
+				},
+			},
+		},
+	}
+}
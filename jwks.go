@@ -0,0 +1,419 @@
+package teak
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	echo "github.com/labstack/echo/v4"
+)
+
+//JWK - JSON web key as defined in RFC 7517, only public RSA and EC keys are
+//supported
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+//JWKSet - set of JSON web keys
+type JWKSet struct {
+	Keys []*JWK `json:"keys"`
+}
+
+//ExternalAuthConfig - configuration for accepting tokens issued by an external
+//identity provider, read from 'externalAuth' key of the app config. Keys of
+//the provider are read from JWKSFile or fetched from JWKSURL. Roles maps the
+//values of RoleClaim to teak auth levels, users without a mapped role get
+//DefaultRole, which is 'Public' - no access - if not configured
+type ExternalAuthConfig struct {
+	JWKSFile    string            `json:"jwksFile"`
+	JWKSURL     string            `json:"jwksURL"`
+	Issuer      string            `json:"issuer"`
+	Audience    string            `json:"audience"`
+	UserIDClaim string            `json:"userIDClaim"`
+	NameClaim   string            `json:"nameClaim"`
+	RoleClaim   string            `json:"roleClaim"`
+	Roles       map[string]string `json:"roles"`
+	DefaultRole string            `json:"defaultRole"`
+	RefreshMins int               `json:"refreshMins"`
+}
+
+var b64 = base64.RawURLEncoding
+
+//externalKeys - keys of the external identity provider, refetched after the
+//refresh interval or when a token with unknown key ID is seen
+var externalKeys struct {
+	sync.Mutex
+	keys    map[string]interface{}
+	fetched time.Time
+}
+
+//minRefetchInterval - minimum interval between fetches of external keys, so
+//that tokens with unknown key IDs can not trigger fetch on every request
+const minRefetchInterval = time.Minute
+
+//GetExternalAuthConfig - gives external auth configuration, enabled is false
+//if external tokens are not accepted
+func GetExternalAuthConfig() (cfg ExternalAuthConfig, enabled bool) {
+	if !GetConfig("externalAuth", &cfg) {
+		return cfg, false
+	}
+	if cfg.UserIDClaim == "" {
+		cfg.UserIDClaim = "sub"
+	}
+	if cfg.NameClaim == "" {
+		cfg.NameClaim = "name"
+	}
+	if cfg.RoleClaim == "" {
+		cfg.RoleClaim = "role"
+	}
+	if cfg.DefaultRole == "" {
+		cfg.DefaultRole = Public.String()
+	}
+	if cfg.RefreshMins <= 0 {
+		cfg.RefreshMins = 60
+	}
+	return cfg, cfg.JWKSFile != "" || cfg.JWKSURL != ""
+}
+
+//padded - gives big endian bytes of the number padded to given size
+func padded(num *big.Int, size int) []byte {
+	buf := num.Bytes()
+	if len(buf) >= size {
+		return buf
+	}
+	out := make([]byte, size)
+	copy(out[size-len(buf):], buf)
+	return out
+}
+
+//jwkOf - gives JWK for the public part of the signing key, nil for HMAC keys
+//as they can not be published
+func jwkOf(key *SigningKey) (jwk *JWK) {
+	switch pub := key.verifyKey.(type) {
+	case *rsa.PublicKey:
+		jwk = &JWK{
+			Kty: "RSA",
+			N:   b64.EncodeToString(pub.N.Bytes()),
+			E:   b64.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		jwk = &JWK{
+			Kty: "EC",
+			Crv: pub.Curve.Params().Name,
+			X:   b64.EncodeToString(padded(pub.X, size)),
+			Y:   b64.EncodeToString(padded(pub.Y, size)),
+		}
+	default:
+		return nil
+	}
+	jwk.Kid = key.ID
+	jwk.Use = "sig"
+	jwk.Alg = key.Algorithm
+	return jwk
+}
+
+//PublicKey - decodes the public key from JWK
+func (jwk *JWK) PublicKey() (key interface{}, err error) {
+	decode := func(val string) (num *big.Int) {
+		buf, derr := b64.DecodeString(val)
+		if derr != nil && err == nil {
+			err = derr
+		}
+		return new(big.Int).SetBytes(buf)
+	}
+	switch jwk.Kty {
+	case "RSA":
+		pub := &rsa.PublicKey{
+			N: decode(jwk.N),
+			E: int(decode(jwk.E).Int64()),
+		}
+		if pub.N.Sign() == 0 || pub.E == 0 {
+			err = fmt.Errorf("Invalid RSA key %s", jwk.Kid)
+		}
+		key = pub
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return key, fmt.Errorf("Unsupported curve '%s' for key %s",
+				jwk.Crv, jwk.Kid)
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     decode(jwk.X),
+			Y:     decode(jwk.Y),
+		}
+		if err == nil && !curve.IsOnCurve(pub.X, pub.Y) {
+			err = fmt.Errorf("Invalid EC key %s", jwk.Kid)
+		}
+		key = pub
+	default:
+		err = fmt.Errorf("Unsupported key type '%s' for key %s",
+			jwk.Kty, jwk.Kid)
+	}
+	return key, err
+}
+
+//PublicJWKS - gives public keys of the asymmetric signing keys as JWK set,
+//the set is empty if only HS256 keys are used
+func PublicJWKS() (jwks *JWKSet, err error) {
+	jwks = &JWKSet{
+		Keys: make([]*JWK, 0, 4),
+	}
+	set, err := getKeySet()
+	if err != nil {
+		return jwks, err
+	}
+	for _, key := range set.keys {
+		if jwk := jwkOf(key); jwk != nil {
+			jwks.Keys = append(jwks.Keys, jwk)
+		}
+	}
+	return jwks, err
+}
+
+//getJWKS - serves the public signing keys so that other services can verify
+//the tokens issued by teak
+func getJWKS(ctx echo.Context) (err error) {
+	jwks, err := PublicJWKS()
+	if err != nil {
+		LogError("t.auth.jwks", err)
+		return &echo.HTTPError{
+			Code:     http.StatusInternalServerError,
+			Message:  "Failed to load signing keys",
+			Internal: err,
+		}
+	}
+	ctx.Response().Header().Set("Cache-Control", "public, max-age=300")
+	return ctx.JSON(http.StatusOK, jwks)
+}
+
+//fetchJWKS - fetches JWK set from the URL
+func fetchJWKS(url string) (jwks *JWKSet, err error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return jwks, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return jwks, fmt.Errorf("Fetching JWKS failed with status %d",
+			resp.StatusCode)
+	}
+	jwks = &JWKSet{}
+	err = json.NewDecoder(resp.Body).Decode(jwks)
+	return jwks, err
+}
+
+//readJWKS - reads JWK set from the configured file or URL
+func readJWKS(cfg *ExternalAuthConfig) (jwks *JWKSet, err error) {
+	if cfg.JWKSURL != "" && cfg.JWKSFile == "" {
+		return fetchJWKS(cfg.JWKSURL)
+	}
+	raw, err := ioutil.ReadFile(cfg.JWKSFile)
+	if err != nil {
+		return jwks, err
+	}
+	jwks = &JWKSet{}
+	err = json.Unmarshal(raw, jwks)
+	return jwks, err
+}
+
+//publicKeys - decodes the keys in the set, invalid keys are skipped
+func (jwks *JWKSet) publicKeys() (keys map[string]interface{}) {
+	keys = make(map[string]interface{})
+	for _, jwk := range jwks.Keys {
+		pub, err := jwk.PublicKey()
+		if err != nil {
+			LogErrorX("t.auth.jwks", "Ignoring key %s", err, jwk.Kid)
+			continue
+		}
+		keys[jwk.Kid] = pub
+	}
+	return keys
+}
+
+//externalKey - gives the public key of external identity provider with the
+//given key ID
+func externalKey(cfg *ExternalAuthConfig, kid string) (
+	key interface{}, err error) {
+	externalKeys.Lock()
+	defer externalKeys.Unlock()
+	key, found := externalKeys.keys[kid]
+	refresh := time.Duration(cfg.RefreshMins) * time.Minute
+	if (found && time.Since(externalKeys.fetched) < refresh) ||
+		(!found && time.Since(externalKeys.fetched) < minRefetchInterval) {
+		if !found {
+			err = fmt.Errorf("Unknown JWT key ID '%s'", kid)
+		}
+		return key, err
+	}
+	externalKeys.fetched = time.Now()
+	jwks, err := readJWKS(cfg)
+	if err != nil {
+		//Keep using the keys fetched earlier
+		LogErrorX("t.auth.jwks", "Failed to read external JWKS", err)
+	} else {
+		externalKeys.keys = jwks.publicKeys()
+	}
+	key, found = externalKeys.keys[kid]
+	if !found {
+		err = fmt.Errorf("Unknown JWT key ID '%s'", kid)
+	}
+	return key, err
+}
+
+//externalKeyFunc - gives verification key for a token issued by the external
+//identity provider
+func externalKeyFunc(cfg *ExternalAuthConfig, t *jwt.Token, kid string) (
+	key interface{}, err error) {
+	if key, err = externalKey(cfg, kid); err != nil {
+		return key, err
+	}
+	return key, checkKeyAlg(t, key)
+}
+
+//checkKeyAlg - checks that the algorithm of the token matches the type of the
+//public key, so that a token can not choose how it is verified
+func checkKeyAlg(t *jwt.Token, key interface{}) (err error) {
+	alg := t.Method.Alg()
+	switch key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") && !strings.HasPrefix(alg, "PS") {
+			err = fmt.Errorf("Unexpected JWT signing method %s", alg)
+		}
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			err = fmt.Errorf("Unexpected JWT signing method %s", alg)
+		}
+	default:
+		err = fmt.Errorf("Unexpected JWT signing method %s", alg)
+	}
+	return err
+}
+
+//hasAudience - checks if the 'aud' claim, which can be a string or a list,
+//contains the audience
+func hasAudience(claims jwt.MapClaims, audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, val := range aud {
+			if str, ok := val.(string); ok && str == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//mapRole - gives the most privileged auth level mapped from the role claim,
+//the claim can be a string or a list of strings. If none of the roles are
+//mapped the default role is given
+func mapRole(roleMap map[string]string, defRole string, claim interface{}) (
+	level AuthLevel, err error) {
+	level, err = ParseAuthLevel(defRole)
+	if err != nil {
+		return level, err
+	}
+	roles := make([]string, 0, 4)
+	switch val := claim.(type) {
+	case string:
+		roles = append(roles, val)
+	case []interface{}:
+		for _, item := range val {
+			if str, ok := item.(string); ok {
+				roles = append(roles, str)
+			}
+		}
+	}
+	for _, role := range roles {
+		mapped, found := roleMap[role]
+		if !found {
+			continue
+		}
+		var lvl AuthLevel
+		if lvl, err = ParseAuthLevel(mapped); err != nil {
+			return level, err
+		}
+		if lvl < level {
+			level = lvl
+		}
+	}
+	return level, err
+}
+
+//mapExternalClaims - validates the claims of an external token and maps them
+//to the claims used by teak. Only the mapped claims are kept so that the
+//external provider can not set teak specific claims such as 'access'. Tokens
+//without expiry are rejected, otherwise they would be valid forever
+func mapExternalClaims(cfg *ExternalAuthConfig, claims jwt.MapClaims) (
+	mapped jwt.MapClaims, err error) {
+	now := time.Now().Unix()
+	switch {
+	case !claims.VerifyExpiresAt(now, true):
+		return mapped, errors.New("External token is expired or has no expiry")
+	case !claims.VerifyNotBefore(now, false):
+		return mapped, errors.New("External token is not valid yet")
+	case !claims.VerifyIssuedAt(now, false):
+		return mapped, errors.New("External token is issued in future")
+	}
+	if cfg.Issuer != "" && !claims.VerifyIssuer(cfg.Issuer, true) {
+		return mapped, errors.New("Invalid issuer for external token")
+	}
+	if cfg.Audience != "" && !hasAudience(claims, cfg.Audience) {
+		return mapped, errors.New("Invalid audience for external token")
+	}
+	userID, ok := claims[cfg.UserIDClaim].(string)
+	if !ok || userID == "" {
+		return mapped, fmt.Errorf("External token does not have '%s' claim",
+			cfg.UserIDClaim)
+	}
+	name, _ := claims[cfg.NameClaim].(string)
+	if name == "" {
+		name = userID
+	}
+	level, err := mapRole(cfg.Roles, cfg.DefaultRole, claims[cfg.RoleClaim])
+	if err != nil {
+		return mapped, err
+	}
+	mapped = jwt.MapClaims{
+		"userID":   userID,
+		"userName": name,
+		"userType": "external",
+		"access":   float64(level),
+	}
+	for _, key := range []string{"jti", "exp", "iat", "nbf", "iss"} {
+		if val, found := claims[key]; found {
+			mapped[key] = val
+		}
+	}
+	return mapped, err
+}
@@ -0,0 +1,184 @@
+package teak
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	echo "github.com/labstack/echo/v4"
+)
+
+func TestPublicJWKS(t *testing.T) {
+	_, restore := useTestKeyFile(t, "RS256")
+	defer restore()
+	signed, kid := signTestToken(t, "u1")
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil)
+	if err := getJWKS(echo.New().NewContext(req, rec)); err != nil {
+		t.Fatalf("Failed to serve JWKS: %v", err)
+	}
+	if rec.Header().Get("Cache-Control") == "" {
+		t.Errorf("Expected JWKS to be cacheable")
+	}
+	jwks := &JWKSet{}
+	if err := json.Unmarshal(rec.Body.Bytes(), jwks); err != nil {
+		t.Fatalf("Invalid JWKS '%s': %v", rec.Body.String(), err)
+	}
+	keys := jwks.publicKeys()
+	if len(keys) != 1 || keys[kid] == nil {
+		t.Fatalf("Expected public key %s in JWKS, got %v", kid, keys)
+	}
+	//Other services should be able to verify tokens with the published key
+	_, err := jwt.Parse(signed, func(t *jwt.Token) (interface{}, error) {
+		return keys[kid], nil
+	})
+	if err != nil {
+		t.Errorf("Failed to verify token with published key: %v", err)
+	}
+}
+
+//testIdP - external identity provider that serves its JWKS and counts the
+//number of times it is fetched
+type testIdP struct {
+	*httptest.Server
+	key     *rsa.PrivateKey
+	fetches int32
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	idp := &testIdP{key: key}
+	jwks := &JWKSet{Keys: []*JWK{jwkOf(&SigningKey{
+		ID:        "ext1",
+		Algorithm: "RS256",
+		verifyKey: &key.PublicKey,
+	})}}
+	idp.Server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&idp.fetches, 1)
+			json.NewEncoder(w).Encode(jwks)
+		}))
+	return idp
+}
+
+//sign - signs the claims as the identity provider with given key ID
+func (idp *testIdP) sign(
+	t *testing.T, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(idp.key)
+	if err != nil {
+		t.Fatalf("Failed to sign external token: %v", err)
+	}
+	return signed
+}
+
+func TestExternalToken(t *testing.T) {
+	idp := newTestIdP(t)
+	defer idp.Close()
+	_, restore := useTestStorage(M{"externalAuth": M{
+		"jwksURL":  idp.URL,
+		"issuer":   "https://idp.example.com",
+		"audience": "teak",
+		"roles":    M{"admins": "Admin", "staff": "Normal"},
+	}})
+	defer restore()
+	signingKeys.set, externalKeys.keys = nil, nil
+	externalKeys.fetched = time.Time{}
+	defer func() {
+		signingKeys.set, externalKeys.keys = nil, nil
+		externalKeys.fetched = time.Time{}
+	}()
+
+	exp := time.Now().Add(time.Hour).Unix()
+	claims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":    "https://idp.example.com",
+			"aud":    []interface{}{"other", "teak"},
+			"sub":    "ext-user",
+			"name":   "External User",
+			"role":   []interface{}{"staff", "admins"},
+			"exp":    exp,
+			"access": float64(Super),
+		}
+	}
+	token, err := ParseToken(idp.sign(t, "ext1", claims()))
+	if err != nil || !token.Valid {
+		t.Fatalf("Expected external token to be valid: %v", err)
+	}
+	mapped := token.Claims.(jwt.MapClaims)
+	if mapped["userID"] != "ext-user" ||
+		mapped["userName"] != "External User" ||
+		mapped["userType"] != "external" ||
+		mapped["access"] != float64(Admin) {
+		t.Errorf("Unexpected mapped claims %v", mapped)
+	}
+
+	//Claims that make the token invalid, nil value removes the claim
+	invalid := []struct {
+		claim string
+		val   interface{}
+	}{
+		{"exp", time.Now().Unix() - 10},
+		{"exp", nil},
+		{"iss", "https://evil.example.com"},
+		{"aud", "other"},
+		{"sub", nil},
+	}
+	for _, inv := range invalid {
+		c := claims()
+		c[inv.claim] = inv.val
+		if inv.val == nil {
+			delete(c, inv.claim)
+		}
+		if _, err = ParseToken(idp.sign(t, "ext1", c)); err == nil {
+			t.Errorf("Expected external token with %s %v to be rejected",
+				inv.claim, inv.val)
+		}
+	}
+
+	//Tokens with unknown key IDs do not make teak fetch the keys every time
+	fetches := atomic.LoadInt32(&idp.fetches)
+	for i := 0; i < 3; i++ {
+		if _, err = ParseToken(idp.sign(t, "unknown", claims())); err == nil {
+			t.Errorf("Expected token with unknown key to be rejected")
+		}
+	}
+	if n := atomic.LoadInt32(&idp.fetches) - fetches; n != 0 {
+		t.Errorf("Expected no refetch within minimum interval, got %d", n)
+	}
+}
+
+func TestMapRole(t *testing.T) {
+	roles := map[string]string{"admins": "Admin", "staff": "Normal"}
+	cases := []struct {
+		claim interface{}
+		level AuthLevel
+	}{
+		{"staff", Normal},
+		{[]interface{}{"staff", "admins"}, Admin},
+		{[]interface{}{"guests", 3}, Monitor},
+		{nil, Monitor},
+	}
+	for _, c := range cases {
+		level, err := mapRole(roles, "Monitor", c.claim)
+		if err != nil || level != c.level {
+			t.Errorf("Role %v: expected %s, got %s, %v",
+				c.claim, c.level, level, err)
+		}
+	}
+	_, err := mapRole(map[string]string{"x": "Root"}, "Monitor", "x")
+	if err == nil {
+		t.Errorf("Expected invalid mapped role to be reported")
+	}
+}
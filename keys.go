@@ -0,0 +1,471 @@
+package teak
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/urfave/cli.v1"
+)
+
+//JWTConfig - configuration for signing JWT tokens, read from 'jwtConfig' key
+//of the app config. If KeyFile is given, keys are read from the file and the
+//file is created if it does not exist. Otherwise if Secret is given it is used
+//as HS256 key. If neither is given a random key is generated, in which case
+//tokens become invalid when the process restarts
+type JWTConfig struct {
+	Algorithm string `json:"algorithm"`
+	KeyFile   string `json:"keyFile"`
+	Secret    string `json:"secret"`
+	MaxKeys   int    `json:"maxKeys"`
+}
+
+//SigningKey - a key used for signing and verifying JWT tokens, identified by
+//the 'kid' header of the token
+type SigningKey struct {
+	ID        string
+	Algorithm string
+	CreatedAt time.Time
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+//keyEntry - a key as stored in the key file. Key is base64 encoded secret for
+//HS256 and PEM encoded PKCS8 private key for RS256 and ES256
+type keyEntry struct {
+	ID        string    `json:"id"`
+	Algorithm string    `json:"alg"`
+	CreatedAt time.Time `json:"createdAt"`
+	Key       string    `json:"key"`
+}
+
+//keyFile - contents of the key file, Current is the ID of the key used for
+//signing, rest of the keys are only used for verification
+type keyFile struct {
+	Current string      `json:"current"`
+	Keys    []*keyEntry `json:"keys"`
+}
+
+//keySet - signing keys loaded in memory
+type keySet struct {
+	current *SigningKey
+	keys    map[string]*SigningKey
+	path    string
+	modTime time.Time
+	checked time.Time
+}
+
+//keyCheckInterval - interval at which the key file is checked for changes, so
+//that keys rotated by another process are picked up
+const keyCheckInterval = 30 * time.Second
+
+var signingKeys struct {
+	sync.Mutex
+	set *keySet
+}
+
+//GetJWTConfig - gives the JWT configuration with defaults filled in
+func GetJWTConfig() (jc JWTConfig) {
+	GetConfig("jwtConfig", &jc)
+	if jc.Algorithm == "" {
+		jc.Algorithm = jwt.SigningMethodHS256.Alg()
+	}
+	if jc.MaxKeys <= 0 {
+		jc.MaxKeys = 3
+	}
+	return jc
+}
+
+//newKeyEntry - generates a new key for the given algorithm
+func newKeyEntry(alg string) (entry *keyEntry, err error) {
+	entry = &keyEntry{
+		ID:        uuid.NewV4().String(),
+		Algorithm: alg,
+		CreatedAt: time.Now(),
+	}
+	var priv interface{}
+	switch alg {
+	case jwt.SigningMethodHS256.Alg():
+		secret := make([]byte, 32)
+		if _, err = rand.Read(secret); err == nil {
+			entry.Key = base64.StdEncoding.EncodeToString(secret)
+		}
+		return entry, err
+	case jwt.SigningMethodRS256.Alg():
+		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+	case jwt.SigningMethodES256.Alg():
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		err = fmt.Errorf("Unsupported JWT signing algorithm '%s'", alg)
+	}
+	if err != nil {
+		return entry, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err == nil {
+		entry.Key = string(pem.EncodeToMemory(&pem.Block{
+			Type:  "PRIVATE KEY",
+			Bytes: der,
+		}))
+	}
+	return entry, err
+}
+
+//toSigningKey - decodes the key stored in the entry
+func (entry *keyEntry) toSigningKey() (key *SigningKey, err error) {
+	key = &SigningKey{
+		ID:        entry.ID,
+		Algorithm: entry.Algorithm,
+		CreatedAt: entry.CreatedAt,
+	}
+	if entry.Algorithm == jwt.SigningMethodHS256.Alg() {
+		var secret []byte
+		secret, err = base64.StdEncoding.DecodeString(entry.Key)
+		key.signKey, key.verifyKey = secret, secret
+		return key, err
+	}
+	block, _ := pem.Decode([]byte(entry.Key))
+	if block == nil {
+		return key, fmt.Errorf("Invalid PEM data for key %s", entry.ID)
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return key, err
+	}
+	switch pk := priv.(type) {
+	case *rsa.PrivateKey:
+		if entry.Algorithm != jwt.SigningMethodRS256.Alg() {
+			err = fmt.Errorf("Key %s is not a %s key", entry.ID, entry.Algorithm)
+		}
+		key.signKey, key.verifyKey = pk, &pk.PublicKey
+	case *ecdsa.PrivateKey:
+		if entry.Algorithm != jwt.SigningMethodES256.Alg() {
+			err = fmt.Errorf("Key %s is not a %s key", entry.ID, entry.Algorithm)
+		}
+		key.signKey, key.verifyKey = pk, &pk.PublicKey
+	default:
+		err = fmt.Errorf("Unsupported private key type for key %s", entry.ID)
+	}
+	return key, err
+}
+
+//readKeyFile - reads the key file at given path
+func readKeyFile(path string) (kf *keyFile, err error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return kf, err
+	}
+	kf = &keyFile{}
+	err = json.Unmarshal(raw, kf)
+	return kf, err
+}
+
+//writeKeyFile - writes keys to the file, the file is replaced atomically so
+//that other processes never read a partially written file
+func writeKeyFile(path string, kf *keyFile) (err error) {
+	raw, err := json.MarshalIndent(kf, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".keys")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(raw); err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	return err
+}
+
+//newKeySet - creates key set from the contents of a key file
+func newKeySet(kf *keyFile) (set *keySet, err error) {
+	set = &keySet{
+		keys: make(map[string]*SigningKey),
+	}
+	for _, entry := range kf.Keys {
+		var key *SigningKey
+		if key, err = entry.toSigningKey(); err != nil {
+			return set, err
+		}
+		set.keys[key.ID] = key
+	}
+	set.current = set.keys[kf.Current]
+	if set.current == nil {
+		err = fmt.Errorf("Current signing key '%s' not found", kf.Current)
+	}
+	return set, err
+}
+
+//loadKeySetFromFile - loads keys from the file, if the file does not exist a
+//new one is created with a key for the given algorithm
+func loadKeySetFromFile(path, alg string) (set *keySet, err error) {
+	kf, err := readKeyFile(path)
+	if os.IsNotExist(err) {
+		var entry *keyEntry
+		if entry, err = newKeyEntry(alg); err != nil {
+			return set, err
+		}
+		kf = &keyFile{
+			Current: entry.ID,
+			Keys:    []*keyEntry{entry},
+		}
+		if err = writeKeyFile(path, kf); err != nil {
+			return set, err
+		}
+		Info("t.auth.keys", "Created JWT key file at %s", path)
+	}
+	if err != nil {
+		return set, err
+	}
+	if set, err = newKeySet(kf); err != nil {
+		return set, err
+	}
+	set.path = path
+	set.checked = time.Now()
+	if info, err := os.Stat(path); err == nil {
+		set.modTime = info.ModTime()
+	}
+	return set, err
+}
+
+//loadKeySet - loads the signing keys based on JWT configuration
+func loadKeySet() (set *keySet, err error) {
+	jc := GetJWTConfig()
+	if jc.KeyFile != "" {
+		return loadKeySetFromFile(jc.KeyFile, jc.Algorithm)
+	}
+	key := &SigningKey{
+		Algorithm: jwt.SigningMethodHS256.Alg(),
+		CreatedAt: time.Now(),
+	}
+	if jc.Secret != "" {
+		//Same secret gives same key ID on all the replicas
+		sum := sha256.Sum256([]byte(jc.Secret))
+		key.ID = hex.EncodeToString(sum[:8])
+		key.signKey = []byte(jc.Secret)
+	} else {
+		Warn("t.auth.keys", "No JWT key configured, using a random key. "+
+			"Tokens will be invalid after restart")
+		key.ID = uuid.NewV4().String()
+		key.signKey, _ = uuid.NewV4().MarshalBinary()
+	}
+	key.verifyKey = key.signKey
+	set = &keySet{
+		current: key,
+		keys:    map[string]*SigningKey{key.ID: key},
+	}
+	return set, err
+}
+
+//getKeySet - gives the loaded signing keys. If the keys are loaded from file
+//and the file is modified, the keys are reloaded
+func getKeySet() (set *keySet, err error) {
+	signingKeys.Lock()
+	defer signingKeys.Unlock()
+	if signingKeys.set == nil {
+		signingKeys.set, err = loadKeySet()
+		if err != nil {
+			signingKeys.set = nil
+			return set, LogErrorX("t.auth.keys", "Failed to load JWT keys", err)
+		}
+	}
+	set = signingKeys.set
+	if set.path != "" && time.Since(set.checked) > keyCheckInterval {
+		set.checked = time.Now()
+		info, serr := os.Stat(set.path)
+		if serr == nil && info.ModTime() != set.modTime {
+			reloaded, lerr := loadKeySetFromFile(set.path, "")
+			if lerr != nil {
+				//Keep using the keys that are already loaded
+				LogErrorX("t.auth.keys", "Failed to reload JWT keys", lerr)
+			} else {
+				signingKeys.set, set = reloaded, reloaded
+				Info("t.auth.keys", "Reloaded JWT keys from %s", set.path)
+			}
+		}
+	}
+	return set, err
+}
+
+//SignToken - signs the claims with the current signing key. The ID of the key
+//is set as 'kid' header of the token
+func SignToken(claims jwt.Claims) (signed string, err error) {
+	set, err := getKeySet()
+	if err != nil {
+		return signed, err
+	}
+	key := set.current
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.signKey)
+}
+
+//ParseToken - parses and verifies a signed token. The key is selected using
+//the 'kid' header, tokens without it are verified with the current key. If
+//external auth is configured, tokens signed with keys not known to teak are
+//verified using the keys of external identity provider and their claims are
+//mapped to teak claims
+func ParseToken(tokStr string) (token *jwt.Token, err error) {
+	set, err := getKeySet()
+	if err != nil {
+		return token, err
+	}
+	cfg, extEnabled := GetExternalAuthConfig()
+	external := false
+	keyFunc := func(t *jwt.Token) (interface{}, error) {
+		key := set.current
+		if kid, ok := t.Header["kid"].(string); ok {
+			if key, ok = set.keys[kid]; !ok {
+				if extEnabled {
+					external = true
+					return externalKeyFunc(&cfg, t, kid)
+				}
+				return nil, fmt.Errorf("Unknown JWT key ID '%s'", kid)
+			}
+		}
+		//Token should not be able to choose the algorithm used to verify it
+		if t.Method.Alg() != key.Algorithm {
+			return nil, fmt.Errorf("Unexpected JWT signing method %s",
+				t.Method.Alg())
+		}
+		return key.verifyKey, nil
+	}
+	token, err = jwt.Parse(tokStr, keyFunc)
+	if err == nil && external {
+		var mapped jwt.MapClaims
+		mapped, err = mapExternalClaims(&cfg, token.Claims.(jwt.MapClaims))
+		if err != nil {
+			token.Valid = false
+			return token, err
+		}
+		token.Claims = mapped
+	}
+	return token, err
+}
+
+//RotateKeys - creates a new key in the key file and makes it the current
+//signing key. The previous keys are retained for verifying the tokens issued
+//before rotation, only maxKeys most recent keys are kept
+func RotateKeys(path, alg string, maxKeys int) (kid string, err error) {
+	if path == "" {
+		return kid, errors.New("JWT key file is not configured")
+	}
+	kf, err := readKeyFile(path)
+	if os.IsNotExist(err) {
+		kf, err = &keyFile{}, nil
+	}
+	if err != nil {
+		return kid, err
+	}
+	entry, err := newKeyEntry(alg)
+	if err != nil {
+		return kid, err
+	}
+	kf.Current = entry.ID
+	kf.Keys = append([]*keyEntry{entry}, kf.Keys...)
+	if maxKeys > 0 && len(kf.Keys) > maxKeys {
+		kf.Keys = kf.Keys[:maxKeys]
+	}
+	if err = writeKeyFile(path, kf); err != nil {
+		return kid, err
+	}
+	//Force reload in this process
+	signingKeys.Lock()
+	signingKeys.set = nil
+	signingKeys.Unlock()
+	return entry.ID, err
+}
+
+func keysCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "keys",
+		Usage: "Manage JWT signing keys",
+		Subcommands: []cli.Command{
+			{
+				Name:  "rotate",
+				Usage: "Create a new signing key and make it current",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "file",
+						Usage: "Key file, 'jwtConfig.keyFile' if not given",
+					},
+					cli.StringFlag{
+						Name:  "alg",
+						Usage: "Signing algorithm - HS256, RS256 or ES256",
+					},
+					cli.IntFlag{
+						Name:  "keep",
+						Usage: "Number of keys to retain including the new one",
+					},
+				},
+				Action: func(ctx *cli.Context) (err error) {
+					jc := GetJWTConfig()
+					ag := NewArgGetter(ctx)
+					path := ag.GetStringOr("file", jc.KeyFile)
+					alg := ag.GetStringOr("alg", jc.Algorithm)
+					keep := ag.GetIntOr("keep", jc.MaxKeys)
+					kid, err := RotateKeys(path, alg, keep)
+					if err != nil {
+						return LogErrorX("t.auth.keys",
+							"Failed to rotate JWT keys", err)
+					}
+					Info("t.auth.keys", "New %s signing key %s created in %s",
+						alg, kid, path)
+					return err
+				},
+			},
+			{
+				Name:  "list",
+				Usage: "List the JWT signing keys",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "file",
+						Usage: "Key file, 'jwtConfig.keyFile' if not given",
+					},
+				},
+				Action: func(ctx *cli.Context) (err error) {
+					ag := NewArgGetter(ctx)
+					path := ag.GetStringOr("file", GetJWTConfig().KeyFile)
+					kf, err := readKeyFile(path)
+					if err != nil {
+						return LogErrorX("t.auth.keys",
+							"Failed to read JWT key file", err)
+					}
+					fmt.Printf("%-38s %-6s %-26s %s\n",
+						"ID", "ALG", "CREATED", "CURRENT")
+					for _, entry := range kf.Keys {
+						fmt.Printf("%-38s %-6s %-26s %t\n",
+							entry.ID,
+							entry.Algorithm,
+							entry.CreatedAt.Format(time.RFC3339),
+							entry.ID == kf.Current)
+					}
+					return err
+				},
+			},
+		},
+	}
+}
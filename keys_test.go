@@ -0,0 +1,126 @@
+package teak
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+//useTestKeyFile - configures JWT keys to be read from a key file in a
+//temporary directory, the returned function restores the previous setup
+func useTestKeyFile(t *testing.T, alg string) (path string, restore func()) {
+	dir, err := ioutil.TempDir("", "teak-keys")
+	if err != nil {
+		t.Fatalf("Failed to create key directory: %v", err)
+	}
+	path = filepath.Join(dir, "keys.json")
+	_, restoreStorage := useTestStorage(M{
+		"jwtConfig": M{"keyFile": path, "algorithm": alg},
+	})
+	signingKeys.set = nil
+	restore = func() {
+		restoreStorage()
+		signingKeys.set = nil
+		os.RemoveAll(dir)
+	}
+	return path, restore
+}
+
+//signTestToken - signs a token for the user with the current key and gives
+//the token along with its key ID
+func signTestToken(t *testing.T, userID string) (signed, kid string) {
+	signed, err := SignToken(jwt.MapClaims{"userID": userID})
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	token, _, _ := new(jwt.Parser).ParseUnverified(signed, jwt.MapClaims{})
+	kid, _ = token.Header["kid"].(string)
+	return signed, kid
+}
+
+func TestKeyRotation(t *testing.T) {
+	for _, alg := range []string{"HS256", "RS256", "ES256"} {
+		alg := alg
+		t.Run(alg, func(t *testing.T) {
+			testKeyRotation(t, alg)
+		})
+	}
+}
+
+func testKeyRotation(t *testing.T, alg string) {
+	path, restore := useTestKeyFile(t, alg)
+	defer restore()
+	first, firstKid := signTestToken(t, "u1")
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected key file to be created readable only by the "+
+			"owner, error: %v", err)
+	}
+
+	kid, err := RotateKeys(path, alg, 2)
+	if err != nil {
+		t.Fatalf("Failed to rotate keys: %v", err)
+	}
+	second, secondKid := signTestToken(t, "u2")
+	if secondKid != kid || secondKid == firstKid {
+		t.Errorf("Expected new tokens to be signed with key %s, got %s",
+			kid, secondKid)
+	}
+	for _, signed := range []string{first, second} {
+		if token, err := ParseToken(signed); err != nil || !token.Valid {
+			t.Errorf("Expected token to be valid after rotation: %v", err)
+		}
+	}
+
+	//Only two keys are kept, the first one is dropped
+	if _, err = RotateKeys(path, alg, 2); err != nil {
+		t.Fatalf("Failed to rotate keys: %v", err)
+	}
+	if _, err = ParseToken(first); err == nil ||
+		!strings.Contains(err.Error(), "Unknown JWT key ID") {
+		t.Errorf("Expected token of dropped key to be rejected, got %v", err)
+	}
+	if _, err = ParseToken(second); err != nil {
+		t.Errorf("Expected token of retained key to be valid: %v", err)
+	}
+}
+
+func TestParseTokenRejectsOtherAlgorithm(t *testing.T) {
+	_, restore := useTestKeyFile(t, "RS256")
+	defer restore()
+	_, kid := signTestToken(t, "u1")
+
+	//Token claims to be HMAC signed with the ID of the RSA key
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256,
+		jwt.MapClaims{"userID": "u1"})
+	forged.Header["kid"] = kid
+	signed, err := forged.SignedString([]byte("guessed"))
+	if err != nil {
+		t.Fatalf("Failed to sign forged token: %v", err)
+	}
+	if _, err = ParseToken(signed); err == nil {
+		t.Errorf("Expected token with other algorithm to be rejected")
+	}
+}
+
+func TestKeyFromSecret(t *testing.T) {
+	_, restore := useTestStorage(M{"jwtConfig": M{"secret": "s3cret"}})
+	defer restore()
+	signingKeys.set = nil
+	defer func() { signingKeys.set = nil }()
+	signed, kid := signTestToken(t, "u1")
+
+	//Replicas with the same secret derive the same key
+	signingKeys.set = nil
+	if _, other := signTestToken(t, "u1"); other != kid {
+		t.Errorf("Expected same key ID for same secret, got %s and %s",
+			kid, other)
+	}
+	if token, err := ParseToken(signed); err != nil || !token.Valid {
+		t.Errorf("Expected token signed with secret to be valid: %v", err)
+	}
+}
@@ -0,0 +1,391 @@
+package teak
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	echo "github.com/labstack/echo/v4"
+	"gopkg.in/urfave/cli.v1"
+)
+
+//Locked - user account is locked temporarily after repeated login failures
+var Locked UserState = "locked"
+
+//LockoutConfig - configuration for brute force protection of login, read from
+//'lockout' key of the app config. After FreeAttempts consecutive failures of
+//an user (IPFreeAttempts for an IP address) every attempt has to wait
+//BaseDelaySecs, doubling with each failure up to MaxDelaySecs. User accounts
+//are locked for LockMins after MaxAttempts failures and IP addresses are
+//blocked after IPMaxAttempts. Failures older than WindowMins are forgotten
+type LockoutConfig struct {
+	MaxAttempts    int `json:"maxAttempts"`
+	IPMaxAttempts  int `json:"ipMaxAttempts"`
+	FreeAttempts   int `json:"freeAttempts"`
+	IPFreeAttempts int `json:"ipFreeAttempts"`
+	BaseDelaySecs  int `json:"baseDelaySecs"`
+	MaxDelaySecs   int `json:"maxDelaySecs"`
+	LockMins       int `json:"lockMins"`
+	WindowMins     int `json:"windowMins"`
+}
+
+//AttemptCounter - keeps count of consecutive login failures of an user or of
+//an IP address. The in-process counter is enough for a single node, cluster
+//deployments need a counter backed by a shared storage
+type AttemptCounter interface {
+	//Fail - records a failed attempt for the key and gives the number of
+	//consecutive failures. Failures older than window are not counted
+	Fail(gtx context.Context, key string, window time.Duration) (
+		failures int, err error)
+
+	//Failures - gives the number of consecutive failures for the key and
+	//the time of last failure
+	Failures(gtx context.Context, key string, window time.Duration) (
+		failures int, last time.Time, err error)
+
+	//Clear - forgets the failures of the key
+	Clear(gtx context.Context, key string) (err error)
+}
+
+//ErrTooManyAttempts - returned when login is attempted before the back-off
+//period is over
+var ErrTooManyAttempts = errors.New("Too many failed attempts, try later")
+
+//GetLockoutConfig - gives the lockout configuration, defaults are used for the
+//values that are not configured
+func GetLockoutConfig() (lc LockoutConfig) {
+	GetConfig("lockout", &lc)
+	if lc.MaxAttempts <= 0 {
+		lc.MaxAttempts = 5
+	}
+	if lc.IPMaxAttempts <= 0 {
+		lc.IPMaxAttempts = 50
+	}
+	if lc.FreeAttempts <= 0 {
+		lc.FreeAttempts = 2
+	}
+	if lc.IPFreeAttempts <= 0 {
+		lc.IPFreeAttempts = 10
+	}
+	if lc.BaseDelaySecs <= 0 {
+		lc.BaseDelaySecs = 1
+	}
+	if lc.MaxDelaySecs <= 0 {
+		lc.MaxDelaySecs = 300
+	}
+	if lc.LockMins <= 0 {
+		lc.LockMins = 15
+	}
+	if lc.WindowMins <= 0 {
+		lc.WindowMins = 60
+	}
+	return lc
+}
+
+//window - gives the duration within which failures are counted
+func (lc *LockoutConfig) window() time.Duration {
+	return time.Duration(lc.WindowMins) * time.Minute
+}
+
+//lockPeriod - gives the duration for which an account stays locked
+func (lc *LockoutConfig) lockPeriod() time.Duration {
+	return time.Duration(lc.LockMins) * time.Minute
+}
+
+//backOff - gives the time to wait after given number of failures, first few
+//failures are free
+func (lc *LockoutConfig) backOff(failures, free int) time.Duration {
+	if failures <= free {
+		return 0
+	}
+	delay := time.Duration(lc.BaseDelaySecs) * time.Second
+	max := time.Duration(lc.MaxDelaySecs) * time.Second
+	for i := free + 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+//memAttempts - failures of a key kept in memory
+type memAttempts struct {
+	failures int
+	last     time.Time
+}
+
+//memPruneInterval - minimum time between removing expired entries from the
+//in-memory counter, so that failures do not scan all the entries every time
+const memPruneInterval = time.Minute
+
+//MemAttemptCounter - AttemptCounter that keeps the counts in process memory
+type MemAttemptCounter struct {
+	sync.Mutex
+	attempts map[string]*memAttempts
+	pruned   time.Time
+}
+
+//NewMemAttemptCounter - creates an in-process attempt counter
+func NewMemAttemptCounter() *MemAttemptCounter {
+	return &MemAttemptCounter{
+		attempts: make(map[string]*memAttempts),
+	}
+}
+
+//Fail - records a failed attempt for the key and gives the number of
+//consecutive failures
+func (mc *MemAttemptCounter) Fail(
+	gtx context.Context, key string, window time.Duration) (
+	failures int, err error) {
+	mc.Lock()
+	defer mc.Unlock()
+	now := time.Now()
+	att, found := mc.attempts[key]
+	if !found || now.Sub(att.last) > window {
+		att = &memAttempts{}
+		mc.attempts[key] = att
+	}
+	att.failures++
+	att.last = now
+	//Old entries are removed now and then while we have the lock, keeps the
+	//map bounded without making every failure go through all the entries
+	if now.Sub(mc.pruned) >= memPruneInterval {
+		mc.pruned = now
+		for k, other := range mc.attempts {
+			if now.Sub(other.last) > window {
+				delete(mc.attempts, k)
+			}
+		}
+	}
+	return att.failures, err
+}
+
+//Failures - gives the number of consecutive failures for the key and the time
+//of last failure
+func (mc *MemAttemptCounter) Failures(
+	gtx context.Context, key string, window time.Duration) (
+	failures int, last time.Time, err error) {
+	mc.Lock()
+	defer mc.Unlock()
+	if att, found := mc.attempts[key]; found &&
+		time.Since(att.last) <= window {
+		failures, last = att.failures, att.last
+	}
+	return failures, last, err
+}
+
+//Clear - forgets the failures of the key
+func (mc *MemAttemptCounter) Clear(
+	gtx context.Context, key string) (err error) {
+	mc.Lock()
+	defer mc.Unlock()
+	delete(mc.attempts, key)
+	return err
+}
+
+var attemptCounter AttemptCounter = NewMemAttemptCounter()
+
+//SetAttemptCounter - sets the counter used for tracking login failures
+func SetAttemptCounter(counter AttemptCounter) {
+	attemptCounter = counter
+}
+
+//GetAttemptCounter - gets the counter used for tracking login failures
+func GetAttemptCounter() AttemptCounter {
+	return attemptCounter
+}
+
+func userAttemptKey(userID string) string {
+	return "user:" + userID
+}
+
+func ipAttemptKey(ip string) string {
+	return "ip:" + ip
+}
+
+//checkAttempt - checks if a login attempt by the user from the IP address is
+//allowed now, gives the time to wait otherwise
+func checkAttempt(gtx context.Context, userID, ip string) (
+	wait time.Duration, err error) {
+	lc := GetLockoutConfig()
+	for _, key := range []string{userAttemptKey(userID), ipAttemptKey(ip)} {
+		failures, last, err := attemptCounter.Failures(gtx, key, lc.window())
+		if err != nil {
+			return wait, LogErrorX("t.auth.lockout",
+				"Failed to get failed attempts", err)
+		}
+		delay := lc.backOff(failures, lc.FreeAttempts)
+		if key == ipAttemptKey(ip) {
+			delay = lc.backOff(failures, lc.IPFreeAttempts)
+			if failures >= lc.IPMaxAttempts {
+				//IP addresses are blocked till the failures are forgotten
+				delay = lc.window()
+			}
+		}
+		if w := time.Until(last.Add(delay)); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		err = ErrTooManyAttempts
+	}
+	return wait, err
+}
+
+//loginFailed - records the failed attempt, locks the user account when it
+//reaches the limit. The lockout is audited
+func loginFailed(gtx context.Context, userID, ip string) {
+	lc := GetLockoutConfig()
+	counter := attemptCounter
+	ipFailures, err := counter.Fail(gtx, ipAttemptKey(ip), lc.window())
+	LogErrorX("t.auth.lockout", "Failed to record failed attempt", err)
+	if ipFailures == lc.IPMaxAttempts {
+		LogEvent("ip_blocked", "", "", true, "", M{
+			"ip":       ip,
+			"failures": ipFailures,
+		})
+	}
+	failures, err := counter.Fail(gtx, userAttemptKey(userID), lc.window())
+	if err != nil || failures < lc.MaxAttempts {
+		LogErrorX("t.auth.lockout", "Failed to record failed attempt", err)
+		return
+	}
+	user, err := GetUserStorage().GetUser(gtx, userID)
+	if err != nil || user.State != Active {
+		//Either there is no such user or it is already locked/disabled
+		return
+	}
+	err = GetUserStorage().SetUserState(gtx, userID, Locked)
+	LogEvent("user_locked", userID, user.FirstName+" "+user.LastName,
+		err == nil, ErrString(err), M{
+			"ip":       ip,
+			"failures": failures,
+			"until":    time.Now().Add(lc.lockPeriod()),
+		})
+	LogErrorX("t.auth.lockout", "Failed to lock user %s", err, userID)
+}
+
+//loginSucceeded - forgets the failures of the user. Failures of the IP are
+//not cleared, otherwise a valid login would reset the IP's back-off
+func loginSucceeded(gtx context.Context, userID string) {
+	err := attemptCounter.Clear(gtx, userAttemptKey(userID))
+	LogErrorX("t.auth.lockout", "Failed to clear failed attempts", err)
+}
+
+//unlockIfExpired - unlocks the user account if the lock period is over since
+//the last failed attempt
+func unlockIfExpired(gtx context.Context, user *User) (err error) {
+	if user.State != Locked {
+		return err
+	}
+	lc := GetLockoutConfig()
+	_, last, err := attemptCounter.Failures(
+		gtx, userAttemptKey(user.UserID), lc.window())
+	if err != nil || time.Since(last) < lc.lockPeriod() {
+		return err
+	}
+	return UnlockUser(gtx, user)
+}
+
+//UnlockUser - unlocks a locked user account and forgets its failed attempts
+func UnlockUser(gtx context.Context, user *User) (err error) {
+	if user.State != Locked {
+		return fmt.Errorf("User account is not locked")
+	}
+	err = GetUserStorage().SetUserState(gtx, user.UserID, Active)
+	if err == nil {
+		user.State = Active
+		err = attemptCounter.Clear(gtx, userAttemptKey(user.UserID))
+	}
+	LogEvent("user_unlocked", user.UserID, user.FirstName+" "+user.LastName,
+		err == nil, ErrString(err), nil)
+	return LogErrorX("t.auth.lockout", "Failed to unlock user", err)
+}
+
+//throttled - sends the 'Too Many Requests' response with the time to wait
+func throttled(ctx echo.Context, op string, wait time.Duration) error {
+	secs := int(wait/time.Second) + 1
+	ctx.Response().Header().Set("Retry-After", fmt.Sprint(secs))
+	return AuditedSend(ctx, &Result{
+		Status: http.StatusTooManyRequests,
+		Op:     op,
+		Msg:    ErrTooManyAttempts.Error(),
+		OK:     false,
+		Data: M{
+			"retryAfter": secs,
+		},
+		Err: ErrTooManyAttempts.Error(),
+	})
+}
+
+func unlockUser(ctx echo.Context) (err error) {
+	status, msg := DefMS("Unlock user")
+	gtx := ctx.Request().Context()
+	userID := ctx.Param("userID")
+	user, err := GetUserStorage().GetUser(gtx, userID)
+	if err != nil {
+		msg = "Failed to find the user"
+		status = http.StatusBadRequest
+	} else if err = UnlockUser(gtx, user); err != nil {
+		msg = "Failed to unlock user"
+		status = http.StatusBadRequest
+	}
+	err = AuditedSend(ctx, &Result{
+		Status: status,
+		Op:     "user_unlock",
+		Msg:    msg,
+		OK:     err == nil,
+		Data: M{
+			"userID": userID,
+		},
+		Err: ErrString(err),
+	})
+	return LogError("t.auth.lockout", err)
+}
+
+func getLockoutEndpoints() []*Endpoint {
+	return []*Endpoint{
+		{
+			Method:   echo.POST,
+			URL:      "uman/user/:userID/unlock",
+			Access:   Admin,
+			Category: "user management",
+			Func:     unlockUser,
+			Comment:  "Unlock an user account locked after login failures",
+		},
+	}
+}
+
+func unlockUserCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "unlock",
+		Usage: "Unlock an user account locked after login failures",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "user",
+				Usage: "ID of the user",
+			},
+		},
+		Action: func(ctx *cli.Context) (err error) {
+			ag := NewArgGetter(ctx)
+			userID := ResolveUserID(context.TODO(),
+				ag.GetRequiredString("user"))
+			if err = ag.Err; err != nil {
+				return err
+			}
+			gtx := context.TODO()
+			user, err := GetUserStorage().GetUser(gtx, userID)
+			if err == nil {
+				err = UnlockUser(gtx, user)
+			}
+			if err == nil {
+				Info("t.auth.lockout", "User account unlocked")
+			}
+			return err
+		},
+	}
+}
@@ -0,0 +1,75 @@
+package teak
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemAttemptCounter(t *testing.T) {
+	gtx := context.Background()
+	mc := NewMemAttemptCounter()
+	for i := 1; i <= 3; i++ {
+		if failures, _ := mc.Fail(gtx, "user:a", time.Hour); failures != i {
+			t.Errorf("Expected %d failures, got %d", i, failures)
+		}
+	}
+	if failures, _, _ := mc.Failures(gtx, "user:a", time.Hour); failures != 3 {
+		t.Errorf("Expected 3 recorded failures, got %d", failures)
+	}
+	mc.Clear(gtx, "user:a")
+	if failures, _, _ := mc.Failures(gtx, "user:a", time.Hour); failures != 0 {
+		t.Errorf("Expected no failures after clear, got %d", failures)
+	}
+
+	//Failures outside the window start a new count
+	mc.Fail(gtx, "user:b", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if failures, _ := mc.Fail(gtx, "user:b", time.Millisecond); failures != 1 {
+		t.Errorf("Expected count to restart after window, got %d", failures)
+	}
+}
+
+func TestMemAttemptCounterPruning(t *testing.T) {
+	gtx := context.Background()
+	mc := NewMemAttemptCounter()
+	for _, key := range []string{"ip:1", "ip:2", "ip:3"} {
+		mc.Fail(gtx, key, time.Millisecond)
+	}
+	time.Sleep(5 * time.Millisecond)
+	//Expired entries stay till the prune interval is over
+	mc.Fail(gtx, "ip:4", time.Millisecond)
+	if len(mc.attempts) != 4 {
+		t.Errorf("Expected no pruning within the interval, found %d entries",
+			len(mc.attempts))
+	}
+	mc.pruned = time.Now().Add(-memPruneInterval)
+	time.Sleep(5 * time.Millisecond)
+	mc.Fail(gtx, "ip:5", time.Millisecond)
+	if len(mc.attempts) != 1 || mc.attempts["ip:5"] == nil {
+		t.Errorf("Expected only the latest entry after pruning, found %d",
+			len(mc.attempts))
+	}
+}
+
+func TestBackOff(t *testing.T) {
+	lc := LockoutConfig{BaseDelaySecs: 1, MaxDelaySecs: 5}
+	cases := []struct {
+		failures int
+		delay    time.Duration
+	}{
+		{2, 0},
+		{3, 0},
+		{4, time.Second},
+		{5, 2 * time.Second},
+		{6, 4 * time.Second},
+		{7, 5 * time.Second},
+		{20, 5 * time.Second},
+	}
+	for _, c := range cases {
+		if delay := lc.backOff(c.failures, 3); delay != c.delay {
+			t.Errorf("After %d failures: expected %v, got %v",
+				c.failures, c.delay, delay)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package teak
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -281,10 +282,25 @@ func (dl *DirectLogger) GetWriter(uniqueID string) (writer Writer) {
 	return dl.writers[uniqueID]
 }
 
+//Flusher - implemented by loggers that write messages in background, Flush
+//should return after all the messages logged so far are written
+type Flusher interface {
+	Flush()
+}
+
+//FlushLogs - waits till the messages logged so far are written, if the
+//configured logger writes in background
+func FlushLogs() {
+	if flusher, ok := lconf.Logger.(Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 //AsyncLogger - logger that uses goroutine for dispatching
 type AsyncLogger struct {
 	sync.Mutex
 	writers map[string]Writer
+	pending sync.WaitGroup
 }
 
 //NewAsyncLogger - creates a new DirectLogger instace
@@ -302,7 +318,9 @@ func (al *AsyncLogger) Log(level Level,
 	if level == PrintLevel {
 		return
 	}
+	al.pending.Add(1)
 	go func() {
+		defer al.pending.Done()
 		fmtstr = ToString(level) + " [" + module + "] " + fmtstr
 		msg := fmt.Sprintf(fmtstr, args...)
 		al.Lock()
@@ -315,6 +333,11 @@ func (al *AsyncLogger) Log(level Level,
 	}()
 }
 
+//Flush - waits till the messages logged so far are written
+func (al *AsyncLogger) Flush() {
+	al.pending.Wait()
+}
+
 //RegisterWriter - registers a writer
 func (al *AsyncLogger) RegisterWriter(writer Writer) {
 	if writer != nil {
@@ -373,15 +396,19 @@ func (cw *ConsoleWriter) IsEnabled() (value bool) {
 	return cw.enabled
 }
 
-//Event - represents a event initiated by a user while performing an operation
+//Event - represents a event initiated by a user while performing an operation.
+//When a super user impersonates another user, UserID and UserName identify the
+//impersonated user and RealUserID and RealUserName identify the super user
 type Event struct {
-	Op       string      `json:"op" db:"op"`
-	UserID   string      `json:"userID" db:"user_id"`
-	UserName string      `json:"userName" db:"user_name"`
-	Success  bool        `json:"success" db:"success"`
-	Error    string      `json:"error" db:"error"`
-	Time     time.Time   `json:"time" db:"time"`
-	Data     interface{} `json:"data" db:"data"`
+	Op           string      `json:"op" db:"op"`
+	UserID       string      `json:"userID" db:"user_id"`
+	UserName     string      `json:"userName" db:"user_name"`
+	RealUserID   string      `json:"realUserID,omitempty" db:"real_user_id"`
+	RealUserName string      `json:"realUserName,omitempty" db:"real_user_name"`
+	Success      bool        `json:"success" db:"success"`
+	Error        string      `json:"error" db:"error"`
+	Time         time.Time   `json:"time" db:"time"`
+	Data         interface{} `json:"data" db:"data"`
 }
 
 //EventAuditor - handles application events for audit purposes
@@ -409,16 +436,26 @@ type NoOpAuditor struct{}
 //LogEvent - logs event to console
 func (n *NoOpAuditor) LogEvent(event *Event) {
 	if event.Success {
-		fmt.Printf("Event:Info - %s BY %s", event.Op, event.UserID)
+		fmt.Printf("Event:Info - %s BY %s%s\n",
+			event.Op, event.UserID, realUserSuffix(event))
 	} else {
-		fmt.Printf("Event:Error - %s BY %s", event.Op, event.UserID)
+		fmt.Printf("Event:Error - %s BY %s%s\n",
+			event.Op, event.UserID, realUserSuffix(event))
 	}
 }
 
+//realUserSuffix - mentions the impersonating user when there is one
+func realUserSuffix(event *Event) string {
+	if event.RealUserID == "" {
+		return ""
+	}
+	return " (impersonated by " + event.RealUserID + ")"
+}
+
 //GetEvents - gives an empty list of events
 func (n *NoOpAuditor) GetEvents(
-	offset, limit int, filter *Filter) (
-	total int, events []*Event, err error) {
+	offset, limit int64, filter *Filter) (
+	total int64, events []*Event, err error) {
 	return total, events, err
 }
 
@@ -428,7 +465,7 @@ func (n *NoOpAuditor) CreateIndices() (err error) { return err }
 //CleanData - there's nothing to clean
 func (n *NoOpAuditor) CleanData() (err error) { return err }
 
-var eventAuditor EventAuditor
+var eventAuditor EventAuditor = &NoOpAuditor{}
 
 //SetEventAuditor - sets the event auditor
 func SetEventAuditor(auditor EventAuditor) {
@@ -448,7 +485,7 @@ func LogEvent(
 	success bool,
 	err string,
 	data interface{}) {
-	eventAuditor.LogEvent(&Event{
+	LogEventX(&Event{
 		Op:       op,
 		UserID:   userID,
 		UserName: userName,
@@ -458,3 +495,57 @@ func LogEvent(
 		Data:     data,
 	})
 }
+
+//auditQueueSize - number of audit events that can wait for the auditor, when
+//the queue is full logging an event blocks till the auditor catches up
+const auditQueueSize = 1024
+
+//auditItem - an audit event along with the auditor it was logged for
+type auditItem struct {
+	auditor EventAuditor
+	event   *Event
+}
+
+//auditQueue - events waiting to be written, a single goroutine writes them so
+//that they are written in the order they were logged
+var auditQueue = struct {
+	sync.Once
+	items   chan auditItem
+	pending sync.WaitGroup
+}{
+	items: make(chan auditItem, auditQueueSize),
+}
+
+//LogEventX - queues a fully populated event for the registered auditor, the
+//event is written in background
+func LogEventX(event *Event) {
+	auditQueue.Do(func() {
+		go writeAuditEvents()
+	})
+	auditQueue.pending.Add(1)
+	auditQueue.items <- auditItem{auditor: eventAuditor, event: event}
+}
+
+//writeAuditEvents - writes the queued audit events with their auditors
+func writeAuditEvents() {
+	for item := range auditQueue.items {
+		item.auditor.LogEvent(item.event)
+		auditQueue.pending.Done()
+	}
+}
+
+//FlushAuditEvents - waits till the audit events logged so far are written or
+//the context is done
+func FlushAuditEvents(gtx context.Context) (err error) {
+	flushed := make(chan struct{})
+	go func() {
+		auditQueue.pending.Wait()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-gtx.Done():
+		err = gtx.Err()
+	}
+	return err
+}
@@ -0,0 +1,69 @@
+package mem
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/varunamachi/teak"
+)
+
+//CreateAPIKey - stores an API key
+func (m *userStorage) CreateAPIKey(
+	gtx context.Context, key *teak.APIKey) (err error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	if _, err = m.getUser(key.UserID); err != nil {
+		return teak.LogError("t.user.mem", err)
+	}
+	cpy := *key
+	m.db.apiKeys[key.ID] = &cpy
+	return err
+}
+
+//GetAPIKey - gets the API key with given hash
+func (m *userStorage) GetAPIKey(
+	gtx context.Context, keyHash string) (key *teak.APIKey, err error) {
+	m.db.RLock()
+	defer m.db.RUnlock()
+	for _, stored := range m.db.apiKeys {
+		if stored.Hash == keyHash {
+			cpy := *stored
+			return &cpy, err
+		}
+	}
+	err = fmt.Errorf("Could not find API key")
+	return nil, teak.LogError("t.user.mem", err)
+}
+
+//GetAPIKeys - gets all the API keys of an user, latest first
+func (m *userStorage) GetAPIKeys(
+	gtx context.Context, userID string) (keys []*teak.APIKey, err error) {
+	m.db.RLock()
+	defer m.db.RUnlock()
+	keys = make([]*teak.APIKey, 0, 10)
+	for _, stored := range m.db.apiKeys {
+		if stored.UserID == userID {
+			cpy := *stored
+			keys = append(keys, &cpy)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.After(keys[j].CreatedAt)
+	})
+	return keys, err
+}
+
+//DeleteAPIKey - deletes the API key with given ID that belongs to the user
+func (m *userStorage) DeleteAPIKey(
+	gtx context.Context, userID, keyID string) (err error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	key, found := m.db.apiKeys[keyID]
+	if !found || key.UserID != userID {
+		err = fmt.Errorf("Could not find API key with ID '%s'", keyID)
+		return teak.LogError("t.user.mem", err)
+	}
+	delete(m.db.apiKeys, keyID)
+	return err
+}
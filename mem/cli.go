@@ -0,0 +1,28 @@
+package mem
+
+import (
+	"github.com/varunamachi/teak"
+)
+
+//NewDefaultApp - creates a new app with in-memory storage providers that share
+//a store. Data is lost when the process exits, this is intended for tests and
+//demos
+func NewDefaultApp(
+	name string,
+	appVersion teak.Version,
+	apiVersion int,
+	desc string) *teak.App {
+	db := NewStore()
+	app := teak.NewApp(
+		name,
+		appVersion,
+		apiVersion,
+		desc,
+		teak.DefaultAuthenticator,
+		nil,
+		db.UserStorage(),
+		db.DataStorage(),
+	)
+	teak.SetEventAuditor(db.Auditor())
+	return app
+}
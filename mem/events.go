@@ -0,0 +1,58 @@
+package mem
+
+import (
+	"github.com/varunamachi/teak"
+)
+
+//eventAuditor - keeps audit events in memory
+type eventAuditor struct {
+	db *Store
+}
+
+//NewAuditor - creates an event auditor that keeps events in a memory store of
+//its own
+func NewAuditor() teak.EventAuditor {
+	return NewStore().Auditor()
+}
+
+//LogEvent - adds the event to the in-memory event list
+func (ea *eventAuditor) LogEvent(event *teak.Event) {
+	ea.db.Lock()
+	defer ea.db.Unlock()
+	ea.db.events = append(ea.db.events, event)
+}
+
+//GetEvents - gives events selected by the filter, latest events come first
+func (ea *eventAuditor) GetEvents(
+	offset, limit int64,
+	filter *teak.Filter) (total int64, events []*teak.Event, err error) {
+	ea.db.RLock()
+	defer ea.db.RUnlock()
+	records := make([]teak.M, 0, len(ea.db.events))
+	for _, event := range ea.db.events {
+		var rec teak.M
+		if rec, err = toRecord(event); err != nil {
+			return total, events, teak.LogError("t.mem.event", err)
+		}
+		records = append(records, rec)
+	}
+	selected := selectRecords(records, filter)
+	sortRecords(selected, "-time")
+	paged := page(selected, offset, limit)
+	events = make([]*teak.Event, 0, len(paged))
+	err = fromRecord(paged, &events)
+	return int64(len(selected)), events, teak.LogError("t.mem.event", err)
+}
+
+//CreateIndices - nothing to index in memory
+func (ea *eventAuditor) CreateIndices() (err error) {
+	return err
+}
+
+//CleanData - removes all the events
+func (ea *eventAuditor) CleanData() (err error) {
+	ea.db.Lock()
+	defer ea.db.Unlock()
+	ea.db.events = make([]*teak.Event, 0, 1000)
+	return err
+}
@@ -0,0 +1,424 @@
+package mem
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/now"
+	"github.com/varunamachi/teak"
+)
+
+//toRecord - converts given value to a generic record by marshalling it to
+//JSON. This makes sure that the field names match the JSON names used in
+//filters and that numbers are represented uniformly
+func toRecord(value interface{}) (rec teak.M, err error) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return rec, err
+	}
+	rec = teak.M{}
+	err = json.Unmarshal(b, &rec)
+	return rec, err
+}
+
+//fromRecord - populates the given 'out' value from a record or a list of
+//records
+func fromRecord(in interface{}, out interface{}) (err error) {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+//normalize - gives JSON representation of the given value so that values
+//coming from filters can be compared with values stored in records
+func normalize(val interface{}) interface{} {
+	b, err := json.Marshal(val)
+	if err != nil {
+		return val
+	}
+	var out interface{}
+	if err = json.Unmarshal(b, &out); err != nil {
+		return val
+	}
+	return out
+}
+
+//getField - gets value of a field from record, nested fields can be given as
+//dot seperated path
+func getField(rec teak.M, path string) (val interface{}, found bool) {
+	var cur interface{} = map[string]interface{}(rec)
+	for _, part := range strings.Split(path, ".") {
+		var mp map[string]interface{}
+		switch m := cur.(type) {
+		case teak.M:
+			mp = m
+		case map[string]interface{}:
+			mp = m
+		default:
+			return nil, false
+		}
+		if cur, found = mp[part]; !found {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+//asList - gives the value as a list, non-list values are wrapped in a list
+//with single element
+func asList(val interface{}) []interface{} {
+	if val == nil {
+		return []interface{}{}
+	}
+	if list, ok := val.([]interface{}); ok {
+		return list
+	}
+	return []interface{}{val}
+}
+
+func contains(list []interface{}, val interface{}) bool {
+	for _, item := range list {
+		if equals(item, val) {
+			return true
+		}
+	}
+	return false
+}
+
+func equals(a, b interface{}) bool {
+	return compare(a, b) == 0
+}
+
+//compare - compares two values that are decoded from JSON. Strings which
+//represent time are compared as time. Values of different types are ordered
+//by their type
+func compare(a, b interface{}) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return -1
+		}
+		return 1
+	}
+	switch av := a.(type) {
+	case float64:
+		if bv, ok := b.(float64); ok {
+			switch {
+			case av < bv:
+				return -1
+			case av > bv:
+				return 1
+			}
+			return 0
+		}
+	case bool:
+		if bv, ok := b.(bool); ok {
+			switch {
+			case av == bv:
+				return 0
+			case !av:
+				return -1
+			}
+			return 1
+		}
+	case string:
+		if bv, ok := b.(string); ok {
+			at, aerr := time.Parse(time.RFC3339Nano, av)
+			bt, berr := time.Parse(time.RFC3339Nano, bv)
+			if aerr == nil && berr == nil {
+				switch {
+				case at.Before(bt):
+					return -1
+				case at.After(bt):
+					return 1
+				}
+				return 0
+			}
+			return strings.Compare(av, bv)
+		}
+	}
+	return strings.Compare(fmt.Sprintf("%T%v", a, a), fmt.Sprintf("%T%v", b, b))
+}
+
+//matchList - matches the value against the matcher fields using the matcher's
+//strategy. This has same semantics as $in, $all and $nin operators of MongoDB
+func matchList(val interface{}, matcher *teak.Matcher) bool {
+	values := asList(val)
+	switch matcher.Strategy {
+	case teak.MatchAll:
+		for _, field := range matcher.Fields {
+			if !contains(values, normalize(field)) {
+				return false
+			}
+		}
+		return true
+	case teak.MatchNone:
+		for _, field := range matcher.Fields {
+			if contains(values, normalize(field)) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, field := range matcher.Fields {
+		if contains(values, normalize(field)) {
+			return true
+		}
+	}
+	return false
+}
+
+//matchSearch - checks if the value contains search strings given in matcher,
+//the search is case insensitive
+func matchSearch(val interface{}, matcher *teak.Matcher) bool {
+	str := strings.ToLower(fmt.Sprint(val))
+	has := func(field interface{}) bool {
+		return strings.Contains(str, strings.ToLower(fmt.Sprint(field)))
+	}
+	switch matcher.Strategy {
+	case teak.MatchAll:
+		for _, field := range matcher.Fields {
+			if !has(field) {
+				return false
+			}
+		}
+		return true
+	case teak.MatchNone:
+		for _, field := range matcher.Fields {
+			if has(field) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, field := range matcher.Fields {
+		if has(field) {
+			return true
+		}
+	}
+	return false
+}
+
+//matchDate - checks if the value is a time that is within given date range
+func matchDate(val interface{}, dateRange *teak.DateRange) bool {
+	str, ok := val.(string)
+	if !ok {
+		return false
+	}
+	t, err := time.Parse(time.RFC3339Nano, str)
+	if err != nil {
+		return false
+	}
+	from := now.New(dateRange.From).BeginningOfDay()
+	to := now.New(dateRange.To).EndOfDay()
+	return !(t.Before(from) || t.After(to))
+}
+
+//Matches - checks if the given record is selected by the filter. Nil filter
+//matches every record
+func Matches(filter *teak.Filter, rec teak.M) bool {
+	if filter == nil {
+		return true
+	}
+	for field, matcher := range filter.Props {
+		if len(matcher.Fields) == 0 {
+			continue
+		}
+		val, _ := getField(rec, field)
+		if !matchList(val, &matcher) {
+			return false
+		}
+	}
+	for field, bval := range filter.Bools {
+		if bval == nil {
+			continue
+		}
+		val, _ := getField(rec, field)
+		if !equals(val, normalize(bval)) {
+			return false
+		}
+	}
+	for field, dateRange := range filter.Dates {
+		if !dateRange.IsValid() {
+			continue
+		}
+		val, _ := getField(rec, field)
+		if !matchDate(val, &dateRange) {
+			return false
+		}
+	}
+	for field, matcher := range filter.Lists {
+		if len(matcher.Fields) == 0 {
+			continue
+		}
+		val, _ := getField(rec, field)
+		if !matchList(val, &matcher) {
+			return false
+		}
+	}
+	for field, matcher := range filter.Searches {
+		if len(matcher.Fields) == 0 {
+			continue
+		}
+		val, _ := getField(rec, field)
+		if !matchSearch(val, &matcher) {
+			return false
+		}
+	}
+	if filter.Owner != nil && !matchOwner(filter.Owner, rec) {
+		return false
+	}
+	return true
+}
+
+//matchOwner - checks if the record is owned by or shared with the user
+func matchOwner(owner *teak.OwnerFilter, rec teak.M) bool {
+	if val, _ := getField(rec, owner.OwnerField); equals(val, owner.UserID) {
+		return true
+	}
+	if owner.SharedField == "" {
+		return false
+	}
+	val, _ := getField(rec, owner.SharedField)
+	return contains(asList(val), owner.UserID)
+}
+
+//findMatching - gives index of the record with given key that also matches
+//the filter, -1 if there is no such record
+func findMatching(
+	records []teak.M, keyField string, key interface{}, filter *teak.Filter) int {
+	idx := findIndex(records, keyField, key)
+	if idx != -1 && !Matches(filter, records[idx]) {
+		idx = -1
+	}
+	return idx
+}
+
+//selectRecords - gives records selected by the filter
+func selectRecords(records []teak.M, filter *teak.Filter) []teak.M {
+	selected := make([]teak.M, 0, len(records))
+	for _, rec := range records {
+		if Matches(filter, rec) {
+			selected = append(selected, rec)
+		}
+	}
+	return selected
+}
+
+//sortRecords - sorts the records based on the sort field. If the field name
+//starts with '-' records are sorted in descending order
+func sortRecords(records []teak.M, sortField string) {
+	if sortField == "" {
+		return
+	}
+	desc := strings.HasPrefix(sortField, "-")
+	if desc {
+		sortField = sortField[1:]
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		a, _ := getField(records[i], sortField)
+		b, _ := getField(records[j], sortField)
+		if desc {
+			return compare(a, b) > 0
+		}
+		return compare(a, b) < 0
+	})
+}
+
+//page - gives a page of records based on offset and limit, a limit of 0 or
+//less returns everything after offset
+func page(records []teak.M, offset, limit int64) []teak.M {
+	total := int64(len(records))
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= total {
+		return []teak.M{}
+	}
+	end := total
+	if limit > 0 && offset+limit < total {
+		end = offset + limit
+	}
+	return records[offset:end]
+}
+
+//distinct - gives distinct values of the field among given records, if the
+//field is an array, elements of the array are considered
+func distinct(records []teak.M, field string) []interface{} {
+	values := make([]interface{}, 0, 100)
+	for _, rec := range records {
+		val, found := getField(rec, field)
+		if !found {
+			continue
+		}
+		for _, item := range asList(val) {
+			if !contains(values, item) {
+				values = append(values, item)
+			}
+		}
+	}
+	return values
+}
+
+//countValues - gives number of occurances of each value of the field sorted
+//in descending order of count
+func countValues(records []teak.M, field string) []*teak.FilterVal {
+	counts := make(map[string]int)
+	order := make([]string, 0, 100)
+	for _, rec := range records {
+		val, found := getField(rec, field)
+		if !found {
+			continue
+		}
+		for _, item := range asList(val) {
+			name := fmt.Sprint(item)
+			if _, has := counts[name]; !has {
+				order = append(order, name)
+			}
+			counts[name]++
+		}
+	}
+	fvals := make([]*teak.FilterVal, 0, len(order))
+	for _, name := range order {
+		fvals = append(fvals, &teak.FilterVal{
+			Name:  name,
+			Count: counts[name],
+		})
+	}
+	sort.SliceStable(fvals, func(i, j int) bool {
+		return fvals[i].Count > fvals[j].Count
+	})
+	return fvals
+}
+
+//dateRange - gives the range of time values for the field
+func dateRange(records []teak.M, field string) (drange teak.DateRange) {
+	for _, rec := range records {
+		val, found := getField(rec, field)
+		if !found {
+			continue
+		}
+		str, ok := val.(string)
+		if !ok {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, str)
+		if err != nil {
+			continue
+		}
+		if drange.From.IsZero() || t.Before(drange.From) {
+			drange.From = t
+		}
+		if drange.To.IsZero() || t.After(drange.To) {
+			drange.To = t
+		}
+	}
+	return drange
+}
@@ -0,0 +1,154 @@
+package mem
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/varunamachi/teak"
+)
+
+//without - gives the members excluding the given users
+func without(members []string, userIDs ...string) (rest []string) {
+	rest = make([]string, 0, len(members))
+	for _, member := range members {
+		if !hasString(userIDs, member) {
+			rest = append(rest, member)
+		}
+	}
+	return rest
+}
+
+func hasString(list []string, item string) bool {
+	for _, val := range list {
+		if val == item {
+			return true
+		}
+	}
+	return false
+}
+
+func copyGroup(group *teak.Group) *teak.Group {
+	return &teak.Group{
+		Name:  group.Name,
+		Users: append([]string{}, group.Users...),
+	}
+}
+
+//addMembers - adds the users who are not members already, all the users must
+//exist
+func (m *userStorage) addMembers(
+	group *teak.Group, userIDs []string) (err error) {
+	for _, userID := range userIDs {
+		if _, err = m.getUser(userID); err != nil {
+			return err
+		}
+	}
+	for _, userID := range userIDs {
+		if !hasString(group.Users, userID) {
+			group.Users = append(group.Users, userID)
+		}
+	}
+	return err
+}
+
+//CreateGroup - creates a group with given members
+func (m *userStorage) CreateGroup(
+	gtx context.Context, group *teak.Group) (err error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	if _, found := m.db.groups[group.Name]; found {
+		err = fmt.Errorf("Group with name '%s' already exists", group.Name)
+		return teak.LogError("t.user.mem", err)
+	}
+	stored := &teak.Group{Name: group.Name, Users: []string{}}
+	if err = m.addMembers(stored, group.Users); err != nil {
+		return teak.LogError("t.user.mem", err)
+	}
+	m.db.groups[group.Name] = stored
+	return err
+}
+
+//GetGroup - gets the group with given name along with its members
+func (m *userStorage) GetGroup(
+	gtx context.Context, name string) (group *teak.Group, err error) {
+	m.db.RLock()
+	defer m.db.RUnlock()
+	stored, found := m.db.groups[name]
+	if !found {
+		err = fmt.Errorf("Could not find group with name '%s'", name)
+		return nil, teak.LogError("t.user.mem", err)
+	}
+	return copyGroup(stored), err
+}
+
+//GetGroups - gets all the groups along with their members
+func (m *userStorage) GetGroups(
+	gtx context.Context) (groups []*teak.Group, err error) {
+	m.db.RLock()
+	defer m.db.RUnlock()
+	groups = make([]*teak.Group, 0, len(m.db.groups))
+	for _, group := range m.db.groups {
+		groups = append(groups, copyGroup(group))
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return groups, err
+}
+
+//DeleteGroup - deletes the group with given name
+func (m *userStorage) DeleteGroup(
+	gtx context.Context, name string) (err error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	if _, found := m.db.groups[name]; !found {
+		err = fmt.Errorf("Could not find group with name '%s'", name)
+		return teak.LogError("t.user.mem", err)
+	}
+	delete(m.db.groups, name)
+	return err
+}
+
+//AddGroupMembers - adds the users to the group, users who are already members
+//are ignored
+func (m *userStorage) AddGroupMembers(
+	gtx context.Context, name string, userIDs []string) (err error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	group, found := m.db.groups[name]
+	if !found {
+		err = fmt.Errorf("Could not find group with name '%s'", name)
+		return teak.LogError("t.user.mem", err)
+	}
+	return teak.LogError("t.user.mem", m.addMembers(group, userIDs))
+}
+
+//RemoveGroupMembers - removes the users from the group
+func (m *userStorage) RemoveGroupMembers(
+	gtx context.Context, name string, userIDs []string) (err error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	group, found := m.db.groups[name]
+	if !found {
+		err = fmt.Errorf("Could not find group with name '%s'", name)
+		return teak.LogError("t.user.mem", err)
+	}
+	group.Users = without(group.Users, userIDs...)
+	return err
+}
+
+//GetUserGroups - gives names of the groups the user is member of
+func (m *userStorage) GetUserGroups(
+	gtx context.Context, userID string) (groups []string, err error) {
+	m.db.RLock()
+	defer m.db.RUnlock()
+	groups = make([]string, 0, 10)
+	for _, group := range m.db.groups {
+		if hasString(group.Users, userID) {
+			groups = append(groups, group.Name)
+		}
+	}
+	sort.Strings(groups)
+	return groups, err
+}
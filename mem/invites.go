@@ -0,0 +1,73 @@
+package mem
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/varunamachi/teak"
+)
+
+//copyInvite - gives a copy of the invite that does not share the groups
+func copyInvite(invite *teak.Invite) *teak.Invite {
+	cpy := *invite
+	cpy.Groups = append([]string{}, invite.Groups...)
+	return &cpy
+}
+
+//CreateInvite - stores an invite
+func (m *userStorage) CreateInvite(
+	gtx context.Context, invite *teak.Invite) (err error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	if _, found := m.db.invites[invite.ID]; found {
+		err = fmt.Errorf("Invite with ID '%s' already exists", invite.ID)
+		return teak.LogError("t.user.mem", err)
+	}
+	m.db.invites[invite.ID] = copyInvite(invite)
+	return err
+}
+
+//GetInvites - gets all the pending invites, latest first
+func (m *userStorage) GetInvites(
+	gtx context.Context) (invites []*teak.Invite, err error) {
+	m.db.RLock()
+	defer m.db.RUnlock()
+	invites = make([]*teak.Invite, 0, len(m.db.invites))
+	for _, invite := range m.db.invites {
+		invites = append(invites, copyInvite(invite))
+	}
+	sort.Slice(invites, func(i, j int) bool {
+		return invites[i].CreatedAt.After(invites[j].CreatedAt)
+	})
+	return invites, err
+}
+
+//DeleteInvite - deletes the invite with given ID
+func (m *userStorage) DeleteInvite(
+	gtx context.Context, inviteID string) (err error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	if _, found := m.db.invites[inviteID]; !found {
+		err = fmt.Errorf("Could not find invite with ID '%s'", inviteID)
+		return teak.LogError("t.user.mem", err)
+	}
+	delete(m.db.invites, inviteID)
+	return err
+}
+
+//UseInvite - removes the invite with given token hash and returns it, an
+//invite can be used only once
+func (m *userStorage) UseInvite(
+	gtx context.Context, hash string) (invite *teak.Invite, err error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	for id, stored := range m.db.invites {
+		if stored.Hash == hash {
+			delete(m.db.invites, id)
+			return stored, err
+		}
+	}
+	err = fmt.Errorf("Could not find invite")
+	return nil, teak.LogError("t.user.mem", err)
+}
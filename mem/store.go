@@ -0,0 +1,399 @@
+package mem
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/varunamachi/teak"
+	"gopkg.in/urfave/cli.v1"
+)
+
+//Store - holds the data kept in process memory. Storages created from a store
+//share its data, data of different stores is independent, so that tests can
+//use a store each
+type Store struct {
+	sync.RWMutex
+	data      map[string][]teak.M
+	users     map[string]*teak.User
+	secrets   map[string]string
+	history   map[string][]string
+	refresh   map[string]*teak.RefreshToken
+	revoked   map[string]time.Time
+	apiKeys   map[string]*teak.APIKey
+	twoFactor map[string]*teak.TwoFactor
+	pwdReset  map[string]*teak.PasswordResetToken
+	groups    map[string]*teak.Group
+	invites   map[string]*teak.Invite
+	events    []*teak.Event
+	internal  teak.M
+}
+
+//NewStore - creates an empty in-memory store
+func NewStore() *Store {
+	return &Store{
+		data:      make(map[string][]teak.M),
+		users:     make(map[string]*teak.User),
+		secrets:   make(map[string]string),
+		history:   make(map[string][]string),
+		refresh:   make(map[string]*teak.RefreshToken),
+		revoked:   make(map[string]time.Time),
+		apiKeys:   make(map[string]*teak.APIKey),
+		twoFactor: make(map[string]*teak.TwoFactor),
+		pwdReset:  make(map[string]*teak.PasswordResetToken),
+		groups:    make(map[string]*teak.Group),
+		invites:   make(map[string]*teak.Invite),
+		events:    make([]*teak.Event, 0, 1000),
+		internal:  teak.M{},
+	}
+}
+
+//DataStorage - gives the data storage that keeps data in this store
+func (s *Store) DataStorage() teak.DataStorage {
+	return &dataStorage{db: s}
+}
+
+//UserStorage - gives the user storage that keeps users in this store
+func (s *Store) UserStorage() teak.UserStorage {
+	return &userStorage{db: s}
+}
+
+//Auditor - gives the event auditor that keeps events in this store
+func (s *Store) Auditor() teak.EventAuditor {
+	return &eventAuditor{db: s}
+}
+
+//dataStorage - in-memory implementation for dataStorage interface
+type dataStorage struct {
+	db *Store
+}
+
+//NewStorage - creates a new in-memory data storage implementation with a
+//store of its own
+func NewStorage() teak.DataStorage {
+	return NewStore().DataStorage()
+}
+
+func (mds *dataStorage) Name() string {
+	return "memory"
+}
+
+//Create - creates an record in 'dtype' collection
+func (mds *dataStorage) Create(
+	gtx context.Context, dtype string, value interface{}) (err error) {
+	defer func() {
+		teak.LogErrorX("t.mem.store", "Failed to create item", err)
+	}()
+	rec, err := toRecord(value)
+	if err != nil {
+		return err
+	}
+	mds.db.Lock()
+	defer mds.db.Unlock()
+	if hdl := teak.GetItemHandler(dtype); hdl != nil {
+		keyField := hdl.UniqueKeyField()
+		key, _ := getField(rec, keyField)
+		if key != nil && findIndex(mds.db.data[dtype], keyField, key) != -1 {
+			err = fmt.Errorf("Item of type %s with %s '%v' already exists",
+				dtype, keyField, key)
+			return err
+		}
+	}
+	mds.db.data[dtype] = append(mds.db.data[dtype], rec)
+	return err
+}
+
+//Update - updates the record in 'dtype' collection which is matched by
+//the key and the filter
+func (mds *dataStorage) Update(
+	gtx context.Context,
+	dtype string,
+	keyField string,
+	key interface{},
+	filter *teak.Filter,
+	value interface{}) (err error) {
+	defer func() {
+		err = teak.LogErrorX("t.mem.store", "Failed to update item", err)
+	}()
+	rec, err := toRecord(value)
+	if err != nil {
+		return err
+	}
+	mds.db.Lock()
+	defer mds.db.Unlock()
+	idx := findMatching(mds.db.data[dtype], keyField, key, filter)
+	if idx == -1 {
+		return teak.ErrNotFound
+	}
+	rec[keyField] = normalize(key)
+	if filter != nil && filter.Owner != nil {
+		//Only admins can change the owner
+		field := filter.Owner.OwnerField
+		rec[field] = mds.db.data[dtype][idx][field]
+	}
+	mds.db.data[dtype][idx] = rec
+	return err
+}
+
+//Delete - deletes record matched by the key and the filter from collection
+//'dtype'
+func (mds *dataStorage) Delete(
+	gtx context.Context,
+	dtype string,
+	keyField string,
+	key interface{},
+	filter *teak.Filter) (err error) {
+	defer func() {
+		err = teak.LogErrorX("t.mem.store", "Failed to delete item", err)
+	}()
+	mds.db.Lock()
+	defer mds.db.Unlock()
+	records := mds.db.data[dtype]
+	idx := findMatching(records, keyField, key, filter)
+	if idx == -1 {
+		return teak.ErrNotFound
+	}
+	mds.db.data[dtype] = append(records[:idx], records[idx+1:]...)
+	return err
+}
+
+//RetrieveOne - gets a record matched by given key and the filter from
+//collection 'dtype'
+func (mds *dataStorage) RetrieveOne(
+	gtx context.Context,
+	dtype string,
+	keyField string,
+	key interface{},
+	filter *teak.Filter,
+	out interface{}) (err error) {
+	defer func() {
+		err = teak.LogErrorX("t.mem.store", "Failed to retrieve item", err)
+	}()
+	mds.db.RLock()
+	defer mds.db.RUnlock()
+	records := mds.db.data[dtype]
+	idx := findMatching(records, keyField, key, filter)
+	if idx == -1 {
+		return teak.ErrNotFound
+	}
+	return fromRecord(records[idx], out)
+}
+
+//Count - counts the number of items for data type
+func (mds *dataStorage) Count(
+	gtx context.Context,
+	dtype string,
+	filter *teak.Filter) (count int64, err error) {
+	mds.db.RLock()
+	defer mds.db.RUnlock()
+	count = int64(len(selectRecords(mds.db.data[dtype], filter)))
+	return count, err
+}
+
+//Retrieve - gets all the items from collection 'dtype' selected by filter &
+//paged
+func (mds *dataStorage) Retrieve(
+	gtx context.Context,
+	dtype string,
+	sortField string,
+	offset int64,
+	limit int64,
+	filter *teak.Filter,
+	out interface{}) (err error) {
+	_, err = mds.RetrieveWithCount(
+		gtx, dtype, sortField, offset, limit, filter, out)
+	return err
+}
+
+//RetrieveWithCount - gets all the items from collection 'dtype' selected by
+//filter & paged also gives the total count of items selected by filter
+func (mds *dataStorage) RetrieveWithCount(
+	gtx context.Context,
+	dtype string,
+	sortField string,
+	offset int64,
+	limit int64,
+	filter *teak.Filter,
+	out interface{}) (count int64, err error) {
+	mds.db.RLock()
+	defer mds.db.RUnlock()
+	selected := selectRecords(mds.db.data[dtype], filter)
+	sortRecords(selected, sortField)
+	err = fromRecord(page(selected, offset, limit), out)
+	return int64(len(selected)), teak.LogError("t.mem.store", err)
+}
+
+//GetFilterValues - provides values associated the fields defined in filter spec
+func (mds *dataStorage) GetFilterValues(
+	gtx context.Context,
+	dtype string,
+	specs teak.FilterSpecList) (values teak.M, err error) {
+	mds.db.RLock()
+	defer mds.db.RUnlock()
+	records := mds.db.data[dtype]
+	values = teak.M{}
+	for _, spec := range specs {
+		switch spec.Type {
+		case teak.Prop:
+			fallthrough
+		case teak.Array:
+			values[spec.Field] = distinct(records, spec.Field)
+		case teak.Date:
+			values[spec.Field] = dateRange(records, spec.Field)
+		case teak.Boolean:
+		case teak.Search:
+		case teak.Static:
+		}
+	}
+	return values, err
+}
+
+//GetFilterValuesX - get values for filter based on given filter. Values for
+//the given field are not computed
+func (mds *dataStorage) GetFilterValuesX(
+	gtx context.Context,
+	dtype string,
+	field string,
+	specs teak.FilterSpecList,
+	filter *teak.Filter) (values teak.M, err error) {
+	mds.db.RLock()
+	defer mds.db.RUnlock()
+	records := selectRecords(mds.db.data[dtype], filter)
+	values = teak.M{}
+	for _, spec := range specs {
+		if spec.Field == field {
+			continue
+		}
+		switch spec.Type {
+		case teak.Prop:
+			fallthrough
+		case teak.Array:
+			values[spec.Field] = countValues(records, spec.Field)
+		case teak.Date:
+			values[spec.Field] = dateRange(records, spec.Field)
+		case teak.Boolean:
+		case teak.Search:
+		case teak.Static:
+		}
+	}
+	return values, err
+}
+
+//Setup - initialize the data storage for the first time, sets it upda and also
+//creates the first admin user. Data store can be setup only once
+func (mds *dataStorage) Setup(
+	gtx context.Context,
+	admin *teak.User,
+	adminPass string,
+	param teak.M) (err error) {
+	val, err := mds.IsSetup(gtx)
+	if err != nil {
+		err = teak.LogErrorX("t.mem.store",
+			"Failed to check setup status of memory store", err)
+		return err
+	}
+	if val {
+		teak.Info("t.mem.store", "Store already setup.")
+		return err
+	}
+	err = mds.Init(gtx, param)
+	if err != nil {
+		err = teak.LogErrorX("t.mem.store", "Failed to init app", err)
+		return err
+	}
+	uStore := &userStorage{db: mds.db}
+	idHash, err := uStore.CreateUser(gtx, admin)
+	if err != nil {
+		err = teak.LogErrorX("t.mem.store",
+			"Failed to create initial super admin", err)
+		return err
+	}
+	err = uStore.SetPassword(gtx, idHash, adminPass)
+	if err != nil {
+		err = teak.LogErrorX("t.mem.store",
+			"Failed to set initial super user password", err)
+		return err
+	}
+	mds.db.Lock()
+	mds.db.internal["initialized"] = true
+	mds.db.internal["initializedAt"] = time.Now()
+	mds.db.Unlock()
+	return err
+}
+
+//Init - nothing to initialize for in-memory store
+func (mds *dataStorage) Init(gtx context.Context, params teak.M) (err error) {
+	return err
+}
+
+//Reset - reset clears the data
+func (mds *dataStorage) Reset(gtx context.Context) (err error) {
+	mds.db.Lock()
+	defer mds.db.Unlock()
+	mds.db.data = make(map[string][]teak.M)
+	mds.db.users = make(map[string]*teak.User)
+	mds.db.secrets = make(map[string]string)
+	mds.db.history = make(map[string][]string)
+	mds.db.refresh = make(map[string]*teak.RefreshToken)
+	mds.db.revoked = make(map[string]time.Time)
+	mds.db.apiKeys = make(map[string]*teak.APIKey)
+	mds.db.twoFactor = make(map[string]*teak.TwoFactor)
+	mds.db.pwdReset = make(map[string]*teak.PasswordResetToken)
+	mds.db.groups = make(map[string]*teak.Group)
+	mds.db.invites = make(map[string]*teak.Invite)
+	mds.db.events = make([]*teak.Event, 0, 1000)
+	return err
+}
+
+//Destroy - deletes everything including setup information
+func (mds *dataStorage) Destroy(gtx context.Context) (err error) {
+	fresh := NewStore()
+	mds.db.Lock()
+	defer mds.db.Unlock()
+	mds.db.data = fresh.data
+	mds.db.users = fresh.users
+	mds.db.secrets = fresh.secrets
+	mds.db.history = fresh.history
+	mds.db.refresh = fresh.refresh
+	mds.db.revoked = fresh.revoked
+	mds.db.apiKeys = fresh.apiKeys
+	mds.db.twoFactor = fresh.twoFactor
+	mds.db.pwdReset = fresh.pwdReset
+	mds.db.groups = fresh.groups
+	mds.db.invites = fresh.invites
+	mds.db.events = fresh.events
+	mds.db.internal = fresh.internal
+	return err
+}
+
+//Close - in-memory store has no connection to close
+func (mds *dataStorage) Close(gtx context.Context) (err error) {
+	return err
+}
+
+//Wrap - in-memory store does not need any connection, so the command is
+//returned as is
+func (mds *dataStorage) Wrap(cmd *cli.Command) *cli.Command {
+	return cmd
+}
+
+//IsSetup - tells if data source is setup
+func (mds *dataStorage) IsSetup(gtx context.Context) (yes bool, err error) {
+	mds.db.RLock()
+	defer mds.db.RUnlock()
+	yes, _ = mds.db.internal["initialized"].(bool)
+	return yes, err
+}
+
+//findIndex - gives the index of record whose keyField matches the key, -1 is
+//returned if no record matches
+func findIndex(records []teak.M, keyField string, key interface{}) int {
+	nkey := normalize(key)
+	for i, rec := range records {
+		if val, found := getField(rec, keyField); found && equals(val, nkey) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,251 @@
+package mem
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/varunamachi/teak"
+)
+
+type item struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Owner  string   `json:"owner"`
+	Shared []string `json:"shared"`
+	Count  int      `json:"count"`
+}
+
+func createItems(t *testing.T, ds teak.DataStorage, items ...*item) {
+	for _, it := range items {
+		if err := ds.Create(context.Background(), "item", it); err != nil {
+			t.Fatalf("Failed to create item %s: %v", it.ID, err)
+		}
+	}
+}
+
+func TestStoresAreIndependent(t *testing.T) {
+	gtx := context.Background()
+	first := NewStore().DataStorage()
+	second := NewStore().DataStorage()
+	createItems(t, first, &item{ID: "a"}, &item{ID: "b"})
+	if count, _ := first.Count(gtx, "item", nil); count != 2 {
+		t.Errorf("Expected 2 items in first store, found %d", count)
+	}
+	if count, _ := second.Count(gtx, "item", nil); count != 0 {
+		t.Errorf("Expected no items in second store, found %d", count)
+	}
+}
+
+func TestParallelStores(t *testing.T) {
+	for _, name := range []string{"a", "b", "c", "d"} {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			gtx := context.Background()
+			ds := NewStore().DataStorage()
+			createItems(t, ds, &item{ID: name})
+			var out item
+			err := ds.RetrieveOne(gtx, "item", "id", name, nil, &out)
+			if err != nil || out.ID != name {
+				t.Errorf("Expected item %s, found '%s', error: %v",
+					name, out.ID, err)
+			}
+			if count, _ := ds.Count(gtx, "item", nil); count != 1 {
+				t.Errorf("Expected 1 item, found %d", count)
+			}
+		})
+	}
+}
+
+func TestCRUD(t *testing.T) {
+	gtx := context.Background()
+	ds := NewStore().DataStorage()
+	createItems(t, ds, &item{ID: "a", Name: "first", Count: 1})
+
+	err := ds.Update(gtx, "item", "id", "a", nil,
+		&item{Name: "updated", Count: 2})
+	if err != nil {
+		t.Fatalf("Failed to update item: %v", err)
+	}
+	var out item
+	if err = ds.RetrieveOne(gtx, "item", "id", "a", nil, &out); err != nil {
+		t.Fatalf("Failed to retrieve item: %v", err)
+	}
+	if out.ID != "a" || out.Name != "updated" || out.Count != 2 {
+		t.Errorf("Unexpected item after update: %+v", out)
+	}
+
+	err = ds.Update(gtx, "item", "id", "missing", nil, &item{})
+	if errors.Cause(err) != teak.ErrNotFound {
+		t.Errorf("Expected ErrNotFound for missing item, got %v", err)
+	}
+
+	if err = ds.Delete(gtx, "item", "id", "a", nil); err != nil {
+		t.Fatalf("Failed to delete item: %v", err)
+	}
+	err = ds.RetrieveOne(gtx, "item", "id", "a", nil, &out)
+	if errors.Cause(err) != teak.ErrNotFound {
+		t.Errorf("Expected ErrNotFound for deleted item, got %v", err)
+	}
+}
+
+func TestRetrieveWithFilter(t *testing.T) {
+	gtx := context.Background()
+	ds := NewStore().DataStorage()
+	createItems(t, ds,
+		&item{ID: "a", Name: "Apple", Count: 3},
+		&item{ID: "b", Name: "Banana", Count: 1},
+		&item{ID: "c", Name: "Cherry", Count: 2},
+		&item{ID: "d", Name: "Pineapple", Count: 4},
+	)
+	filter := &teak.Filter{
+		Searches: map[string]teak.Matcher{
+			"name": {Strategy: teak.MatchOne, Fields: []interface{}{"apple"}},
+		},
+	}
+	var out []*item
+	total, err := ds.RetrieveWithCount(
+		gtx, "item", "-count", 0, 1, filter, &out)
+	if err != nil {
+		t.Fatalf("Failed to retrieve items: %v", err)
+	}
+	if total != 2 {
+		t.Errorf("Expected 2 matching items, found %d", total)
+	}
+	if len(out) != 1 || out[0].ID != "d" {
+		t.Errorf("Expected first page to have item 'd', found %+v", out)
+	}
+}
+
+func TestOwnerFilter(t *testing.T) {
+	gtx := context.Background()
+	ds := NewStore().DataStorage()
+	createItems(t, ds,
+		&item{ID: "a", Owner: "u1"},
+		&item{ID: "b", Owner: "u2", Shared: []string{"u1"}},
+		&item{ID: "c", Owner: "u2"},
+	)
+	filter := &teak.Filter{
+		Owner: &teak.OwnerFilter{
+			OwnerField:  "owner",
+			SharedField: "shared",
+			UserID:      "u1",
+		},
+	}
+	if count, _ := ds.Count(gtx, "item", filter); count != 2 {
+		t.Errorf("Expected 2 items visible to u1, found %d", count)
+	}
+	err := ds.Update(gtx, "item", "id", "c", filter, &item{Name: "x"})
+	if errors.Cause(err) != teak.ErrNotFound {
+		t.Errorf("Expected ErrNotFound for item of other user, got %v", err)
+	}
+	//Owner can not be changed through an owner filtered update
+	err = ds.Update(gtx, "item", "id", "a", filter, &item{Owner: "u2"})
+	if err != nil {
+		t.Fatalf("Failed to update own item: %v", err)
+	}
+	var out item
+	ds.RetrieveOne(gtx, "item", "id", "a", nil, &out)
+	if out.Owner != "u1" {
+		t.Errorf("Expected owner to remain u1, found '%s'", out.Owner)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	rec := teak.M{
+		"name":   "Teak Wood",
+		"tags":   []interface{}{"hard", "brown"},
+		"active": true,
+		"made":   "2020-06-15T10:00:00Z",
+	}
+	day := func(d int) time.Time {
+		return time.Date(2020, 6, d, 0, 0, 0, 0, time.UTC)
+	}
+	cases := []struct {
+		name    string
+		filter  *teak.Filter
+		matches bool
+	}{
+		{"nil filter", nil, true},
+		{"list one", &teak.Filter{Lists: map[string]teak.Matcher{
+			"tags": {Strategy: teak.MatchOne,
+				Fields: []interface{}{"soft", "brown"}},
+		}}, true},
+		{"list all", &teak.Filter{Lists: map[string]teak.Matcher{
+			"tags": {Strategy: teak.MatchAll,
+				Fields: []interface{}{"hard", "soft"}},
+		}}, false},
+		{"list none", &teak.Filter{Lists: map[string]teak.Matcher{
+			"tags": {Strategy: teak.MatchNone,
+				Fields: []interface{}{"soft"}},
+		}}, true},
+		{"bool", &teak.Filter{Bools: map[string]interface{}{
+			"active": false,
+		}}, false},
+		{"date inside", &teak.Filter{Dates: map[string]teak.DateRange{
+			"made": {From: day(15), To: day(15)},
+		}}, true},
+		{"date outside", &teak.Filter{Dates: map[string]teak.DateRange{
+			"made": {From: day(16), To: day(20)},
+		}}, false},
+		{"search", &teak.Filter{Searches: map[string]teak.Matcher{
+			"name": {Strategy: teak.MatchAll,
+				Fields: []interface{}{"teak", "WOOD"}},
+		}}, true},
+	}
+	for _, c := range cases {
+		if got := Matches(c.filter, rec); got != c.matches {
+			t.Errorf("%s: expected %v, got %v", c.name, c.matches, got)
+		}
+	}
+}
+
+func TestRefreshTokenIsUsedOnce(t *testing.T) {
+	gtx := context.Background()
+	us := NewStore().UserStorage().(teak.TokenStorage)
+	err := us.SaveRefreshToken(gtx, &teak.RefreshToken{
+		ID:        "t1",
+		UserID:    "u1",
+		Family:    "f1",
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("Failed to save refresh token: %v", err)
+	}
+	if err = us.UseRefreshToken(gtx, "t1"); err != nil {
+		t.Fatalf("Failed to use refresh token: %v", err)
+	}
+	if err = us.UseRefreshToken(gtx, "t1"); err != teak.ErrTokenUsed {
+		t.Errorf("Expected ErrTokenUsed on reuse, got %v", err)
+	}
+	if err = us.RevokeRefreshTokens(gtx, "u1", "f1"); err != nil {
+		t.Fatalf("Failed to revoke refresh tokens: %v", err)
+	}
+	if _, err = us.GetRefreshToken(gtx, "t1"); err == nil {
+		t.Errorf("Expected revoked refresh token to be removed")
+	}
+}
+
+func TestNegativePaging(t *testing.T) {
+	gtx := context.Background()
+	store := NewStore()
+	for _, id := range []string{"a", "b"} {
+		store.users[id] = &teak.User{UserID: id}
+	}
+	total, users, err := store.UserStorage().GetUsersWithCount(
+		gtx, -1, -1, nil)
+	if err != nil || total != 2 || len(users) != 2 {
+		t.Errorf("Expected all users for negative offset and limit, "+
+			"got %d of %d, error: %v", len(users), total, err)
+	}
+
+	auditor := store.Auditor()
+	auditor.LogEvent(&teak.Event{Op: "first", Time: time.Now()})
+	total, events, err := auditor.GetEvents(-5, -1, nil)
+	if err != nil || total != 1 || len(events) != 1 {
+		t.Errorf("Expected all events for negative offset and limit, "+
+			"got %d of %d, error: %v", len(events), total, err)
+	}
+}
@@ -0,0 +1,121 @@
+package mem
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/varunamachi/teak"
+)
+
+//SaveRefreshToken - stores a refresh token
+func (m *userStorage) SaveRefreshToken(
+	gtx context.Context, token *teak.RefreshToken) (err error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	cpy := *token
+	m.db.refresh[token.ID] = &cpy
+	return err
+}
+
+//GetRefreshToken - gets the refresh token with given ID
+func (m *userStorage) GetRefreshToken(
+	gtx context.Context, tokenID string) (token *teak.RefreshToken, err error) {
+	m.db.RLock()
+	defer m.db.RUnlock()
+	stored, found := m.db.refresh[tokenID]
+	if !found {
+		err = fmt.Errorf("Could not find refresh token")
+		return nil, teak.LogError("t.user.mem", err)
+	}
+	cpy := *stored
+	return &cpy, err
+}
+
+//UseRefreshToken - marks the refresh token as used. If the token is already
+//used teak.ErrTokenUsed is returned
+func (m *userStorage) UseRefreshToken(
+	gtx context.Context, tokenID string) (err error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	stored, found := m.db.refresh[tokenID]
+	if !found {
+		err = fmt.Errorf("Could not find refresh token")
+		return teak.LogError("t.user.mem", err)
+	}
+	if stored.Used {
+		return teak.ErrTokenUsed
+	}
+	stored.Used = true
+	return err
+}
+
+//RevokeRefreshTokens - removes refresh tokens of the given family of the user,
+//if family is empty all the refresh tokens of the user are removed
+func (m *userStorage) RevokeRefreshTokens(
+	gtx context.Context, userID, family string) (err error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	for id, token := range m.db.refresh {
+		if token.UserID == userID && (family == "" || token.Family == family) {
+			delete(m.db.refresh, id)
+		}
+	}
+	return err
+}
+
+//RevokeToken - adds the access token ID to revocation list till expiry
+func (m *userStorage) RevokeToken(
+	gtx context.Context, tokenID string, expiry time.Time) (err error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	//Tokens that are expired are rejected anyway, no need to keep them
+	for id, exp := range m.db.revoked {
+		if time.Now().After(exp) {
+			delete(m.db.revoked, id)
+		}
+	}
+	m.db.revoked[tokenID] = expiry
+	return err
+}
+
+//IsTokenRevoked - checks if the access token with given ID is revoked
+func (m *userStorage) IsTokenRevoked(
+	gtx context.Context, tokenID string) (revoked bool, err error) {
+	m.db.RLock()
+	defer m.db.RUnlock()
+	_, revoked = m.db.revoked[tokenID]
+	return revoked, err
+}
+
+//SavePasswordResetToken - stores a password reset token, earlier reset tokens
+//of the user are removed
+func (m *userStorage) SavePasswordResetToken(
+	gtx context.Context, token *teak.PasswordResetToken) (err error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	for id, rt := range m.db.pwdReset {
+		if rt.UserID == token.UserID || time.Now().After(rt.ExpiresAt) {
+			delete(m.db.pwdReset, id)
+		}
+	}
+	cpy := *token
+	m.db.pwdReset[token.ID] = &cpy
+	return err
+}
+
+//UsePasswordResetToken - removes the password reset token with given ID and
+//returns it, a token can be used only once
+func (m *userStorage) UsePasswordResetToken(
+	gtx context.Context, tokenID string) (
+	token *teak.PasswordResetToken, err error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	token, found := m.db.pwdReset[tokenID]
+	if !found {
+		err = fmt.Errorf("Could not find password reset token")
+		return nil, teak.LogError("t.user.mem", err)
+	}
+	delete(m.db.pwdReset, tokenID)
+	return token, err
+}
@@ -0,0 +1,78 @@
+package mem
+
+import (
+	"context"
+
+	"github.com/varunamachi/teak"
+)
+
+//SaveTwoFactor - stores the TOTP secret, state and recovery code hashes of the
+//user
+func (m *userStorage) SaveTwoFactor(
+	gtx context.Context, tf *teak.TwoFactor) (err error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	if _, err = m.getUser(tf.UserID); err != nil {
+		return teak.LogError("t.user.mem", err)
+	}
+	cpy := *tf
+	cpy.RecoveryCodes = append([]string{}, tf.RecoveryCodes...)
+	m.db.twoFactor[tf.UserID] = &cpy
+	return err
+}
+
+//GetTwoFactor - gets the 2FA details of the user, the secret is empty if the
+//user has not enrolled
+func (m *userStorage) GetTwoFactor(
+	gtx context.Context, userID string) (tf *teak.TwoFactor, err error) {
+	m.db.RLock()
+	defer m.db.RUnlock()
+	stored, found := m.db.twoFactor[userID]
+	if !found {
+		return &teak.TwoFactor{UserID: userID}, err
+	}
+	cpy := *stored
+	cpy.RecoveryCodes = append([]string{}, stored.RecoveryCodes...)
+	return &cpy, err
+}
+
+//UseTOTPStep - records the time step of a verified TOTP code. If the step is
+//not after the last used step teak.ErrCodeUsed is returned
+func (m *userStorage) UseTOTPStep(
+	gtx context.Context, userID string, step int64) (err error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	stored, found := m.db.twoFactor[userID]
+	if !found || stored.LastStep >= step {
+		return teak.ErrCodeUsed
+	}
+	stored.LastStep = step
+	return err
+}
+
+//UseRecoveryCode - removes the recovery code with given hash. If the user does
+//not have such code teak.ErrCodeUsed is returned
+func (m *userStorage) UseRecoveryCode(
+	gtx context.Context, userID, codeHash string) (err error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	if stored, found := m.db.twoFactor[userID]; found {
+		for i, hash := range stored.RecoveryCodes {
+			if hash == codeHash {
+				stored.RecoveryCodes = append(
+					stored.RecoveryCodes[:i:i], stored.RecoveryCodes[i+1:]...)
+				return err
+			}
+		}
+	}
+	return teak.ErrCodeUsed
+}
+
+//DeleteTwoFactor - removes 2FA details of the user
+func (m *userStorage) DeleteTwoFactor(
+	gtx context.Context, userID string) (err error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	delete(m.db.twoFactor, userID)
+	return err
+}
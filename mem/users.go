@@ -0,0 +1,483 @@
+package mem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/varunamachi/teak"
+	"gopkg.in/hlandau/passlib.v1"
+)
+
+//userStorage - in-memory storage for user information
+type userStorage struct {
+	db *Store
+}
+
+//NewUserStorage - creates a new user storage that keeps users in a memory
+//store of its own
+func NewUserStorage() teak.UserStorage {
+	return NewStore().UserStorage()
+}
+
+//emailTaken - tells if an user other than the given user has the email
+//index, the caller should hold the store lock
+func (m *userStorage) emailTaken(userID, index string) bool {
+	if index == "" {
+		return false
+	}
+	for _, user := range m.db.users {
+		if user.EmailIndex == index && user.UserID != userID {
+			return true
+		}
+	}
+	return false
+}
+
+//getUser - gets user with given ID, the caller should hold the store lock
+func (m *userStorage) getUser(userID string) (user *teak.User, err error) {
+	user, found := m.db.users[userID]
+	if !found {
+		err = fmt.Errorf("Could not find user with ID '%s'", userID)
+	}
+	return user, err
+}
+
+//CreateUser - creates user in memory store
+func (m *userStorage) CreateUser(
+	gtx context.Context, user *teak.User) (idHash string, err error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	if err = m.validateForSuper(user.Auth); err != nil {
+		return "", err
+	}
+	if err = teak.UpdateUserInfo(user); err != nil {
+		err = teak.LogErrorX("t.user.mem",
+			"Failed to create user, user storage not properly configured", err)
+		return "", err
+	}
+	if _, found := m.db.users[user.UserID]; found {
+		err = fmt.Errorf("User with ID '%s' already exists", user.UserID)
+		return "", teak.LogError("t.user.mem", err)
+	}
+	if m.emailTaken(user.UserID, user.EmailIndex) {
+		return "", teak.ErrEmailExists
+	}
+	cpy := *user
+	m.db.users[user.UserID] = &cpy
+	return user.UserID, err
+}
+
+//UpdateUser - updates user in memory store
+func (m *userStorage) UpdateUser(
+	gtx context.Context, user *teak.User) (err error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	if err = m.validateForSuper(user.Auth); err != nil {
+		return err
+	}
+	if _, err = m.getUser(user.UserID); err != nil {
+		return teak.LogError("t.user.mem", err)
+	}
+	if m.emailTaken(user.UserID, user.EmailIndex) {
+		return teak.ErrEmailExists
+	}
+	cpy := *user
+	m.db.users[user.UserID] = &cpy
+	return err
+}
+
+//DeleteUser - deletes user with given user ID
+func (m *userStorage) DeleteUser(
+	gtx context.Context, userID string) (err error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	if _, err = m.getUser(userID); err != nil {
+		return teak.LogError("t.user.mem", err)
+	}
+	delete(m.db.users, userID)
+	delete(m.db.secrets, userID)
+	delete(m.db.history, userID)
+	delete(m.db.twoFactor, userID)
+	for id, rt := range m.db.pwdReset {
+		if rt.UserID == userID {
+			delete(m.db.pwdReset, id)
+		}
+	}
+	for _, group := range m.db.groups {
+		group.Users = without(group.Users, userID)
+	}
+	for id, token := range m.db.refresh {
+		if token.UserID == userID {
+			delete(m.db.refresh, id)
+		}
+	}
+	for id, key := range m.db.apiKeys {
+		if key.UserID == userID {
+			delete(m.db.apiKeys, id)
+		}
+	}
+	return err
+}
+
+//RenameUser - changes the identifier of an user along with the data that
+//refers to it
+func (m *userStorage) RenameUser(
+	gtx context.Context, oldID, newID string) (err error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	user, err := m.getUser(oldID)
+	if err != nil {
+		return teak.LogError("t.user.mem", err)
+	}
+	if _, found := m.db.users[newID]; found {
+		err = fmt.Errorf("User with ID '%s' already exists", newID)
+		return teak.LogError("t.user.mem", err)
+	}
+	user.UserID = newID
+	m.db.users[newID] = user
+	delete(m.db.users, oldID)
+	if secret, found := m.db.secrets[oldID]; found {
+		m.db.secrets[newID] = secret
+		delete(m.db.secrets, oldID)
+	}
+	if history, found := m.db.history[oldID]; found {
+		m.db.history[newID] = history
+		delete(m.db.history, oldID)
+	}
+	if tf, found := m.db.twoFactor[oldID]; found {
+		tf.UserID = newID
+		m.db.twoFactor[newID] = tf
+		delete(m.db.twoFactor, oldID)
+	}
+	for _, rt := range m.db.pwdReset {
+		if rt.UserID == oldID {
+			rt.UserID = newID
+		}
+	}
+	for _, token := range m.db.refresh {
+		if token.UserID == oldID {
+			token.UserID = newID
+		}
+	}
+	for _, key := range m.db.apiKeys {
+		if key.UserID == oldID {
+			key.UserID = newID
+		}
+	}
+	for _, group := range m.db.groups {
+		if hasString(group.Users, oldID) {
+			group.Users = append(without(group.Users, oldID), newID)
+		}
+	}
+	for _, invite := range m.db.invites {
+		if invite.CreatedBy == oldID {
+			invite.CreatedBy = newID
+		}
+	}
+	for _, event := range m.db.events {
+		if event.UserID == oldID {
+			event.UserID = newID
+		}
+		if event.RealUserID == oldID {
+			event.RealUserID = newID
+		}
+	}
+	return err
+}
+
+//SetEmails - updates encrypted email and email index of users
+func (m *userStorage) SetEmails(
+	gtx context.Context, users []*teak.User) (err error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	for _, user := range users {
+		if m.emailTaken(user.UserID, user.EmailIndex) {
+			return teak.ErrEmailExists
+		}
+	}
+	for _, user := range users {
+		if stored, found := m.db.users[user.UserID]; found {
+			stored.Email = user.Email
+			stored.EmailIndex = user.EmailIndex
+		}
+	}
+	return err
+}
+
+//GetUserByEmail - gets the user whose email index matches the email
+func (m *userStorage) GetUserByEmail(
+	gtx context.Context, email string) (user *teak.User, err error) {
+	index, err := teak.EmailIndex(email)
+	if err != nil {
+		return nil, teak.LogError("t.user.mem", err)
+	}
+	m.db.RLock()
+	defer m.db.RUnlock()
+	for _, stored := range m.db.users {
+		if stored.EmailIndex == index {
+			cpy := *stored
+			return &cpy, err
+		}
+	}
+	return nil, fmt.Errorf("Could not find user with given email")
+}
+
+//GetUser - gets details of the user corresponding to ID
+func (m *userStorage) GetUser(
+	gtx context.Context, userID string) (user *teak.User, err error) {
+	m.db.RLock()
+	defer m.db.RUnlock()
+	stored, err := m.getUser(userID)
+	if err != nil {
+		return nil, teak.LogError("t.user.mem", err)
+	}
+	cpy := *stored
+	return &cpy, err
+}
+
+//GetUsers - gets all users based on offset, limit and filter
+func (m *userStorage) GetUsers(
+	gtx context.Context,
+	offset, limit int64,
+	filter *teak.Filter) (users []*teak.User, err error) {
+	_, users, err = m.GetUsersWithCount(gtx, offset, limit, filter)
+	return users, err
+}
+
+//GetCount - gives the number of user selected by given filter
+func (m *userStorage) GetCount(
+	gtx context.Context, filter *teak.Filter) (count int64, err error) {
+	m.db.RLock()
+	defer m.db.RUnlock()
+	records, err := m.userRecords()
+	if err != nil {
+		return count, teak.LogError("t.user.mem", err)
+	}
+	count = int64(len(selectRecords(records, filter)))
+	return count, err
+}
+
+//GetUsersWithCount - Get users with total count
+func (m *userStorage) GetUsersWithCount(
+	gtx context.Context,
+	offset, limit int64,
+	filter *teak.Filter) (total int64, users []*teak.User, err error) {
+	m.db.RLock()
+	defer m.db.RUnlock()
+	records, err := m.userRecords()
+	if err != nil {
+		return total, users, teak.LogError("t.user.mem", err)
+	}
+	selected := selectRecords(records, filter)
+	sortRecords(selected, "-createdAt")
+	paged := page(selected, offset, limit)
+	users = make([]*teak.User, 0, len(paged))
+	err = fromRecord(paged, &users)
+	//Email index is not part of the records, as it is not serialized
+	for _, user := range users {
+		if stored, found := m.db.users[user.UserID]; found {
+			user.EmailIndex = stored.EmailIndex
+		}
+	}
+	return int64(len(selected)), users, teak.LogError("t.user.mem", err)
+}
+
+//userRecords - gives users as generic records so that filters can be applied,
+//the caller should hold the store lock
+func (m *userStorage) userRecords() (records []teak.M, err error) {
+	records = make([]teak.M, 0, len(m.db.users))
+	for _, user := range m.db.users {
+		var rec teak.M
+		if rec, err = toRecord(user); err != nil {
+			break
+		}
+		records = append(records, rec)
+	}
+	//Map iteration order is random, keep the order stable
+	sortRecords(records, "userID")
+	return records, err
+}
+
+//ResetPassword - sets password of a unauthenticated user
+func (m *userStorage) ResetPassword(
+	gtx context.Context,
+	userID, oldPwd, newPwd string) (err error) {
+	if err = m.ValidateUser(gtx, userID, oldPwd); err != nil {
+		err = teak.LogErrorX("t.user.mem",
+			"Reset password: Invalid current password given for userID %s",
+			err, userID)
+		return err
+	}
+	return m.SetPassword(gtx, userID, newPwd)
+}
+
+//SetPassword - sets password of a already authenticated user, old password
+//is not required. The password policy is enforced and the password expiry of
+//the user is updated
+func (m *userStorage) SetPassword(
+	gtx context.Context, userID, newPwd string) (err error) {
+	defer func() {
+		err = teak.LogErrorX("t.user.mem",
+			"Failed to set password for user %s", err, userID)
+	}()
+	m.db.Lock()
+	defer m.db.Unlock()
+	user, err := m.getUser(userID)
+	if err != nil {
+		return err
+	}
+	previous := m.db.history[userID]
+	if phash, found := m.db.secrets[userID]; found && len(previous) == 0 {
+		previous = []string{phash}
+	}
+	policy := teak.GetPasswordPolicy()
+	if err = policy.Check(newPwd, previous); err != nil {
+		return err
+	}
+	newHash, err := passlib.Hash(newPwd)
+	if err != nil {
+		return err
+	}
+	m.db.secrets[userID] = newHash
+	m.db.history[userID] = policy.NextHistory(newHash, previous)
+	user.PwdExpiry = policy.Expiry(time.Now())
+	return err
+}
+
+//ValidateUser - validates user ID and password
+func (m *userStorage) ValidateUser(
+	gtx context.Context, userID, password string) (err error) {
+	defer func() {
+		err = teak.LogErrorX("t.user.mem",
+			"Failed to validate user with id %s", err, userID)
+	}()
+	m.db.Lock()
+	defer m.db.Unlock()
+	phash, found := m.db.secrets[userID]
+	if !found {
+		err = errors.New("No password set for user")
+		return err
+	}
+	newHash, err := passlib.Verify(password, phash)
+	if err != nil {
+		return err
+	}
+	if newHash != "" {
+		m.db.secrets[userID] = newHash
+	}
+	return err
+}
+
+//GetUserAuthLevel - gets user authorization level
+func (m *userStorage) GetUserAuthLevel(
+	gtx context.Context,
+	userID string) (level teak.AuthLevel, err error) {
+	m.db.RLock()
+	defer m.db.RUnlock()
+	user, err := m.getUser(userID)
+	if err != nil {
+		return teak.Public, teak.LogErrorX("t.user.mem",
+			"Failed to retrieve auth level for '%s'", err, userID)
+	}
+	return user.Auth, err
+}
+
+//SetAuthLevel - sets the auth level for the user
+func (m *userStorage) SetAuthLevel(
+	gtx context.Context,
+	userID string,
+	authLevel teak.AuthLevel) (err error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	if err = m.validateForSuper(authLevel); err != nil {
+		return err
+	}
+	user, err := m.getUser(userID)
+	if err != nil {
+		return teak.LogErrorX("t.user.mem",
+			"Failed to update auth level for user with ID '%s'", err, userID)
+	}
+	user.Auth = authLevel
+	return err
+}
+
+//validateForSuper - checks if another super user can be created, the caller
+//should hold the store lock
+func (m *userStorage) validateForSuper(alevel teak.AuthLevel) (err error) {
+	if alevel != teak.Super {
+		return err
+	}
+	numSuper := 0
+	for _, user := range m.db.users {
+		if user.Auth == teak.Super {
+			numSuper++
+		}
+	}
+	if numSuper >= 5 {
+		err = teak.Error("t.user.mem",
+			"Maximum limit for super admins reached")
+	}
+	return err
+}
+
+//SetUserState - sets state of an user account
+func (m *userStorage) SetUserState(
+	gtx context.Context,
+	userID string,
+	state teak.UserState) (err error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	user, err := m.getUser(userID)
+	if err != nil {
+		return teak.LogErrorX("t.user.mem",
+			"Failed to update state for user with ID '%s'", err, userID)
+	}
+	user.State = state
+	return err
+}
+
+//VerifyUser - sets state of an user account to verified based on userID
+//and verification ID
+func (m *userStorage) VerifyUser(
+	gtx context.Context, userID, verID string) (err error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	user, err := m.getUser(userID)
+	if err == nil && user.VerID != verID {
+		err = errors.New("Invalid verification ID given")
+	}
+	if err != nil {
+		return teak.LogErrorX("t.user.mem",
+			"Failed to verify user with id %s", err, userID)
+	}
+	user.State = teak.Active
+	user.VerfiedAt = time.Now()
+	user.VerID = ""
+	return err
+}
+
+//UpdateProfile - updates user details - this should be used when user logged in
+//is updating own user account
+func (m *userStorage) UpdateProfile(
+	gtx context.Context, user *teak.User) (err error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	stored, err := m.getUser(user.UserID)
+	if err != nil {
+		return teak.LogError("t.user.mem", err)
+	}
+	if m.emailTaken(user.UserID, user.EmailIndex) {
+		return teak.ErrEmailExists
+	}
+	stored.Email = user.Email
+	stored.EmailIndex = user.EmailIndex
+	stored.FirstName = user.FirstName
+	stored.LastName = user.LastName
+	stored.Title = user.Title
+	stored.FullName = user.FirstName + " " + user.LastName
+	stored.ModifiedAt = time.Now()
+	stored.ModifiedBy = stored.FullName
+	return err
+}
@@ -0,0 +1,190 @@
+package teak
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	echo "github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+//Metrics are registered with the default prometheus registry, so that the
+//applications can add their own metrics with promauto
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "teak",
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests handled",
+	}, []string{"category", "method", "route", "status"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "teak",
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to handle HTTP requests",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"category", "method", "route", "status"})
+
+	storageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "teak",
+		Name:      "storage_operation_duration_seconds",
+		Help:      "Time taken by data and user storage operations",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"storage", "op"})
+
+	storageErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "teak",
+		Name:      "storage_errors_total",
+		Help:      "Number of data and user storage operations that failed",
+	}, []string{"storage", "op"})
+
+	logins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "teak",
+		Name:      "logins_total",
+		Help:      "Number of login attempts by login step and result",
+	}, []string{"op", "result"})
+
+	auditQueueDepth = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "teak",
+		Name:      "audit_queue_depth",
+		Help:      "Number of audit events waiting to be written",
+	}, func() float64 {
+		return float64(len(auditQueue.items))
+	})
+)
+
+//routeCategories - category of the endpoints keyed by method and route, used
+//for labelling the request metrics. Requests to other routes are labelled as
+//unmatched
+var routeCategories = make(map[string]string)
+
+//metricMethods - HTTP methods that are used as labels as they are, other
+//methods are labelled as other so that clients can not create new series
+var metricMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+//MetricsConfig - configuration of the metrics endpoint, read from 'metrics' key
+//of the app config. Access is one of 'public', 'monitor', 'port' and 'none'.
+//With 'public' metrics are served from '/metrics' without authentication,
+//with 'monitor' they are served from 'in/r3/metrics' of the API root to users
+//with Monitor or higher access level. With 'port' they are served from
+//'/metrics' of a separate HTTP server listening on Port, access to it should
+//be restricted by the network. Metrics are collected even with 'none', the
+//default is 'monitor'
+type MetricsConfig struct {
+	Access string `json:"access"`
+	Port   int    `json:"port"`
+}
+
+//GetMetricsConfig - gives the metrics configuration with defaults applied
+func GetMetricsConfig() (mc MetricsConfig) {
+	GetConfig("metrics", &mc)
+	if mc.Access == "" {
+		mc.Access = "monitor"
+	}
+	return mc
+}
+
+//metricsServer - gives the server that serves metrics on a separate port,
+//nil if metrics are not served on a separate port
+func metricsServer(mc *MetricsConfig) (srv *http.Server, err error) {
+	switch mc.Access {
+	case "public", "monitor", "none":
+		return srv, err
+	case "port":
+		if mc.Port <= 0 {
+			return srv, fmt.Errorf("Invalid metrics port %d", mc.Port)
+		}
+	default:
+		return srv, fmt.Errorf("Invalid metrics access '%s'", mc.Access)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv = &http.Server{
+		Addr:    fmt.Sprintf(":%d", mc.Port),
+		Handler: mux,
+	}
+	return srv, err
+}
+
+//metricsEndpoint - endpoint for getting the metrics with Monitor access level
+func metricsEndpoint() *Endpoint {
+	return &Endpoint{
+		Method:   echo.GET,
+		URL:      "metrics",
+		Access:   Monitor,
+		Category: "monitoring",
+		Func:     echo.WrapHandler(promhttp.Handler()),
+		Comment:  "Get metrics in prometheus format",
+	}
+}
+
+//metricsMiddleware - records count and duration of requests. Routes are used
+//as labels instead of paths so that the number of series stays bounded, echo
+//gives the path as route for requests that do not match any route. Methods
+//are bounded the same way
+func metricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) (err error) {
+		start := time.Now()
+		err = next(ctx)
+		//Error handler runs after the middleware, so the status it would
+		//send is derived from the error
+		status := ctx.Response().Status
+		if err != nil && !ctx.Response().Committed {
+			status = http.StatusInternalServerError
+			if he, ok := err.(*echo.HTTPError); ok {
+				status = he.Code
+			}
+		}
+		method := ctx.Request().Method
+		route := ctx.Path()
+		category, found := routeCategories[method+" "+route]
+		if !found {
+			route = "unmatched"
+		}
+		if !metricMethods[method] {
+			method = "other"
+		}
+		labels := prometheus.Labels{
+			"category": category,
+			"method":   method,
+			"route":    route,
+			"status":   strconv.Itoa(status),
+		}
+		httpRequests.With(labels).Inc()
+		httpDuration.With(labels).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+//observeStorage - records duration of a storage operation and its failure,
+//meant to be deferred with the address of operation's error
+func observeStorage(storage, op string, start time.Time, err *error) {
+	storageDuration.WithLabelValues(storage, op).Observe(
+		time.Since(start).Seconds())
+	if *err != nil {
+		storageErrors.WithLabelValues(storage, op).Inc()
+	}
+}
+
+//countLogin - records result of a login step, op is the audit operation of
+//the step
+func countLogin(op string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	logins.WithLabelValues(op, result).Inc()
+}
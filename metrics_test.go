@@ -0,0 +1,97 @@
+package teak
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	echo "github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+//gatedAuditor - auditor that holds every event till it is released
+type gatedAuditor struct {
+	NoOpAuditor
+	received chan string
+	release  chan struct{}
+}
+
+func (ga *gatedAuditor) LogEvent(event *Event) {
+	ga.received <- event.Op
+	<-ga.release
+}
+
+func TestAuditQueueDepth(t *testing.T) {
+	gtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := FlushAuditEvents(gtx); err != nil {
+		t.Fatalf("Failed to flush earlier events: %v", err)
+	}
+	auditor := &gatedAuditor{
+		received: make(chan string, 3),
+		release:  make(chan struct{}),
+	}
+	prev := eventAuditor
+	SetEventAuditor(auditor)
+	defer SetEventAuditor(prev)
+
+	for _, op := range []string{"first", "second", "third"} {
+		LogEventX(&Event{Op: op})
+	}
+	//The first event is being written, the others wait in the queue
+	if op := <-auditor.received; op != "first" {
+		t.Fatalf("Expected first event to be written first, got %s", op)
+	}
+	if depth := testutil.ToFloat64(auditQueueDepth); depth != 2 {
+		t.Errorf("Expected audit queue depth 2, got %v", depth)
+	}
+	close(auditor.release)
+	if err := FlushAuditEvents(gtx); err != nil {
+		t.Fatalf("Failed to flush audit events: %v", err)
+	}
+	for _, expected := range []string{"second", "third"} {
+		if op := <-auditor.received; op != expected {
+			t.Errorf("Expected event %s, got %s", expected, op)
+		}
+	}
+	if depth := testutil.ToFloat64(auditQueueDepth); depth != 0 {
+		t.Errorf("Expected empty audit queue after flush, got %v", depth)
+	}
+}
+
+func TestMetricsMiddlewareLabels(t *testing.T) {
+	e := echo.New()
+	e.Use(metricsMiddleware)
+	e.GET("/things", func(ctx echo.Context) error {
+		return ctx.NoContent(http.StatusOK)
+	})
+	routeCategories["GET /things"] = "test"
+	defer delete(routeCategories, "GET /things")
+	requests := func(category, method, route, status string) float64 {
+		return testutil.ToFloat64(httpRequests.With(prometheus.Labels{
+			"category": category,
+			"method":   method,
+			"route":    route,
+			"status":   status,
+		}))
+	}
+	matched := requests("test", "GET", "/things", "200")
+	unknown := requests("", "other", "unmatched", "404")
+	for _, method := range []string{http.MethodGet, "FOO", "BAR"} {
+		path := "/things"
+		if method != http.MethodGet {
+			path = "/random/path/" + method
+		}
+		req := httptest.NewRequest(method, path, nil)
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if n := requests("test", "GET", "/things", "200") - matched; n != 1 {
+		t.Errorf("Expected 1 request on matched route, got %v", n)
+	}
+	if n := requests("", "other", "unmatched", "404") - unknown; n != 2 {
+		t.Errorf("Expected 2 unmatched requests with other method, got %v", n)
+	}
+}
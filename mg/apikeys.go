@@ -0,0 +1,97 @@
+package mg
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/varunamachi/teak"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//apiKeyDoc - mongo representation of teak.APIKey
+type apiKeyDoc struct {
+	ID        string         `bson:"_id"`
+	UserID    string         `bson:"userID"`
+	Name      string         `bson:"name"`
+	Hash      string         `bson:"hash"`
+	Auth      teak.AuthLevel `bson:"auth"`
+	CreatedAt time.Time      `bson:"createdAt"`
+	ExpiresAt time.Time      `bson:"expiresAt"`
+}
+
+func (doc *apiKeyDoc) toAPIKey() *teak.APIKey {
+	return &teak.APIKey{
+		ID:        doc.ID,
+		UserID:    doc.UserID,
+		Name:      doc.Name,
+		Hash:      doc.Hash,
+		Auth:      doc.Auth,
+		CreatedAt: doc.CreatedAt,
+		ExpiresAt: doc.ExpiresAt,
+	}
+}
+
+//CreateAPIKey - stores an API key in 'apiKeys' collection
+func (m *userStorage) CreateAPIKey(
+	gtx context.Context, key *teak.APIKey) (err error) {
+	_, err = C("apiKeys").InsertOne(gtx, &apiKeyDoc{
+		ID:        key.ID,
+		UserID:    key.UserID,
+		Name:      key.Name,
+		Hash:      key.Hash,
+		Auth:      key.Auth,
+		CreatedAt: key.CreatedAt,
+		ExpiresAt: key.ExpiresAt,
+	})
+	return teak.LogErrorX("t.user.mongo", "Failed to create API key", err)
+}
+
+//GetAPIKey - gets the API key with given hash
+func (m *userStorage) GetAPIKey(
+	gtx context.Context, keyHash string) (key *teak.APIKey, err error) {
+	var doc apiKeyDoc
+	err = C("apiKeys").FindOne(gtx, bson.M{"hash": keyHash}).Decode(&doc)
+	if err != nil {
+		return nil, teak.LogErrorX("t.user.mongo",
+			"Failed to retrieve API key", err)
+	}
+	return doc.toAPIKey(), err
+}
+
+//GetAPIKeys - gets all the API keys of an user, latest first
+func (m *userStorage) GetAPIKeys(
+	gtx context.Context, userID string) (keys []*teak.APIKey, err error) {
+	keys = make([]*teak.APIKey, 0, 10)
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+	cur, err := C("apiKeys").Find(gtx, bson.M{"userID": userID}, opts)
+	if err != nil {
+		return keys, teak.LogErrorX("t.user.mongo",
+			"Failed to retrieve API keys of user %s", err, userID)
+	}
+	defer cur.Close(gtx)
+	for cur.Next(gtx) {
+		var doc apiKeyDoc
+		if err = cur.Decode(&doc); err != nil {
+			break
+		}
+		keys = append(keys, doc.toAPIKey())
+	}
+	if err == nil {
+		err = cur.Err()
+	}
+	return keys, teak.LogErrorX("t.user.mongo",
+		"Failed to retrieve API keys of user %s", err, userID)
+}
+
+//DeleteAPIKey - deletes the API key with given ID that belongs to the user
+func (m *userStorage) DeleteAPIKey(
+	gtx context.Context, userID, keyID string) (err error) {
+	res, err := C("apiKeys").DeleteOne(gtx,
+		bson.M{"_id": keyID, "userID": userID})
+	if err == nil && res.DeletedCount == 0 {
+		err = fmt.Errorf("Could not find API key with ID '%s'", keyID)
+	}
+	return teak.LogErrorX("t.user.mongo", "Failed to delete API key", err)
+}
@@ -0,0 +1,80 @@
+package mg
+
+import (
+	"context"
+	"time"
+
+	"github.com/varunamachi/teak"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//attemptDoc - failures of a key in 'loginAttempts' collection
+type attemptDoc struct {
+	Key      string    `bson:"_id"`
+	Failures int       `bson:"failures"`
+	Last     time.Time `bson:"last"`
+}
+
+//attemptCounter - teak.AttemptCounter that keeps the counts in mongo so that
+//all the nodes of a cluster see the same counts
+type attemptCounter struct{}
+
+//NewAttemptCounter - creates an attempt counter backed by mongo
+func NewAttemptCounter() teak.AttemptCounter {
+	return &attemptCounter{}
+}
+
+//Fail - records a failed attempt for the key and gives the number of
+//consecutive failures. The count starts again if the last failure is older
+//than window
+func (ac *attemptCounter) Fail(
+	gtx context.Context, key string, window time.Duration) (
+	failures int, err error) {
+	now := time.Now()
+	cutoff := now.Add(-window)
+	_, err = C("loginAttempts").DeleteMany(gtx,
+		bson.M{"last": bson.M{"$lt": cutoff}})
+	if err != nil {
+		return failures, teak.LogErrorX("t.mongo.store",
+			"Failed to record failed attempt", err)
+	}
+	var doc attemptDoc
+	err = C("loginAttempts").FindOneAndUpdate(gtx,
+		bson.M{"_id": key},
+		bson.M{
+			"$inc": bson.M{"failures": 1},
+			"$set": bson.M{"last": now},
+		},
+		options.FindOneAndUpdate().
+			SetUpsert(true).
+			SetReturnDocument(options.After)).Decode(&doc)
+	return doc.Failures, teak.LogErrorX("t.mongo.store",
+		"Failed to record failed attempt", err)
+}
+
+//Failures - gives the number of consecutive failures for the key and the time
+//of last failure
+func (ac *attemptCounter) Failures(
+	gtx context.Context, key string, window time.Duration) (
+	failures int, last time.Time, err error) {
+	var doc attemptDoc
+	err = C("loginAttempts").FindOne(gtx, bson.M{
+		"_id":  key,
+		"last": bson.M{"$gte": time.Now().Add(-window)},
+	}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		err = nil
+	}
+	return doc.Failures, doc.Last, teak.LogErrorX("t.mongo.store",
+		"Failed to get failed attempts", err)
+}
+
+//Clear - forgets the failures of the key
+func (ac *attemptCounter) Clear(
+	gtx context.Context, key string) (err error) {
+	_, err = C("loginAttempts").DeleteOne(gtx, bson.M{"_id": key})
+	return teak.LogErrorX("t.mongo.store",
+		"Failed to clear failed attempts", err)
+}
@@ -13,7 +13,7 @@ func NewDefaultApp(
 	appVersion teak.Version,
 	apiVersion int,
 	desc string) *teak.App {
-	return teak.NewApp(
+	app := teak.NewApp(
 		name,
 		appVersion,
 		apiVersion,
@@ -23,6 +23,9 @@ func NewDefaultApp(
 		NewUserStorage(),
 		NewStorage(),
 	)
+	teak.SetEventAuditor(NewAuditor())
+	teak.SetAttemptCounter(NewAttemptCounter())
+	return app
 }
 
 //mongoFlags - flags to get mongo connection options
@@ -0,0 +1,150 @@
+package mg
+
+import (
+	"context"
+	"time"
+
+	"github.com/varunamachi/teak"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//eventDoc - mongo representation of teak.Event, field names are same as JSON
+//names of teak.Event so that filters work as expected
+type eventDoc struct {
+	Op           string      `bson:"op"`
+	UserID       string      `bson:"userID"`
+	UserName     string      `bson:"userName"`
+	RealUserID   string      `bson:"realUserID,omitempty"`
+	RealUserName string      `bson:"realUserName,omitempty"`
+	Success      bool        `bson:"success"`
+	Error        string      `bson:"error"`
+	Time         time.Time   `bson:"time"`
+	Data         interface{} `bson:"data"`
+}
+
+//eventAuditor - mongodb based event auditor, events are stored in 'events'
+//collection
+type eventAuditor struct {
+	retention time.Duration
+}
+
+//NewAuditor - creates a new mongodb based event auditor. If the config has
+//'mongo.eventRetentionDays' set, events older than that are removed by
+//mongodb automatically
+func NewAuditor() teak.EventAuditor {
+	return &eventAuditor{}
+}
+
+//NewAuditorWithRetention - creates a new mongodb based event auditor which
+//keeps the events for given duration, a retention of zero keeps the events
+//forever
+func NewAuditorWithRetention(retention time.Duration) teak.EventAuditor {
+	return &eventAuditor{
+		retention: retention,
+	}
+}
+
+//LogEvent - logs given event into events collection. Failure to log the event
+//is logged but not propagated
+func (ea *eventAuditor) LogEvent(event *teak.Event) {
+	_, err := C("events").InsertOne(context.Background(), &eventDoc{
+		Op:           event.Op,
+		UserID:       event.UserID,
+		UserName:     event.UserName,
+		RealUserID:   event.RealUserID,
+		RealUserName: event.RealUserName,
+		Success:      event.Success,
+		Error:        event.Error,
+		Time:         event.Time,
+		Data:         event.Data,
+	})
+	teak.LogErrorX("t.mongo.event", "Failed to log event %s", err, event.Op)
+}
+
+//GetEvents - retrieves event entries based on filters, latest events come
+//first
+func (ea *eventAuditor) GetEvents(
+	offset, limit int64,
+	filter *teak.Filter) (total int64, events []*teak.Event, err error) {
+	gtx := context.Background()
+	//Negative skip is an error and negative limit is a single batch in mongo,
+	//both are treated like the ones not given
+	if offset < 0 {
+		offset = 0
+	}
+	if limit < 0 {
+		limit = 0
+	}
+	selector := GenerateSelector(filter)
+	total, err = C("events").CountDocuments(gtx, selector)
+	if err != nil {
+		return total, events, logMongoError("t.mongo.event", err)
+	}
+	fopts := options.Find().
+		SetSkip(offset).
+		SetLimit(limit).
+		SetSort(GetSort("-time"))
+	cur, err := C("events").Find(gtx, selector, fopts)
+	if err != nil {
+		return total, events, logMongoError("t.mongo.event", err)
+	}
+	docs := make([]*eventDoc, 0, limit)
+	if err = ReadAllAndClose(gtx, cur, &docs); err != nil {
+		return total, events, logMongoError("t.mongo.event", err)
+	}
+	events = make([]*teak.Event, 0, len(docs))
+	for _, doc := range docs {
+		events = append(events, &teak.Event{
+			Op:           doc.Op,
+			UserID:       doc.UserID,
+			UserName:     doc.UserName,
+			RealUserID:   doc.RealUserID,
+			RealUserName: doc.RealUserName,
+			Success:      doc.Success,
+			Error:        doc.Error,
+			Time:         doc.Time,
+			Data:         doc.Data,
+		})
+	}
+	return total, events, err
+}
+
+//CreateIndices - creates indices on op, userID and time fields. If retention
+//is configured the index on time is a TTL index. Changing the retention
+//requires dropping the existing index on time
+func (ea *eventAuditor) CreateIndices() (err error) {
+	retention := ea.retention
+	var days int
+	if retention == 0 && teak.GetConfig("mongo.eventRetentionDays", &days) {
+		retention = time.Duration(days) * 24 * time.Hour
+	}
+	timeOpts := options.Index().SetName("time")
+	if retention > 0 {
+		timeOpts.SetExpireAfterSeconds(int32(retention.Seconds()))
+	}
+	_, err = C("events").Indexes().CreateMany(
+		context.Background(),
+		[]mongo.IndexModel{
+			{
+				Keys:    bson.D{{Key: "op", Value: 1}},
+				Options: options.Index().SetName("op"),
+			},
+			{
+				Keys:    bson.D{{Key: "userID", Value: 1}},
+				Options: options.Index().SetName("userID"),
+			},
+			{
+				Keys:    bson.D{{Key: "time", Value: -1}},
+				Options: timeOpts,
+			},
+		})
+	return teak.LogErrorX("t.mongo.event", "Failed to create event indices", err)
+}
+
+//CleanData - deletes all the events
+func (ea *eventAuditor) CleanData() (err error) {
+	_, err = C("events").DeleteMany(context.Background(), bson.M{})
+	return teak.LogErrorX("t.mongo.event", "Failed to delete events", err)
+}
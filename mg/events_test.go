@@ -0,0 +1,111 @@
+package mg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/varunamachi/teak"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+//useMockClient - makes the client connected to the mock deployment the one
+//used by the store
+func useMockClient(mt *mtest.T) (restore func()) {
+	prev := mongoStore
+	mongoStore = &store{client: mt.Client}
+	return func() { mongoStore = prev }
+}
+
+//intOf - gives the value of a numeric field irrespective of its BSON type
+func intOf(val bson.RawValue) (num int64, ok bool) {
+	if num32, ok := val.Int32OK(); ok {
+		return int64(num32), ok
+	}
+	if num, ok = val.Int64OK(); ok {
+		return num, ok
+	}
+	flt, ok := val.DoubleOK()
+	return int64(flt), ok
+}
+
+func TestEventAuditor(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("indices with retention", func(mt *mtest.T) {
+		defer useMockClient(mt)()
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		auditor := NewAuditorWithRetention(30 * 24 * time.Hour)
+		if err := auditor.CreateIndices(); err != nil {
+			mt.Fatalf("Failed to create indices: %v", err)
+		}
+		cmd := mt.GetStartedEvent().Command
+		indices, _ := cmd.Lookup("indexes").Array().Values()
+		if len(indices) != 3 {
+			mt.Fatalf("Expected 3 indices, got %d", len(indices))
+		}
+		for _, val := range indices {
+			index := val.Document()
+			name := index.Lookup("name").StringValue()
+			ttl, hasTTL := intOf(index.Lookup("expireAfterSeconds"))
+			if name == "time" && (!hasTTL || ttl != 30*24*3600) {
+				mt.Errorf("Expected TTL of 30 days on time index, got %d", ttl)
+			}
+			if name != "time" && hasTTL {
+				mt.Errorf("Expected no TTL on %s index", name)
+			}
+		}
+	})
+
+	mt.Run("get events", func(mt *mtest.T) {
+		defer useMockClient(mt)()
+		at := time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)
+		ns := defaultDB + ".events"
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, ns, mtest.FirstBatch,
+				bson.D{{Key: "n", Value: 7}}),
+			mtest.CreateCursorResponse(0, ns, mtest.FirstBatch, bson.D{
+				{Key: "op", Value: "user.login"},
+				{Key: "userID", Value: "u1"},
+				{Key: "realUserID", Value: "s1"},
+				{Key: "success", Value: true},
+				{Key: "time", Value: at},
+				{Key: "data", Value: bson.D{{Key: "attempt", Value: 3}}},
+			}),
+		)
+		filter := &teak.Filter{Props: map[string]teak.Matcher{
+			"userID": {Fields: []interface{}{"u1"}},
+		}}
+		total, events, err := NewAuditor().GetEvents(-5, 10, filter)
+		if err != nil {
+			mt.Fatalf("Failed to get events: %v", err)
+		}
+		if total != 7 || len(events) != 1 {
+			mt.Fatalf("Expected 1 of 7 events, got %d of %d",
+				len(events), total)
+		}
+		event := events[0]
+		if event.Op != "user.login" || event.UserID != "u1" ||
+			event.RealUserID != "s1" || !event.Success ||
+			!event.Time.Equal(at) {
+			mt.Errorf("Unexpected event %+v", event)
+		}
+
+		//First command is the aggregation for the count
+		mt.GetStartedEvent()
+		find := mt.GetStartedEvent().Command
+		if find.Lookup("find").StringValue() != "events" {
+			mt.Fatalf("Expected find on events, got %v", find)
+		}
+		if skip, ok := intOf(find.Lookup("skip")); ok && skip != 0 {
+			mt.Errorf("Expected negative offset to be ignored, skip %d", skip)
+		}
+		if limit, _ := intOf(find.Lookup("limit")); limit != 10 {
+			mt.Errorf("Expected limit 10, got %d", limit)
+		}
+		if order, _ := intOf(find.Lookup("sort", "time")); order != -1 {
+			mt.Errorf("Expected latest events first, sort %d", order)
+		}
+	})
+}
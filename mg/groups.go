@@ -0,0 +1,148 @@
+package mg
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/varunamachi/teak"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//groupDoc - mongo representation of teak.Group, the group name is used as the
+//document ID
+type groupDoc struct {
+	Name      string    `bson:"_id"`
+	Users     []string  `bson:"users"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+//checkUsers - checks if all the given users exist
+func checkUsers(gtx context.Context, userIDs []string) (err error) {
+	if len(userIDs) == 0 {
+		return err
+	}
+	count, err := C("users").CountDocuments(gtx,
+		bson.M{userIDKey: bson.M{"$in": userIDs}})
+	if err == nil && count != int64(len(unique(userIDs))) {
+		err = fmt.Errorf("Some of the given users do not exist")
+	}
+	return err
+}
+
+func unique(list []string) (uniq []string) {
+	seen := make(map[string]bool)
+	uniq = make([]string, 0, len(list))
+	for _, item := range list {
+		if !seen[item] {
+			seen[item] = true
+			uniq = append(uniq, item)
+		}
+	}
+	return uniq
+}
+
+//CreateGroup - creates a group with given members in 'groups' collection
+func (m *userStorage) CreateGroup(
+	gtx context.Context, group *teak.Group) (err error) {
+	if err = checkUsers(gtx, group.Users); err == nil {
+		_, err = C("groups").InsertOne(gtx, &groupDoc{
+			Name:      group.Name,
+			Users:     unique(group.Users),
+			CreatedAt: time.Now(),
+		})
+	}
+	return teak.LogErrorX("t.user.mongo",
+		"Failed to create group %s", err, group.Name)
+}
+
+//GetGroup - gets the group with given name along with its members
+func (m *userStorage) GetGroup(
+	gtx context.Context, name string) (group *teak.Group, err error) {
+	var doc groupDoc
+	err = C("groups").FindOne(gtx, bson.M{"_id": name}).Decode(&doc)
+	if err != nil {
+		return nil, teak.LogErrorX("t.user.mongo",
+			"Failed to retrieve group %s", err, name)
+	}
+	group = &teak.Group{Name: doc.Name, Users: doc.Users}
+	return group, err
+}
+
+//GetGroups - gets all the groups along with their members
+func (m *userStorage) GetGroups(
+	gtx context.Context) (groups []*teak.Group, err error) {
+	docs := make([]*groupDoc, 0, 100)
+	cur, err := C("groups").Find(gtx, bson.M{},
+		options.Find().SetSort(bson.M{"_id": 1}))
+	if err == nil {
+		defer cur.Close(gtx)
+		err = cur.All(gtx, &docs)
+	}
+	if err != nil {
+		return groups, teak.LogErrorX("t.user.mongo",
+			"Failed to retrieve groups", err)
+	}
+	groups = make([]*teak.Group, 0, len(docs))
+	for _, doc := range docs {
+		groups = append(groups, &teak.Group{Name: doc.Name, Users: doc.Users})
+	}
+	return groups, err
+}
+
+//DeleteGroup - deletes the group with given name
+func (m *userStorage) DeleteGroup(
+	gtx context.Context, name string) (err error) {
+	res, err := C("groups").DeleteOne(gtx, bson.M{"_id": name})
+	if err == nil && res.DeletedCount != 1 {
+		err = fmt.Errorf("Could not find group with name '%s'", name)
+	}
+	return teak.LogErrorX("t.user.mongo", "Failed to delete group %s", err, name)
+}
+
+//AddGroupMembers - adds the users to the group, users who are already members
+//are ignored
+func (m *userStorage) AddGroupMembers(
+	gtx context.Context, name string, userIDs []string) (err error) {
+	if err = checkUsers(gtx, userIDs); err == nil {
+		var res *mongo.UpdateResult
+		res, err = C("groups").UpdateOne(gtx, bson.M{"_id": name}, bson.M{
+			"$addToSet": bson.M{"users": bson.M{"$each": userIDs}},
+		})
+		if err == nil && res.MatchedCount != 1 {
+			err = fmt.Errorf("Could not find group with name '%s'", name)
+		}
+	}
+	return teak.LogErrorX("t.user.mongo",
+		"Failed to add members to group %s", err, name)
+}
+
+//RemoveGroupMembers - removes the users from the group
+func (m *userStorage) RemoveGroupMembers(
+	gtx context.Context, name string, userIDs []string) (err error) {
+	_, err = C("groups").UpdateOne(gtx, bson.M{"_id": name}, bson.M{
+		"$pull": bson.M{"users": bson.M{"$in": userIDs}},
+	})
+	return teak.LogErrorX("t.user.mongo",
+		"Failed to remove members from group %s", err, name)
+}
+
+//GetUserGroups - gives names of the groups the user is member of
+func (m *userStorage) GetUserGroups(
+	gtx context.Context, userID string) (groups []string, err error) {
+	docs := make([]*groupDoc, 0, 10)
+	cur, err := C("groups").Find(gtx, bson.M{"users": userID},
+		options.Find().SetSort(bson.M{"_id": 1}))
+	if err == nil {
+		defer cur.Close(gtx)
+		err = cur.All(gtx, &docs)
+	}
+	groups = make([]string, 0, len(docs))
+	for _, doc := range docs {
+		groups = append(groups, doc.Name)
+	}
+	return groups, teak.LogErrorX("t.user.mongo",
+		"Failed to retrieve groups of user %s", err, userID)
+}
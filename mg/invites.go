@@ -0,0 +1,104 @@
+package mg
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/varunamachi/teak"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//inviteDoc - mongo representation of teak.Invite
+type inviteDoc struct {
+	ID        string         `bson:"_id"`
+	Hash      string         `bson:"hash"`
+	Email     string         `bson:"email"`
+	Auth      teak.AuthLevel `bson:"auth"`
+	Groups    []string       `bson:"groups"`
+	CreatedBy string         `bson:"createdBy"`
+	CreatedAt time.Time      `bson:"createdAt"`
+	ExpiresAt time.Time      `bson:"expiresAt"`
+}
+
+func (doc *inviteDoc) toInvite() *teak.Invite {
+	groups := doc.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+	return &teak.Invite{
+		ID:        doc.ID,
+		Hash:      doc.Hash,
+		Email:     doc.Email,
+		Auth:      doc.Auth,
+		Groups:    groups,
+		CreatedBy: doc.CreatedBy,
+		CreatedAt: doc.CreatedAt,
+		ExpiresAt: doc.ExpiresAt,
+	}
+}
+
+//CreateInvite - stores an invite in 'invites' collection
+func (m *userStorage) CreateInvite(
+	gtx context.Context, invite *teak.Invite) (err error) {
+	_, err = C("invites").InsertOne(gtx, &inviteDoc{
+		ID:        invite.ID,
+		Hash:      invite.Hash,
+		Email:     invite.Email,
+		Auth:      invite.Auth,
+		Groups:    invite.Groups,
+		CreatedBy: invite.CreatedBy,
+		CreatedAt: invite.CreatedAt,
+		ExpiresAt: invite.ExpiresAt,
+	})
+	return teak.LogErrorX("t.user.mongo", "Failed to create invite", err)
+}
+
+//GetInvites - gets all the pending invites, latest first
+func (m *userStorage) GetInvites(
+	gtx context.Context) (invites []*teak.Invite, err error) {
+	invites = make([]*teak.Invite, 0, 10)
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+	cur, err := C("invites").Find(gtx, bson.M{}, opts)
+	if err != nil {
+		return invites, teak.LogErrorX("t.user.mongo",
+			"Failed to retrieve invites", err)
+	}
+	defer cur.Close(gtx)
+	for cur.Next(gtx) {
+		var doc inviteDoc
+		if err = cur.Decode(&doc); err != nil {
+			break
+		}
+		invites = append(invites, doc.toInvite())
+	}
+	if err == nil {
+		err = cur.Err()
+	}
+	return invites, teak.LogErrorX("t.user.mongo",
+		"Failed to retrieve invites", err)
+}
+
+//DeleteInvite - deletes the invite with given ID
+func (m *userStorage) DeleteInvite(
+	gtx context.Context, inviteID string) (err error) {
+	res, err := C("invites").DeleteOne(gtx, bson.M{"_id": inviteID})
+	if err == nil && res.DeletedCount == 0 {
+		err = fmt.Errorf("Could not find invite with ID '%s'", inviteID)
+	}
+	return teak.LogErrorX("t.user.mongo", "Failed to delete invite", err)
+}
+
+//UseInvite - removes the invite with given token hash and returns it, an
+//invite can be used only once
+func (m *userStorage) UseInvite(
+	gtx context.Context, hash string) (invite *teak.Invite, err error) {
+	var doc inviteDoc
+	err = C("invites").FindOneAndDelete(
+		gtx, bson.M{"hash": hash}).Decode(&doc)
+	if err != nil {
+		return nil, teak.LogErrorX("t.user.mongo", "Failed to use invite", err)
+	}
+	return doc.toInvite(), err
+}
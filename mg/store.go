@@ -50,46 +50,67 @@ func (mds *dataStorage) Create(
 	return logMongoError("t.mongo.data", err)
 }
 
-//Update - updates the records in 'dtype' collection which are matched by
-//the matcher query
+//Update - updates the record in 'dtype' collection which is matched by the
+//key and the filter
 func (mds *dataStorage) Update(
 	gtx context.Context,
 	dtype string,
 	keyField string,
 	key interface{},
-	value interface{}) error {
-
-	_, err := C(dtype).UpdateOne(gtx, bson.M{
-		keyField: key,
-	}, value)
+	filter *teak.Filter,
+	value interface{}) (err error) {
+	var update interface{} = value
+	if filter != nil && filter.Owner != nil {
+		//Only admins can change the owner
+		var doc bson.M
+		var b []byte
+		if b, err = bson.Marshal(value); err == nil {
+			err = bson.Unmarshal(b, &doc)
+		}
+		if err != nil {
+			return logMongoError("t.mongo.store", err)
+		}
+		delete(doc, filter.Owner.OwnerField)
+		update = doc
+	}
+	res, err := C(dtype).UpdateOne(gtx,
+		keySelector(keyField, key, filter),
+		bson.M{"$set": update})
+	if err == nil && res.MatchedCount == 0 {
+		err = teak.ErrNotFound
+	}
 	return logMongoError("t.mongo.store", err)
 }
 
-//Delete - deletes record matched by the matcher from collection 'dtype'
+//Delete - deletes record matched by the key and the filter from collection
+//'dtype'
 func (mds *dataStorage) Delete(
 	gtx context.Context,
 	dtype string,
 	keyField string,
-	key interface{}) error {
-
-	_, err := C(dtype).DeleteOne(gtx, bson.M{
-		keyField: key,
-	})
+	key interface{},
+	filter *teak.Filter) error {
+	res, err := C(dtype).DeleteOne(gtx, keySelector(keyField, key, filter))
+	if err == nil && res.DeletedCount == 0 {
+		err = teak.ErrNotFound
+	}
 	return logMongoError("t.mongo.store", err)
 }
 
-//RetrieveOne - gets a record matched by given matcher from collection 'dtype'
+//RetrieveOne - gets a record matched by given key and the filter from
+//collection 'dtype'
 func (mds *dataStorage) RetrieveOne(
 	gtx context.Context,
 	dtype string,
 	keyField string,
 	key interface{},
+	filter *teak.Filter,
 	out interface{}) error {
-
-	res := C(dtype).FindOne(gtx, bson.M{
-		keyField: key,
-	})
+	res := C(dtype).FindOne(gtx, keySelector(keyField, key, filter))
 	err := Decode(res, out)
+	if err == mongo.ErrNoDocuments {
+		err = teak.ErrNotFound
+	}
 	return logMongoError("t.mongo.store", err)
 }
 
@@ -259,9 +280,14 @@ func (mds *dataStorage) GetFilterValuesX(
 	return values, logMongoError("t.mongo.store", err)
 }
 
-//GenerateSelector - creates mongodb query for a generic filter
+//GenerateSelector - creates mongodb query for a generic filter. An empty
+//selector is returned if the filter is nil or empty
 func GenerateSelector(
 	filter *teak.Filter) (selector bson.M) {
+	selector = bson.M{}
+	if filter == nil {
+		return selector
+	}
 	queries := make([]bson.M, 0, 100)
 	// for key, values := range filter.Props {
 	// 	if len(values) == 1 {
@@ -321,6 +347,17 @@ func GenerateSelector(
 			})
 		}
 	}
+	if filter.Owner != nil {
+		owner := bson.M{filter.Owner.OwnerField: filter.Owner.UserID}
+		if filter.Owner.SharedField != "" {
+			//Equality matches an element when the field is an array
+			owner = bson.M{"$or": []bson.M{
+				owner,
+				{filter.Owner.SharedField: filter.Owner.UserID},
+			}}
+		}
+		queries = append(queries, owner)
+	}
 	if len(queries) != 0 {
 		selector = bson.M{
 			"$and": queries,
@@ -331,6 +368,17 @@ func GenerateSelector(
 	return selector
 }
 
+//keySelector - creates mongodb query that selects the record with given key
+//which also matches the filter
+func keySelector(
+	keyField string, key interface{}, filter *teak.Filter) (selector bson.M) {
+	selector = GenerateSelector(filter)
+	if len(selector) == 0 {
+		return bson.M{keyField: key}
+	}
+	return bson.M{"$and": []bson.M{{keyField: key}, selector}}
+}
+
 //Setup - initialize the data storage for the first time, sets it upda and also
 //creates the first admin user. Data store can be setup only once
 func (mds *dataStorage) Setup(
@@ -374,9 +422,17 @@ func (mds *dataStorage) Setup(
 //Setup - setup has to be run when data storage structure changes, such as
 //adding index, altering tables etc
 func (mds *dataStorage) Init(gtx context.Context, params teak.M) (err error) {
-	//Setup indices for user collection
+	//Setup indices for user collection, users without email index are the
+	//ones created before it was introduced and are left out
+	_, err = C("users").Indexes().CreateOne(gtx, mongo.IndexModel{
+		Keys: bson.D{{Key: "emailindex", Value: 1}},
+		Options: options.Index().
+			SetName("emailindex").
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"emailindex": bson.M{"$gt": ""}}),
+	})
 	//Setup indices for event collection
-	return err
+	return teak.LogErrorX("t.mongo.store", "Failed to create user indices", err)
 }
 
 //Reset - reset clears the data without affecting the structure/schema
@@ -389,6 +445,14 @@ func (mds *dataStorage) Destroy(gtx context.Context) (err error) {
 	return err
 }
 
+//Close - disconnects from mongodb
+func (mds *dataStorage) Close(gtx context.Context) (err error) {
+	if mongoStore != nil {
+		err = mongoStore.client.Disconnect(gtx)
+	}
+	return teak.LogErrorX("t.mongo.store", "Failed to disconnect", err)
+}
+
 //Wrap - wraps a command with flags required to connect to this data source
 func (mds *dataStorage) Wrap(cmd *cli.Command) *cli.Command {
 	req := func(ctx *cli.Context) error {
@@ -432,6 +496,6 @@ func GetSort(sortField string) bson.D {
 		sortDir = -1
 		sortField = sortField[1:]
 	}
-	return bson.D{{sortField, sortDir}}
+	return bson.D{{Key: sortField, Value: sortDir}}
 
 }
@@ -0,0 +1,163 @@
+package mg
+
+import (
+	"context"
+	"time"
+
+	"github.com/varunamachi/teak"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+//refreshTokenDoc - mongo representation of teak.RefreshToken, the hash of the
+//token is used as the document ID
+type refreshTokenDoc struct {
+	ID        string    `bson:"_id"`
+	UserID    string    `bson:"userID"`
+	Family    string    `bson:"family"`
+	Used      bool      `bson:"used"`
+	CreatedAt time.Time `bson:"createdAt"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+//SaveRefreshToken - stores a refresh token in 'refreshTokens' collection
+func (m *userStorage) SaveRefreshToken(
+	gtx context.Context, token *teak.RefreshToken) (err error) {
+	_, err = C("refreshTokens").InsertOne(gtx, &refreshTokenDoc{
+		ID:        token.ID,
+		UserID:    token.UserID,
+		Family:    token.Family,
+		Used:      token.Used,
+		CreatedAt: token.CreatedAt,
+		ExpiresAt: token.ExpiresAt,
+	})
+	return teak.LogErrorX("t.user.mongo", "Failed to save refresh token", err)
+}
+
+//GetRefreshToken - gets the refresh token with given ID
+func (m *userStorage) GetRefreshToken(
+	gtx context.Context, tokenID string) (token *teak.RefreshToken, err error) {
+	var doc refreshTokenDoc
+	err = C("refreshTokens").FindOne(gtx, bson.M{"_id": tokenID}).Decode(&doc)
+	if err != nil {
+		return nil, teak.LogErrorX("t.user.mongo",
+			"Failed to retrieve refresh token", err)
+	}
+	token = &teak.RefreshToken{
+		ID:        doc.ID,
+		UserID:    doc.UserID,
+		Family:    doc.Family,
+		Used:      doc.Used,
+		CreatedAt: doc.CreatedAt,
+		ExpiresAt: doc.ExpiresAt,
+	}
+	return token, err
+}
+
+//UseRefreshToken - marks the refresh token as used. If the token is already
+//used teak.ErrTokenUsed is returned. The check and update happen in a single
+//update so that a token can not be used twice by concurrent requests
+func (m *userStorage) UseRefreshToken(
+	gtx context.Context, tokenID string) (err error) {
+	res, err := C("refreshTokens").UpdateOne(gtx,
+		bson.M{"_id": tokenID, "used": false},
+		bson.M{"$set": bson.M{"used": true}})
+	if err != nil {
+		return teak.LogErrorX("t.user.mongo", "Failed to use refresh token", err)
+	}
+	if res.ModifiedCount != 1 {
+		return teak.ErrTokenUsed
+	}
+	return err
+}
+
+//RevokeRefreshTokens - removes refresh tokens of the given family of the user,
+//if family is empty all the refresh tokens of the user are removed
+func (m *userStorage) RevokeRefreshTokens(
+	gtx context.Context, userID, family string) (err error) {
+	selector := bson.M{"userID": userID}
+	if family != "" {
+		selector["family"] = family
+	}
+	_, err = C("refreshTokens").DeleteMany(gtx, selector)
+	return teak.LogErrorX("t.user.mongo",
+		"Failed to revoke refresh tokens of user %s", err, userID)
+}
+
+//RevokeToken - adds the access token ID to 'revokedTokens' collection till
+//expiry
+func (m *userStorage) RevokeToken(
+	gtx context.Context, tokenID string, expiry time.Time) (err error) {
+	//Tokens that are expired are rejected anyway, no need to keep them
+	_, err = C("revokedTokens").DeleteMany(gtx,
+		bson.M{"expiresAt": bson.M{"$lt": time.Now()}})
+	if err == nil {
+		_, err = C("revokedTokens").InsertOne(gtx, bson.M{
+			"_id":       tokenID,
+			"expiresAt": expiry,
+		})
+	}
+	return teak.LogErrorX("t.user.mongo", "Failed to revoke token", err)
+}
+
+//IsTokenRevoked - checks if the access token with given ID is revoked
+func (m *userStorage) IsTokenRevoked(
+	gtx context.Context, tokenID string) (revoked bool, err error) {
+	count, err := C("revokedTokens").CountDocuments(gtx, bson.M{"_id": tokenID})
+	return count > 0, teak.LogErrorX("t.user.mongo",
+		"Failed to check revocation status of token", err)
+}
+
+//pwdResetTokenDoc - mongo representation of teak.PasswordResetToken, the hash
+//of the token is used as the document ID
+type pwdResetTokenDoc struct {
+	ID        string    `bson:"_id"`
+	UserID    string    `bson:"userID"`
+	CreatedAt time.Time `bson:"createdAt"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+//SavePasswordResetToken - stores a password reset token in 'pwdResetTokens'
+//collection, earlier reset tokens of the user are removed
+func (m *userStorage) SavePasswordResetToken(
+	gtx context.Context, token *teak.PasswordResetToken) (err error) {
+	_, err = C("pwdResetTokens").DeleteMany(gtx, bson.M{
+		"$or": []bson.M{
+			{"userID": token.UserID},
+			{"expiresAt": bson.M{"$lt": time.Now()}},
+		},
+	})
+	if err != nil {
+		return teak.LogErrorX("t.user.mongo",
+			"Failed to remove old password reset tokens", err)
+	}
+	_, err = C("pwdResetTokens").InsertOne(gtx, &pwdResetTokenDoc{
+		ID:        token.ID,
+		UserID:    token.UserID,
+		CreatedAt: token.CreatedAt,
+		ExpiresAt: token.ExpiresAt,
+	})
+	return teak.LogErrorX("t.user.mongo",
+		"Failed to save password reset token", err)
+}
+
+//UsePasswordResetToken - removes the password reset token with given ID and
+//returns it. Find and delete happen in a single operation so that a token can
+//not be used twice by concurrent requests
+func (m *userStorage) UsePasswordResetToken(
+	gtx context.Context, tokenID string) (
+	token *teak.PasswordResetToken, err error) {
+	var doc pwdResetTokenDoc
+	err = C("pwdResetTokens").FindOneAndDelete(
+		gtx, bson.M{"_id": tokenID}).Decode(&doc)
+	if err != nil {
+		return nil, teak.LogErrorX("t.user.mongo",
+			"Failed to use password reset token", err)
+	}
+	token = &teak.PasswordResetToken{
+		ID:        doc.ID,
+		UserID:    doc.UserID,
+		CreatedAt: doc.CreatedAt,
+		ExpiresAt: doc.ExpiresAt,
+	}
+	return token, err
+}
@@ -0,0 +1,116 @@
+package mg
+
+import (
+	"context"
+
+	"github.com/varunamachi/teak"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//twoFactorDoc - 2FA fields of the user's document in 'secret' collection
+type twoFactorDoc struct {
+	Secret        string   `bson:"totpSecret"`
+	Enabled       bool     `bson:"totpEnabled"`
+	LastStep      int64    `bson:"totpStep"`
+	RecoveryCodes []string `bson:"recoveryCodes"`
+}
+
+//SaveTwoFactor - stores the TOTP secret, state and recovery code hashes of the
+//user in the user's document in 'secret' collection
+func (m *userStorage) SaveTwoFactor(
+	gtx context.Context, tf *teak.TwoFactor) (err error) {
+	_, err = C("secret").UpdateOne(gtx,
+		bson.M{"userID": tf.UserID},
+		bson.M{
+			"$set": bson.M{
+				"userID":        tf.UserID,
+				"totpSecret":    tf.Secret,
+				"totpEnabled":   tf.Enabled,
+				"totpStep":      tf.LastStep,
+				"recoveryCodes": tf.RecoveryCodes,
+			},
+		},
+		options.Update().SetUpsert(true))
+	return teak.LogErrorX("t.user.mongo",
+		"Failed to save 2FA details of user %s", err, tf.UserID)
+}
+
+//GetTwoFactor - gets the 2FA details of the user, the secret is empty if the
+//user has not enrolled
+func (m *userStorage) GetTwoFactor(
+	gtx context.Context, userID string) (tf *teak.TwoFactor, err error) {
+	var doc twoFactorDoc
+	fopts := options.FindOne().SetProjection(bson.M{
+		"totpSecret":    1,
+		"totpEnabled":   1,
+		"totpStep":      1,
+		"recoveryCodes": 1,
+		"_id":           0,
+	})
+	err = C("secret").FindOne(gtx, bson.M{"userID": userID}, fopts).
+		Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		err = nil
+	}
+	tf = &teak.TwoFactor{
+		UserID:        userID,
+		Secret:        doc.Secret,
+		Enabled:       doc.Enabled,
+		LastStep:      doc.LastStep,
+		RecoveryCodes: doc.RecoveryCodes,
+	}
+	return tf, teak.LogErrorX("t.user.mongo",
+		"Failed to retrieve 2FA details of user %s", err, userID)
+}
+
+//UseTOTPStep - records the time step of a verified TOTP code. If the step is
+//not after the last used step teak.ErrCodeUsed is returned
+func (m *userStorage) UseTOTPStep(
+	gtx context.Context, userID string, step int64) (err error) {
+	res, err := C("secret").UpdateOne(gtx,
+		bson.M{"userID": userID, "totpStep": bson.M{"$lt": step}},
+		bson.M{"$set": bson.M{"totpStep": step}})
+	if err != nil {
+		return teak.LogErrorX("t.user.mongo", "Failed to use TOTP code", err)
+	}
+	if res.ModifiedCount != 1 {
+		return teak.ErrCodeUsed
+	}
+	return err
+}
+
+//UseRecoveryCode - removes the recovery code with given hash. If the user does
+//not have such code teak.ErrCodeUsed is returned
+func (m *userStorage) UseRecoveryCode(
+	gtx context.Context, userID, codeHash string) (err error) {
+	res, err := C("secret").UpdateOne(gtx,
+		bson.M{"userID": userID, "recoveryCodes": codeHash},
+		bson.M{"$pull": bson.M{"recoveryCodes": codeHash}})
+	if err != nil {
+		return teak.LogErrorX("t.user.mongo",
+			"Failed to use recovery code", err)
+	}
+	if res.ModifiedCount != 1 {
+		return teak.ErrCodeUsed
+	}
+	return err
+}
+
+//DeleteTwoFactor - removes 2FA details of the user
+func (m *userStorage) DeleteTwoFactor(
+	gtx context.Context, userID string) (err error) {
+	_, err = C("secret").UpdateOne(gtx,
+		bson.M{"userID": userID},
+		bson.M{
+			"$unset": bson.M{
+				"totpSecret":    "",
+				"totpEnabled":   "",
+				"totpStep":      "",
+				"recoveryCodes": "",
+			},
+		})
+	return teak.LogErrorX("t.user.mongo",
+		"Failed to delete 2FA details of user %s", err, userID)
+}
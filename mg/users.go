@@ -3,14 +3,20 @@ package mg
 import (
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/varunamachi/teak"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"gopkg.in/hlandau/passlib.v1"
 )
 
+//userIDKey - field of user documents that holds the user ID, given by the
+//bson tag of teak.User.UserID
+const userIDKey = "userid"
+
 //userStorage - mongodb storage for user information
 type userStorage struct{}
 
@@ -19,6 +25,19 @@ func NewUserStorage() teak.UserStorage {
 	return &userStorage{}
 }
 
+//emailTaken - tells if an user other than the given user has the email index
+func emailTaken(gtx context.Context, userID, index string) (
+	taken bool, err error) {
+	if index == "" {
+		return taken, err
+	}
+	count, err := C("users").CountDocuments(gtx, bson.M{
+		"emailindex": index,
+		userIDKey:    bson.M{"$ne": userID},
+	})
+	return count != 0, err
+}
+
 //CreateUser - creates user in database
 func (m *userStorage) CreateUser(
 	gtx context.Context,
@@ -31,6 +50,11 @@ func (m *userStorage) CreateUser(
 	if err := m.validateForSuper(gtx, user.Auth); err != nil {
 		return "", err
 	}
+	if taken, err := emailTaken(gtx, user.UserID, user.EmailIndex); taken {
+		return "", teak.ErrEmailExists
+	} else if err != nil {
+		return "", teak.LogError("t.user.mongo", err)
+	}
 	_, err := C("users").InsertOne(gtx, user)
 	return user.UserID, teak.LogError("t.user.mongo", err)
 }
@@ -41,22 +65,120 @@ func (m *userStorage) UpdateUser(
 	if err := m.validateForSuper(gtx, user.Auth); err != nil {
 		return err
 	}
-	_, err := C("users").UpdateOne(gtx, bson.M{"id": user.UserID}, user)
+	if taken, err := emailTaken(gtx, user.UserID, user.EmailIndex); taken {
+		return teak.ErrEmailExists
+	} else if err != nil {
+		return teak.LogError("t.user.mongo", err)
+	}
+	_, err := C("users").UpdateOne(gtx, bson.M{userIDKey: user.UserID},
+		bson.M{"$set": user})
 	return teak.LogError("t.user.mongo", err)
 }
 
 //DeleteUser - deletes user with given user ID
 func (m *userStorage) DeleteUser(
 	gtx context.Context, userID string) error {
-	_, err := C("users").DeleteOne(gtx, bson.M{"id": userID})
+	_, err := C("users").DeleteOne(gtx, bson.M{userIDKey: userID})
+	if err == nil {
+		_, err = C("refreshTokens").DeleteMany(gtx, bson.M{"userID": userID})
+	}
+	if err == nil {
+		_, err = C("apiKeys").DeleteMany(gtx, bson.M{"userID": userID})
+	}
+	if err == nil {
+		_, err = C("pwdResetTokens").DeleteMany(gtx, bson.M{"userID": userID})
+	}
+	if err == nil {
+		_, err = C("groups").UpdateMany(gtx, bson.M{"users": userID},
+			bson.M{"$pull": bson.M{"users": userID}})
+	}
+	if err == nil {
+		_, err = C("secret").DeleteOne(gtx, bson.M{"userID": userID})
+	}
 	return teak.LogError("t.user.mongo", err)
 }
 
+//RenameUser - changes the identifier of an user along with the documents
+//that refer to it. Mongo does not cascade, so each collection is updated
+func (m *userStorage) RenameUser(
+	gtx context.Context, oldID, newID string) (err error) {
+	res, err := C("users").UpdateOne(gtx, bson.M{userIDKey: oldID},
+		bson.M{"$set": bson.M{userIDKey: newID}})
+	if err == nil && res.MatchedCount == 0 {
+		err = fmt.Errorf("Could not find user with ID '%s'", oldID)
+	}
+	updates := []struct {
+		coll  string
+		field string
+	}{
+		{"secret", "userID"},
+		{"refreshTokens", "userID"},
+		{"apiKeys", "userID"},
+		{"pwdResetTokens", "userID"},
+		{"events", "userID"},
+		{"events", "realUserID"},
+		{"invites", "createdBy"},
+	}
+	for _, up := range updates {
+		if err != nil {
+			break
+		}
+		_, err = C(up.coll).UpdateMany(gtx, bson.M{up.field: oldID},
+			bson.M{"$set": bson.M{up.field: newID}})
+	}
+	if err == nil {
+		_, err = C("groups").UpdateMany(gtx, bson.M{"users": oldID},
+			bson.M{"$addToSet": bson.M{"users": newID}})
+	}
+	if err == nil {
+		_, err = C("groups").UpdateMany(gtx, bson.M{"users": oldID},
+			bson.M{"$pull": bson.M{"users": oldID}})
+	}
+	return teak.LogErrorX("t.user.mongo", "Failed to rename user %s", err,
+		oldID)
+}
+
+//SetEmails - updates encrypted email and email index of users
+func (m *userStorage) SetEmails(
+	gtx context.Context, users []*teak.User) (err error) {
+	for _, user := range users {
+		var taken bool
+		taken, err = emailTaken(gtx, user.UserID, user.EmailIndex)
+		if taken {
+			err = teak.ErrEmailExists
+		}
+		if err != nil {
+			break
+		}
+		_, err = C("users").UpdateOne(gtx, bson.M{userIDKey: user.UserID},
+			bson.M{"$set": bson.M{
+				"email":      user.Email,
+				"emailindex": user.EmailIndex,
+			}})
+		if err != nil {
+			break
+		}
+	}
+	return teak.LogErrorX("t.user.mongo", "Failed to update emails", err)
+}
+
+//GetUserByEmail - gets the user whose email index matches the email
+func (m *userStorage) GetUserByEmail(
+	gtx context.Context, email string) (*teak.User, error) {
+	index, err := teak.EmailIndex(email)
+	if err != nil {
+		return nil, teak.LogError("t.user.mongo", err)
+	}
+	var user teak.User
+	err = C("users").FindOne(gtx, bson.M{"emailindex": index}).Decode(&user)
+	return &user, teak.LogError("t.user.mongo", err)
+}
+
 //GetUser - gets details of the user corresponding to ID
 func (m *userStorage) GetUser(gtx context.Context,
 	userID string) (*teak.User, error) {
 	user := &teak.User{}
-	res := C("users").FindOne(gtx, bson.M{"id": userID})
+	res := C("users").FindOne(gtx, bson.M{userIDKey: userID})
 	if err := res.Decode(user); err != nil {
 		return nil, teak.LogError("t.user.mongo", err)
 	}
@@ -120,55 +242,77 @@ func (m *userStorage) GetUsersWithCount(
 //ResetPassword - sets password of a unauthenticated user
 func (m *userStorage) ResetPassword(
 	gtx context.Context, userID, oldPwd, newPwd string) error {
-	var newHash string
-	newHash, err := passlib.Hash(newPwd)
-	if err != nil {
-		return err
-	}
-	if err = m.ValidateUser(gtx, userID, oldPwd); err != nil {
+	if err := m.ValidateUser(gtx, userID, oldPwd); err != nil {
 		return errors.New("Could not match old password")
 	}
-	_, err = C("secret").UpdateOne(
-		gtx,
-		bson.M{
-			"userID": userID,
-		},
-		bson.M{
-			"$set": bson.M{
-				"phash": newHash,
-			},
-		},
-	)
-	return teak.LogError("t.user.mongo", err)
+	return m.SetPassword(gtx, userID, newPwd)
+}
+
+//secretDoc - password fields of the user's document in 'secret' collection
+type secretDoc struct {
+	PHash   string   `bson:"phash"`
+	History []string `bson:"phashHistory"`
 }
 
 //SetPassword - sets password of a already authenticated user, old password
-//is not required
+//is not required. The password policy is enforced and the password expiry of
+//the user is updated
 func (m *userStorage) SetPassword(
 	gtx context.Context, userID, newPwd string) (err error) {
+	var doc secretDoc
+	err = C("secret").FindOne(gtx, bson.M{"userID": userID}).Decode(&doc)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return teak.LogError("t.user.mongo", err)
+	}
+	previous := doc.History
+	if len(previous) == 0 && doc.PHash != "" {
+		previous = []string{doc.PHash}
+	}
+	policy := teak.GetPasswordPolicy()
+	if err = policy.Check(newPwd, previous); err != nil {
+		return teak.LogError("t.user.mongo", err)
+	}
 	var newHash string
 	newHash, err = passlib.Hash(newPwd)
 	if err != nil {
 		return teak.LogError("t.user.mongo", err)
 	}
-	m.setPasswordHash(gtx, userID, newHash)
+	_, err = C("secret").UpdateOne(gtx,
+		bson.M{"userID": userID},
+		bson.M{
+			"$set": bson.M{
+				"userID":       userID,
+				"phash":        newHash,
+				"phashHistory": policy.NextHistory(newHash, previous),
+			},
+		},
+		options.Update().SetUpsert(true))
+	if err == nil {
+		_, err = C("users").UpdateOne(gtx,
+			bson.M{userIDKey: userID},
+			bson.M{
+				"$set": bson.M{
+					"pwdexpiry": policy.Expiry(time.Now()),
+				},
+			})
+	}
 	return teak.LogError("t.user.mongo", err)
 }
 
+//setPasswordHash - replaces the password hash, used when the hash is upgraded
+//while validating the password
 func (m *userStorage) setPasswordHash(
 	gtx context.Context, userID, hash string) (err error) {
-	// _, err = C("secret").Upsert(
-	// 	bson.M{
-	// 		"userID": userID,
-	// 	},
-	// 	bson.M{
-	// 		"$set": bson.M{
-	// 			"userID": userID,
-	// 			"phash":  hash,
-	// 		},
-	// 	})
-	// return err
-	return nil
+	_, err = C("secret").UpdateOne(gtx,
+		bson.M{"userID": userID},
+		bson.M{
+			"$set": bson.M{
+				"userID": userID,
+				"phash":  hash,
+			},
+		},
+		options.Update().SetUpsert(true))
+	return err
 }
 
 //ValidateUser - validates user ID and password
@@ -210,7 +354,7 @@ func (m *userStorage) GetUserAuthLevel(
 	userID string) (teak.AuthLevel, error) {
 
 	fopts := options.FindOne().SetProjection(bson.M{"auth": 1})
-	res := C("users").FindOne(gtx, bson.M{"userID": userID}, fopts)
+	res := C("users").FindOne(gtx, bson.M{userIDKey: userID}, fopts)
 	if res.Err() != nil {
 		return teak.Public, teak.LogError("t.user.mongo", res.Err())
 	}
@@ -230,7 +374,7 @@ func (m *userStorage) SetAuthLevel(
 
 	_, err := C("users").UpdateOne(gtx,
 		bson.M{
-			"id": userID,
+			userIDKey: userID,
 		},
 		bson.M{
 			"$set": bson.M{
@@ -267,7 +411,7 @@ func (m *userStorage) SetUserState(
 	userID string, state teak.UserState) (err error) {
 	_, err = C("users").UpdateOne(gtx,
 		bson.M{
-			"id": userID,
+			userIDKey: userID,
 		},
 		bson.M{
 			"$set": bson.M{
@@ -284,7 +428,7 @@ func (m *userStorage) VerifyUser(
 	_, err := C("users").UpdateOne(gtx,
 		bson.M{
 			"$and": []bson.M{
-				{"id": userID},
+				{userIDKey: userID},
 				{"verID": verID},
 			},
 		},
@@ -326,13 +470,19 @@ func (m *userStorage) CleanData(gtx context.Context) error {
 //is updating own user account
 func (m *userStorage) UpdateProfile(
 	gtx context.Context, user *teak.User) error {
+	if taken, err := emailTaken(gtx, user.UserID, user.EmailIndex); taken {
+		return teak.ErrEmailExists
+	} else if err != nil {
+		return teak.LogError("UMan:Mongo", err)
+	}
 	user.FullName = user.FirstName + " " + user.LastName
 	_, err := C("users").UpdateOne(gtx,
 		bson.M{
-			"id": user.UserID,
+			userIDKey: user.UserID,
 		}, bson.M{
 			"$set": bson.M{
 				"email":      user.Email,
+				"emailindex": user.EmailIndex,
 				"firstName":  user.FirstName,
 				"lastName":   user.LastName,
 				"title":      user.Title,
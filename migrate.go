@@ -0,0 +1,338 @@
+package teak
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"gopkg.in/urfave/cli.v1"
+)
+
+//Migration - a versioned change to the structure of the data storage. The Up
+//and Down scripts are interpreted by the data storage, for postgres they are
+//SQL statements
+type Migration struct {
+	Version int    `json:"version"`
+	Desc    string `json:"desc"`
+	Up      string `json:"up"`
+	Down    string `json:"down"`
+}
+
+//Migrator - implemented by data storages that support versioned migrations
+type Migrator interface {
+	//StoreMigrations - migrations for the structures used by the data storage
+	//itself, these are recorded against the name of the data storage
+	StoreMigrations() []*Migration
+
+	//GetMigrationVersion - gives version of the last migration applied for
+	//the module, 0 if no migration is applied yet
+	GetMigrationVersion(
+		gtx context.Context, module string) (version int, err error)
+
+	//RunMigration - runs the migration script and records the given version
+	//as current version of the module. Both of these should happen
+	//atomically
+	RunMigration(
+		gtx context.Context, module, script string, version int) error
+}
+
+//MigrationStatus - migration state of a module
+type MigrationStatus struct {
+	Module  string       `json:"module"`
+	Current int          `json:"current"`
+	Latest  int          `json:"latest"`
+	Pending []*Migration `json:"pending"`
+}
+
+type migrationSet struct {
+	module     string
+	migrations []*Migration
+}
+
+//GetMigrator - gives the data storage as migrator if it supports migrations
+func GetMigrator() (migrator Migrator, err error) {
+	migrator, ok := unwrapStore(GetStore()).(Migrator)
+	if !ok {
+		err = fmt.Errorf("Data storage '%s' does not support migrations",
+			GetStore().Name())
+	}
+	return migrator, err
+}
+
+//sortMigrations - sorts the migrations by version and makes sure that the
+//versions are positive and unique
+func sortMigrations(
+	module string, migrations []*Migration) (sorted []*Migration, err error) {
+	sorted = make([]*Migration, len(migrations))
+	copy(sorted, migrations)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+	for i, mig := range sorted {
+		if mig.Version <= 0 {
+			err = fmt.Errorf("Invalid migration version %d in module %s",
+				mig.Version, module)
+			return sorted, err
+		}
+		if i > 0 && sorted[i-1].Version == mig.Version {
+			err = fmt.Errorf("Duplicate migration version %d in module %s",
+				mig.Version, module)
+			return sorted, err
+		}
+	}
+	return sorted, err
+}
+
+//migrationSets - gives migrations of the data storage followed by migrations
+//of each module in the order in which modules are registered
+func (app *App) migrationSets(
+	migrator Migrator, module string) (sets []*migrationSet, err error) {
+	sets = make([]*migrationSet, 0, len(app.modules)+1)
+	add := func(name string, migrations []*Migration) error {
+		if len(migrations) == 0 || (module != "" && module != name) {
+			return nil
+		}
+		sorted, err := sortMigrations(name, migrations)
+		if err == nil {
+			sets = append(sets, &migrationSet{
+				module:     name,
+				migrations: sorted,
+			})
+		}
+		return err
+	}
+	if err = add(GetStore().Name(), migrator.StoreMigrations()); err != nil {
+		return sets, err
+	}
+	for _, mod := range app.modules {
+		if err = add(mod.Name, mod.Migrations); err != nil {
+			return sets, err
+		}
+	}
+	if module != "" && len(sets) == 0 {
+		err = fmt.Errorf("No migrations found for module '%s'", module)
+	}
+	return sets, err
+}
+
+//MigrationStatus - gives migration status of the data storage and all the
+//modules that have migrations
+func (app *App) MigrationStatus(gtx context.Context) (
+	status []*MigrationStatus, err error) {
+	migrator, err := GetMigrator()
+	if err != nil {
+		return status, err
+	}
+	sets, err := app.migrationSets(migrator, "")
+	if err != nil {
+		return status, err
+	}
+	status = make([]*MigrationStatus, 0, len(sets))
+	for _, set := range sets {
+		var current int
+		current, err = migrator.GetMigrationVersion(gtx, set.module)
+		if err != nil {
+			return status, err
+		}
+		st := &MigrationStatus{
+			Module:  set.module,
+			Current: current,
+			Latest:  set.migrations[len(set.migrations)-1].Version,
+			Pending: make([]*Migration, 0, len(set.migrations)),
+		}
+		for _, mig := range set.migrations {
+			if mig.Version > current {
+				st.Pending = append(st.Pending, mig)
+			}
+		}
+		status = append(status, st)
+	}
+	return status, err
+}
+
+//MigrateUp - applies pending migrations of the given module up to the target
+//version. If module is empty all the modules are migrated and if target is 0
+//or less all the pending migrations are applied
+func (app *App) MigrateUp(
+	gtx context.Context, module string, target int) (err error) {
+	migrator, err := GetMigrator()
+	if err != nil {
+		return LogError("t.app.migrate", err)
+	}
+	sets, err := app.migrationSets(migrator, module)
+	if err != nil {
+		return LogError("t.app.migrate", err)
+	}
+	for _, set := range sets {
+		err = ApplyMigrations(gtx, migrator, set.module, set.migrations, target)
+		if err != nil {
+			break
+		}
+	}
+	return err
+}
+
+//ApplyMigrations - applies the migrations of a module that are newer than the
+//current version of the module up to the target version. If the target is 0
+//or less all the pending migrations are applied
+func ApplyMigrations(
+	gtx context.Context,
+	migrator Migrator,
+	module string,
+	migrations []*Migration,
+	target int) (err error) {
+	sorted, err := sortMigrations(module, migrations)
+	if err != nil {
+		return LogError("t.app.migrate", err)
+	}
+	current, err := migrator.GetMigrationVersion(gtx, module)
+	if err != nil {
+		return LogError("t.app.migrate", err)
+	}
+	for _, mig := range sorted {
+		if mig.Version <= current {
+			continue
+		}
+		if target > 0 && mig.Version > target {
+			break
+		}
+		err = migrator.RunMigration(gtx, module, mig.Up, mig.Version)
+		if err != nil {
+			return LogErrorX("t.app.migrate",
+				"Failed to apply migration %d of %s", err, mig.Version, module)
+		}
+		Info("t.app.migrate", "Applied migration %d of %s - %s",
+			mig.Version, module, mig.Desc)
+	}
+	return err
+}
+
+//MigrateDown - reverts given number of migrations of a module, starting from
+//the last applied migration
+func (app *App) MigrateDown(
+	gtx context.Context, module string, steps int) (err error) {
+	if module == "" {
+		err = errors.New("Module is required for reverting migrations")
+		return LogError("t.app.migrate", err)
+	}
+	migrator, err := GetMigrator()
+	if err != nil {
+		return LogError("t.app.migrate", err)
+	}
+	sets, err := app.migrationSets(migrator, module)
+	if err != nil {
+		return LogError("t.app.migrate", err)
+	}
+	migrations := sets[0].migrations
+	current, err := migrator.GetMigrationVersion(gtx, module)
+	if err != nil {
+		return LogError("t.app.migrate", err)
+	}
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		mig := migrations[i]
+		if mig.Version > current {
+			continue
+		}
+		prev := 0
+		if i > 0 {
+			prev = migrations[i-1].Version
+		}
+		err = migrator.RunMigration(gtx, module, mig.Down, prev)
+		if err != nil {
+			return LogErrorX("t.app.migrate",
+				"Failed to revert migration %d of %s", err, mig.Version, module)
+		}
+		Info("t.app.migrate", "Reverted migration %d of %s - %s",
+			mig.Version, module, mig.Desc)
+		current = prev
+		steps--
+	}
+	return err
+}
+
+func migrateCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "migrate",
+		Usage: "Manage versioned migrations of the data storage",
+		Subcommands: []cli.Command{
+			{
+				Name:  "up",
+				Usage: "Apply pending migrations",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "module",
+						Usage: "Migrate only the given module",
+					},
+					cli.IntFlag{
+						Name:  "to",
+						Usage: "Target version, latest if not given",
+					},
+				},
+				Action: func(ctx *cli.Context) (err error) {
+					vapp := GetAppReference(ctx)
+					if vapp == nil {
+						return Error("t.app", "App not properly initialized")
+					}
+					ag := NewArgGetter(ctx)
+					module := ag.GetOptionalString("module")
+					target := ag.GetOptionalInt("to")
+					err = vapp.MigrateUp(context.TODO(), module, target)
+					if err == nil {
+						Info("t.app.migrate", "Migration complete")
+					}
+					return err
+				},
+			},
+			{
+				Name:  "down",
+				Usage: "Revert migrations of a module",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "module",
+						Usage: "Module whose migrations need to be reverted",
+					},
+					cli.IntFlag{
+						Name:  "steps",
+						Value: 1,
+						Usage: "Number of migrations to revert",
+					},
+				},
+				Action: func(ctx *cli.Context) (err error) {
+					vapp := GetAppReference(ctx)
+					if vapp == nil {
+						return Error("t.app", "App not properly initialized")
+					}
+					ag := NewArgGetter(ctx)
+					module := ag.GetRequiredString("module")
+					steps := ag.GetIntOr("steps", 1)
+					if err = ag.Err; err == nil {
+						err = vapp.MigrateDown(context.TODO(), module, steps)
+					}
+					return err
+				},
+			},
+			{
+				Name:  "status",
+				Usage: "Show migration status of each module",
+				Action: func(ctx *cli.Context) (err error) {
+					vapp := GetAppReference(ctx)
+					if vapp == nil {
+						return Error("t.app", "App not properly initialized")
+					}
+					status, err := vapp.MigrationStatus(context.TODO())
+					if err != nil {
+						return err
+					}
+					fmt.Printf("%-20s %10s %10s %10s\n",
+						"MODULE", "CURRENT", "LATEST", "PENDING")
+					for _, st := range status {
+						fmt.Printf("%-20s %10d %10d %10d\n",
+							st.Module, st.Current, st.Latest, len(st.Pending))
+					}
+					return err
+				},
+			},
+		},
+	}
+}
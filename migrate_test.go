@@ -0,0 +1,150 @@
+package teak
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+//testMigrator - data storage that records the migration scripts it runs,
+//other methods of DataStorage panic through the nil embedded interface
+type testMigrator struct {
+	DataStorage
+	versions map[string]int
+	scripts  []string
+	failOn   string
+}
+
+//useTestMigrator - makes the test migrator the data storage, the returned
+//function restores the previous data storage
+func useTestMigrator() (migrator *testMigrator, restore func()) {
+	migrator = &testMigrator{versions: make(map[string]int)}
+	prev := dataStorage
+	dataStorage = migrator
+	return migrator, func() { dataStorage = prev }
+}
+
+func (tm *testMigrator) Name() string {
+	return "test"
+}
+
+func (tm *testMigrator) StoreMigrations() []*Migration {
+	return []*Migration{
+		{Version: 1, Up: "store.1.up", Down: "store.1.down"},
+	}
+}
+
+func (tm *testMigrator) GetMigrationVersion(
+	gtx context.Context, module string) (version int, err error) {
+	return tm.versions[module], err
+}
+
+func (tm *testMigrator) RunMigration(
+	gtx context.Context, module, script string, version int) (err error) {
+	if script == tm.failOn {
+		return errors.New("migration failed")
+	}
+	tm.scripts = append(tm.scripts, script)
+	tm.versions[module] = version
+	return err
+}
+
+//shopMigrations - migrations of a module, deliberately out of order
+var shopMigrations = []*Migration{
+	{Version: 3, Up: "shop.3.up", Down: "shop.3.down"},
+	{Version: 1, Up: "shop.1.up", Down: "shop.1.down"},
+	{Version: 2, Up: "shop.2.up", Down: "shop.2.down"},
+}
+
+func TestSortMigrations(t *testing.T) {
+	sorted, err := sortMigrations("shop", shopMigrations)
+	if err != nil {
+		t.Fatalf("Failed to sort migrations: %v", err)
+	}
+	for i, mig := range sorted {
+		if mig.Version != i+1 {
+			t.Errorf("Expected version %d at %d, got %d", i+1, i, mig.Version)
+		}
+	}
+	if shopMigrations[0].Version != 3 {
+		t.Errorf("Expected given migrations to be left as they are")
+	}
+	invalid := [][]*Migration{
+		{{Version: 1}, {Version: 1}},
+		{{Version: 0}},
+		{{Version: -2}, {Version: 1}},
+	}
+	for _, migrations := range invalid {
+		if _, err = sortMigrations("shop", migrations); err == nil {
+			t.Errorf("Expected versions %d to be rejected",
+				migrations[0].Version)
+		}
+	}
+}
+
+func TestMigrateUpAndDown(t *testing.T) {
+	migrator, restore := useTestMigrator()
+	defer restore()
+	gtx := context.Background()
+	app := &App{modules: []*Module{
+		{Name: "shop", Migrations: shopMigrations},
+		{Name: "empty"},
+	}}
+
+	if err := app.MigrateUp(gtx, "shop", 2); err != nil {
+		t.Fatalf("Failed to migrate shop: %v", err)
+	}
+	if err := app.MigrateUp(gtx, "", 0); err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+	expected := []string{"shop.1.up", "shop.2.up", "store.1.up", "shop.3.up"}
+	if !reflect.DeepEqual(migrator.scripts, expected) {
+		t.Errorf("Expected migrations %v, got %v", expected, migrator.scripts)
+	}
+	status, err := app.MigrationStatus(gtx)
+	if err != nil || len(status) != 2 {
+		t.Fatalf("Expected status of store and shop, got %v, %v",
+			status, err)
+	}
+	for _, st := range status {
+		if st.Current != st.Latest || len(st.Pending) != 0 {
+			t.Errorf("Expected %s to be up to date, got %+v", st.Module, st)
+		}
+	}
+
+	migrator.scripts = nil
+	if err = app.MigrateDown(gtx, "shop", 2); err != nil {
+		t.Fatalf("Failed to revert shop migrations: %v", err)
+	}
+	expected = []string{"shop.3.down", "shop.2.down"}
+	if !reflect.DeepEqual(migrator.scripts, expected) {
+		t.Errorf("Expected reverts %v, got %v", expected, migrator.scripts)
+	}
+	if migrator.versions["shop"] != 1 {
+		t.Errorf("Expected shop at version 1, got %d",
+			migrator.versions["shop"])
+	}
+	if err = app.MigrateDown(gtx, "", 1); err == nil {
+		t.Errorf("Expected revert without module to be rejected")
+	}
+	if err = app.MigrateUp(gtx, "missing", 0); err == nil {
+		t.Errorf("Expected migration of unknown module to fail")
+	}
+}
+
+func TestApplyMigrationsStopsOnFailure(t *testing.T) {
+	migrator, restore := useTestMigrator()
+	defer restore()
+	migrator.failOn = "shop.2.up"
+	err := ApplyMigrations(
+		context.Background(), migrator, "shop", shopMigrations, 0)
+	if err == nil {
+		t.Fatalf("Expected failed migration to be reported")
+	}
+	if migrator.versions["shop"] != 1 ||
+		!reflect.DeepEqual(migrator.scripts, []string{"shop.1.up"}) {
+		t.Errorf("Expected migrations to stop at the failed one, ran %v",
+			migrator.scripts)
+	}
+}
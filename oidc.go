@@ -0,0 +1,445 @@
+package teak
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	echo "github.com/labstack/echo/v4"
+)
+
+//OIDCConfig - configuration for login using an OpenID Connect provider, read
+//from 'oidc' key of the app config. Users logging in for the first time are
+//created with the auth level mapped from RoleClaim using Roles, or DefaultRole
+//which is 'Normal' if not configured. Users are not created if provisioning
+//or registration is disabled, invited users have to accept the invite first.
+//Existing users keep their auth level. Users that were not created by OIDC
+//login are linked only if LinkExistingUsers is set, otherwise the provider
+//could log in as any user with a matching email
+type OIDCConfig struct {
+	Issuer              string            `json:"issuer"`
+	ClientID            string            `json:"clientID"`
+	ClientSecret        string            `json:"clientSecret"`
+	RedirectURL         string            `json:"redirectURL"`
+	Scopes              []string          `json:"scopes"`
+	RoleClaim           string            `json:"roleClaim"`
+	Roles               map[string]string `json:"roles"`
+	DefaultRole         string            `json:"defaultRole"`
+	DisableProvisioning bool              `json:"disableProvisioning"`
+	LinkExistingUsers   bool              `json:"linkExistingUsers"`
+}
+
+//oidcProvider - endpoints of the provider from its discovery document and the
+//keys used by the provider for signing ID tokens
+type oidcProvider struct {
+	Issuer      string `json:"issuer"`
+	AuthURL     string `json:"authorization_endpoint"`
+	TokenURL    string `json:"token_endpoint"`
+	JWKSURL     string `json:"jwks_uri"`
+	keys        map[string]interface{}
+	keysFetched time.Time
+}
+
+var oidcState struct {
+	sync.Mutex
+	provider *oidcProvider
+}
+
+//oidcCookie - cookie that keeps the state, nonce and PKCE verifier between
+//login and callback requests
+const oidcCookie = "teak_oidc"
+
+//oidcFlowTimeout - time within which the login at provider should complete
+const oidcFlowTimeout = 10 * time.Minute
+
+//GetOIDCConfig - gives the OIDC configuration, enabled is false if OIDC is not
+//configured
+func GetOIDCConfig() (cfg OIDCConfig, enabled bool) {
+	if !GetConfig("oidc", &cfg) {
+		return cfg, false
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	if cfg.RoleClaim == "" {
+		cfg.RoleClaim = "role"
+	}
+	if cfg.DefaultRole == "" {
+		cfg.DefaultRole = Normal.String()
+	}
+	return cfg, cfg.Issuer != "" && cfg.ClientID != ""
+}
+
+//getOIDCProvider - gives the provider details, the discovery document is
+//fetched on first use
+func getOIDCProvider(cfg *OIDCConfig) (provider *oidcProvider, err error) {
+	oidcState.Lock()
+	defer oidcState.Unlock()
+	if oidcState.provider != nil {
+		return oidcState.provider, err
+	}
+	discoveryURL := strings.TrimSuffix(cfg.Issuer, "/") +
+		"/.well-known/openid-configuration"
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(discoveryURL)
+	if err != nil {
+		return provider, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return provider, fmt.Errorf("OIDC discovery failed with status %d",
+			resp.StatusCode)
+	}
+	provider = &oidcProvider{}
+	if err = json.NewDecoder(resp.Body).Decode(provider); err != nil {
+		return provider, err
+	}
+	if provider.Issuer != cfg.Issuer {
+		return provider, fmt.Errorf("OIDC issuer mismatch, expected %s got %s",
+			cfg.Issuer, provider.Issuer)
+	}
+	oidcState.provider = provider
+	return provider, err
+}
+
+//key - gives the provider's key with given ID, keys are refetched when an
+//unknown key ID is seen
+func (provider *oidcProvider) key(kid string) (key interface{}, err error) {
+	oidcState.Lock()
+	defer oidcState.Unlock()
+	key, found := provider.keys[kid]
+	if found || time.Since(provider.keysFetched) < minRefetchInterval {
+		if !found {
+			err = fmt.Errorf("Unknown key ID '%s' in ID token", kid)
+		}
+		return key, err
+	}
+	provider.keysFetched = time.Now()
+	jwks, err := fetchJWKS(provider.JWKSURL)
+	if err != nil {
+		return key, err
+	}
+	provider.keys = jwks.publicKeys()
+	if key, found = provider.keys[kid]; !found {
+		err = fmt.Errorf("Unknown key ID '%s' in ID token", kid)
+	}
+	return key, err
+}
+
+//pkceChallenge - S256 code challenge for the verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return b64.EncodeToString(sum[:])
+}
+
+//exchangeCode - exchanges authorization code for tokens at the token endpoint
+//and gives the ID token
+func exchangeCode(
+	gtx context.Context,
+	cfg *OIDCConfig,
+	provider *oidcProvider,
+	code, verifier string) (idToken string, err error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", cfg.RedirectURL)
+	form.Set("client_id", cfg.ClientID)
+	form.Set("code_verifier", verifier)
+	req, err := http.NewRequest(
+		http.MethodPost, provider.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return idToken, err
+	}
+	req = req.WithContext(gtx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cfg.ClientSecret != "" {
+		req.SetBasicAuth(
+			url.QueryEscape(cfg.ClientID), url.QueryEscape(cfg.ClientSecret))
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return idToken, err
+	}
+	defer resp.Body.Close()
+	res := struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+		Desc    string `json:"error_description"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return idToken, err
+	}
+	if resp.StatusCode != http.StatusOK || res.Error != "" {
+		return idToken, fmt.Errorf("Token exchange failed: %s %s",
+			res.Error, res.Desc)
+	}
+	if res.IDToken == "" {
+		return idToken, errors.New("Token response does not have ID token")
+	}
+	return res.IDToken, err
+}
+
+//verifyIDToken - verifies signature, issuer, audience, expiry and nonce of the
+//ID token and gives its claims
+func verifyIDToken(
+	cfg *OIDCConfig,
+	provider *oidcProvider,
+	idToken, nonce string) (claims jwt.MapClaims, err error) {
+	token, err := jwt.Parse(idToken, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, err := provider.key(kid)
+		if err != nil {
+			return nil, err
+		}
+		return key, checkKeyAlg(t, key)
+	})
+	if err != nil {
+		return claims, err
+	}
+	claims = token.Claims.(jwt.MapClaims)
+	switch {
+	case !claims.VerifyIssuer(provider.Issuer, true):
+		err = errors.New("Invalid issuer in ID token")
+	case !hasAudience(claims, cfg.ClientID):
+		err = errors.New("Invalid audience in ID token")
+	case !claims.VerifyExpiresAt(time.Now().Unix(), true):
+		err = errors.New("ID token is expired")
+	case claims["nonce"] != nonce:
+		err = errors.New("Invalid nonce in ID token")
+	}
+	return claims, err
+}
+
+//oidcUser - gives the user for the claims of ID token, the user is created if
+//it does not exist and provisioning is enabled
+func oidcUser(gtx context.Context, cfg *OIDCConfig, claims jwt.MapClaims) (
+	user *User, err error) {
+	email, _ := claims["email"].(string)
+	if email == "" {
+		return user, errors.New("ID token does not have email claim")
+	}
+	//Email is used to find the user, so it has to be verified by provider
+	if claims["email_verified"] != true {
+		return user, errors.New("Email is not verified by identity provider")
+	}
+	user, err = GetUserStorage().GetUser(gtx, ResolveUserID(gtx, email))
+	if err == nil {
+		if user.CreatedBy != "oidc" && !cfg.LinkExistingUsers {
+			return nil, fmt.Errorf(
+				"User %s is not allowed to login with OIDC", user.UserID)
+		}
+		return user, err
+	}
+	//Registration by invitation only applies to identity providers as well
+	if cfg.DisableProvisioning || GetRegistrationConfig().Disabled {
+		return user, fmt.Errorf("User %s is not registered", email)
+	}
+	level, err := mapRole(cfg.Roles, cfg.DefaultRole, claims[cfg.RoleClaim])
+	if err != nil {
+		return user, err
+	}
+	user = &User{
+		UserID:    email,
+		Email:     email,
+		Auth:      level,
+		State:     Active,
+		CreatedBy: "oidc",
+		VerfiedAt: time.Now(),
+	}
+	user.FirstName, _ = claims["given_name"].(string)
+	user.LastName, _ = claims["family_name"].(string)
+	if user.FirstName == "" {
+		user.FirstName, _ = claims["name"].(string)
+	}
+	idHash, err := GetUserStorage().CreateUser(gtx, user)
+	if err != nil {
+		return user, err
+	}
+	Info("t.auth.oidc", "Provisioned user %s with auth level %s",
+		idHash, level)
+	return GetUserStorage().GetUser(gtx, idHash)
+}
+
+//OIDCAuthenticator - authenticator that completes OpenID Connect login. The
+//params should have 'code' given by the provider and the 'codeVerifier' and
+//'nonce' used when starting the login
+func OIDCAuthenticator(
+	gtx context.Context, params map[string]interface{}) (
+	user *User, err error) {
+	defer func() {
+		LogError("t.auth.oidc", err)
+	}()
+	cfg, enabled := GetOIDCConfig()
+	if !enabled {
+		return user, errors.New("OIDC is not configured")
+	}
+	code, _ := params["code"].(string)
+	verifier, _ := params["codeVerifier"].(string)
+	nonce, _ := params["nonce"].(string)
+	if code == "" || verifier == "" || nonce == "" {
+		return user, errors.New("Authorization, invalid OIDC parameters")
+	}
+	provider, err := getOIDCProvider(&cfg)
+	if err != nil {
+		return user, err
+	}
+	idToken, err := exchangeCode(gtx, &cfg, provider, code, verifier)
+	if err != nil {
+		return user, err
+	}
+	claims, err := verifyIDToken(&cfg, provider, idToken, nonce)
+	if err != nil {
+		return user, err
+	}
+	return oidcUser(gtx, &cfg, claims)
+}
+
+//oidcLogin - starts the authorization code flow by redirecting to provider
+func oidcLogin(ctx echo.Context) (err error) {
+	cfg, enabled := GetOIDCConfig()
+	if !enabled {
+		return echo.NewHTTPError(http.StatusNotFound, "OIDC is not configured")
+	}
+	provider, err := getOIDCProvider(&cfg)
+	if err != nil {
+		LogErrorX("t.auth.oidc", "Failed to discover OIDC provider", err)
+		return echo.NewHTTPError(
+			http.StatusBadGateway, "OIDC provider is not available")
+	}
+	var state, nonce, verifier string
+	for _, val := range []*string{&state, &nonce, &verifier} {
+		if *val, err = randomToken(); err != nil {
+			return LogError("t.auth.oidc", err)
+		}
+	}
+	//The cookie is signed, so that it can not be tampered by the client
+	signed, err := SignToken(jwt.MapClaims{
+		"purpose":  "oidc",
+		"state":    state,
+		"nonce":    nonce,
+		"verifier": verifier,
+		"exp":      time.Now().Add(oidcFlowTimeout).Unix(),
+	})
+	if err != nil {
+		return LogError("t.auth.oidc", err)
+	}
+	ctx.SetCookie(&http.Cookie{
+		Name:     oidcCookie,
+		Value:    signed,
+		Path:     "/",
+		MaxAge:   int(oidcFlowTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   ctx.IsTLS(),
+		SameSite: http.SameSiteLaxMode,
+	})
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", cfg.ClientID)
+	query.Set("redirect_uri", cfg.RedirectURL)
+	query.Set("scope", strings.Join(cfg.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", pkceChallenge(verifier))
+	query.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(provider.AuthURL, "?") {
+		sep = "&"
+	}
+	return ctx.Redirect(http.StatusFound, provider.AuthURL+sep+query.Encode())
+}
+
+//oidcFlowParams - reads the flow parameters from cookie and validates the
+//state returned by the provider
+func oidcFlowParams(ctx echo.Context) (params M, err error) {
+	cookie, err := ctx.Cookie(oidcCookie)
+	if err != nil {
+		return params, errors.New("OIDC login is not started or expired")
+	}
+	token, err := ParseToken(cookie.Value)
+	if err != nil {
+		return params, err
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	state, _ := claims["state"].(string)
+	if claims["purpose"] != "oidc" || state == "" ||
+		subtle.ConstantTimeCompare(
+			[]byte(state), []byte(ctx.QueryParam("state"))) != 1 {
+		return params, errors.New("Invalid OIDC state")
+	}
+	params = M{
+		"code":         ctx.QueryParam("code"),
+		"codeVerifier": claims["verifier"],
+		"nonce":        claims["nonce"],
+	}
+	return params, err
+}
+
+//oidcCallback - completes the login when provider redirects back, the tokens
+//or the 2FA challenge are given in the same format as the login endpoint
+func oidcCallback(ctx echo.Context) (err error) {
+	status, msg := DefMS("OIDC login")
+	var data M
+	var user *User
+	defer func() {
+		if user != nil {
+			ctx.Set("userID", user.UserID)
+			ctx.Set("userName", user.FirstName+" "+user.LastName)
+		}
+		countLogin("oidc_login", err)
+		AuditedSendSecret(ctx, &Result{
+			Status: status,
+			Op:     "oidc_login",
+			Msg:    msg,
+			OK:     err == nil,
+			Data:   data,
+			Err:    ErrString(err),
+		})
+		LogError("t.auth.oidc", err)
+	}()
+	//Flow parameters can be used only once
+	ctx.SetCookie(&http.Cookie{
+		Name:     oidcCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	if perr := ctx.QueryParam("error"); perr != "" {
+		msg = "Login failed at identity provider"
+		status = http.StatusUnauthorized
+		err = fmt.Errorf("%s: %s", perr, ctx.QueryParam("error_description"))
+		return err
+	}
+	params, err := oidcFlowParams(ctx)
+	if err != nil {
+		msg = "Invalid OIDC callback"
+		status = http.StatusBadRequest
+		return err
+	}
+	gtx := ctx.Request().Context()
+	user, err = DoLoginWithParams(gtx, params)
+	if err == nil && user.State != Active {
+		err = errors.New("User is not active")
+	}
+	if err != nil {
+		msg = "Login failed"
+		status = http.StatusUnauthorized
+		return err
+	}
+	//Provider does not verify the second factor required by this app, so
+	//the login continues with 'login/2fa' like password login
+	data, msg, err = loginTokens(gtx, user)
+	if err != nil {
+		status = http.StatusInternalServerError
+	}
+	return err
+}
@@ -0,0 +1,221 @@
+package teak
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	echo "github.com/labstack/echo/v4"
+)
+
+//testProvider - mock OpenID Connect provider that issues ID tokens for a
+//single authorization code
+type testProvider struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	code      string
+	challenge string
+	nonce     string
+	claims    jwt.MapClaims
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate provider key: %v", err)
+	}
+	provider := &testProvider{key: key, code: "authcode"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration",
+		func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(M{
+				"issuer":                 provider.URL,
+				"authorization_endpoint": provider.URL + "/auth",
+				"token_endpoint":         provider.URL + "/token",
+				"jwks_uri":               provider.URL + "/jwks",
+			})
+		})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&JWKSet{Keys: []*JWK{{
+			Kty: "RSA",
+			Kid: "k1",
+			N:   b64.EncodeToString(key.N.Bytes()),
+			E:   b64.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", provider.token)
+	provider.Server = httptest.NewServer(mux)
+	return provider
+}
+
+//token - token endpoint, checks the code and PKCE verifier before issuing
+//the ID token
+func (provider *testProvider) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if r.Form.Get("code") != provider.code ||
+		pkceChallenge(r.Form.Get("code_verifier")) != provider.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(M{"error": "invalid_grant"})
+		return
+	}
+	claims := jwt.MapClaims{
+		"iss":   provider.URL,
+		"aud":   "teak-test",
+		"sub":   "ext-1",
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": provider.nonce,
+	}
+	for key, val := range provider.claims {
+		claims[key] = val
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "k1"
+	signed, _ := token.SignedString(provider.key)
+	json.NewEncoder(w).Encode(M{"id_token": signed})
+}
+
+//startOIDCLogin - starts the login and gives the flow cookie and the state,
+//the provider remembers the nonce and challenge like a real one would
+func startOIDCLogin(
+	t *testing.T, provider *testProvider) (cookie *http.Cookie, state string) {
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/oidc/login", nil)
+	rec := httptest.NewRecorder()
+	if err := oidcLogin(echo.New().NewContext(req, rec)); err != nil {
+		t.Fatalf("Failed to start OIDC login: %v", err)
+	}
+	redirect, err := url.Parse(rec.Header().Get(echo.HeaderLocation))
+	if err != nil || rec.Code != http.StatusFound {
+		t.Fatalf("Expected redirect to provider, status %d", rec.Code)
+	}
+	query := redirect.Query()
+	provider.nonce = query.Get("nonce")
+	provider.challenge = query.Get("code_challenge")
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcCookie {
+		t.Fatalf("Expected OIDC flow cookie to be set")
+	}
+	return cookies[0], query.Get("state")
+}
+
+//callOIDCCallback - calls the callback handler like the browser redirected
+//by the provider would
+func callOIDCCallback(
+	cookie *http.Cookie, state, code string) (rec *httptest.ResponseRecorder) {
+	query := url.Values{}
+	query.Set("state", state)
+	query.Set("code", code)
+	req := httptest.NewRequest(http.MethodGet,
+		"/api/v1/oidc/callback?"+query.Encode(), nil)
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	oidcCallback(echo.New().NewContext(req, rec))
+	return rec
+}
+
+//useTestOIDC - configures OIDC login with the mock provider along with the
+//test user storage, the returned function restores the previous setup
+func useTestOIDC(provider *testProvider, cfg M) (
+	storage *testUserStorage, restore func()) {
+	cfg["oidc"] = M{
+		"issuer":      provider.URL,
+		"clientID":    "teak-test",
+		"redirectURL": "http://localhost/api/v1/oidc/callback",
+	}
+	storage, restoreStorage := useTestStorage(cfg)
+	prevAuthn, prevAuthz := authenticator, authorizer
+	authenticator, authorizer = OIDCAuthenticator, nil
+	oidcState.provider = nil
+	restore = func() {
+		restoreStorage()
+		authenticator, authorizer = prevAuthn, prevAuthz
+		oidcState.provider = nil
+	}
+	return storage, restore
+}
+
+func TestOIDCCallback(t *testing.T) {
+	provider := newTestProvider(t)
+	defer provider.Close()
+	storage, restore := useTestOIDC(provider, M{})
+	defer restore()
+
+	provider.claims = jwt.MapClaims{
+		"email":          "oidc@example.com",
+		"email_verified": false,
+	}
+	cookie, state := startOIDCLogin(t, provider)
+	rec := callOIDCCallback(cookie, state, provider.code)
+	if rec.Code != http.StatusUnauthorized || len(storage.users) != 0 {
+		t.Errorf("Expected unverified email to be rejected, status %d",
+			rec.Code)
+	}
+
+	provider.claims["email_verified"] = true
+	provider.claims["given_name"] = "Oidc"
+	cookie, state = startOIDCLogin(t, provider)
+	if rec = callOIDCCallback(cookie, "other", provider.code); rec.Code !=
+		http.StatusBadRequest {
+		t.Errorf("Expected state mismatch to be rejected, status %d",
+			rec.Code)
+	}
+	if rec = callOIDCCallback(cookie, state, "wrong"); rec.Code !=
+		http.StatusUnauthorized {
+		t.Errorf("Expected invalid code to be rejected, status %d", rec.Code)
+	}
+
+	cookie, state = startOIDCLogin(t, provider)
+	rec = callOIDCCallback(cookie, state, provider.code)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected OIDC login to succeed, status %d: %s",
+			rec.Code, rec.Body.String())
+	}
+	res := struct {
+		Data struct {
+			Token string `json:"token"`
+		} `json:"data"`
+	}{}
+	json.Unmarshal(rec.Body.Bytes(), &res)
+	if res.Data.Token == "" {
+		t.Errorf("Expected access token in the response")
+	}
+	user, err := storage.GetUser(
+		context.Background(), UserIDHash("oidc@example.com"))
+	if err != nil {
+		t.Fatalf("Expected user to be provisioned: %v", err)
+	}
+	if user.CreatedBy != "oidc" || user.Auth != Normal ||
+		user.FirstName != "Oidc" {
+		t.Errorf("Unexpected provisioned user %+v", user)
+	}
+}
+
+func TestOIDCRegistrationDisabled(t *testing.T) {
+	provider := newTestProvider(t)
+	defer provider.Close()
+	storage, restore := useTestOIDC(provider, M{
+		"registration": M{"disabled": true},
+	})
+	defer restore()
+	provider.claims = jwt.MapClaims{
+		"email":          "oidc@example.com",
+		"email_verified": true,
+	}
+	cookie, state := startOIDCLogin(t, provider)
+	rec := callOIDCCallback(cookie, state, provider.code)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected login of unregistered user to be rejected, "+
+			"status %d", rec.Code)
+	}
+	if len(storage.users) != 0 {
+		t.Errorf("Expected no user to be created when registration is " +
+			"disabled")
+	}
+}
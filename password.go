@@ -0,0 +1,154 @@
+package teak
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"gopkg.in/hlandau/passlib.v1"
+)
+
+//PasswordPolicy - rules for user passwords, read from 'passwordPolicy' key of
+//the app config. A new password can not be same as any of the last History
+//passwords. Passwords expire MaxAgeDays after they are set, 0 disables expiry
+type PasswordPolicy struct {
+	MinLength     int  `json:"minLength"`
+	RequireUpper  bool `json:"requireUpper"`
+	RequireLower  bool `json:"requireLower"`
+	RequireDigit  bool `json:"requireDigit"`
+	RequireSymbol bool `json:"requireSymbol"`
+	History       int  `json:"history"`
+	MaxAgeDays    int  `json:"maxAgeDays"`
+}
+
+//PolicyViolation - a password policy rule that is not satisfied
+type PolicyViolation struct {
+	Rule string `json:"rule"`
+	Msg  string `json:"msg"`
+}
+
+//PasswordPolicyError - error returned when a password does not satisfy the
+//password policy. The violations are sent to the client so that they can be
+//shown to the user
+type PasswordPolicyError struct {
+	Violations []PolicyViolation `json:"violations"`
+}
+
+func (pe *PasswordPolicyError) Error() string {
+	msgs := make([]string, 0, len(pe.Violations))
+	for _, v := range pe.Violations {
+		msgs = append(msgs, v.Msg)
+	}
+	return "Password does not satisfy the policy: " + strings.Join(msgs, ", ")
+}
+
+//AsPolicyError - gives the password policy error if the err is caused by one
+func AsPolicyError(err error) (pe *PasswordPolicyError, ok bool) {
+	pe, ok = errors.Cause(err).(*PasswordPolicyError)
+	return pe, ok
+}
+
+//passwordFailure - gives status, message and result data for an error from
+//setting a password. Policy violations are sent to the client so that they can
+//be shown to the user
+func passwordFailure(err error, defMsg string) (
+	status int, msg string, data interface{}) {
+	if pe, ok := AsPolicyError(err); ok {
+		return http.StatusBadRequest, pe.Error(), pe
+	}
+	return http.StatusInternalServerError, defMsg, data
+}
+
+//GetPasswordPolicy - gives the password policy, defaults are used for the
+//values that are not configured
+func GetPasswordPolicy() (policy PasswordPolicy) {
+	GetConfig("passwordPolicy", &policy)
+	if policy.MinLength <= 0 {
+		policy.MinLength = 8
+	}
+	return policy
+}
+
+//Check - checks if the password satisfies the policy. The previous hashes are
+//the hashes of earlier passwords of the user, latest first
+func (policy *PasswordPolicy) Check(
+	password string, previous []string) (err error) {
+	violations := make([]PolicyViolation, 0, 6)
+	add := func(rule, msg string) {
+		violations = append(violations, PolicyViolation{Rule: rule, Msg: msg})
+	}
+	if len([]rune(password)) < policy.MinLength {
+		add("minLength", fmt.Sprintf(
+			"must be at least %d characters long", policy.MinLength))
+	}
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+	if policy.RequireUpper && !upper {
+		add("requireUpper", "must contain an uppercase letter")
+	}
+	if policy.RequireLower && !lower {
+		add("requireLower", "must contain a lowercase letter")
+	}
+	if policy.RequireDigit && !digit {
+		add("requireDigit", "must contain a digit")
+	}
+	if policy.RequireSymbol && !symbol {
+		add("requireSymbol", "must contain a symbol")
+	}
+	for i, hash := range previous {
+		if i >= policy.History {
+			break
+		}
+		if _, verr := passlib.Verify(password, hash); verr == nil {
+			add("history", fmt.Sprintf(
+				"must not be one of last %d passwords", policy.History))
+			break
+		}
+	}
+	if len(violations) != 0 {
+		err = &PasswordPolicyError{Violations: violations}
+	}
+	return err
+}
+
+//NextHistory - gives the password history to be stored after the password is
+//changed, the new hash followed by the previous ones
+func (policy *PasswordPolicy) NextHistory(
+	newHash string, previous []string) (history []string) {
+	if policy.History <= 0 {
+		return history
+	}
+	history = append([]string{newHash}, previous...)
+	if len(history) > policy.History {
+		history = history[:policy.History]
+	}
+	return history
+}
+
+//Expiry - gives the expiry time of a password that is set at given time, zero
+//time if passwords do not expire
+func (policy *PasswordPolicy) Expiry(setAt time.Time) (expiry time.Time) {
+	if policy.MaxAgeDays > 0 {
+		expiry = setAt.AddDate(0, 0, policy.MaxAgeDays)
+	}
+	return expiry
+}
+
+//IsPasswordExpired - tells if the password of the user is expired
+func IsPasswordExpired(user *User) bool {
+	return !user.PwdExpiry.IsZero() && time.Now().After(user.PwdExpiry)
+}
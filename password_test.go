@@ -0,0 +1,144 @@
+package teak
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	echo "github.com/labstack/echo/v4"
+	"gopkg.in/hlandau/passlib.v1"
+)
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	policy := PasswordPolicy{
+		MinLength:     10,
+		RequireUpper:  true,
+		RequireLower:  true,
+		RequireDigit:  true,
+		RequireSymbol: true,
+	}
+	cases := []struct {
+		password string
+		rules    []string
+	}{
+		{"Valid pass 1", nil},
+		{"Ünïcödé-Päss1", nil},
+		{"Sh0rt!", []string{"minLength"}},
+		{"no upper case 1", []string{"requireUpper"}},
+		{"NO LOWER CASE 1", []string{"requireLower"}},
+		{"NoDigitsHere!", []string{"requireDigit"}},
+		{"NoSymbolsHere1", []string{"requireSymbol"}},
+		{"short", []string{
+			"minLength", "requireUpper", "requireDigit", "requireSymbol",
+		}},
+	}
+	for _, c := range cases {
+		err := policy.Check(c.password, nil)
+		pe, ok := AsPolicyError(err)
+		if len(c.rules) == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", c.password, err)
+			}
+			continue
+		}
+		if !ok || len(pe.Violations) != len(c.rules) {
+			t.Errorf("%s: expected violations %v, got %v",
+				c.password, c.rules, err)
+			continue
+		}
+		for i, rule := range c.rules {
+			if pe.Violations[i].Rule != rule {
+				t.Errorf("%s: expected violation %s, got %s",
+					c.password, rule, pe.Violations[i].Rule)
+			}
+		}
+	}
+}
+
+func TestPasswordHistory(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 4, History: 2}
+	history := []string{}
+	for _, password := range []string{"first", "second", "third"} {
+		hash, err := passlib.Hash(password)
+		if err != nil {
+			t.Fatalf("Failed to hash password: %v", err)
+		}
+		history = policy.NextHistory(hash, history)
+	}
+	if len(history) != 2 {
+		t.Fatalf("Expected history of 2 passwords, got %d", len(history))
+	}
+	for _, password := range []string{"second", "third"} {
+		pe, ok := AsPolicyError(policy.Check(password, history))
+		if !ok || pe.Violations[0].Rule != "history" {
+			t.Errorf("Expected recent password %s to be rejected", password)
+		}
+	}
+	if err := policy.Check("first", history); err != nil {
+		t.Errorf("Expected password older than history to be allowed: %v",
+			err)
+	}
+	history = (&PasswordPolicy{}).NextHistory("hash", history)
+	if history != nil {
+		t.Errorf("Expected no history when it is disabled, got %v", history)
+	}
+}
+
+func TestPasswordExpiry(t *testing.T) {
+	setAt := time.Date(2021, 1, 30, 10, 0, 0, 0, time.UTC)
+	policy := PasswordPolicy{MaxAgeDays: 30}
+	if expiry := policy.Expiry(setAt); !expiry.Equal(setAt.AddDate(0, 0, 30)) {
+		t.Errorf("Expected expiry after 30 days, got %v", expiry)
+	}
+	if expiry := (&PasswordPolicy{}).Expiry(setAt); !expiry.IsZero() {
+		t.Errorf("Expected no expiry when max age is not set, got %v", expiry)
+	}
+	user := &User{PwdExpiry: time.Now().Add(-time.Minute)}
+	if !IsPasswordExpired(user) {
+		t.Errorf("Expected password to be expired")
+	}
+	if IsPasswordExpired(&User{}) {
+		t.Errorf("Expected password without expiry to be valid")
+	}
+}
+
+func TestExpiredPasswordToken(t *testing.T) {
+	storage, restore := useTestStorage(nil)
+	defer restore()
+	userID := createTestUser(t, storage, "expired", Normal)
+	user := storage.users[userID]
+	user.PwdExpiry = time.Now().Add(-time.Hour)
+
+	data, expired, err := sessionTokens(context.Background(), user)
+	if err != nil || !expired {
+		t.Fatalf("Expected password reset token, error: %v", err)
+	}
+	if data["refreshToken"] != nil {
+		t.Errorf("Expected no refresh token for expired password")
+	}
+	token, _ := data["token"].(string)
+	call := func(method, path string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		ctx := echo.New().NewContext(req, httptest.NewRecorder())
+		ctx.SetPath(path)
+		err := jwtMiddleware(func(ctx echo.Context) error {
+			return nil
+		})(ctx)
+		if he, ok := err.(*echo.HTTPError); ok {
+			return he.Code
+		}
+		return http.StatusOK
+	}
+	status := call(http.MethodPut, "/api/v1/uman/user/password")
+	if status != http.StatusOK {
+		t.Errorf("Expected token to allow password reset, status %d", status)
+	}
+	if status = call(http.MethodGet, "/api/v1/uman/user"); status !=
+		http.StatusUnauthorized {
+		t.Errorf("Expected token to be rejected for other requests, "+
+			"status %d", status)
+	}
+}
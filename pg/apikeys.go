@@ -0,0 +1,68 @@
+package pg
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/varunamachi/teak"
+)
+
+//CreateAPIKey - stores an API key
+func (m *userStorage) CreateAPIKey(
+	gtx context.Context, key *teak.APIKey) (err error) {
+	query := `
+		INSERT INTO teak_api_key(
+			id,
+			user_id,
+			name,
+			hash,
+			auth,
+			created_at,
+			expires_at
+		) VALUES (
+			:id,
+			:user_id,
+			:name,
+			:hash,
+			:auth,
+			:created_at,
+			:expires_at
+		)
+	`
+	_, err = defDB.NamedExecContext(gtx, query, key)
+	return teak.LogErrorX("t.user.pg", "Failed to create API key", err)
+}
+
+//GetAPIKey - gets the API key with given hash
+func (m *userStorage) GetAPIKey(
+	gtx context.Context, keyHash string) (key *teak.APIKey, err error) {
+	key = &teak.APIKey{}
+	err = defDB.GetContext(gtx, key,
+		`SELECT * FROM teak_api_key WHERE hash = $1`, keyHash)
+	return key, teak.LogErrorX("t.user.pg", "Failed to retrieve API key", err)
+}
+
+//GetAPIKeys - gets all the API keys of an user, latest first
+func (m *userStorage) GetAPIKeys(
+	gtx context.Context, userID string) (keys []*teak.APIKey, err error) {
+	keys = make([]*teak.APIKey, 0, 10)
+	err = defDB.SelectContext(gtx, &keys,
+		`SELECT * FROM teak_api_key WHERE user_id = $1
+			ORDER BY created_at DESC`, userID)
+	return keys, teak.LogErrorX("t.user.pg",
+		"Failed to retrieve API keys of user %s", err, userID)
+}
+
+//DeleteAPIKey - deletes the API key with given ID that belongs to the user
+func (m *userStorage) DeleteAPIKey(
+	gtx context.Context, userID, keyID string) (err error) {
+	res, err := defDB.ExecContext(gtx,
+		`DELETE FROM teak_api_key WHERE id = $1 AND user_id = $2`,
+		keyID, userID)
+	if err == nil {
+		if affected, _ := res.RowsAffected(); affected == 0 {
+			err = fmt.Errorf("Could not find API key with ID '%s'", keyID)
+		}
+	}
+	return teak.LogErrorX("t.user.pg", "Failed to delete API key", err)
+}
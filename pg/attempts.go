@@ -0,0 +1,68 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/varunamachi/teak"
+)
+
+//attemptCounter - teak.AttemptCounter that keeps the counts in postgres so
+//that all the nodes of a cluster see the same counts
+type attemptCounter struct{}
+
+//NewAttemptCounter - creates an attempt counter backed by postgres
+func NewAttemptCounter() teak.AttemptCounter {
+	return &attemptCounter{}
+}
+
+//Fail - records a failed attempt for the key and gives the number of
+//consecutive failures. The count starts again if the last failure is older
+//than window
+func (ac *attemptCounter) Fail(
+	gtx context.Context, key string, window time.Duration) (
+	failures int, err error) {
+	now := time.Now()
+	cutoff := now.Add(-window)
+	err = defDB.GetContext(gtx, &failures, `
+		INSERT INTO teak_login_attempt(key, failures, last_failure)
+			VALUES ($1, 1, $2)
+			ON CONFLICT(key) DO UPDATE SET
+				failures = CASE
+					WHEN teak_login_attempt.last_failure < $3 THEN 1
+					ELSE teak_login_attempt.failures + 1
+				END,
+				last_failure = EXCLUDED.last_failure
+			RETURNING failures`, key, now, cutoff)
+	if err == nil {
+		_, err = defDB.ExecContext(gtx,
+			`DELETE FROM teak_login_attempt WHERE last_failure < $1`, cutoff)
+	}
+	return failures, teak.LogErrorX("t.pg.store",
+		"Failed to record failed attempt", err)
+}
+
+//Failures - gives the number of consecutive failures for the key and the time
+//of last failure
+func (ac *attemptCounter) Failures(
+	gtx context.Context, key string, window time.Duration) (
+	failures int, last time.Time, err error) {
+	err = defDB.QueryRowContext(gtx, `
+		SELECT failures, last_failure FROM teak_login_attempt
+			WHERE key = $1 AND last_failure >= $2`,
+		key, time.Now().Add(-window)).Scan(&failures, &last)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return failures, last, teak.LogErrorX("t.pg.store",
+		"Failed to get failed attempts", err)
+}
+
+//Clear - forgets the failures of the key
+func (ac *attemptCounter) Clear(
+	gtx context.Context, key string) (err error) {
+	_, err = defDB.ExecContext(gtx,
+		`DELETE FROM teak_login_attempt WHERE key = $1`, key)
+	return teak.LogErrorX("t.pg.store", "Failed to clear failed attempts", err)
+}
@@ -5,13 +5,13 @@ import (
 	"gopkg.in/urfave/cli.v1"
 )
 
-//NewDefaultApp - creates a new app with MongoDB based storage providers
+//NewDefaultApp - creates a new app with postgres based storage providers
 func NewDefaultApp(
 	name string,
 	appVersion teak.Version,
 	apiVersion int,
 	desc string) *teak.App {
-	return teak.NewApp(
+	app := teak.NewApp(
 		name,
 		appVersion,
 		apiVersion,
@@ -21,6 +21,9 @@ func NewDefaultApp(
 		NewUserStorage(),
 		NewStorage(),
 	)
+	teak.SetEventAuditor(NewAuditor())
+	teak.SetAttemptCounter(NewAttemptCounter())
+	return app
 }
 
 func requirePostgres(ctx *cli.Context) (err error) {
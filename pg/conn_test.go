@@ -0,0 +1,163 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+//fakeStmt - statement executed on the fake database along with its arguments
+type fakeStmt struct {
+	query string
+	args  []driver.Value
+}
+
+//fakeRows - canned result for a query on the fake database
+type fakeRows struct {
+	cols []string
+	vals [][]driver.Value
+}
+
+//fakeDB - database driver that records the statements and answers queries
+//with canned rows in the order in which they are added. Statements that
+//contain failOn fail
+type fakeDB struct {
+	sync.Mutex
+	stmts     []fakeStmt
+	rows      []*fakeRows
+	commits   int
+	rollbacks int
+	failOn    string
+}
+
+//useFakeDB - makes the fake database the default connection, the returned
+//function restores the previous connection
+func useFakeDB() (fdb *fakeDB, restore func()) {
+	fdb = &fakeDB{}
+	prev := defDB
+	defDB = sqlx.NewDb(sql.OpenDB(fdb), "postgres")
+	return fdb, func() {
+		defDB.Close()
+		defDB = prev
+	}
+}
+
+func (fdb *fakeDB) addRows(cols []string, vals ...[]driver.Value) {
+	fdb.Lock()
+	defer fdb.Unlock()
+	fdb.rows = append(fdb.rows, &fakeRows{cols: cols, vals: vals})
+}
+
+func (fdb *fakeDB) record(query string, args []driver.Value) (err error) {
+	fdb.Lock()
+	defer fdb.Unlock()
+	fdb.stmts = append(fdb.stmts, fakeStmt{query: query, args: args})
+	if fdb.failOn != "" && strings.Contains(query, fdb.failOn) {
+		err = errors.New("fake failure")
+	}
+	return err
+}
+
+func (fdb *fakeDB) Connect(gtx context.Context) (driver.Conn, error) {
+	return &fakeConn{fdb: fdb}, nil
+}
+
+func (fdb *fakeDB) Driver() driver.Driver {
+	return nil
+}
+
+type fakeConn struct {
+	fdb *fakeDB
+}
+
+func (fc *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeDriverStmt{fdb: fc.fdb, query: query}, nil
+}
+
+func (fc *fakeConn) Close() error {
+	return nil
+}
+
+func (fc *fakeConn) Begin() (driver.Tx, error) {
+	return &fakeTx{fdb: fc.fdb}, nil
+}
+
+type fakeTx struct {
+	fdb *fakeDB
+}
+
+func (tx *fakeTx) Commit() error {
+	tx.fdb.Lock()
+	defer tx.fdb.Unlock()
+	tx.fdb.commits++
+	return nil
+}
+
+func (tx *fakeTx) Rollback() error {
+	tx.fdb.Lock()
+	defer tx.fdb.Unlock()
+	tx.fdb.rollbacks++
+	return nil
+}
+
+type fakeDriverStmt struct {
+	fdb   *fakeDB
+	query string
+}
+
+func (st *fakeDriverStmt) Close() error {
+	return nil
+}
+
+func (st *fakeDriverStmt) NumInput() int {
+	return -1
+}
+
+func (st *fakeDriverStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if err := st.fdb.record(st.query, args); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (st *fakeDriverStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if err := st.fdb.record(st.query, args); err != nil {
+		return nil, err
+	}
+	st.fdb.Lock()
+	defer st.fdb.Unlock()
+	if len(st.fdb.rows) == 0 {
+		return nil, errors.New("no rows prepared for query")
+	}
+	rows := st.fdb.rows[0]
+	st.fdb.rows = st.fdb.rows[1:]
+	return &fakeDriverRows{rows: rows}, nil
+}
+
+type fakeDriverRows struct {
+	rows *fakeRows
+	next int
+}
+
+func (fr *fakeDriverRows) Columns() []string {
+	return fr.rows.cols
+}
+
+func (fr *fakeDriverRows) Close() error {
+	return nil
+}
+
+func (fr *fakeDriverRows) Next(dest []driver.Value) error {
+	if fr.next >= len(fr.rows.vals) {
+		return io.EOF
+	}
+	copy(dest, fr.rows.vals[fr.next])
+	fr.next++
+	return nil
+}
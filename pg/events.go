@@ -0,0 +1,134 @@
+package pg
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/varunamachi/teak"
+)
+
+//eventColumns - maps JSON field names of teak.Event to teak_event columns
+var eventColumns = map[string]string{
+	"op":           "op",
+	"userID":       "user_id",
+	"userName":     "user_name",
+	"realUserID":   "real_user_id",
+	"realUserName": "real_user_name",
+	"success":      "success",
+	"error":        "error",
+	"time":         "time",
+	"data":         "data",
+}
+
+//eventAuditor - postgres based event auditor, events are stored in teak_event
+//table
+type eventAuditor struct{}
+
+//NewAuditor - creates a new postgres based event auditor
+func NewAuditor() teak.EventAuditor {
+	return &eventAuditor{}
+}
+
+//LogEvent - logs given event into teak_event table. Failure to log the event
+//is logged but not propagated
+func (ea *eventAuditor) LogEvent(event *teak.Event) {
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		teak.LogErrorX("t.pg.event", "Failed to marshal data for event %s",
+			err, event.Op)
+		data = []byte("null")
+	}
+	query := `
+		INSERT INTO teak_event(
+			op,
+			user_id,
+			user_name,
+			real_user_id,
+			real_user_name,
+			success,
+			error,
+			time,
+			data
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9::jsonb)
+	`
+	_, err = defDB.ExecContext(context.Background(), query,
+		event.Op,
+		event.UserID,
+		event.UserName,
+		event.RealUserID,
+		event.RealUserName,
+		event.Success,
+		event.Error,
+		event.Time,
+		string(data))
+	teak.LogErrorX("t.pg.event", "Failed to log event %s", err, event.Op)
+}
+
+//GetEvents - retrieves event entries based on filters, latest events come
+//first
+func (ea *eventAuditor) GetEvents(
+	offset, limit int64,
+	filter *teak.Filter) (total int64, events []*teak.Event, err error) {
+	defer func() {
+		err = teak.LogErrorX("t.pg.event", "Failed to retrieve events", err)
+	}()
+	//Postgres rejects negative offsets, negative limit selects all like 0
+	if offset < 0 {
+		offset = 0
+	}
+	if limit < 0 {
+		limit = 0
+	}
+	selector, args, err := generateSelector(filter, eventColumns)
+	if err != nil {
+		return total, events, err
+	}
+	gtx := context.Background()
+	err = defDB.GetContext(gtx, &total,
+		`SELECT COUNT(*) FROM teak_event`+selector, args...)
+	if err != nil {
+		return total, events, err
+	}
+	query := `
+		SELECT op, user_id, user_name, real_user_id, real_user_name, success,
+			error, time, data
+		FROM teak_event` + selector +
+		` ORDER BY time DESC` + pageClause(offset, limit)
+	events = make([]*teak.Event, 0, limit)
+	err = defDB.SelectContext(gtx, &events, query, args...)
+	if err != nil {
+		return total, events, err
+	}
+	for _, event := range events {
+		if raw, ok := event.Data.([]byte); ok {
+			var data interface{}
+			if err = json.Unmarshal(raw, &data); err != nil {
+				return total, events, err
+			}
+			event.Data = data
+		}
+	}
+	return total, events, err
+}
+
+//CreateIndices - creates indices on commonly filtered columns of teak_event
+func (ea *eventAuditor) CreateIndices() (err error) {
+	queries := []string{
+		`CREATE INDEX IF NOT EXISTS idx_event_op ON teak_event(op)`,
+		`CREATE INDEX IF NOT EXISTS idx_event_user ON teak_event(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_event_time ON teak_event(time)`,
+	}
+	for _, query := range queries {
+		_, err = defDB.ExecContext(context.Background(), query)
+		if err != nil {
+			break
+		}
+	}
+	return teak.LogErrorX("t.pg.event", "Failed to create event indices", err)
+}
+
+//CleanData - deletes all the events
+func (ea *eventAuditor) CleanData() (err error) {
+	_, err = defDB.ExecContext(context.Background(), `DELETE FROM teak_event`)
+	return teak.LogErrorX("t.pg.event", "Failed to delete events", err)
+}
@@ -0,0 +1,90 @@
+package pg
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/varunamachi/teak"
+)
+
+func TestLogEvent(t *testing.T) {
+	fdb, restore := useFakeDB()
+	defer restore()
+	at := time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)
+	NewAuditor().LogEvent(&teak.Event{
+		Op:           "user.delete",
+		UserID:       "u1",
+		UserName:     "Admin",
+		RealUserID:   "s1",
+		RealUserName: "Super",
+		Success:      true,
+		Time:         at,
+		Data:         teak.M{"deleted": "u2"},
+	})
+	if len(fdb.stmts) != 1 ||
+		!strings.Contains(fdb.stmts[0].query, "INSERT INTO teak_event") {
+		t.Fatalf("Expected an insert into teak_event, got %+v", fdb.stmts)
+	}
+	args := fdb.stmts[0].args
+	expected := []driver.Value{
+		"user.delete", "u1", "Admin", "s1", "Super", true, "", at,
+		`{"deleted":"u2"}`,
+	}
+	if len(args) != len(expected) {
+		t.Fatalf("Expected %d arguments, got %d", len(expected), len(args))
+	}
+	for i, arg := range expected {
+		if args[i] != arg {
+			t.Errorf("Argument %d: expected %v, got %v", i+1, arg, args[i])
+		}
+	}
+}
+
+func TestGetEvents(t *testing.T) {
+	fdb, restore := useFakeDB()
+	defer restore()
+	at := time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)
+	fdb.addRows([]string{"count"}, []driver.Value{int64(7)})
+	fdb.addRows(
+		[]string{"op", "user_id", "user_name", "real_user_id",
+			"real_user_name", "success", "error", "time", "data"},
+		[]driver.Value{"user.login", "u1", "User", "", "", false,
+			"invalid password", at, []byte(`{"attempt":3}`)},
+	)
+	filter := &teak.Filter{Props: map[string]teak.Matcher{
+		"userID": {Fields: []interface{}{"u1"}},
+	}}
+	total, events, err := NewAuditor().GetEvents(-10, 5, filter)
+	if err != nil {
+		t.Fatalf("Failed to get events: %v", err)
+	}
+	if total != 7 || len(events) != 1 {
+		t.Fatalf("Expected 1 of 7 events, got %d of %d", len(events), total)
+	}
+	event := events[0]
+	if event.Op != "user.login" || event.Success ||
+		event.Error != "invalid password" || !event.Time.Equal(at) {
+		t.Errorf("Unexpected event %+v", event)
+	}
+	data, ok := event.Data.(map[string]interface{})
+	if !ok || data["attempt"] != float64(3) {
+		t.Errorf("Expected event data to be decoded, got %#v", event.Data)
+	}
+
+	if len(fdb.stmts) != 2 {
+		t.Fatalf("Expected count and select queries, got %d", len(fdb.stmts))
+	}
+	for _, stmt := range fdb.stmts {
+		if !strings.Contains(stmt.query, "WHERE (user_id = $1)") ||
+			len(stmt.args) != 1 || stmt.args[0] != "u1" {
+			t.Errorf("Expected filter on user_id, got %q with %v",
+				stmt.query, stmt.args)
+		}
+	}
+	query := fdb.stmts[1].query
+	if !strings.Contains(query, "ORDER BY time DESC OFFSET 0 LIMIT 5") {
+		t.Errorf("Expected latest events first within page, got %q", query)
+	}
+}
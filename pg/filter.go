@@ -0,0 +1,357 @@
+package pg
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jinzhu/now"
+	"github.com/varunamachi/teak"
+)
+
+//identRx - matches the identifiers that are allowed as field names in filters
+//and sort fields. Anything else is rejected so that field names can be safely
+//used in queries
+var identRx = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+//userColumns - maps JSON field names of teak.User to teak_user columns
+var userColumns = map[string]string{
+	"userID":     "id",
+	"email":      "email",
+	"auth":       "auth",
+	"firstName":  "first_name",
+	"lastName":   "last_name",
+	"title":      "title",
+	"fullName":   "full_name",
+	"state":      "state",
+	"ver_id":     "ver_id",
+	"pwdExpiry":  "pwd_expiry",
+	"createdAt":  "created_at",
+	"createdBy":  "created_by",
+	"modifiedAt": "modified_at",
+	"modifiedBy": "modified_by",
+	"verifiedAt": "verified_at",
+	"props":      "props",
+}
+
+//selectorGen - generates parameterised SQL conditions from teak.Filter. Values
+//are never written into the query, they are collected as arguments
+type selectorGen struct {
+	columns map[string]string
+	conds   []string
+	args    []interface{}
+}
+
+//arg - adds an argument and gives the placeholder for it
+func (sg *selectorGen) arg(val interface{}) string {
+	sg.args = append(sg.args, val)
+	return "$" + strconv.Itoa(len(sg.args))
+}
+
+//column - gives SQL expression for the field. The first component of a dot
+//seperated field is the column, rest of the components are treated as path
+//inside JSONB column. If asText is true JSON values are extracted as text
+func (sg *selectorGen) column(field string, asText bool) (
+	expr string, isPath bool, err error) {
+	parts := strings.Split(field, ".")
+	for _, part := range parts {
+		if !identRx.MatchString(part) {
+			err = fmt.Errorf("Invalid field name '%s' in filter", field)
+			return expr, isPath, err
+		}
+	}
+	col := parts[0]
+	if mapped, found := sg.columns[col]; found {
+		col = mapped
+	}
+	if len(parts) == 1 {
+		return col, false, err
+	}
+	op := "#>"
+	if asText {
+		op = "#>>"
+	}
+	expr = fmt.Sprintf("%s%s'{%s}'", col, op, strings.Join(parts[1:], ","))
+	return expr, true, err
+}
+
+//textOf - gives text representation of a value as extracted by #>> operator
+func textOf(val interface{}) string {
+	if str, ok := val.(string); ok {
+		return str
+	}
+	b, err := json.Marshal(val)
+	if err != nil {
+		return fmt.Sprint(val)
+	}
+	return string(b)
+}
+
+//jsonArrayOf - gives JSON array containing given values
+func jsonArrayOf(vals ...interface{}) string {
+	b, err := json.Marshal(vals)
+	if err != nil {
+		return "[]"
+	}
+	return string(b)
+}
+
+func sortedKeys(mp interface{}) []string {
+	keys := make([]string, 0, 10)
+	switch m := mp.(type) {
+	case map[string]teak.Matcher:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]interface{}:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]teak.DateRange:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//join - joins the conditions based on match strategy. For MatchNone the
+//negated condition also selects rows that do not have a value for the column
+func join(col string, strategy teak.MatchStrategy, conds []string) string {
+	switch strategy {
+	case teak.MatchAll:
+		return "(" + strings.Join(conds, " AND ") + ")"
+	case teak.MatchNone:
+		return fmt.Sprintf("(%s IS NULL OR NOT (%s))",
+			col, strings.Join(conds, " OR "))
+	}
+	return "(" + strings.Join(conds, " OR ") + ")"
+}
+
+//props - conditions for scalar values, same semantics as $in, $all and $nin
+func (sg *selectorGen) props(field string, matcher *teak.Matcher) error {
+	col, isPath, err := sg.column(field, true)
+	if err != nil {
+		return err
+	}
+	conds := make([]string, 0, len(matcher.Fields))
+	for _, val := range matcher.Fields {
+		if isPath {
+			val = textOf(val)
+		}
+		conds = append(conds, col+" = "+sg.arg(val))
+	}
+	sg.conds = append(sg.conds, join(col, matcher.Strategy, conds))
+	return nil
+}
+
+//lists - conditions for array and JSONB array columns. Both are converted to
+//JSONB so that containment operator works irrespective of the column type
+func (sg *selectorGen) lists(field string, matcher *teak.Matcher) error {
+	col, _, err := sg.column(field, false)
+	if err != nil {
+		return err
+	}
+	conds := make([]string, 0, len(matcher.Fields))
+	for _, val := range matcher.Fields {
+		conds = append(conds, fmt.Sprintf("to_jsonb(%s) @> %s::jsonb",
+			col, sg.arg(jsonArrayOf(val))))
+	}
+	sg.conds = append(sg.conds, join(col, matcher.Strategy, conds))
+	return nil
+}
+
+//bools - condition for boolean fields
+func (sg *selectorGen) bools(field string, val interface{}) error {
+	col, isPath, err := sg.column(field, true)
+	if err != nil {
+		return err
+	}
+	if isPath {
+		val = textOf(val)
+	}
+	sg.conds = append(sg.conds, col+" = "+sg.arg(val))
+	return nil
+}
+
+//dates - condition for date range, range covers from the beginning of the
+//'From' day till the end of the 'To' day
+func (sg *selectorGen) dates(field string, dateRange *teak.DateRange) error {
+	col, isPath, err := sg.column(field, true)
+	if err != nil {
+		return err
+	}
+	if isPath {
+		col = "(" + col + ")::timestamptz"
+	}
+	sg.conds = append(sg.conds, fmt.Sprintf("%s BETWEEN %s AND %s",
+		col,
+		sg.arg(now.New(dateRange.From).BeginningOfDay()),
+		sg.arg(now.New(dateRange.To).EndOfDay())))
+	return nil
+}
+
+//searches - case insensitive search for the given strings in the field
+func (sg *selectorGen) searches(field string, matcher *teak.Matcher) error {
+	col, isPath, err := sg.column(field, true)
+	if err != nil {
+		return err
+	}
+	if !isPath {
+		col = col + "::text"
+	}
+	escaper := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	conds := make([]string, 0, len(matcher.Fields))
+	for _, val := range matcher.Fields {
+		pattern := "%" + escaper.Replace(fmt.Sprint(val)) + "%"
+		conds = append(conds, col+" ILIKE "+sg.arg(pattern))
+	}
+	sg.conds = append(sg.conds, join(col, matcher.Strategy, conds))
+	return nil
+}
+
+//owner - condition that selects records owned by or shared with the user
+func (sg *selectorGen) owner(owner *teak.OwnerFilter) error {
+	col, isPath, err := sg.column(owner.OwnerField, true)
+	if err != nil {
+		return err
+	}
+	if !isPath {
+		col = col + "::text"
+	}
+	cond := col + " = " + sg.arg(owner.UserID)
+	if owner.SharedField != "" {
+		shared, _, err := sg.column(owner.SharedField, false)
+		if err != nil {
+			return err
+		}
+		cond = fmt.Sprintf("(%s OR to_jsonb(%s) @> %s::jsonb)",
+			cond, shared, sg.arg(jsonArrayOf(owner.UserID)))
+	}
+	sg.conds = append(sg.conds, cond)
+	return nil
+}
+
+func (sg *selectorGen) generate(filter *teak.Filter) (err error) {
+	if filter == nil {
+		return err
+	}
+	if filter.Owner != nil {
+		if err = sg.owner(filter.Owner); err != nil {
+			return err
+		}
+	}
+	for _, field := range sortedKeys(filter.Props) {
+		matcher := filter.Props[field]
+		if len(matcher.Fields) != 0 {
+			if err = sg.props(field, &matcher); err != nil {
+				return err
+			}
+		}
+	}
+	for _, field := range sortedKeys(filter.Bools) {
+		if val := filter.Bools[field]; val != nil {
+			if err = sg.bools(field, val); err != nil {
+				return err
+			}
+		}
+	}
+	for _, field := range sortedKeys(filter.Dates) {
+		dateRange := filter.Dates[field]
+		if dateRange.IsValid() {
+			if err = sg.dates(field, &dateRange); err != nil {
+				return err
+			}
+		}
+	}
+	for _, field := range sortedKeys(filter.Lists) {
+		matcher := filter.Lists[field]
+		if len(matcher.Fields) != 0 {
+			if err = sg.lists(field, &matcher); err != nil {
+				return err
+			}
+		}
+	}
+	for _, field := range sortedKeys(filter.Searches) {
+		matcher := filter.Searches[field]
+		if len(matcher.Fields) != 0 {
+			if err = sg.searches(field, &matcher); err != nil {
+				return err
+			}
+		}
+	}
+	return err
+}
+
+//generateSelector - creates a parameterised WHERE clause for the filter. The
+//clause starts with a space so that it can be appended to a query directly.
+//If the filter does not select anything an empty string is returned. Column
+//names can be mapped from field names using the columns map, fields not
+//present in the map are used as column names
+func generateSelector(
+	filter *teak.Filter,
+	columns map[string]string) (
+	selector string, args []interface{}, err error) {
+	sg := selectorGen{
+		columns: columns,
+		conds:   make([]string, 0, 10),
+		args:    make([]interface{}, 0, 10),
+	}
+	if err = sg.generate(filter); err != nil {
+		return selector, args, err
+	}
+	if len(sg.conds) != 0 {
+		selector = " WHERE " + strings.Join(sg.conds, " AND ")
+	}
+	return selector, sg.args, err
+}
+
+//generateKeySelector - creates a parameterised WHERE clause that selects the
+//record with given key which also matches the filter. Placeholders are
+//numbered after the given arguments, which are returned along with the
+//arguments of the clause
+func generateKeySelector(
+	keyField string,
+	key interface{},
+	filter *teak.Filter,
+	args []interface{}) (selector string, allArgs []interface{}, err error) {
+	sg := selectorGen{
+		conds: make([]string, 0, 10),
+		args:  args,
+	}
+	col, _, err := sg.column(keyField, false)
+	if err != nil {
+		return selector, args, err
+	}
+	sg.conds = append(sg.conds, col+" = "+sg.arg(key))
+	if err = sg.generate(filter); err != nil {
+		return selector, args, err
+	}
+	selector = " WHERE " + strings.Join(sg.conds, " AND ")
+	return selector, sg.args, err
+}
+
+//generateSort - creates ORDER BY clause for the sort field. If the field
+//starts with '-' the order is descending
+func generateSort(
+	sortField string, columns map[string]string) (order string, err error) {
+	if sortField == "" {
+		return order, err
+	}
+	dir := "ASC"
+	if strings.HasPrefix(sortField, "-") {
+		dir = "DESC"
+		sortField = sortField[1:]
+	}
+	sg := selectorGen{columns: columns}
+	col, _, err := sg.column(sortField, true)
+	if err != nil {
+		return order, err
+	}
+	order = " ORDER BY " + col + " " + dir
+	return order, err
+}
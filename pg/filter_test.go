@@ -0,0 +1,184 @@
+package pg
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/varunamachi/teak"
+)
+
+func TestGenerateSelector(t *testing.T) {
+	day := time.Date(2020, 6, 15, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name     string
+		filter   *teak.Filter
+		selector string
+		args     []interface{}
+	}{
+		{
+			name: "nil filter",
+		},
+		{
+			name: "empty matchers are ignored",
+			filter: &teak.Filter{
+				Props: map[string]teak.Matcher{"state": {}},
+				Bools: map[string]interface{}{"active": nil},
+			},
+		},
+		{
+			name: "props",
+			filter: &teak.Filter{Props: map[string]teak.Matcher{
+				"state": {
+					Strategy: teak.MatchOne,
+					Fields:   []interface{}{"active", "locked"},
+				},
+			}},
+			selector: " WHERE (state = $1 OR state = $2)",
+			args:     []interface{}{"active", "locked"},
+		},
+		{
+			name: "props none on JSON path",
+			filter: &teak.Filter{Props: map[string]teak.Matcher{
+				"props.level": {
+					Strategy: teak.MatchNone,
+					Fields:   []interface{}{3},
+				},
+			}},
+			selector: " WHERE (props#>>'{level}' IS NULL OR " +
+				"NOT (props#>>'{level}' = $1))",
+			args: []interface{}{"3"},
+		},
+		{
+			name: "mapped columns in field order",
+			filter: &teak.Filter{
+				Bools: map[string]interface{}{"verified": true},
+				Lists: map[string]teak.Matcher{
+					"tags": {
+						Strategy: teak.MatchAll,
+						Fields:   []interface{}{"a", "b"},
+					},
+				},
+				Searches: map[string]teak.Matcher{
+					"firstName": {Fields: []interface{}{"50%_off"}},
+				},
+			},
+			selector: " WHERE verified = $1" +
+				" AND (to_jsonb(tags) @> $2::jsonb" +
+				" AND to_jsonb(tags) @> $3::jsonb)" +
+				" AND (first_name::text ILIKE $4)",
+			args: []interface{}{true, `["a"]`, `["b"]`, `%50\%\_off%`},
+		},
+		{
+			name: "dates cover whole days",
+			filter: &teak.Filter{Dates: map[string]teak.DateRange{
+				"createdAt": {From: day, To: day},
+			}},
+			selector: " WHERE created_at BETWEEN $1 AND $2",
+			args: []interface{}{
+				time.Date(2020, 6, 15, 0, 0, 0, 0, time.UTC),
+				time.Date(2020, 6, 15, 23, 59, 59, 999999999, time.UTC),
+			},
+		},
+		{
+			name: "owner comes first",
+			filter: &teak.Filter{
+				Props: map[string]teak.Matcher{
+					"state": {Fields: []interface{}{"active"}},
+				},
+				Owner: &teak.OwnerFilter{
+					OwnerField:  "createdBy",
+					SharedField: "sharedWith",
+					UserID:      "u1",
+				},
+			},
+			selector: " WHERE (created_by::text = $1" +
+				" OR to_jsonb(sharedWith) @> $2::jsonb)" +
+				" AND (state = $3)",
+			args: []interface{}{"u1", `["u1"]`, "active"},
+		},
+	}
+	for _, c := range cases {
+		selector, args, err := generateSelector(c.filter, userColumns)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+			continue
+		}
+		if selector != c.selector {
+			t.Errorf("%s: expected selector\n%q\ngot\n%q",
+				c.name, c.selector, selector)
+		}
+		if len(c.args) == 0 && len(args) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(args, c.args) {
+			t.Errorf("%s: expected args %#v, got %#v", c.name, c.args, args)
+		}
+	}
+}
+
+func TestGenerateSelectorRejectsInvalidFields(t *testing.T) {
+	fields := []string{
+		"name; DROP TABLE teak_user",
+		"props.a'b",
+		"1abc",
+		"a..b",
+		"",
+	}
+	for _, field := range fields {
+		filter := &teak.Filter{Props: map[string]teak.Matcher{
+			field: {Fields: []interface{}{"x"}},
+		}}
+		if _, _, err := generateSelector(filter, nil); err == nil {
+			t.Errorf("Expected field '%s' to be rejected", field)
+		}
+	}
+	owner := &teak.Filter{Owner: &teak.OwnerFilter{
+		OwnerField: "owner) OR (1=1",
+		UserID:     "u1",
+	}}
+	if _, _, err := generateSelector(owner, nil); err == nil {
+		t.Errorf("Expected invalid owner field to be rejected")
+	}
+}
+
+func TestGenerateKeySelector(t *testing.T) {
+	filter := &teak.Filter{Bools: map[string]interface{}{"active": true}}
+	selector, args, err := generateKeySelector(
+		"id", "k1", filter, []interface{}{"first"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if expected := " WHERE id = $2 AND active = $3"; selector != expected {
+		t.Errorf("Expected selector %q, got %q", expected, selector)
+	}
+	expectedArgs := []interface{}{"first", "k1", true}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("Expected args %#v, got %#v", expectedArgs, args)
+	}
+	if _, _, err = generateKeySelector("id = id", "k1", nil, nil); err == nil {
+		t.Errorf("Expected invalid key field to be rejected")
+	}
+}
+
+func TestGenerateSort(t *testing.T) {
+	cases := []struct {
+		field string
+		order string
+		fails bool
+	}{
+		{"", "", false},
+		{"createdAt", " ORDER BY created_at ASC", false},
+		{"-props.rank", " ORDER BY props#>>'{rank}' DESC", false},
+		{"-name desc", "", true},
+	}
+	for _, c := range cases {
+		order, err := generateSort(c.field, userColumns)
+		if (err != nil) != c.fails {
+			t.Errorf("%s: unexpected error %v", c.field, err)
+		}
+		if order != c.order {
+			t.Errorf("%s: expected %q, got %q", c.field, c.order, order)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package pg
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/varunamachi/teak"
+)
+
+//groupRow - row of the group query, members are aggregated into an array
+type groupRow struct {
+	Name  string         `db:"name"`
+	Users pq.StringArray `db:"users"`
+}
+
+const groupQuery = `
+	SELECT
+		g.name,
+		COALESCE(
+			array_agg(m.user_id ORDER BY m.user_id)
+				FILTER (WHERE m.user_id IS NOT NULL),
+			'{}') AS users
+	FROM teak_group g
+		LEFT JOIN teak_group_member m ON m.group_name = g.name
+`
+
+//CreateGroup - creates a group with given members
+func (m *userStorage) CreateGroup(
+	gtx context.Context, group *teak.Group) (err error) {
+	defer func() {
+		err = teak.LogErrorX("t.user.pg",
+			"Failed to create group %s", err, group.Name)
+	}()
+	tx, err := defDB.BeginTxx(gtx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	_, err = tx.ExecContext(gtx,
+		`INSERT INTO teak_group(name) VALUES($1)`, group.Name)
+	if err != nil {
+		return err
+	}
+	if err = addMembers(gtx, tx, group.Name, group.Users); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+//addMembers - adds the users to the group, existing members are ignored
+func addMembers(gtx context.Context,
+	execer sqlx.ExecerContext, name string, userIDs []string) (err error) {
+	if len(userIDs) == 0 {
+		return err
+	}
+	_, err = execer.ExecContext(gtx, `
+		INSERT INTO teak_group_member(group_name, user_id)
+			SELECT $1, unnest($2::TEXT[])
+			ON CONFLICT DO NOTHING`, name, pq.StringArray(userIDs))
+	return err
+}
+
+//GetGroup - gets the group with given name along with its members
+func (m *userStorage) GetGroup(
+	gtx context.Context, name string) (group *teak.Group, err error) {
+	var row groupRow
+	err = defDB.GetContext(gtx, &row,
+		groupQuery+` WHERE g.name = $1 GROUP BY g.name`, name)
+	if err != nil {
+		return nil, teak.LogErrorX("t.user.pg",
+			"Failed to retrieve group %s", err, name)
+	}
+	group = &teak.Group{Name: row.Name, Users: row.Users}
+	return group, err
+}
+
+//GetGroups - gets all the groups along with their members
+func (m *userStorage) GetGroups(
+	gtx context.Context) (groups []*teak.Group, err error) {
+	rows := make([]*groupRow, 0, 100)
+	err = defDB.SelectContext(gtx, &rows,
+		groupQuery+` GROUP BY g.name ORDER BY g.name`)
+	if err != nil {
+		return groups, teak.LogErrorX("t.user.pg",
+			"Failed to retrieve groups", err)
+	}
+	groups = make([]*teak.Group, 0, len(rows))
+	for _, row := range rows {
+		groups = append(groups, &teak.Group{Name: row.Name, Users: row.Users})
+	}
+	return groups, err
+}
+
+//DeleteGroup - deletes the group with given name, memberships are removed by
+//the foreign key constraint
+func (m *userStorage) DeleteGroup(
+	gtx context.Context, name string) (err error) {
+	res, err := defDB.ExecContext(gtx,
+		`DELETE FROM teak_group WHERE name = $1`, name)
+	if err == nil {
+		if affected, _ := res.RowsAffected(); affected != 1 {
+			err = fmt.Errorf("Could not find group with name '%s'", name)
+		}
+	}
+	return teak.LogErrorX("t.user.pg", "Failed to delete group %s", err, name)
+}
+
+//AddGroupMembers - adds the users to the group, users who are already members
+//are ignored
+func (m *userStorage) AddGroupMembers(
+	gtx context.Context, name string, userIDs []string) (err error) {
+	err = addMembers(gtx, defDB, name, userIDs)
+	return teak.LogErrorX("t.user.pg",
+		"Failed to add members to group %s", err, name)
+}
+
+//RemoveGroupMembers - removes the users from the group
+func (m *userStorage) RemoveGroupMembers(
+	gtx context.Context, name string, userIDs []string) (err error) {
+	_, err = defDB.ExecContext(gtx, `
+		DELETE FROM teak_group_member
+			WHERE group_name = $1 AND user_id = ANY($2)`,
+		name, pq.StringArray(userIDs))
+	return teak.LogErrorX("t.user.pg",
+		"Failed to remove members from group %s", err, name)
+}
+
+//GetUserGroups - gives names of the groups the user is member of
+func (m *userStorage) GetUserGroups(
+	gtx context.Context, userID string) (groups []string, err error) {
+	groups = make([]string, 0, 10)
+	err = defDB.SelectContext(gtx, &groups, `
+		SELECT group_name FROM teak_group_member
+			WHERE user_id = $1 ORDER BY group_name`, userID)
+	return groups, teak.LogErrorX("t.user.pg",
+		"Failed to retrieve groups of user %s", err, userID)
+}
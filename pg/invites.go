@@ -0,0 +1,117 @@
+package pg
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/varunamachi/teak"
+)
+
+//inviteRow - teak_invite row, groups are stored as an array column
+type inviteRow struct {
+	ID        string         `db:"id"`
+	Hash      string         `db:"hash"`
+	Email     string         `db:"email"`
+	Auth      teak.AuthLevel `db:"auth"`
+	Groups    pq.StringArray `db:"groups"`
+	CreatedBy string         `db:"created_by"`
+	CreatedAt time.Time      `db:"created_at"`
+	ExpiresAt time.Time      `db:"expires_at"`
+}
+
+func (row *inviteRow) toInvite() *teak.Invite {
+	groups := []string(row.Groups)
+	if groups == nil {
+		groups = []string{}
+	}
+	return &teak.Invite{
+		ID:        row.ID,
+		Hash:      row.Hash,
+		Email:     row.Email,
+		Auth:      row.Auth,
+		Groups:    groups,
+		CreatedBy: row.CreatedBy,
+		CreatedAt: row.CreatedAt,
+		ExpiresAt: row.ExpiresAt,
+	}
+}
+
+//CreateInvite - stores an invite
+func (m *userStorage) CreateInvite(
+	gtx context.Context, invite *teak.Invite) (err error) {
+	query := `
+		INSERT INTO teak_invite(
+			id,
+			hash,
+			email,
+			auth,
+			groups,
+			created_by,
+			created_at,
+			expires_at
+		) VALUES (
+			:id,
+			:hash,
+			:email,
+			:auth,
+			:groups,
+			:created_by,
+			:created_at,
+			:expires_at
+		)
+	`
+	_, err = defDB.NamedExecContext(gtx, query, &inviteRow{
+		ID:        invite.ID,
+		Hash:      invite.Hash,
+		Email:     invite.Email,
+		Auth:      invite.Auth,
+		Groups:    pq.StringArray(invite.Groups),
+		CreatedBy: invite.CreatedBy,
+		CreatedAt: invite.CreatedAt,
+		ExpiresAt: invite.ExpiresAt,
+	})
+	return teak.LogErrorX("t.user.pg", "Failed to create invite", err)
+}
+
+//GetInvites - gets all the pending invites, latest first
+func (m *userStorage) GetInvites(
+	gtx context.Context) (invites []*teak.Invite, err error) {
+	rows := make([]*inviteRow, 0, 10)
+	err = defDB.SelectContext(gtx, &rows,
+		`SELECT * FROM teak_invite ORDER BY created_at DESC`)
+	invites = make([]*teak.Invite, 0, len(rows))
+	for _, row := range rows {
+		invites = append(invites, row.toInvite())
+	}
+	return invites, teak.LogErrorX("t.user.pg", "Failed to retrieve invites",
+		err)
+}
+
+//DeleteInvite - deletes the invite with given ID
+func (m *userStorage) DeleteInvite(
+	gtx context.Context, inviteID string) (err error) {
+	res, err := defDB.ExecContext(gtx,
+		`DELETE FROM teak_invite WHERE id = $1`, inviteID)
+	if err == nil {
+		if affected, _ := res.RowsAffected(); affected == 0 {
+			err = fmt.Errorf("Could not find invite with ID '%s'", inviteID)
+		}
+	}
+	return teak.LogErrorX("t.user.pg", "Failed to delete invite", err)
+}
+
+//UseInvite - removes the invite with given token hash and returns it. The
+//invite is deleted and read in the same statement so that it can not be used
+//twice by concurrent requests
+func (m *userStorage) UseInvite(
+	gtx context.Context, hash string) (invite *teak.Invite, err error) {
+	var row inviteRow
+	err = defDB.GetContext(gtx, &row,
+		`DELETE FROM teak_invite WHERE hash = $1 RETURNING *`, hash)
+	if err != nil {
+		return nil, teak.LogErrorX("t.user.pg", "Failed to use invite", err)
+	}
+	return row.toInvite(), err
+}
@@ -0,0 +1,446 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/varunamachi/teak"
+)
+
+//migrationPrefix - prefix for the names of teak_internal rows that hold the
+//migration version of each module
+const migrationPrefix = "migration."
+
+//migrations - migrations for the tables used by the postgres store itself
+var migrations = []*teak.Migration{
+	{
+		Version: 1,
+		Desc:    "Create teak tables",
+		Up: `
+			CREATE TABLE IF NOT EXISTS teak_user(
+				id				VARCHAR(128)	NOT NULL,
+				email			VARCHAR(100)	NOT NULL,
+				auth			INTEGER			NOT NULL,
+				first_name		VARCHAR(64)		NOT NULL,
+				last_name		VARCHAR(64)		,
+				title			VARCHAR(10)		NOT NULL,
+				full_name		VARCHAR(128)	NOT NULL,
+				state			VARCHAR(10)		NOT NULL DEFAULT 'disabled',
+				ver_id			VARCHAR(38),
+				pwd_expiry		TIMESTAMPTZ,
+				created_at		TIMESTAMPTZ,
+				created_by		VARCHAR(128),
+				modified_at		TIMESTAMPTZ,
+				modified_by		VARCHAR(128),
+				verified_at		TIMESTAMPTZ,
+				props			JSONB,
+				CONSTRAINT pk_id PRIMARY KEY(id)
+			);
+			CREATE TABLE IF NOT EXISTS user_secret(
+				user_id  	VARCHAR(128)		PRIMARY KEY,
+				phash		VARCHAR(256),
+				FOREIGN KEY (user_id) REFERENCES teak_user(id) ON DELETE CASCADE
+			);
+			CREATE TABLE IF NOT EXISTS teak_event(
+				id			BIGSERIAL		PRIMARY KEY,
+				op			VARCHAR(60)		NOT NULL,
+				user_id		VARCHAR(128)	NOT NULL DEFAULT '',
+				user_name	VARCHAR(128)	NOT NULL DEFAULT '',
+				success		BOOLEAN			NOT NULL,
+				error		TEXT			NOT NULL DEFAULT '',
+				time		TIMESTAMPTZ		NOT NULL,
+				data		JSONB
+			);
+		`,
+		Down: `
+			DROP TABLE IF EXISTS teak_event;
+			DROP TABLE IF EXISTS user_secret;
+			DROP TABLE IF EXISTS teak_user;
+		`,
+	},
+	{
+		Version: 2,
+		Desc:    "Widen title column of teak_user",
+		Up: `
+			ALTER TABLE teak_user ALTER COLUMN title TYPE VARCHAR(64);
+		`,
+		Down: `
+			ALTER TABLE teak_user ALTER COLUMN title TYPE VARCHAR(10)
+				USING substr(title, 1, 10);
+		`,
+	},
+	{
+		Version: 3,
+		Desc:    "Create refresh token and token revocation tables",
+		Up: `
+			CREATE TABLE IF NOT EXISTS teak_refresh_token(
+				id			VARCHAR(64)		PRIMARY KEY,
+				user_id		VARCHAR(128)	NOT NULL,
+				family		VARCHAR(64)		NOT NULL,
+				used		BOOLEAN			NOT NULL DEFAULT FALSE,
+				created_at	TIMESTAMPTZ		NOT NULL,
+				expires_at	TIMESTAMPTZ		NOT NULL,
+				FOREIGN KEY (user_id) REFERENCES teak_user(id) ON DELETE CASCADE
+			);
+			CREATE INDEX IF NOT EXISTS idx_refresh_token_user
+				ON teak_refresh_token(user_id, family);
+			CREATE TABLE IF NOT EXISTS teak_revoked_token(
+				id			VARCHAR(64)		PRIMARY KEY,
+				expires_at	TIMESTAMPTZ		NOT NULL
+			);
+		`,
+		Down: `
+			DROP TABLE IF EXISTS teak_revoked_token;
+			DROP TABLE IF EXISTS teak_refresh_token;
+		`,
+	},
+	{
+		Version: 4,
+		Desc:    "Create API key table",
+		Up: `
+			CREATE TABLE IF NOT EXISTS teak_api_key(
+				id			VARCHAR(38)		PRIMARY KEY,
+				user_id		VARCHAR(128)	NOT NULL,
+				name		VARCHAR(100)	NOT NULL,
+				hash		VARCHAR(64)		NOT NULL UNIQUE,
+				auth		INTEGER			NOT NULL,
+				created_at	TIMESTAMPTZ		NOT NULL,
+				expires_at	TIMESTAMPTZ		NOT NULL,
+				FOREIGN KEY (user_id) REFERENCES teak_user(id) ON DELETE CASCADE
+			);
+			CREATE INDEX IF NOT EXISTS idx_api_key_user
+				ON teak_api_key(user_id);
+		`,
+		Down: `
+			DROP TABLE IF EXISTS teak_api_key;
+		`,
+	},
+	{
+		Version: 5,
+		Desc:    "Add TOTP columns to user_secret",
+		Up: `
+			ALTER TABLE user_secret
+				ADD COLUMN IF NOT EXISTS totp_secret	TEXT,
+				ADD COLUMN IF NOT EXISTS totp_enabled	BOOLEAN	NOT NULL DEFAULT FALSE,
+				ADD COLUMN IF NOT EXISTS totp_step		BIGINT	NOT NULL DEFAULT 0,
+				ADD COLUMN IF NOT EXISTS recovery_codes	TEXT[];
+		`,
+		Down: `
+			ALTER TABLE user_secret
+				DROP COLUMN IF EXISTS recovery_codes,
+				DROP COLUMN IF EXISTS totp_step,
+				DROP COLUMN IF EXISTS totp_enabled,
+				DROP COLUMN IF EXISTS totp_secret;
+		`,
+	},
+	{
+		Version: 6,
+		Desc:    "Create login attempt table",
+		Up: `
+			CREATE TABLE IF NOT EXISTS teak_login_attempt(
+				key				VARCHAR(256)	PRIMARY KEY,
+				failures		INTEGER			NOT NULL,
+				last_failure	TIMESTAMPTZ		NOT NULL
+			);
+			CREATE INDEX IF NOT EXISTS idx_login_attempt_last
+				ON teak_login_attempt(last_failure);
+		`,
+		Down: `
+			DROP TABLE IF EXISTS teak_login_attempt;
+		`,
+	},
+	{
+		Version: 7,
+		Desc:    "Add password history to user_secret",
+		Up: `
+			ALTER TABLE user_secret
+				ADD COLUMN IF NOT EXISTS phash_history TEXT[];
+		`,
+		Down: `
+			ALTER TABLE user_secret DROP COLUMN IF EXISTS phash_history;
+		`,
+	},
+	{
+		Version: 8,
+		Desc:    "Create password reset token table",
+		Up: `
+			CREATE TABLE IF NOT EXISTS teak_pwd_reset_token(
+				id			VARCHAR(64)		PRIMARY KEY,
+				user_id		VARCHAR(128)	NOT NULL,
+				created_at	TIMESTAMPTZ		NOT NULL,
+				expires_at	TIMESTAMPTZ		NOT NULL,
+				FOREIGN KEY (user_id) REFERENCES teak_user(id) ON DELETE CASCADE
+			);
+			CREATE INDEX IF NOT EXISTS idx_pwd_reset_token_user
+				ON teak_pwd_reset_token(user_id);
+		`,
+		Down: `
+			DROP TABLE IF EXISTS teak_pwd_reset_token;
+		`,
+	},
+	{
+		Version: 9,
+		Desc:    "Create group and group member tables",
+		Up: `
+			CREATE TABLE IF NOT EXISTS teak_group(
+				name		VARCHAR(100)	PRIMARY KEY,
+				created_at	TIMESTAMPTZ		NOT NULL DEFAULT NOW()
+			);
+			CREATE TABLE IF NOT EXISTS teak_group_member(
+				group_name	VARCHAR(100)	NOT NULL,
+				user_id		VARCHAR(128)	NOT NULL,
+				PRIMARY KEY (group_name, user_id),
+				FOREIGN KEY (group_name) REFERENCES teak_group(name)
+					ON DELETE CASCADE,
+				FOREIGN KEY (user_id) REFERENCES teak_user(id) ON DELETE CASCADE
+			);
+			CREATE INDEX IF NOT EXISTS idx_group_member_user
+				ON teak_group_member(user_id);
+		`,
+		Down: `
+			DROP TABLE IF EXISTS teak_group_member;
+			DROP TABLE IF EXISTS teak_group;
+		`,
+	},
+	{
+		Version: 10,
+		Desc:    "Add impersonating user to teak_event",
+		Up: `
+			ALTER TABLE teak_event
+				ADD COLUMN IF NOT EXISTS real_user_id VARCHAR(128)
+					NOT NULL DEFAULT '',
+				ADD COLUMN IF NOT EXISTS real_user_name VARCHAR(128)
+					NOT NULL DEFAULT '';
+		`,
+		Down: `
+			ALTER TABLE teak_event
+				DROP COLUMN IF EXISTS real_user_id,
+				DROP COLUMN IF EXISTS real_user_name;
+		`,
+	},
+	{
+		Version: 11,
+		Desc:    "Create invite table",
+		Up: `
+			CREATE TABLE IF NOT EXISTS teak_invite(
+				id			VARCHAR(38)		PRIMARY KEY,
+				hash		VARCHAR(64)		NOT NULL UNIQUE,
+				email		TEXT			NOT NULL,
+				auth		INTEGER			NOT NULL,
+				groups		TEXT[]			NOT NULL DEFAULT '{}',
+				created_by	VARCHAR(128)	NOT NULL DEFAULT '',
+				created_at	TIMESTAMPTZ		NOT NULL,
+				expires_at	TIMESTAMPTZ		NOT NULL
+			);
+		`,
+		Down: `
+			DROP TABLE IF EXISTS teak_invite;
+		`,
+	},
+	{
+		Version: 12,
+		Desc:    "Cascade updates of user ID",
+		Up: `
+			ALTER TABLE user_secret
+				DROP CONSTRAINT IF EXISTS user_secret_user_id_fkey,
+				ADD CONSTRAINT user_secret_user_id_fkey FOREIGN KEY (user_id)
+					REFERENCES teak_user(id) ON DELETE CASCADE ON UPDATE CASCADE;
+			ALTER TABLE teak_refresh_token
+				DROP CONSTRAINT IF EXISTS teak_refresh_token_user_id_fkey,
+				ADD CONSTRAINT teak_refresh_token_user_id_fkey FOREIGN KEY (user_id)
+					REFERENCES teak_user(id) ON DELETE CASCADE ON UPDATE CASCADE;
+			ALTER TABLE teak_api_key
+				DROP CONSTRAINT IF EXISTS teak_api_key_user_id_fkey,
+				ADD CONSTRAINT teak_api_key_user_id_fkey FOREIGN KEY (user_id)
+					REFERENCES teak_user(id) ON DELETE CASCADE ON UPDATE CASCADE;
+			ALTER TABLE teak_pwd_reset_token
+				DROP CONSTRAINT IF EXISTS teak_pwd_reset_token_user_id_fkey,
+				ADD CONSTRAINT teak_pwd_reset_token_user_id_fkey FOREIGN KEY (user_id)
+					REFERENCES teak_user(id) ON DELETE CASCADE ON UPDATE CASCADE;
+			ALTER TABLE teak_group_member
+				DROP CONSTRAINT IF EXISTS teak_group_member_user_id_fkey,
+				ADD CONSTRAINT teak_group_member_user_id_fkey FOREIGN KEY (user_id)
+					REFERENCES teak_user(id) ON DELETE CASCADE ON UPDATE CASCADE;
+		`,
+		Down: `
+			ALTER TABLE user_secret
+				DROP CONSTRAINT IF EXISTS user_secret_user_id_fkey,
+				ADD CONSTRAINT user_secret_user_id_fkey FOREIGN KEY (user_id)
+					REFERENCES teak_user(id) ON DELETE CASCADE;
+			ALTER TABLE teak_refresh_token
+				DROP CONSTRAINT IF EXISTS teak_refresh_token_user_id_fkey,
+				ADD CONSTRAINT teak_refresh_token_user_id_fkey FOREIGN KEY (user_id)
+					REFERENCES teak_user(id) ON DELETE CASCADE;
+			ALTER TABLE teak_api_key
+				DROP CONSTRAINT IF EXISTS teak_api_key_user_id_fkey,
+				ADD CONSTRAINT teak_api_key_user_id_fkey FOREIGN KEY (user_id)
+					REFERENCES teak_user(id) ON DELETE CASCADE;
+			ALTER TABLE teak_pwd_reset_token
+				DROP CONSTRAINT IF EXISTS teak_pwd_reset_token_user_id_fkey,
+				ADD CONSTRAINT teak_pwd_reset_token_user_id_fkey FOREIGN KEY (user_id)
+					REFERENCES teak_user(id) ON DELETE CASCADE;
+			ALTER TABLE teak_group_member
+				DROP CONSTRAINT IF EXISTS teak_group_member_user_id_fkey,
+				ADD CONSTRAINT teak_group_member_user_id_fkey FOREIGN KEY (user_id)
+					REFERENCES teak_user(id) ON DELETE CASCADE;
+		`,
+	},
+	{
+		Version: 13,
+		Desc:    "Allow longer encrypted emails",
+		Up: `
+			ALTER TABLE teak_user ALTER COLUMN email TYPE TEXT;
+		`,
+		Down: `
+			ALTER TABLE teak_user ALTER COLUMN email TYPE VARCHAR(100);
+		`,
+	},
+	{
+		Version: 14,
+		Desc:    "Add email index to users",
+		Up: `
+			ALTER TABLE teak_user
+				ADD COLUMN IF NOT EXISTS email_index TEXT NOT NULL DEFAULT '';
+			CREATE UNIQUE INDEX IF NOT EXISTS teak_user_email_index
+				ON teak_user(email_index) WHERE email_index <> '';
+		`,
+		Down: `
+			DROP INDEX IF EXISTS teak_user_email_index;
+			ALTER TABLE teak_user DROP COLUMN IF EXISTS email_index;
+		`,
+	},
+	{
+		//Tables created before migrations have text columns and an ID without
+		//default, so the events are copied to a table with version 1 schema
+		Version: 15,
+		Desc:    "Convert teak_event created by earlier versions",
+		Up: `
+			DO $$
+			BEGIN
+				IF EXISTS (
+					SELECT 1 FROM information_schema.columns
+					WHERE table_schema = current_schema()
+						AND table_name = 'teak_event'
+						AND column_name = 'id'
+						AND data_type = 'character varying'
+				) THEN
+					ALTER TABLE teak_event RENAME TO teak_event_legacy;
+					ALTER TABLE teak_event_legacy
+						RENAME CONSTRAINT teak_event_pkey
+						TO teak_event_legacy_pkey;
+					CREATE TABLE teak_event(
+						id				BIGSERIAL		PRIMARY KEY,
+						op				VARCHAR(60)		NOT NULL,
+						user_id			VARCHAR(128)	NOT NULL DEFAULT '',
+						user_name		VARCHAR(128)	NOT NULL DEFAULT '',
+						success			BOOLEAN			NOT NULL,
+						error			TEXT			NOT NULL DEFAULT '',
+						time			TIMESTAMPTZ		NOT NULL,
+						data			JSONB,
+						real_user_id	VARCHAR(128)	NOT NULL DEFAULT '',
+						real_user_name	VARCHAR(128)	NOT NULL DEFAULT ''
+					);
+					INSERT INTO teak_event(
+						op,
+						user_id,
+						user_name,
+						success,
+						error,
+						time,
+						data,
+						real_user_id,
+						real_user_name
+					) SELECT
+						COALESCE(op, ''),
+						COALESCE(user_id, ''),
+						COALESCE(user_name, ''),
+						COALESCE(lower(success) IN ('true', 't', '1'), FALSE),
+						COALESCE(error, ''),
+						COALESCE(NULLIF(time, '')::TIMESTAMPTZ, now()),
+						data,
+						real_user_id,
+						real_user_name
+					FROM teak_event_legacy;
+					DROP TABLE teak_event_legacy;
+				END IF;
+			END $$;
+		`,
+		//Converted table has the schema expected by this version, so there
+		//is nothing to undo
+		Down: "",
+	},
+}
+
+//ensureInternalTable - creates teak_internal table, which holds the
+//migration versions, if it does not exist
+func ensureInternalTable(gtx context.Context) (err error) {
+	_, err = defDB.ExecContext(gtx, `
+		CREATE TABLE IF NOT EXISTS teak_internal(
+			name	CHAR(128)	PRIMARY KEY,
+			val		JSONB
+		)`)
+	return teak.LogErrorX("t.pg.migrate",
+		"Failed to create teak_internal table", err)
+}
+
+//StoreMigrations - migrations for the tables used by the postgres store
+func (pg *dataStorage) StoreMigrations() []*teak.Migration {
+	return migrations
+}
+
+//GetMigrationVersion - gives the version of last migration applied for the
+//module
+func (pg *dataStorage) GetMigrationVersion(
+	gtx context.Context, module string) (version int, err error) {
+	if err = ensureInternalTable(gtx); err != nil {
+		return version, err
+	}
+	err = defDB.GetContext(gtx, &version,
+		`SELECT (val->>'value')::INTEGER FROM teak_internal WHERE name = $1`,
+		migrationPrefix+module)
+	if err == sql.ErrNoRows {
+		version, err = 0, nil
+	}
+	return version, teak.LogErrorX("t.pg.migrate",
+		"Failed to get migration version of %s", err, module)
+}
+
+//RunMigration - runs the migration script and records the version in a
+//single transaction
+func (pg *dataStorage) RunMigration(
+	gtx context.Context,
+	module, script string,
+	version int) (err error) {
+	defer func() {
+		err = teak.LogErrorX("t.pg.migrate",
+			"Failed to run migration for %s", err, module)
+	}()
+	tx, err := defDB.BeginTxx(gtx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	if strings.TrimSpace(script) != "" {
+		if _, err = tx.ExecContext(gtx, script); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(gtx, `
+		INSERT INTO teak_internal(name, val) VALUES ($1, $2::jsonb)
+			ON CONFLICT(name) DO UPDATE SET val = EXCLUDED.val
+		`,
+		migrationPrefix+module,
+		fmt.Sprintf(`{ "value": %d, "migratedAt": "%s" }`,
+			version, time.Now().Format(time.RFC3339)))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,83 @@
+package pg
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+)
+
+func TestStoreMigrations(t *testing.T) {
+	for i, mig := range migrations {
+		if mig.Version != i+1 {
+			t.Errorf("Expected version %d at %d, got %d",
+				i+1, i, mig.Version)
+		}
+		if strings.TrimSpace(mig.Up) == "" || mig.Desc == "" {
+			t.Errorf("Expected script and description for version %d",
+				mig.Version)
+		}
+	}
+}
+
+func TestGetMigrationVersion(t *testing.T) {
+	fdb, restore := useFakeDB()
+	defer restore()
+	ds := &dataStorage{}
+	gtx := context.Background()
+	fdb.addRows([]string{"int4"})
+	fdb.addRows([]string{"int4"}, []driver.Value{int64(4)})
+	if version, err := ds.GetMigrationVersion(gtx, "shop"); err != nil ||
+		version != 0 {
+		t.Errorf("Expected version 0 before migrations, got %d, %v",
+			version, err)
+	}
+	if version, err := ds.GetMigrationVersion(gtx, "shop"); err != nil ||
+		version != 4 {
+		t.Errorf("Expected version 4, got %d, %v", version, err)
+	}
+	if len(fdb.stmts) != 4 ||
+		!strings.Contains(fdb.stmts[0].query, "CREATE TABLE IF NOT EXISTS") ||
+		fdb.stmts[1].args[0] != "migration.shop" {
+		t.Errorf("Expected teak_internal to be created and queried, got %+v",
+			fdb.stmts)
+	}
+}
+
+func TestRunMigration(t *testing.T) {
+	fdb, restore := useFakeDB()
+	defer restore()
+	ds := &dataStorage{}
+	gtx := context.Background()
+	err := ds.RunMigration(gtx, "shop", "CREATE TABLE item()", 3)
+	if err != nil {
+		t.Fatalf("Failed to run migration: %v", err)
+	}
+	if len(fdb.stmts) != 2 || fdb.commits != 1 {
+		t.Fatalf("Expected script and version in a transaction, got %+v",
+			fdb.stmts)
+	}
+	record := fdb.stmts[1]
+	if !strings.Contains(record.query, "INSERT INTO teak_internal") ||
+		record.args[0] != "migration.shop" ||
+		!strings.Contains(record.args[1].(string), `"value": 3`) {
+		t.Errorf("Expected version 3 to be recorded, got %+v", record)
+	}
+
+	//Empty script only records the version
+	fdb.stmts = nil
+	if err = ds.RunMigration(gtx, "shop", " ", 2); err != nil ||
+		len(fdb.stmts) != 1 {
+		t.Errorf("Expected only version to be recorded, got %+v, %v",
+			fdb.stmts, err)
+	}
+
+	fdb.stmts, fdb.failOn = nil, "DROP"
+	if err = ds.RunMigration(gtx, "shop", "DROP TABLE item", 1); err == nil {
+		t.Fatalf("Expected failed script to be reported")
+	}
+	if len(fdb.stmts) != 1 || fdb.rollbacks != 1 || fdb.commits != 2 {
+		t.Errorf("Expected failed migration to be rolled back without "+
+			"recording the version, got %+v", fdb.stmts)
+	}
+}
@@ -2,6 +2,7 @@ package pg
 
 import (
 	"context"
+	"database/sql"
 	"database/sql/driver"
 	"encoding/json"
 	"errors"
@@ -91,85 +92,112 @@ func (pg *dataStorage) Create(
 	return err
 }
 
-//Update - updates the records in 'dtype' collection which are matched by
-//the matcher query
+//Update - updates the record in 'dtype' table which is matched by the key and
+//the filter
 func (pg *dataStorage) Update(
 	gtx context.Context,
 	dtype string,
 	keyField string,
 	key interface{},
+	filter *teak.Filter,
 	value interface{}) (err error) {
 	defer func() {
-		teak.LogErrorX("t.pg.store", "Failed to update item", err)
+		err = teak.LogErrorX("t.pg.store", "Failed to update item", err)
 	}()
 	hdl := teak.GetItemHandler(dtype)
 	if hdl == nil {
 		err = fmt.Errorf("Failed to get handler for data type %s", dtype)
 		return err
 	}
+	if !identRx.MatchString(dtype) {
+		err = fmt.Errorf("Invalid data type '%s' given", dtype)
+		return err
+	}
 	mp := teak.ToFlatMap(value, "json")
-	buf := strings.Builder{}
-	buf.WriteString("UPDATE ")
-	buf.WriteString(dtype)
-	buf.WriteString(" SET ")
-	vals := make([]interface{}, 0, len(mp))
-	for i, propName := range hdl.PropNames() {
-		if val, has := mp[propName]; has && val != keyField {
-			if i != 0 {
-				buf.WriteString(", ")
-			}
-			buf.WriteString(propName)
-			buf.WriteString(" = $")
-			buf.WriteString(strconv.Itoa(i + 1))
-			vals = append(vals, val)
+	sets := make([]string, 0, len(mp))
+	vals := make([]interface{}, 0, len(mp)+10)
+	for _, propName := range hdl.PropNames() {
+		val, has := mp[propName]
+		if !has || propName == keyField {
+			continue
+		}
+		if filter != nil && filter.Owner != nil &&
+			propName == filter.Owner.OwnerField {
+			//Only admins can change the owner
+			continue
+		}
+		vals = append(vals, val)
+		sets = append(sets, propName+" = $"+strconv.Itoa(len(vals)))
+	}
+	if len(sets) == 0 {
+		err = fmt.Errorf("Nothing to update in %s", dtype)
+		return err
+	}
+	selector, vals, err := generateKeySelector(keyField, key, filter, vals)
+	if err != nil {
+		return err
+	}
+	query := "UPDATE " + dtype + " SET " + strings.Join(sets, ", ") + selector
+	res, err := defDB.ExecContext(gtx, query, vals...)
+	if err == nil {
+		if affected, _ := res.RowsAffected(); affected == 0 {
+			err = teak.ErrNotFound
 		}
 	}
-	buf.WriteString(" WHERE ")
-	buf.WriteString(keyField)
-	buf.WriteString(" = $")
-	buf.WriteString(strconv.Itoa(len(hdl.PropNames()) + 1))
-	vals = append(vals, key)
-	// fmt.Println(buf.String())
-	_, err = defDB.ExecContext(gtx, buf.String(), vals...)
 	return err
 }
 
-//Delete - deletes record matched by the matcher from collection 'dtype'
+//Delete - deletes record matched by the key and the filter from table 'dtype'
 func (pg *dataStorage) Delete(
 	gtx context.Context,
 	dtype string,
 	keyField string,
-	key interface{}) (err error) {
+	key interface{},
+	filter *teak.Filter) (err error) {
 	defer func() {
-		teak.LogErrorX("t.pg.store", "Failed to delete item", err)
+		err = teak.LogErrorX("t.pg.store", "Failed to delete item", err)
 	}()
-	var buf strings.Builder
-	buf.WriteString("DELETE FROM ")
-	buf.WriteString(dtype)
-	buf.WriteString(" WHERE ")
-	buf.WriteString(keyField)
-	buf.WriteString(" = $1")
-	_, err = defDB.ExecContext(gtx, buf.String(), key)
+	if !identRx.MatchString(dtype) {
+		err = fmt.Errorf("Invalid data type '%s' given", dtype)
+		return err
+	}
+	selector, args, err := generateKeySelector(keyField, key, filter, nil)
+	if err != nil {
+		return err
+	}
+	res, err := defDB.ExecContext(gtx, "DELETE FROM "+dtype+selector, args...)
+	if err == nil {
+		if affected, _ := res.RowsAffected(); affected == 0 {
+			err = teak.ErrNotFound
+		}
+	}
 	return err
 }
 
-//RetrieveOne - gets a record matched by given matcher from collection 'dtype'
+//RetrieveOne - gets a record matched by given key and the filter from table
+//'dtype'
 func (pg *dataStorage) RetrieveOne(
 	gtx context.Context,
 	dtype string,
 	keyField string,
 	key interface{},
+	filter *teak.Filter,
 	out interface{}) (err error) {
 	defer func() {
-		teak.LogErrorX("t.pg.store", "Failed to delete item", err)
+		err = teak.LogErrorX("t.pg.store", "Failed to retrieve item", err)
 	}()
-	var buf strings.Builder
-	buf.WriteString("SELECT * FROM ")
-	buf.WriteString(dtype)
-	buf.WriteString(" WHERE ")
-	buf.WriteString(keyField)
-	buf.WriteString(" = $1")
-	err = defDB.SelectContext(gtx, out, buf.String(), key)
+	if !identRx.MatchString(dtype) {
+		err = fmt.Errorf("Invalid data type '%s' given", dtype)
+		return err
+	}
+	selector, args, err := generateKeySelector(keyField, key, filter, nil)
+	if err != nil {
+		return err
+	}
+	err = defDB.GetContext(gtx, out, "SELECT * FROM "+dtype+selector, args...)
+	if err == sql.ErrNoRows {
+		err = teak.ErrNotFound
+	}
 	return err
 }
 
@@ -179,11 +207,18 @@ func (pg *dataStorage) Count(
 	dtype string,
 	filter *teak.Filter) (count int64, err error) {
 	defer func() {
-		teak.LogErrorX("t.pg.store", "Failed to delete item", err)
+		teak.LogErrorX("t.pg.store", "Failed to count items", err)
 	}()
-	query := fmt.Sprintf("SELECT COUNT(*) FROM %s %s",
-		dtype, generateSelector(filter))
-	err = defDB.SelectContext(gtx, &count, query)
+	if !identRx.MatchString(dtype) {
+		err = fmt.Errorf("Invalid data type '%s' given", dtype)
+		return count, err
+	}
+	selector, args, err := generateSelector(filter, nil)
+	if err != nil {
+		return count, err
+	}
+	query := "SELECT COUNT(*) FROM " + dtype + selector
+	err = defDB.GetContext(gtx, &count, query, args...)
 	return count, err
 }
 
@@ -197,19 +232,26 @@ func (pg *dataStorage) Retrieve(
 	limit int64,
 	filter *teak.Filter,
 	out interface{}) (err error) {
-	selector := generateSelector(filter)
+	if !identRx.MatchString(dtype) {
+		err = fmt.Errorf("Invalid data type '%s' given", dtype)
+		return teak.LogError("t.pg.store", err)
+	}
+	selector, args, err := generateSelector(filter, nil)
+	if err != nil {
+		return teak.LogError("t.pg.store", err)
+	}
+	order, err := generateSort(sortFiled, nil)
+	if err != nil {
+		return teak.LogError("t.pg.store", err)
+	}
 	var buf strings.Builder
 	buf.Grow(100)
 	buf.WriteString("SELECT * FROM ")
 	buf.WriteString(dtype)
 	buf.WriteString(selector)
-	buf.WriteString(" OFFSET ")
-	buf.WriteString(strconv.FormatInt(offset, 10))
-	buf.WriteString(" LIMIT ")
-	buf.WriteString(strconv.FormatInt(limit, 10))
-	buf.WriteString(" ORDER BY ")
-	buf.WriteString(sortFiled) //Check for minus sign?? like in mongo??
-	err = defDB.SelectContext(gtx, out, buf.String())
+	buf.WriteString(order)
+	buf.WriteString(pageClause(offset, limit))
+	err = defDB.SelectContext(gtx, out, buf.String(), args...)
 	return teak.LogError("t.pg.store", err)
 }
 
@@ -333,88 +375,46 @@ func (pg *dataStorage) Setup(
 	return err
 }
 
-var tables = []struct {
-	name  string
-	query string
-}{
-	{
-		name: "teak_user",
-		query: `CREATE TABLE teak_user(
-			id				VARCHAR(128)	NOT NULL,
-			email			VARCHAR(100)	NOT NULL,
-			auth			INTEGER			NOT NULL,
-			first_name		VARCHAR(64)		NOT NULL,
-			last_name		VARCHAR(64)		,
-			title			VARCHAR(10)		NOT NULL,
-			full_name		VARCHAR(128)	NOT NULL,
-			state			VARCHAR(10)		NOT NULL DEFAULT 'disabled',
-			ver_id			VARCHAR(38),
-			pwd_expiry		TIMESTAMPTZ,
-			created_at		TIMESTAMPTZ,
-			created_by		VARCHAR(128),
-			modified_at		TIMESTAMPTZ,
-			modified_by		VARCHAR(128),
-			verified_at		TIMESTAMPTZ,
-			props			JSONB,
-			CONSTRAINT pk_id PRIMARY KEY(id)
-		);`,
-	},
-	{
-		name: "user_secret",
-		query: `CREATE TABLE user_secret(
-			user_id  	VARCHAR(128)		PRIMARY KEY,
-			phash		VARCHAR(256),
-			FOREIGN KEY (user_id) REFERENCES teak_user(id) ON DELETE CASCADE
-		)`,
-	},
-	{
-		name: "teak_event",
-		query: `CREATE TABLE teak_event(
-			id			VARCHAR(60)		PRIMARY KEY,
-			op			VARCHAR(60),
-			user_id		VARCHAR(60),
-			user_name	VARCHAR(60),
-			success		VARCHAR(60),
-			error		VARCHAR(60),
-			time		VARCHAR(60),
-			data		JSONB
-		)`,
-	},
-	{
-		name: "teak_internal",
-		query: `CREATE TABLE teak_internal(
-			name	CHAR(128)	PRIMARY KEY,
-			val		JSONB
-		)`,
-	},
+//tables - tables used by the postgres store, in the order of creation
+var tables = []string{
+	"teak_user",
+	"user_secret",
+	"teak_event",
+	"teak_refresh_token",
+	"teak_revoked_token",
+	"teak_api_key",
+	"teak_login_attempt",
+	"teak_pwd_reset_token",
+	"teak_group",
+	"teak_group_member",
+	"teak_invite",
+	"teak_internal",
 }
 
 //Init - has to be run when data storage structure changes, such as
-//adding index, altering tables etc
+//adding index, altering tables etc. Pending migrations of the store are
+//applied
 func (pg *dataStorage) Init(gtx context.Context, params teak.M) (err error) {
-	// for name, query := range tables {
-	for _, tab := range tables {
-		if has, _ := pg.HasTable(gtx, tab.name); has {
-			continue
-		}
-		_, err = defDB.ExecContext(gtx, tab.query)
-		if err != nil {
-			err = teak.LogErrorX("t.pg.store", "Failed to create table '%s'",
-				err, tab.name)
-			break
-		}
+	if err = ensureInternalTable(gtx); err != nil {
+		return err
 	}
-	return err
+	err = teak.ApplyMigrations(gtx, pg, pg.Name(), pg.StoreMigrations(), 0)
+	return teak.LogErrorX("t.pg.store", "Failed to migrate the store", err)
 }
 
-//Reset - reset clears the data without affecting the structure/schema
+//Reset - reset clears the data without affecting the structure/schema. The
+//migration versions are retained
 func (pg *dataStorage) Reset(gtx context.Context) (err error) {
-	for _, tab := range tables {
-		query := fmt.Sprintf("DELETE FROM %s;", tab.name)
+	for _, table := range tables {
+		query := fmt.Sprintf("DELETE FROM %s;", table)
+		if table == "teak_internal" {
+			query = fmt.Sprintf("DELETE FROM %s WHERE name NOT LIKE '%s%%';",
+				table, migrationPrefix)
+		}
 		_, err = defDB.ExecContext(gtx, query)
 		if err != nil {
 			teak.Error(
-				"t.pg.store", "Failed clear data from %s: %v", tab.name, err)
+				"t.pg.store", "Failed clear data from %s: %v", table, err)
 			//break??
 		}
 	}
@@ -423,19 +423,34 @@ func (pg *dataStorage) Reset(gtx context.Context) (err error) {
 
 //Destroy - deletes data and also structure
 func (pg *dataStorage) Destroy(gtx context.Context) (err error) {
-	// for _, tab := range tables {
 	for i := len(tables) - 1; i >= 0; i-- {
-		tab := tables[i]
-		query := fmt.Sprintf("DROP TABLE %s;", tab.name)
+		query := fmt.Sprintf("DROP TABLE %s;", tables[i])
 		_, err = defDB.ExecContext(gtx, query)
 		if err != nil {
 			teak.Warn(
-				"t.pg.store", "Failed delete table '%s': %v", tab.name, err)
+				"t.pg.store", "Failed delete table '%s': %v", tables[i], err)
 		}
 	}
 	return err
 }
 
+//Close - closes the default connection and the named connections
+func (pg *dataStorage) Close(gtx context.Context) (err error) {
+	for name, db := range conns {
+		if cerr := db.Close(); cerr != nil {
+			err = cerr
+			teak.Warn("t.pg.store", "Failed to close connection '%s': %v",
+				name, cerr)
+		}
+	}
+	if defDB != nil {
+		if cerr := defDB.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return teak.LogErrorX("t.pg.store", "Failed to close connections", err)
+}
+
 //Wrap - wraps a command with flags required to connect to this data source
 func (pg *dataStorage) Wrap(cmd *cli.Command) *cli.Command {
 	var curUserName string
@@ -545,8 +560,3 @@ func (pg *dataStorage) HasTable(
 	return yes, teak.LogErrorX("t.pg.store",
 		"Failed to check if table %s exists", err, tableName)
 }
-
-func generateSelector(filter *teak.Filter) (selector string) {
-	//Will have to generate WHERE keyword if the filter is not empty
-	return selector
-}
@@ -0,0 +1,142 @@
+package pg
+
+import (
+	"context"
+	"time"
+
+	"github.com/varunamachi/teak"
+)
+
+//SaveRefreshToken - stores a refresh token
+func (m *userStorage) SaveRefreshToken(
+	gtx context.Context, token *teak.RefreshToken) (err error) {
+	query := `
+		INSERT INTO teak_refresh_token(
+			id,
+			user_id,
+			family,
+			used,
+			created_at,
+			expires_at
+		) VALUES (
+			:id,
+			:user_id,
+			:family,
+			:used,
+			:created_at,
+			:expires_at
+		)
+	`
+	_, err = defDB.NamedExecContext(gtx, query, token)
+	return teak.LogErrorX("t.user.pg", "Failed to save refresh token", err)
+}
+
+//GetRefreshToken - gets the refresh token with given ID
+func (m *userStorage) GetRefreshToken(
+	gtx context.Context, tokenID string) (token *teak.RefreshToken, err error) {
+	token = &teak.RefreshToken{}
+	err = defDB.GetContext(gtx, token,
+		`SELECT * FROM teak_refresh_token WHERE id = $1`, tokenID)
+	return token, teak.LogErrorX("t.user.pg",
+		"Failed to retrieve refresh token", err)
+}
+
+//UseRefreshToken - marks the refresh token as used. If the token is already
+//used teak.ErrTokenUsed is returned. The check and update are done in the same
+//statement so that a token can not be used twice by concurrent requests
+func (m *userStorage) UseRefreshToken(
+	gtx context.Context, tokenID string) (err error) {
+	res, err := defDB.ExecContext(gtx,
+		`UPDATE teak_refresh_token SET used = TRUE
+			WHERE id = $1 AND used = FALSE`, tokenID)
+	if err != nil {
+		return teak.LogErrorX("t.user.pg", "Failed to use refresh token", err)
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected != 1 {
+		return teak.ErrTokenUsed
+	}
+	return err
+}
+
+//RevokeRefreshTokens - removes refresh tokens of the given family of the user,
+//if family is empty all the refresh tokens of the user are removed
+func (m *userStorage) RevokeRefreshTokens(
+	gtx context.Context, userID, family string) (err error) {
+	query := `DELETE FROM teak_refresh_token WHERE user_id = $1`
+	args := []interface{}{userID}
+	if family != "" {
+		query += ` AND family = $2`
+		args = append(args, family)
+	}
+	_, err = defDB.ExecContext(gtx, query, args...)
+	return teak.LogErrorX("t.user.pg",
+		"Failed to revoke refresh tokens of user %s", err, userID)
+}
+
+//RevokeToken - adds the access token ID to revocation list till expiry
+func (m *userStorage) RevokeToken(
+	gtx context.Context, tokenID string, expiry time.Time) (err error) {
+	//Tokens that are expired are rejected anyway, no need to keep them
+	_, err = defDB.ExecContext(gtx,
+		`DELETE FROM teak_revoked_token WHERE expires_at < NOW()`)
+	if err == nil {
+		_, err = defDB.ExecContext(gtx, `
+			INSERT INTO teak_revoked_token(id, expires_at) VALUES($1, $2)
+				ON CONFLICT(id) DO NOTHING`,
+			tokenID, expiry)
+	}
+	return teak.LogErrorX("t.user.pg", "Failed to revoke token", err)
+}
+
+//IsTokenRevoked - checks if the access token with given ID is revoked
+func (m *userStorage) IsTokenRevoked(
+	gtx context.Context, tokenID string) (revoked bool, err error) {
+	err = defDB.GetContext(gtx, &revoked,
+		`SELECT EXISTS(SELECT 1 FROM teak_revoked_token WHERE id = $1)`,
+		tokenID)
+	return revoked, teak.LogErrorX("t.user.pg",
+		"Failed to check revocation status of token", err)
+}
+
+//SavePasswordResetToken - stores a password reset token, earlier reset tokens
+//of the user are removed
+func (m *userStorage) SavePasswordResetToken(
+	gtx context.Context, token *teak.PasswordResetToken) (err error) {
+	_, err = defDB.ExecContext(gtx,
+		`DELETE FROM teak_pwd_reset_token
+			WHERE user_id = $1 OR expires_at < $2`,
+		token.UserID, time.Now())
+	if err != nil {
+		return teak.LogErrorX("t.user.pg",
+			"Failed to remove old password reset tokens", err)
+	}
+	query := `
+		INSERT INTO teak_pwd_reset_token(
+			id,
+			user_id,
+			created_at,
+			expires_at
+		) VALUES (
+			:id,
+			:user_id,
+			:created_at,
+			:expires_at
+		)
+	`
+	_, err = defDB.NamedExecContext(gtx, query, token)
+	return teak.LogErrorX("t.user.pg", "Failed to save password reset token",
+		err)
+}
+
+//UsePasswordResetToken - removes the password reset token with given ID and
+//returns it. The token is deleted and read in the same statement so that it
+//can not be used twice by concurrent requests
+func (m *userStorage) UsePasswordResetToken(
+	gtx context.Context, tokenID string) (
+	token *teak.PasswordResetToken, err error) {
+	token = &teak.PasswordResetToken{}
+	err = defDB.GetContext(gtx, token,
+		`DELETE FROM teak_pwd_reset_token WHERE id = $1 RETURNING *`, tokenID)
+	return token, teak.LogErrorX("t.user.pg",
+		"Failed to use password reset token", err)
+}
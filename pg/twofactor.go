@@ -0,0 +1,109 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+	"github.com/varunamachi/teak"
+)
+
+//SaveTwoFactor - stores the TOTP secret, state and recovery code hashes of the
+//user in user_secret table. Users logged in through external providers may not
+//have a row yet, hence the upsert
+func (m *userStorage) SaveTwoFactor(
+	gtx context.Context, tf *teak.TwoFactor) (err error) {
+	query := `
+		INSERT INTO user_secret(
+			user_id,
+			totp_secret,
+			totp_enabled,
+			totp_step,
+			recovery_codes
+		) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT(user_id) DO UPDATE SET
+				totp_secret = EXCLUDED.totp_secret,
+				totp_enabled = EXCLUDED.totp_enabled,
+				totp_step = EXCLUDED.totp_step,
+				recovery_codes = EXCLUDED.recovery_codes
+	`
+	_, err = defDB.ExecContext(gtx, query,
+		tf.UserID,
+		tf.Secret,
+		tf.Enabled,
+		tf.LastStep,
+		pq.StringArray(tf.RecoveryCodes))
+	return teak.LogErrorX("t.user.pg",
+		"Failed to save 2FA details of user %s", err, tf.UserID)
+}
+
+//GetTwoFactor - gets the 2FA details of the user, the secret is empty if the
+//user has not enrolled
+func (m *userStorage) GetTwoFactor(
+	gtx context.Context, userID string) (tf *teak.TwoFactor, err error) {
+	tf = &teak.TwoFactor{UserID: userID}
+	var codes pq.StringArray
+	err = defDB.QueryRowContext(gtx, `
+		SELECT
+			COALESCE(totp_secret, ''),
+			totp_enabled,
+			totp_step,
+			recovery_codes
+		FROM user_secret WHERE user_id = $1`, userID).Scan(
+		&tf.Secret, &tf.Enabled, &tf.LastStep, &codes)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	tf.RecoveryCodes = codes
+	return tf, teak.LogErrorX("t.user.pg",
+		"Failed to retrieve 2FA details of user %s", err, userID)
+}
+
+//UseTOTPStep - records the time step of a verified TOTP code. If the step is
+//not after the last used step teak.ErrCodeUsed is returned. The check and
+//update happen in a single statement so that concurrent requests can not use
+//the same code
+func (m *userStorage) UseTOTPStep(
+	gtx context.Context, userID string, step int64) (err error) {
+	res, err := defDB.ExecContext(gtx, `
+		UPDATE user_secret SET totp_step = $2
+			WHERE user_id = $1 AND totp_step < $2`, userID, step)
+	if err != nil {
+		return teak.LogErrorX("t.user.pg", "Failed to use TOTP code", err)
+	}
+	if affected, _ := res.RowsAffected(); affected != 1 {
+		return teak.ErrCodeUsed
+	}
+	return err
+}
+
+//UseRecoveryCode - removes the recovery code with given hash. If the user does
+//not have such code teak.ErrCodeUsed is returned
+func (m *userStorage) UseRecoveryCode(
+	gtx context.Context, userID, codeHash string) (err error) {
+	res, err := defDB.ExecContext(gtx, `
+		UPDATE user_secret
+			SET recovery_codes = array_remove(recovery_codes, $2)
+			WHERE user_id = $1 AND $2 = ANY(recovery_codes)`, userID, codeHash)
+	if err != nil {
+		return teak.LogErrorX("t.user.pg", "Failed to use recovery code", err)
+	}
+	if affected, _ := res.RowsAffected(); affected != 1 {
+		return teak.ErrCodeUsed
+	}
+	return err
+}
+
+//DeleteTwoFactor - removes 2FA details of the user
+func (m *userStorage) DeleteTwoFactor(
+	gtx context.Context, userID string) (err error) {
+	_, err = defDB.ExecContext(gtx, `
+		UPDATE user_secret SET
+			totp_secret = NULL,
+			totp_enabled = FALSE,
+			totp_step = 0,
+			recovery_codes = NULL
+		WHERE user_id = $1`, userID)
+	return teak.LogErrorX("t.user.pg",
+		"Failed to delete 2FA details of user %s", err, userID)
+}
@@ -2,8 +2,12 @@ package pg
 
 import (
 	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/varunamachi/teak"
 	"gopkg.in/hlandau/passlib.v1"
 )
@@ -11,6 +15,19 @@ import (
 //userStorage - mongodb storage for user information
 type userStorage struct{}
 
+//emailIndexConstraint - unique index that prevents users from sharing email
+const emailIndexConstraint = "teak_user_email_index"
+
+//checkEmailExists - gives teak.ErrEmailExists if the error is a violation of
+//the unique email index
+func checkEmailExists(err error) error {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" &&
+		pqErr.Constraint == emailIndexConstraint {
+		return teak.ErrEmailExists
+	}
+	return err
+}
+
 //NewUserStorage - creates a new user storage based on postgres
 func NewUserStorage() teak.UserStorage {
 	return &userStorage{}
@@ -33,6 +50,7 @@ func (m *userStorage) CreateUser(
 		INSERT INTO teak_user(
 			id,
 			email,
+			email_index,
 			auth,
 			first_name,
 			last_name,
@@ -49,6 +67,7 @@ func (m *userStorage) CreateUser(
 		) VALUES (
 			:id,
 			:email,
+			:email_index,
 			:auth,
 			:first_name,
 			:last_name,
@@ -66,7 +85,7 @@ func (m *userStorage) CreateUser(
 	`
 	//Skipped props for now
 	_, err = defDB.NamedExecContext(gtx, query, user)
-	return user.UserID, teak.LogError("t.user.pg", err)
+	return user.UserID, teak.LogError("t.user.pg", checkEmailExists(err))
 }
 
 //UpdateUser - updates user in database
@@ -78,6 +97,7 @@ func (m *userStorage) UpdateUser(
 	query := `
 		UPDATE teak_user SET 
 			email = :email,
+			email_index = :email_index,
 			auth = :auth,
 			first_name = :first_name,
 			last_name = :last_name,
@@ -95,7 +115,7 @@ func (m *userStorage) UpdateUser(
 		WHERE id = :id
 	`
 	_, err = defDB.NamedExecContext(gtx, query, user)
-	return teak.LogError("t.user.pg", err)
+	return teak.LogError("t.user.pg", checkEmailExists(err))
 }
 
 //DeleteUser - deletes user with given user ID
@@ -107,6 +127,85 @@ func (m *userStorage) DeleteUser(
 		err, userID)
 }
 
+//RenameUser - changes the identifier of an user. Tables with foreign keys to
+//teak_user are updated by cascade, events and invites are updated here
+func (m *userStorage) RenameUser(
+	gtx context.Context, oldID, newID string) (err error) {
+	defer func() {
+		err = teak.LogErrorX("t.user.pg",
+			"Failed to rename user %s", err, oldID)
+	}()
+	tx, err := defDB.BeginTxx(gtx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	res, err := tx.ExecContext(gtx,
+		`UPDATE teak_user SET id = $2 WHERE id = $1`, oldID, newID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		err = fmt.Errorf("Could not find user with ID '%s'", oldID)
+		return err
+	}
+	queries := []string{
+		`UPDATE teak_event SET user_id = $2 WHERE user_id = $1`,
+		`UPDATE teak_event SET real_user_id = $2 WHERE real_user_id = $1`,
+		`UPDATE teak_invite SET created_by = $2 WHERE created_by = $1`,
+	}
+	for _, query := range queries {
+		if _, err = tx.ExecContext(gtx, query, oldID, newID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+//SetEmails - updates encrypted email and email index of users in a single
+//transaction
+func (m *userStorage) SetEmails(
+	gtx context.Context, users []*teak.User) (err error) {
+	defer func() {
+		err = teak.LogErrorX("t.user.pg", "Failed to update emails", err)
+	}()
+	tx, err := defDB.BeginTxx(gtx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	for _, user := range users {
+		_, err = tx.ExecContext(gtx,
+			`UPDATE teak_user SET email = $2, email_index = $3 WHERE id = $1`,
+			user.UserID, user.Email, user.EmailIndex)
+		if err != nil {
+			return checkEmailExists(err)
+		}
+	}
+	return tx.Commit()
+}
+
+//GetUserByEmail - gets the user whose email index matches the email
+func (m *userStorage) GetUserByEmail(
+	gtx context.Context, email string) (user *teak.User, err error) {
+	index, err := teak.EmailIndex(email)
+	if err != nil {
+		return nil, teak.LogError("t.user.pg", err)
+	}
+	user = &teak.User{}
+	err = defDB.GetContext(gtx, user,
+		`SELECT * FROM teak_user WHERE email_index = $1`, index)
+	return user, teak.LogError("t.user.pg", err)
+}
+
 //GetUser - gets details of the user corresponding to ID
 func (m *userStorage) GetUser(
 	gtx context.Context, userID string) (user *teak.User, err error) {
@@ -122,18 +221,25 @@ func (m *userStorage) GetUsers(
 	gtx context.Context, offset, limit int64, filter *teak.Filter) (
 	users []*teak.User, err error) {
 	users = make([]*teak.User, 0, limit)
-	selector := generateSelector(filter)
-	query := `SELECT * FROM teak_users ` + selector
-	err = defDB.SelectContext(gtx, users, query, nil)
+	selector, args, err := generateSelector(filter, userColumns)
+	if err != nil {
+		return users, teak.LogError("t.user.pg", err)
+	}
+	query := `SELECT * FROM teak_user` + selector +
+		` ORDER BY created_at DESC` + pageClause(offset, limit)
+	err = defDB.SelectContext(gtx, &users, query, args...)
 	return users, teak.LogError("t.user.pg", err)
 }
 
 //GetCount - gives the number of user selected by given filter
 func (m *userStorage) GetCount(
 	gtx context.Context, filter *teak.Filter) (count int64, err error) {
-	selector := generateSelector(filter)
-	query := `SELECT COUNT(*) FROM teak_user ` + selector
-	err = defDB.SelectContext(gtx, &count, query)
+	selector, args, err := generateSelector(filter, userColumns)
+	if err != nil {
+		return count, teak.LogError("t.user.pg", err)
+	}
+	query := `SELECT COUNT(*) FROM teak_user` + selector
+	err = defDB.GetContext(gtx, &count, query, args...)
 	return count, teak.LogError("t.user.pg", err)
 }
 
@@ -147,18 +253,32 @@ func (m *userStorage) GetUsersWithCount(
 		err = teak.LogErrorX("t.user.pg",
 			"Error getting count and list", err)
 	}()
-	selector := generateSelector(filter)
-	get := `SELECT * FROM teak_user ` + selector
-	count := `SELECT COUNT(*) FROM teak_user ` + selector
+	selector, args, err := generateSelector(filter, userColumns)
+	if err != nil {
+		return total, users, err
+	}
+	get := `SELECT * FROM teak_user` + selector +
+		` ORDER BY created_at DESC` + pageClause(offset, limit)
+	count := `SELECT COUNT(*) FROM teak_user` + selector
 	users = make([]*teak.User, 0, limit)
-	err = defDB.SelectContext(gtx, users, get, nil)
+	err = defDB.SelectContext(gtx, &users, get, args...)
 	if err != nil {
-		return
+		return total, users, err
 	}
-	err = defDB.SelectContext(gtx, &total, count, nil)
+	err = defDB.GetContext(gtx, &total, count, args...)
 	return total, users, err
 }
 
+//pageClause - gives OFFSET and LIMIT clause, limit of 0 or less selects all
+//the rows after offset
+func pageClause(offset, limit int64) string {
+	clause := " OFFSET " + strconv.FormatInt(offset, 10)
+	if limit > 0 {
+		clause += " LIMIT " + strconv.FormatInt(limit, 10)
+	}
+	return clause
+}
+
 //ResetPassword - sets password of a unauthenticated user
 func (m *userStorage) ResetPassword(
 	gtx context.Context,
@@ -174,25 +294,62 @@ func (m *userStorage) ResetPassword(
 }
 
 //SetPassword - sets password of a already authenticated user, old password
-//is not required
+//is not required. The password policy is enforced and the password expiry of
+//the user is updated
 func (m *userStorage) SetPassword(
 	gtx context.Context, userID, newPwd string) (err error) {
 	defer func() {
 		err = teak.LogErrorX("t.user.pg",
 			"Failed to set password for user %s", err, userID)
 	}()
+	tx, err := defDB.BeginTxx(gtx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	var phash sql.NullString
+	var history pq.StringArray
+	err = tx.QueryRowContext(gtx, `
+		SELECT phash, phash_history FROM user_secret
+			WHERE user_id = $1 FOR UPDATE`, userID).Scan(&phash, &history)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	previous := []string(history)
+	if len(previous) == 0 && phash.Valid {
+		previous = []string{phash.String}
+	}
+	policy := teak.GetPasswordPolicy()
+	if err = policy.Check(newPwd, previous); err != nil {
+		return err
+	}
 	newHash, err := passlib.Hash(newPwd)
 	if err != nil {
 		return err
 	}
-	//TODO - see why is new hash is set
 	query := `
-		INSERT INTO user_secret(user_id, phash) VALUES($1, $2)
-			ON CONFLICT(user_id) DO UPDATE
-				SET phash = EXCLUDED.phash
+		INSERT INTO user_secret(user_id, phash, phash_history)
+			VALUES($1, $2, $3)
+			ON CONFLICT(user_id) DO UPDATE SET
+				phash = EXCLUDED.phash,
+				phash_history = EXCLUDED.phash_history
 	`
-	_, err = defDB.ExecContext(gtx, query, userID, newHash)
-	return err
+	_, err = tx.ExecContext(gtx, query, userID, newHash,
+		pq.StringArray(policy.NextHistory(newHash, previous)))
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(gtx,
+		`UPDATE teak_user SET pwd_expiry = $1 WHERE id = $2`,
+		policy.Expiry(time.Now()), userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 //ValidateUser - validates user ID and password
@@ -273,7 +430,7 @@ func (m *userStorage) SetUserState(
 	state teak.UserState) (err error) {
 	_, err = defDB.ExecContext(gtx,
 		"UPDATE teak_user SET state = $1 WHERE id = $2",
-		userID, state)
+		state, userID)
 	return teak.LogErrorX("t.user.pg",
 		"Failed to update state for user with ID '%s'", err, userID)
 }
@@ -315,7 +472,8 @@ func (m *userStorage) UpdateProfile(
 			title = $4,
 			full_name = $5,
 			modified_at = $6,
-			modified_by = $7
+			modified_by = $7,
+			email_index = $9
 		WHERE id = $8
 	`
 	_, err = defDB.ExecContext(gtx, query,
@@ -326,6 +484,7 @@ func (m *userStorage) UpdateProfile(
 		user.FullName,
 		time.Now(),
 		user.FullName,
-		user.UserID)
-	return teak.LogError("t.user.pg", err)
+		user.UserID,
+		user.EmailIndex)
+	return teak.LogError("t.user.pg", checkEmailExists(err))
 }
@@ -2,17 +2,24 @@ package teak
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	echo "github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	uuid "github.com/satori/go.uuid"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gopkg.in/urfave/cli.v1"
 )
 
@@ -22,17 +29,21 @@ var endpoints = make([]*Endpoint, 0, 200)
 var e = echo.New()
 var accessPos = 0
 var rootPath = ""
-var jwtKey []byte
 
-//Endpoint - represents a REST endpoint with associated metadata
+//Endpoint - represents a REST endpoint with associated metadata. If Groups is
+//given, the user also needs to be member of one of those groups in addition to
+//having the access level. Sensitive endpoints can not be used by a super user
+//who is impersonating another user
 type Endpoint struct {
-	Method   string      `json:"method"`
-	URL      string      `json:"url"`
-	Access   AuthLevel   `json:"access"`
-	Category string      `json:"cateogry"`
-	Route    *echo.Route `json:"route"`
-	Comment  string      `json:"Comment"`
-	Func     echo.HandlerFunc
+	Method    string      `json:"method"`
+	URL       string      `json:"url"`
+	Access    AuthLevel   `json:"access"`
+	Category  string      `json:"cateogry"`
+	Route     *echo.Route `json:"route"`
+	Comment   string      `json:"Comment"`
+	Groups    []string    `json:"groups,omitempty"`
+	Sensitive bool        `json:"sensitive,omitempty"`
+	Func      echo.HandlerFunc
 }
 
 //Result - result of an API call
@@ -53,21 +64,30 @@ type Result struct {
 // 	Authorizer    Authorizer
 // }
 
-//GetJWTKey - gives a unique JWT key
+//GetJWTKey - gives the secret of the current signing key if it is a HS256
+//key, nil otherwise. Use SignToken and ParseToken instead of using the key
+//directly
 func GetJWTKey() []byte {
-	if len(jwtKey) == 0 {
-		jwtKey, _ = uuid.NewV4().MarshalBinary()
+	set, err := getKeySet()
+	if err != nil {
+		return nil
 	}
-	return jwtKey
+	secret, _ := set.current.signKey.([]byte)
+	return secret
 }
 
-//Session - container for retrieving session & user information from JWT
+//Session - container for retrieving session & user information from JWT. If
+//the token was issued for impersonation, ImpersonatedBy and ImpersonatorName
+//identify the super user acting as the session user
 type Session struct {
-	UserID   string    `json:"userID"`
-	UserName string    `json:"userName"`
-	UserType string    `json:"userType"`
-	Valid    bool      `json:"valid"`
-	Role     AuthLevel `json:"role"`
+	UserID           string    `json:"userID"`
+	UserName         string    `json:"userName"`
+	UserType         string    `json:"userType"`
+	Valid            bool      `json:"valid"`
+	Role             AuthLevel `json:"role"`
+	Groups           []string  `json:"groups"`
+	ImpersonatedBy   string    `json:"impersonatedBy,omitempty"`
+	ImpersonatorName string    `json:"impersonatorName,omitempty"`
 }
 
 func getAccessLevel(path string) (access AuthLevel, err error) {
@@ -89,42 +109,98 @@ func getAccessLevel(path string) (access AuthLevel, err error) {
 	return access, err
 }
 
+//jwtMiddleware - verifies the bearer token, the API key or the client
+//certificate of the request and keeps the parsed token in the context with key
+//'token'. Keys are looked up on each request so that rotated keys are used
+//without restarting the server
+func jwtMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) (err error) {
+		if key := apiKeyFromRequest(ctx.Request()); key != "" {
+			token, err := apiKeyToken(ctx.Request().Context(), key)
+			if err != nil {
+				return &echo.HTTPError{
+					Code:     http.StatusUnauthorized,
+					Message:  "Invalid API key",
+					Internal: err,
+				}
+			}
+			ctx.Set("token", token)
+			return next(ctx)
+		}
+		header := ctx.Request().Header.Get(echo.HeaderAuthorization)
+		cert := verifiedClientCert(ctx.Request())
+		if header == "" && cert != nil {
+			token, err := clientCertToken(ctx.Request().Context(), cert)
+			if err != nil {
+				return &echo.HTTPError{
+					Code:     http.StatusUnauthorized,
+					Message:  "Invalid client certificate",
+					Internal: err,
+				}
+			}
+			ctx.Set("token", token)
+			return next(ctx)
+		}
+		if !strings.HasPrefix(header, "Bearer ") {
+			return middleware.ErrJWTMissing
+		}
+		token, err := ParseToken(header[len("Bearer "):])
+		if err == nil && !tokenAllowed(ctx, token) {
+			err = errors.New("Token can not be used for this request")
+		}
+		if err != nil || !token.Valid {
+			return &echo.HTTPError{
+				Code:     middleware.ErrJWTInvalid.Code,
+				Message:  middleware.ErrJWTInvalid.Message,
+				Internal: err,
+			}
+		}
+		ctx.Set("token", token)
+		return next(ctx)
+	}
+}
+
 func authMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(ctx echo.Context) (err error) {
-		var userRole, access AuthLevel
-		access, err = getAccessLevel(ctx.Path())
+		access, err := getAccessLevel(ctx.Path())
 		if err != nil {
 			Error("Net", "URL: %s ERR: %v", ctx.Path(), err)
-			err = &echo.HTTPError{
+			return &echo.HTTPError{
 				Code:     http.StatusForbidden,
 				Message:  "Invalid URL",
 				Internal: err,
 			}
 		}
-		var userInfo Session
-		userInfo, err = RetrieveSessionInfo(ctx)
-		// fmt.Println(err)
+		userInfo, err := RetrieveSessionInfo(ctx)
 		if err != nil {
 			err = &echo.HTTPError{
 				Code:     http.StatusForbidden,
 				Message:  "Invalid JWT toke found, does not have user info",
 				Internal: err,
 			}
-			LogError("Net", err)
+			return LogError("Net", err)
 		}
-		if access < userRole {
-			err = &echo.HTTPError{
-				Code:     http.StatusForbidden,
-				Message:  "",
+		revoked, err := isRevoked(ctx)
+		if err != nil || revoked {
+			return &echo.HTTPError{
+				Code:     http.StatusUnauthorized,
+				Message:  "Token is revoked",
 				Internal: err,
 			}
-			return err
 		}
-		if err == nil {
-			ctx.Set("userID", userInfo.UserID)
-			ctx.Set("userName", userInfo.UserName)
-			err = next(ctx)
+		if access < userInfo.Role {
+			return &echo.HTTPError{
+				Code:    http.StatusForbidden,
+				Message: "Insufficient privileges",
+			}
+		}
+		ctx.Set("userID", userInfo.UserID)
+		ctx.Set("userName", userInfo.UserName)
+		if userInfo.IsImpersonated() {
+			ctx.Set("realUserID", userInfo.ImpersonatedBy)
+			ctx.Set("realUserName", userInfo.ImpersonatorName)
 		}
+		err = next(ctx)
 		return LogError("Net", err)
 	}
 }
@@ -136,6 +212,13 @@ func DoLogin(
 	params := make(map[string]interface{})
 	params["userID"] = userID
 	params["password"] = password
+	return DoLoginWithParams(gtx, params)
+}
+
+//DoLoginWithParams - performs login using the parameters understood by the
+//configured authenticator
+func DoLoginWithParams(
+	gtx context.Context, params map[string]interface{}) (*User, error) {
 	user, err := authenticator(gtx, params)
 	if err == nil && authorizer != nil {
 		user.Auth, err = authorizer(gtx, user.UserID)
@@ -155,12 +238,7 @@ func GetToken(ctx echo.Context) (token *jwt.Token, err error) {
 		header := ctx.Request().Header.Get("Authorization")
 		authSchemeLen := len("Bearer")
 		if len(header) > authSchemeLen {
-			tokStr := header[authSchemeLen+1:]
-			keyFunc := func(t *jwt.Token) (interface{}, error) {
-				return GetJWTKey(), nil
-			}
-			token = new(jwt.Token)
-			token, err = jwt.Parse(tokStr, keyFunc)
+			token, err = ParseToken(header[authSchemeLen+1:])
 		} else {
 			err = fmt.Errorf("Unexpected auth scheme used to JWT")
 		}
@@ -192,6 +270,9 @@ func RetrieveSessionInfo(ctx echo.Context) (uinfo Session, err error) {
 			} else {
 				uinfo.Role = AuthLevel(access)
 			}
+			uinfo.Groups = groupsFromClaim(claims["groups"])
+			uinfo.ImpersonatedBy, _ = claims["impersonatedBy"].(string)
+			uinfo.ImpersonatorName, _ = claims["impersonatorName"].(string)
 			uinfo.Valid = token.Valid
 		}
 	}
@@ -286,6 +367,8 @@ func ModifiedHTTPErrorHandler(err error, c echo.Context) {
 func InitServer(rootName string, apiVersion int) {
 	e.HideBanner = true
 	e.HTTPErrorHandler = ModifiedHTTPErrorHandler
+	//Outside of recover so that the panics are counted as errors
+	e.Use(metricsMiddleware)
 	e.Use(middleware.Recover())
 	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
 		Format: "[ACCSS] [Net:HTTP] ${status} : ${method} => ${path}\n",
@@ -295,13 +378,13 @@ func InitServer(rootName string, apiVersion int) {
 	rootPath = fmt.Sprintf("%s/api/v%d/", rootName, apiVersion)
 	accessPos = len(rootPath) + len("in/")
 	root := e.Group(rootPath)
+
+	//Public keys for verifying tokens issued by this app
+	e.GET("/.well-known/jwks.json", getJWKS)
 	in := root.Group("in/")
 
 	//For checking token
-	in.Use(middleware.JWTWithConfig(middleware.JWTConfig{
-		SigningKey: GetJWTKey(),
-		ContextKey: "token",
-	}))
+	in.Use(jwtMiddleware)
 
 	//For checking authorization level
 	in.Use(authMiddleware)
@@ -320,16 +403,187 @@ func InitServer(rootName string, apiVersion int) {
 			configure(root, "", ep)
 		}
 	}
+
+	switch GetMetricsConfig().Access {
+	case "public":
+		e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+		routeCategories[echo.GET+" /metrics"] = "monitoring"
+	case "monitor":
+		configure(in, "r3/", metricsEndpoint())
+	}
+	//Routes registered without an endpoint do not have a category
+	for _, route := range e.Routes() {
+		key := route.Method + " " + route.Path
+		if _, found := routeCategories[key]; !found {
+			routeCategories[key] = ""
+		}
+	}
+}
+
+//ServerConfig - configuration of the HTTP server, read from 'server' key of
+//the app config. When stopping, the server waits for DrainTimeoutSecs for the
+//in-flight requests to complete, after which the application and the storage
+//get StopTimeoutSecs each to stop. If CertFile and KeyFile are given the server
+//uses HTTPS, the files are checked for changes every CertCheckSecs. ClientAuth
+//is one of 'none', 'optional' and 'require', client certificates are verified
+//against ClientCAFile. If RedirectPort is given, plain HTTP requests to it are
+//redirected to HTTPS
+type ServerConfig struct {
+	DrainTimeoutSecs int    `json:"drainTimeoutSecs"`
+	StopTimeoutSecs  int    `json:"stopTimeoutSecs"`
+	CertFile         string `json:"certFile"`
+	KeyFile          string `json:"keyFile"`
+	ClientCAFile     string `json:"clientCAFile"`
+	ClientAuth       string `json:"clientAuth"`
+	RedirectPort     int    `json:"redirectPort"`
+	CertCheckSecs    int    `json:"certCheckSecs"`
+}
+
+var serverConfig *ServerConfig
+
+//SetServerConfig - sets the server configuration, which is used instead of
+//the 'server' key of the app config
+func SetServerConfig(sc ServerConfig) {
+	serverConfig = &sc
+}
+
+//GetServerConfig - gives the server configuration, defaults are used for the
+//values that are not configured
+func GetServerConfig() (sc ServerConfig) {
+	if serverConfig != nil {
+		sc = *serverConfig
+	} else {
+		GetConfig("server", &sc)
+	}
+	if sc.DrainTimeoutSecs <= 0 {
+		sc.DrainTimeoutSecs = 30
+	}
+	if sc.StopTimeoutSecs <= 0 {
+		sc.StopTimeoutSecs = 10
+	}
+	if sc.CertCheckSecs <= 0 {
+		sc.CertCheckSecs = 30
+	}
+	return sc
 }
 
-//Serve - start the server
-func Serve(port int) (err error) {
+//Serve - starts the modules and the server. The server runs till the context
+//is done or the process gets SIGINT or SIGTERM. Then in-flight requests are
+//drained, modules are stopped, the store is closed and the logs are flushed
+func Serve(gtx context.Context, port int) (err error) {
 	printConfig()
+	sc := GetServerConfig()
 	address := fmt.Sprintf(":%d", port)
-	err = e.Start(address)
+	var tlsCfg *tls.Config
+	if sc.CertFile != "" || sc.KeyFile != "" {
+		tlsCfg, err = serverTLSConfig(&sc, !e.DisableHTTP2)
+		if err != nil {
+			return LogErrorX("t.server", "Invalid TLS configuration", err)
+		}
+	}
+	mc := GetMetricsConfig()
+	metrics, err := metricsServer(&mc)
+	if err != nil {
+		return LogErrorX("t.server", "Invalid metrics configuration", err)
+	}
+	runCtx, cancel := context.WithCancel(gtx)
+	defer cancel()
+	if execApp != nil {
+		if err = execApp.Start(runCtx); err != nil {
+			return err
+		}
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	served := make(chan error, 3)
+	var redirect *http.Server
+	if tlsCfg == nil {
+		go func() {
+			served <- e.Start(address)
+		}()
+	} else {
+		go func() {
+			served <- serveTLS(address, tlsCfg)
+		}()
+		if sc.RedirectPort > 0 {
+			redirect = &http.Server{
+				Addr:    fmt.Sprintf(":%d", sc.RedirectPort),
+				Handler: redirectHandler(port),
+			}
+			go func() {
+				served <- redirect.ListenAndServe()
+			}()
+		}
+	}
+	if metrics != nil {
+		go func() {
+			served <- metrics.ListenAndServe()
+		}()
+	}
+	select {
+	case err = <-served:
+		LogErrorX("t.server", "Server stopped unexpectedly", err)
+	case sig := <-signals:
+		Info("t.server", "Received %v, shutting down", sig)
+	case <-gtx.Done():
+		Info("t.server", "Shutting down, %v", gtx.Err())
+	}
+	cancel()
+	drain := time.Duration(sc.DrainTimeoutSecs) * time.Second
+	stx, done := context.WithTimeout(context.Background(), drain)
+	defer done()
+	if redirect != nil {
+		redirect.Shutdown(stx)
+	}
+	if metrics != nil {
+		metrics.Shutdown(stx)
+	}
+	if serr := e.Shutdown(stx); serr != nil {
+		LogErrorX("t.server", "Failed to drain requests", serr)
+	}
+	//Draining may use up its timeout, stopping should not be cut short by it
+	stop := time.Duration(sc.StopTimeoutSecs) * time.Second
+	if execApp != nil {
+		ctx, done := context.WithTimeout(context.Background(), stop)
+		execApp.Stop(ctx)
+		done()
+	}
+	//Queued audit events may be written to the store
+	ctx, flushed := context.WithTimeout(context.Background(), stop)
+	LogErrorX("t.server", "Failed to write audit events",
+		FlushAuditEvents(ctx))
+	flushed()
+	if GetStore() != nil {
+		ctx, done := context.WithTimeout(context.Background(), stop)
+		GetStore().Close(ctx)
+		done()
+	}
+	Info("t.server", "Server stopped")
+	FlushLogs()
+	if err == http.ErrServerClosed {
+		err = nil
+	}
 	return err
 }
 
+//serveTLS - serves HTTPS using echo's TLS server with the given configuration,
+//HTTP/2 is negotiated if it is part of the configured protocols
+func serveTLS(address string, cfg *tls.Config) (err error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	s := e.TLSServer
+	s.Addr = address
+	s.Handler = e
+	s.ErrorLog = e.StdLogger
+	s.TLSConfig = cfg
+	e.TLSListener = tls.NewListener(listener, cfg)
+	Info("t.server", "HTTPS server started on %s", listener.Addr())
+	return s.Serve(e.TLSListener)
+}
+
 //GetRootPath - get base URL of the configured application's REST Endpoints
 func GetRootPath() string {
 	return rootPath
@@ -337,27 +591,37 @@ func GetRootPath() string {
 
 func configure(grp *echo.Group, urlPrefix string, ep *Endpoint) {
 	var route *echo.Route
+	//Group check runs after the auth level check of the group middleware,
+	//public endpoints do not have a session to check
+	mw := make([]echo.MiddlewareFunc, 0, 2)
+	if len(ep.Groups) != 0 && ep.Access != Public {
+		mw = append(mw, groupMiddleware(ep.Groups))
+	}
+	if ep.Sensitive && ep.Access != Public {
+		mw = append(mw, noImpersonation)
+	}
 	switch ep.Method {
 	case echo.CONNECT:
-		route = grp.CONNECT(urlPrefix+ep.URL, ep.Func)
+		route = grp.CONNECT(urlPrefix+ep.URL, ep.Func, mw...)
 	case echo.DELETE:
-		route = grp.DELETE(urlPrefix+ep.URL, ep.Func)
+		route = grp.DELETE(urlPrefix+ep.URL, ep.Func, mw...)
 	case echo.GET:
-		route = grp.GET(urlPrefix+ep.URL, ep.Func)
+		route = grp.GET(urlPrefix+ep.URL, ep.Func, mw...)
 	case echo.HEAD:
-		route = grp.HEAD(urlPrefix+ep.URL, ep.Func)
+		route = grp.HEAD(urlPrefix+ep.URL, ep.Func, mw...)
 	case echo.OPTIONS:
-		route = grp.OPTIONS(urlPrefix+ep.URL, ep.Func)
+		route = grp.OPTIONS(urlPrefix+ep.URL, ep.Func, mw...)
 	case echo.PATCH:
-		route = grp.PATCH(urlPrefix+ep.URL, ep.Func)
+		route = grp.PATCH(urlPrefix+ep.URL, ep.Func, mw...)
 	case echo.POST:
-		route = grp.POST(urlPrefix+ep.URL, ep.Func)
+		route = grp.POST(urlPrefix+ep.URL, ep.Func, mw...)
 	case echo.PUT:
-		route = grp.PUT(urlPrefix+ep.URL, ep.Func)
+		route = grp.PUT(urlPrefix+ep.URL, ep.Func, mw...)
 	case echo.TRACE:
-		route = grp.TRACE(urlPrefix+ep.URL, ep.Func)
+		route = grp.TRACE(urlPrefix+ep.URL, ep.Func, mw...)
 	}
 	ep.Route = route
+	routeCategories[route.Method+" "+route.Path] = ep.Category
 	if _, found := categories[ep.Category]; !found {
 		categories[ep.Category] = make([]*Endpoint, 0, 20)
 	}
@@ -392,17 +656,28 @@ func GetString(ctx echo.Context, key string) (value string) {
 	return ""
 }
 
+//logCtxEvent - logs an event for the user of the request. If the user is
+//being impersonated the super user is recorded as the real user
+func logCtxEvent(
+	ctx echo.Context, op string, success bool, err string, data interface{}) {
+	LogEventX(&Event{
+		Op:           op,
+		UserID:       GetString(ctx, "userID"),
+		UserName:     GetString(ctx, "userName"),
+		RealUserID:   GetString(ctx, "realUserID"),
+		RealUserName: GetString(ctx, "realUserName"),
+		Success:      success,
+		Error:        err,
+		Time:         time.Now(),
+		Data:         data,
+	})
+}
+
 //AuditedSend - sends result as JSON while logging it as event. The event data
 //is same as the data present in the result
 func AuditedSend(ctx echo.Context, res *Result) (err error) {
 	err = ctx.JSON(res.Status, res)
-	LogEvent(
-		res.Op,
-		GetString(ctx, "userID"),
-		GetString(ctx, "userName"),
-		res.OK,
-		res.Err,
-		res.Data)
+	logCtxEvent(ctx, res.Op, res.OK, res.Err, res.Data)
 	return err
 }
 
@@ -410,13 +685,7 @@ func AuditedSend(ctx echo.Context, res *Result) (err error) {
 //secret data field
 func AuditedSendSecret(ctx echo.Context, res *Result) (err error) {
 	err = ctx.JSON(res.Status, res)
-	LogEvent(
-		res.Op,
-		GetString(ctx, "userID"),
-		GetString(ctx, "userName"),
-		res.OK,
-		res.Err,
-		nil)
+	logCtxEvent(ctx, res.Op, res.OK, res.Err, nil)
 	return err
 }
 
@@ -424,13 +693,7 @@ func AuditedSendSecret(ctx echo.Context, res *Result) (err error) {
 //logs event data which is seperate from result data
 func AuditedSendX(ctx echo.Context, data interface{}, res *Result) (err error) {
 	err = ctx.JSON(res.Status, res)
-	LogEvent(
-		res.Op,
-		GetString(ctx, "userID"),
-		GetString(ctx, "userName"),
-		res.OK,
-		res.Err,
-		data)
+	logCtxEvent(ctx, res.Op, res.OK, res.Err, data)
 	return err
 }
 
@@ -443,13 +706,7 @@ func SendAndAuditOnErr(ctx echo.Context, res *Result) (err error) {
 		if err != nil {
 			estr = err.Error()
 		}
-		LogEvent(
-			res.Op,
-			GetString(ctx, "userID"),
-			GetString(ctx, "userName"),
-			false,
-			estr,
-			res.Data)
+		logCtxEvent(ctx, res.Op, false, estr, res.Data)
 	}
 	return err
 }
@@ -524,7 +781,8 @@ func GetQueryParam(ctx echo.Context, name string, def string) (val string) {
 //GetServiceStartCmd - creates a command to service start, if serveFunc is
 //not nil then that function is invoked at the end of command, otherwise
 //default serve is used
-func GetServiceStartCmd(serveFunc func(port int) error) *cli.Command {
+func GetServiceStartCmd(
+	serveFunc func(gtx context.Context, port int) error) *cli.Command {
 	return GetStore().Wrap(&cli.Command{
 		Name:  "serve",
 		Usage: "Starts the HTTP service",
@@ -534,12 +792,58 @@ func GetServiceStartCmd(serveFunc func(port int) error) *cli.Command {
 				Value: 8000,
 				Usage: "Port at which the service needs to serve",
 			},
+			cli.StringFlag{
+				Name:  "cert",
+				Usage: "TLS certificate file, HTTPS is served if given",
+			},
+			cli.StringFlag{
+				Name:  "key",
+				Usage: "Private key file of the TLS certificate",
+			},
+			cli.StringFlag{
+				Name:  "client-ca",
+				Usage: "CA certificates for verifying client certificates",
+			},
+			cli.StringFlag{
+				Name: "client-auth",
+				Usage: "Client certificate verification, one of 'none', " +
+					"'optional' and 'require'",
+			},
+			cli.IntFlag{
+				Name:  "redirect-port",
+				Usage: "Port at which HTTP requests are redirected to HTTPS",
+			},
 		},
 		Action: func(ctx *cli.Context) (err error) {
 			ag := NewArgGetter(ctx)
 			port := ag.GetRequiredInt("port")
+			//Flags override the values from config
+			sc := GetServerConfig()
+			if cert := ag.GetOptionalString("cert"); cert != "" {
+				sc.CertFile = cert
+			}
+			if key := ag.GetOptionalString("key"); key != "" {
+				sc.KeyFile = key
+			}
+			if ca := ag.GetOptionalString("client-ca"); ca != "" {
+				sc.ClientCAFile = ca
+			}
+			if mode := ag.GetOptionalString("client-auth"); mode != "" {
+				sc.ClientAuth = mode
+			}
+			if ctx.IsSet("redirect-port") {
+				sc.RedirectPort = ctx.Int("redirect-port")
+			}
+			SetServerConfig(sc)
+			gtx := context.Background()
+			if execApp != nil && execApp.gtx != nil {
+				gtx = execApp.gtx
+			}
+			if serveFunc == nil {
+				serveFunc = Serve
+			}
 			if err = ag.Err; err == nil {
-				err = serveFunc(port)
+				err = serveFunc(gtx, port)
 			}
 			return err
 		},
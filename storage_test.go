@@ -0,0 +1,491 @@
+package teak
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+//testUserStorage - user storage for the tests of this package, the storages
+//in sub packages can not be used as they import this package. Methods that
+//are not implemented panic through the nil embedded interface
+type testUserStorage struct {
+	UserStorage
+	sync.Mutex
+	users   map[string]*User
+	refresh map[string]*RefreshToken
+	revoked map[string]time.Time
+	tfs     map[string]*TwoFactor
+	apiKeys map[string]*APIKey
+	resets  map[string]*PasswordResetToken
+	pwds    map[string]string
+	groups  map[string]*Group
+}
+
+//useTestStorage - sets a new test user storage and test configuration, the
+//returned function restores the previous ones
+func useTestStorage(cfg M) (storage *testUserStorage, restore func()) {
+	storage = &testUserStorage{
+		users:   make(map[string]*User),
+		refresh: make(map[string]*RefreshToken),
+		revoked: make(map[string]time.Time),
+		tfs:     make(map[string]*TwoFactor),
+		apiKeys: make(map[string]*APIKey),
+		resets:  make(map[string]*PasswordResetToken),
+		pwds:    make(map[string]string),
+		groups:  make(map[string]*Group),
+	}
+	prevStorage, prevConfig := userStorage, config
+	config = map[string]interface{}{
+		"emailKey": "0123456789abcdef0123456789abcdef",
+	}
+	for key, val := range cfg {
+		config[key] = val
+	}
+	SetUserStorage(storage)
+	restore = func() {
+		userStorage, config = prevStorage, prevConfig
+	}
+	return storage, restore
+}
+
+func (s *testUserStorage) CreateUser(
+	gtx context.Context, user *User) (idHash string, err error) {
+	s.Lock()
+	defer s.Unlock()
+	if err = UpdateUserInfo(user); err != nil {
+		return idHash, err
+	}
+	for _, stored := range s.users {
+		if stored.EmailIndex == user.EmailIndex {
+			return idHash, ErrEmailExists
+		}
+	}
+	cpy := *user
+	s.users[user.UserID] = &cpy
+	return user.UserID, err
+}
+
+func (s *testUserStorage) GetUser(
+	gtx context.Context, userID string) (user *User, err error) {
+	s.Lock()
+	defer s.Unlock()
+	found, ok := s.users[userID]
+	if !ok {
+		return user, ErrNotFound
+	}
+	cpy := *found
+	return &cpy, err
+}
+
+func (s *testUserStorage) SaveRefreshToken(
+	gtx context.Context, token *RefreshToken) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	cpy := *token
+	s.refresh[token.ID] = &cpy
+	return err
+}
+
+func (s *testUserStorage) GetRefreshToken(
+	gtx context.Context, tokenID string) (token *RefreshToken, err error) {
+	s.Lock()
+	defer s.Unlock()
+	found, ok := s.refresh[tokenID]
+	if !ok {
+		return token, ErrNotFound
+	}
+	cpy := *found
+	return &cpy, err
+}
+
+func (s *testUserStorage) UseRefreshToken(
+	gtx context.Context, tokenID string) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	found, ok := s.refresh[tokenID]
+	if !ok {
+		return ErrNotFound
+	}
+	if found.Used {
+		return ErrTokenUsed
+	}
+	found.Used = true
+	return err
+}
+
+func (s *testUserStorage) RevokeRefreshTokens(
+	gtx context.Context, userID, family string) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	for id, token := range s.refresh {
+		if token.UserID == userID &&
+			(family == "" || token.Family == family) {
+			delete(s.refresh, id)
+		}
+	}
+	return err
+}
+
+func (s *testUserStorage) RevokeToken(
+	gtx context.Context, tokenID string, expiry time.Time) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.revoked[tokenID] = expiry
+	return err
+}
+
+func (s *testUserStorage) IsTokenRevoked(
+	gtx context.Context, tokenID string) (revoked bool, err error) {
+	s.Lock()
+	defer s.Unlock()
+	_, revoked = s.revoked[tokenID]
+	return revoked, err
+}
+
+func (s *testUserStorage) SaveTwoFactor(
+	gtx context.Context, tf *TwoFactor) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	cpy := *tf
+	s.tfs[tf.UserID] = &cpy
+	return err
+}
+
+func (s *testUserStorage) GetTwoFactor(
+	gtx context.Context, userID string) (tf *TwoFactor, err error) {
+	s.Lock()
+	defer s.Unlock()
+	tf = &TwoFactor{UserID: userID}
+	if found, ok := s.tfs[userID]; ok {
+		*tf = *found
+	}
+	return tf, err
+}
+
+func (s *testUserStorage) UseTOTPStep(
+	gtx context.Context, userID string, step int64) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	tf, ok := s.tfs[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	if step <= tf.LastStep {
+		return ErrCodeUsed
+	}
+	tf.LastStep = step
+	return err
+}
+
+func (s *testUserStorage) UseRecoveryCode(
+	gtx context.Context, userID, codeHash string) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	tf, ok := s.tfs[userID]
+	if !ok {
+		return ErrCodeUsed
+	}
+	for i, hash := range tf.RecoveryCodes {
+		if hash == codeHash {
+			tf.RecoveryCodes = append(
+				tf.RecoveryCodes[:i], tf.RecoveryCodes[i+1:]...)
+			return err
+		}
+	}
+	return ErrCodeUsed
+}
+
+func (s *testUserStorage) DeleteTwoFactor(
+	gtx context.Context, userID string) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.tfs, userID)
+	return err
+}
+
+func (s *testUserStorage) CreateAPIKey(
+	gtx context.Context, key *APIKey) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	cpy := *key
+	s.apiKeys[key.Hash] = &cpy
+	return err
+}
+
+func (s *testUserStorage) GetAPIKey(
+	gtx context.Context, keyHash string) (key *APIKey, err error) {
+	s.Lock()
+	defer s.Unlock()
+	found, ok := s.apiKeys[keyHash]
+	if !ok {
+		return key, ErrNotFound
+	}
+	cpy := *found
+	return &cpy, err
+}
+
+func (s *testUserStorage) GetAPIKeys(
+	gtx context.Context, userID string) (keys []*APIKey, err error) {
+	s.Lock()
+	defer s.Unlock()
+	keys = make([]*APIKey, 0, len(s.apiKeys))
+	for _, key := range s.apiKeys {
+		if key.UserID == userID {
+			cpy := *key
+			keys = append(keys, &cpy)
+		}
+	}
+	return keys, err
+}
+
+func (s *testUserStorage) DeleteAPIKey(
+	gtx context.Context, userID, keyID string) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	for hash, key := range s.apiKeys {
+		if key.UserID == userID && key.ID == keyID {
+			delete(s.apiKeys, hash)
+			return err
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *testUserStorage) SetPassword(
+	gtx context.Context, userID, newPwd string) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.users[userID]; !ok {
+		return ErrNotFound
+	}
+	s.pwds[userID] = newPwd
+	return err
+}
+
+func (s *testUserStorage) SetUserState(
+	gtx context.Context, userID string, state UserState) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	user, ok := s.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	user.State = state
+	return err
+}
+
+func (s *testUserStorage) SavePasswordResetToken(
+	gtx context.Context, token *PasswordResetToken) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	for id, other := range s.resets {
+		if other.UserID == token.UserID {
+			delete(s.resets, id)
+		}
+	}
+	cpy := *token
+	s.resets[token.ID] = &cpy
+	return err
+}
+
+func (s *testUserStorage) UsePasswordResetToken(
+	gtx context.Context, tokenID string) (
+	token *PasswordResetToken, err error) {
+	s.Lock()
+	defer s.Unlock()
+	token, ok := s.resets[tokenID]
+	if !ok {
+		return token, ErrNotFound
+	}
+	delete(s.resets, tokenID)
+	return token, err
+}
+
+func (s *testUserStorage) CreateGroup(
+	gtx context.Context, group *Group) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.groups[group.Name]; ok {
+		return fmt.Errorf("Group with name '%s' already exists", group.Name)
+	}
+	s.groups[group.Name] = &Group{
+		Name:  group.Name,
+		Users: append([]string{}, group.Users...),
+	}
+	return err
+}
+
+func (s *testUserStorage) GetGroup(
+	gtx context.Context, name string) (group *Group, err error) {
+	s.Lock()
+	defer s.Unlock()
+	found, ok := s.groups[name]
+	if !ok {
+		return group, ErrNotFound
+	}
+	return &Group{Name: name, Users: append([]string{}, found.Users...)}, err
+}
+
+func (s *testUserStorage) GetGroups(
+	gtx context.Context) (groups []*Group, err error) {
+	s.Lock()
+	defer s.Unlock()
+	groups = make([]*Group, 0, len(s.groups))
+	for _, group := range s.groups {
+		groups = append(groups, &Group{
+			Name:  group.Name,
+			Users: append([]string{}, group.Users...),
+		})
+	}
+	return groups, err
+}
+
+func (s *testUserStorage) DeleteGroup(
+	gtx context.Context, name string) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.groups[name]; !ok {
+		return ErrNotFound
+	}
+	delete(s.groups, name)
+	return err
+}
+
+func (s *testUserStorage) AddGroupMembers(
+	gtx context.Context, name string, userIDs []string) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	group, ok := s.groups[name]
+	if !ok {
+		return ErrNotFound
+	}
+	for _, userID := range userIDs {
+		found := false
+		for _, member := range group.Users {
+			found = found || member == userID
+		}
+		if !found {
+			group.Users = append(group.Users, userID)
+		}
+	}
+	return err
+}
+
+func (s *testUserStorage) RemoveGroupMembers(
+	gtx context.Context, name string, userIDs []string) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	group, ok := s.groups[name]
+	if !ok {
+		return ErrNotFound
+	}
+	members := make([]string, 0, len(group.Users))
+	for _, member := range group.Users {
+		removed := false
+		for _, userID := range userIDs {
+			removed = removed || member == userID
+		}
+		if !removed {
+			members = append(members, member)
+		}
+	}
+	group.Users = members
+	return err
+}
+
+func (s *testUserStorage) GetUserGroups(
+	gtx context.Context, userID string) (groups []string, err error) {
+	s.Lock()
+	defer s.Unlock()
+	groups = make([]string, 0, len(s.groups))
+	for _, group := range s.groups {
+		for _, member := range group.Users {
+			if member == userID {
+				groups = append(groups, group.Name)
+			}
+		}
+	}
+	return groups, err
+}
+
+func (s *testUserStorage) RenameUser(
+	gtx context.Context, oldID, newID string) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	user, found := s.users[oldID]
+	if !found {
+		return ErrNotFound
+	}
+	if _, found = s.users[newID]; found {
+		return fmt.Errorf("User with ID '%s' already exists", newID)
+	}
+	user.UserID = newID
+	s.users[newID] = user
+	delete(s.users, oldID)
+	if pwd, found := s.pwds[oldID]; found {
+		s.pwds[newID] = pwd
+		delete(s.pwds, oldID)
+	}
+	for _, token := range s.refresh {
+		if token.UserID == oldID {
+			token.UserID = newID
+		}
+	}
+	for _, key := range s.apiKeys {
+		if key.UserID == oldID {
+			key.UserID = newID
+		}
+	}
+	return err
+}
+
+func (s *testUserStorage) GetUsers(
+	gtx context.Context, offset, limit int64, filter *Filter) (
+	users []*User, err error) {
+	s.Lock()
+	defer s.Unlock()
+	ids := make([]string, 0, len(s.users))
+	for id := range s.users {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	users = make([]*User, 0, len(ids))
+	for i := offset; i < int64(len(ids)) && i < offset+limit; i++ {
+		cpy := *s.users[ids[i]]
+		users = append(users, &cpy)
+	}
+	return users, err
+}
+
+func (s *testUserStorage) SetEmails(
+	gtx context.Context, users []*User) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	for _, user := range users {
+		if stored, found := s.users[user.UserID]; found {
+			stored.Email = user.Email
+			stored.EmailIndex = user.EmailIndex
+		}
+	}
+	return err
+}
+
+func (s *testUserStorage) GetUserByEmail(
+	gtx context.Context, email string) (user *User, err error) {
+	index, err := EmailIndex(email)
+	if err != nil {
+		return user, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, stored := range s.users {
+		if stored.EmailIndex == index {
+			cpy := *stored
+			return &cpy, err
+		}
+	}
+	return user, ErrNotFound
+}
@@ -0,0 +1,519 @@
+package teak
+
+import (
+	"context"
+	"time"
+)
+
+//metricUserStorage - user storage that records latency and failures of the
+//operations of the wrapped storage
+type metricUserStorage struct {
+	UserStorage
+}
+
+//metricDataStorage - data storage that records latency and failures of the
+//operations of the wrapped storage
+type metricDataStorage struct {
+	DataStorage
+}
+
+//metricTokenStorage - TokenStorage whose operations are measured
+type metricTokenStorage struct {
+	TokenStorage
+}
+
+//metricAPIKeyStorage - APIKeyStorage whose operations are measured
+type metricAPIKeyStorage struct {
+	APIKeyStorage
+}
+
+//metricTwoFactorStorage - TwoFactorStorage whose operations are measured
+type metricTwoFactorStorage struct {
+	TwoFactorStorage
+}
+
+//metricPasswordResetStorage - PasswordResetStorage whose operations are
+//measured
+type metricPasswordResetStorage struct {
+	PasswordResetStorage
+}
+
+//metricGroupStorage - GroupStorage whose operations are measured
+type metricGroupStorage struct {
+	GroupStorage
+}
+
+//metricInviteStorage - InviteStorage whose operations are measured
+type metricInviteStorage struct {
+	InviteStorage
+}
+
+//metricUserRenamer - UserRenamer whose operations are measured
+type metricUserRenamer struct {
+	UserRenamer
+}
+
+//metricEmailStorage - EmailStorage whose operations are measured
+type metricEmailStorage struct {
+	EmailStorage
+}
+
+//withUserMetrics - wraps the user storage so that its operations are measured
+func withUserMetrics(storage UserStorage) UserStorage {
+	if storage == nil {
+		return storage
+	}
+	if _, ok := storage.(*metricUserStorage); ok {
+		return storage
+	}
+	return &metricUserStorage{storage}
+}
+
+//withDataMetrics - wraps the data storage so that its operations are measured
+func withDataMetrics(storage DataStorage) DataStorage {
+	if storage == nil {
+		return storage
+	}
+	if _, ok := storage.(*metricDataStorage); ok {
+		return storage
+	}
+	return &metricDataStorage{storage}
+}
+
+//unwrapUserStorage - gives the user storage without the metrics wrapper,
+//optional interfaces like TokenStorage are implemented by the wrapped storage
+func unwrapUserStorage(storage UserStorage) UserStorage {
+	if ms, ok := storage.(*metricUserStorage); ok {
+		return ms.UserStorage
+	}
+	return storage
+}
+
+//unwrapStore - gives the data storage without the metrics wrapper, optional
+//interfaces like Migrator are implemented by the wrapped storage
+func unwrapStore(storage DataStorage) DataStorage {
+	if ms, ok := storage.(*metricDataStorage); ok {
+		return ms.DataStorage
+	}
+	return storage
+}
+
+//--- UserStorage ----
+
+func (ms *metricUserStorage) CreateUser(
+	gtx context.Context, user *User) (idHash string, err error) {
+	defer observeStorage("user", "CreateUser", time.Now(), &err)
+	return ms.UserStorage.CreateUser(gtx, user)
+}
+
+func (ms *metricUserStorage) UpdateUser(
+	gtx context.Context, user *User) (err error) {
+	defer observeStorage("user", "UpdateUser", time.Now(), &err)
+	return ms.UserStorage.UpdateUser(gtx, user)
+}
+
+func (ms *metricUserStorage) DeleteUser(
+	gtx context.Context, userID string) (err error) {
+	defer observeStorage("user", "DeleteUser", time.Now(), &err)
+	return ms.UserStorage.DeleteUser(gtx, userID)
+}
+
+func (ms *metricUserStorage) GetUser(
+	gtx context.Context, userID string) (user *User, err error) {
+	defer observeStorage("user", "GetUser", time.Now(), &err)
+	return ms.UserStorage.GetUser(gtx, userID)
+}
+
+func (ms *metricUserStorage) GetUsers(
+	gtx context.Context, offset, limit int64, filter *Filter) (
+	users []*User, err error) {
+	defer observeStorage("user", "GetUsers", time.Now(), &err)
+	return ms.UserStorage.GetUsers(gtx, offset, limit, filter)
+}
+
+func (ms *metricUserStorage) GetCount(
+	gtx context.Context, filter *Filter) (count int64, err error) {
+	defer observeStorage("user", "GetCount", time.Now(), &err)
+	return ms.UserStorage.GetCount(gtx, filter)
+}
+
+func (ms *metricUserStorage) GetUsersWithCount(
+	gtx context.Context, offset, limit int64, filter *Filter) (
+	total int64, users []*User, err error) {
+	defer observeStorage("user", "GetUsersWithCount", time.Now(), &err)
+	return ms.UserStorage.GetUsersWithCount(gtx, offset, limit, filter)
+}
+
+func (ms *metricUserStorage) ResetPassword(
+	gtx context.Context, userID, oldPwd, newPwd string) (err error) {
+	defer observeStorage("user", "ResetPassword", time.Now(), &err)
+	return ms.UserStorage.ResetPassword(gtx, userID, oldPwd, newPwd)
+}
+
+func (ms *metricUserStorage) SetPassword(
+	gtx context.Context, userID, newPwd string) (err error) {
+	defer observeStorage("user", "SetPassword", time.Now(), &err)
+	return ms.UserStorage.SetPassword(gtx, userID, newPwd)
+}
+
+func (ms *metricUserStorage) ValidateUser(
+	gtx context.Context, userID, password string) (err error) {
+	defer observeStorage("user", "ValidateUser", time.Now(), &err)
+	return ms.UserStorage.ValidateUser(gtx, userID, password)
+}
+
+func (ms *metricUserStorage) GetUserAuthLevel(
+	gtx context.Context, userID string) (level AuthLevel, err error) {
+	defer observeStorage("user", "GetUserAuthLevel", time.Now(), &err)
+	return ms.UserStorage.GetUserAuthLevel(gtx, userID)
+}
+
+func (ms *metricUserStorage) SetAuthLevel(
+	gtx context.Context, userID string, authLevel AuthLevel) (err error) {
+	defer observeStorage("user", "SetAuthLevel", time.Now(), &err)
+	return ms.UserStorage.SetAuthLevel(gtx, userID, authLevel)
+}
+
+func (ms *metricUserStorage) SetUserState(
+	gtx context.Context, userID string, state UserState) (err error) {
+	defer observeStorage("user", "SetUserState", time.Now(), &err)
+	return ms.UserStorage.SetUserState(gtx, userID, state)
+}
+
+func (ms *metricUserStorage) VerifyUser(
+	gtx context.Context, userID, verID string) (err error) {
+	defer observeStorage("user", "VerifyUser", time.Now(), &err)
+	return ms.UserStorage.VerifyUser(gtx, userID, verID)
+}
+
+func (ms *metricUserStorage) UpdateProfile(
+	gtx context.Context, user *User) (err error) {
+	defer observeStorage("user", "UpdateProfile", time.Now(), &err)
+	return ms.UserStorage.UpdateProfile(gtx, user)
+}
+
+//--- TokenStorage ----
+
+func (ms *metricTokenStorage) SaveRefreshToken(
+	gtx context.Context, token *RefreshToken) (err error) {
+	defer observeStorage("user", "SaveRefreshToken", time.Now(), &err)
+	return ms.TokenStorage.SaveRefreshToken(gtx, token)
+}
+
+func (ms *metricTokenStorage) GetRefreshToken(
+	gtx context.Context, tokenID string) (token *RefreshToken, err error) {
+	defer observeStorage("user", "GetRefreshToken", time.Now(), &err)
+	return ms.TokenStorage.GetRefreshToken(gtx, tokenID)
+}
+
+func (ms *metricTokenStorage) UseRefreshToken(
+	gtx context.Context, tokenID string) (err error) {
+	defer observeStorage("user", "UseRefreshToken", time.Now(), &err)
+	return ms.TokenStorage.UseRefreshToken(gtx, tokenID)
+}
+
+func (ms *metricTokenStorage) RevokeRefreshTokens(
+	gtx context.Context, userID, family string) (err error) {
+	defer observeStorage("user", "RevokeRefreshTokens", time.Now(), &err)
+	return ms.TokenStorage.RevokeRefreshTokens(gtx, userID, family)
+}
+
+func (ms *metricTokenStorage) RevokeToken(
+	gtx context.Context, tokenID string, expiry time.Time) (err error) {
+	defer observeStorage("user", "RevokeToken", time.Now(), &err)
+	return ms.TokenStorage.RevokeToken(gtx, tokenID, expiry)
+}
+
+func (ms *metricTokenStorage) IsTokenRevoked(
+	gtx context.Context, tokenID string) (revoked bool, err error) {
+	defer observeStorage("user", "IsTokenRevoked", time.Now(), &err)
+	return ms.TokenStorage.IsTokenRevoked(gtx, tokenID)
+}
+
+//--- APIKeyStorage ----
+
+func (ms *metricAPIKeyStorage) CreateAPIKey(
+	gtx context.Context, key *APIKey) (err error) {
+	defer observeStorage("user", "CreateAPIKey", time.Now(), &err)
+	return ms.APIKeyStorage.CreateAPIKey(gtx, key)
+}
+
+func (ms *metricAPIKeyStorage) GetAPIKey(
+	gtx context.Context, keyHash string) (key *APIKey, err error) {
+	defer observeStorage("user", "GetAPIKey", time.Now(), &err)
+	return ms.APIKeyStorage.GetAPIKey(gtx, keyHash)
+}
+
+func (ms *metricAPIKeyStorage) GetAPIKeys(
+	gtx context.Context, userID string) (keys []*APIKey, err error) {
+	defer observeStorage("user", "GetAPIKeys", time.Now(), &err)
+	return ms.APIKeyStorage.GetAPIKeys(gtx, userID)
+}
+
+func (ms *metricAPIKeyStorage) DeleteAPIKey(
+	gtx context.Context, userID, keyID string) (err error) {
+	defer observeStorage("user", "DeleteAPIKey", time.Now(), &err)
+	return ms.APIKeyStorage.DeleteAPIKey(gtx, userID, keyID)
+}
+
+//--- TwoFactorStorage ----
+
+func (ms *metricTwoFactorStorage) SaveTwoFactor(
+	gtx context.Context, tf *TwoFactor) (err error) {
+	defer observeStorage("user", "SaveTwoFactor", time.Now(), &err)
+	return ms.TwoFactorStorage.SaveTwoFactor(gtx, tf)
+}
+
+func (ms *metricTwoFactorStorage) GetTwoFactor(
+	gtx context.Context, userID string) (tf *TwoFactor, err error) {
+	defer observeStorage("user", "GetTwoFactor", time.Now(), &err)
+	return ms.TwoFactorStorage.GetTwoFactor(gtx, userID)
+}
+
+func (ms *metricTwoFactorStorage) UseTOTPStep(
+	gtx context.Context, userID string, step int64) (err error) {
+	defer observeStorage("user", "UseTOTPStep", time.Now(), &err)
+	return ms.TwoFactorStorage.UseTOTPStep(gtx, userID, step)
+}
+
+func (ms *metricTwoFactorStorage) UseRecoveryCode(
+	gtx context.Context, userID, codeHash string) (err error) {
+	defer observeStorage("user", "UseRecoveryCode", time.Now(), &err)
+	return ms.TwoFactorStorage.UseRecoveryCode(gtx, userID, codeHash)
+}
+
+func (ms *metricTwoFactorStorage) DeleteTwoFactor(
+	gtx context.Context, userID string) (err error) {
+	defer observeStorage("user", "DeleteTwoFactor", time.Now(), &err)
+	return ms.TwoFactorStorage.DeleteTwoFactor(gtx, userID)
+}
+
+//--- PasswordResetStorage ----
+
+func (ms *metricPasswordResetStorage) SavePasswordResetToken(
+	gtx context.Context, token *PasswordResetToken) (err error) {
+	defer observeStorage("user", "SavePasswordResetToken", time.Now(), &err)
+	return ms.PasswordResetStorage.SavePasswordResetToken(gtx, token)
+}
+
+func (ms *metricPasswordResetStorage) UsePasswordResetToken(
+	gtx context.Context, tokenID string) (
+	token *PasswordResetToken, err error) {
+	defer observeStorage("user", "UsePasswordResetToken", time.Now(), &err)
+	return ms.PasswordResetStorage.UsePasswordResetToken(gtx, tokenID)
+}
+
+//--- GroupStorage ----
+
+func (ms *metricGroupStorage) CreateGroup(
+	gtx context.Context, group *Group) (err error) {
+	defer observeStorage("user", "CreateGroup", time.Now(), &err)
+	return ms.GroupStorage.CreateGroup(gtx, group)
+}
+
+func (ms *metricGroupStorage) GetGroup(
+	gtx context.Context, name string) (group *Group, err error) {
+	defer observeStorage("user", "GetGroup", time.Now(), &err)
+	return ms.GroupStorage.GetGroup(gtx, name)
+}
+
+func (ms *metricGroupStorage) GetGroups(
+	gtx context.Context) (groups []*Group, err error) {
+	defer observeStorage("user", "GetGroups", time.Now(), &err)
+	return ms.GroupStorage.GetGroups(gtx)
+}
+
+func (ms *metricGroupStorage) DeleteGroup(
+	gtx context.Context, name string) (err error) {
+	defer observeStorage("user", "DeleteGroup", time.Now(), &err)
+	return ms.GroupStorage.DeleteGroup(gtx, name)
+}
+
+func (ms *metricGroupStorage) AddGroupMembers(
+	gtx context.Context, name string, userIDs []string) (err error) {
+	defer observeStorage("user", "AddGroupMembers", time.Now(), &err)
+	return ms.GroupStorage.AddGroupMembers(gtx, name, userIDs)
+}
+
+func (ms *metricGroupStorage) RemoveGroupMembers(
+	gtx context.Context, name string, userIDs []string) (err error) {
+	defer observeStorage("user", "RemoveGroupMembers", time.Now(), &err)
+	return ms.GroupStorage.RemoveGroupMembers(gtx, name, userIDs)
+}
+
+func (ms *metricGroupStorage) GetUserGroups(
+	gtx context.Context, userID string) (groups []string, err error) {
+	defer observeStorage("user", "GetUserGroups", time.Now(), &err)
+	return ms.GroupStorage.GetUserGroups(gtx, userID)
+}
+
+//--- InviteStorage ----
+
+func (ms *metricInviteStorage) CreateInvite(
+	gtx context.Context, invite *Invite) (err error) {
+	defer observeStorage("user", "CreateInvite", time.Now(), &err)
+	return ms.InviteStorage.CreateInvite(gtx, invite)
+}
+
+func (ms *metricInviteStorage) GetInvites(
+	gtx context.Context) (invites []*Invite, err error) {
+	defer observeStorage("user", "GetInvites", time.Now(), &err)
+	return ms.InviteStorage.GetInvites(gtx)
+}
+
+func (ms *metricInviteStorage) DeleteInvite(
+	gtx context.Context, inviteID string) (err error) {
+	defer observeStorage("user", "DeleteInvite", time.Now(), &err)
+	return ms.InviteStorage.DeleteInvite(gtx, inviteID)
+}
+
+func (ms *metricInviteStorage) UseInvite(
+	gtx context.Context, hash string) (invite *Invite, err error) {
+	defer observeStorage("user", "UseInvite", time.Now(), &err)
+	return ms.InviteStorage.UseInvite(gtx, hash)
+}
+
+//--- UserRenamer ----
+
+func (ms *metricUserRenamer) RenameUser(
+	gtx context.Context, oldID, newID string) (err error) {
+	defer observeStorage("user", "RenameUser", time.Now(), &err)
+	return ms.UserRenamer.RenameUser(gtx, oldID, newID)
+}
+
+//--- EmailStorage ----
+
+func (ms *metricEmailStorage) SetEmails(
+	gtx context.Context, users []*User) (err error) {
+	defer observeStorage("user", "SetEmails", time.Now(), &err)
+	return ms.EmailStorage.SetEmails(gtx, users)
+}
+
+func (ms *metricEmailStorage) GetUserByEmail(
+	gtx context.Context, email string) (user *User, err error) {
+	defer observeStorage("user", "GetUserByEmail", time.Now(), &err)
+	return ms.EmailStorage.GetUserByEmail(gtx, email)
+}
+
+//--- DataStorage ----
+
+func (ms *metricDataStorage) Count(
+	gtx context.Context, dtype string, filter *Filter) (
+	count int64, err error) {
+	defer observeStorage("data", "Count", time.Now(), &err)
+	return ms.DataStorage.Count(gtx, dtype, filter)
+}
+
+func (ms *metricDataStorage) Create(
+	gtx context.Context, dataType string, data interface{}) (err error) {
+	defer observeStorage("data", "Create", time.Now(), &err)
+	return ms.DataStorage.Create(gtx, dataType, data)
+}
+
+func (ms *metricDataStorage) Update(
+	gtx context.Context,
+	dataType string,
+	keyField string,
+	key interface{},
+	filter *Filter,
+	data interface{}) (err error) {
+	defer observeStorage("data", "Update", time.Now(), &err)
+	return ms.DataStorage.Update(gtx, dataType, keyField, key, filter, data)
+}
+
+func (ms *metricDataStorage) Delete(
+	gtx context.Context,
+	dataType string,
+	keyField string,
+	key interface{},
+	filter *Filter) (err error) {
+	defer observeStorage("data", "Delete", time.Now(), &err)
+	return ms.DataStorage.Delete(gtx, dataType, keyField, key, filter)
+}
+
+func (ms *metricDataStorage) RetrieveOne(
+	gtx context.Context,
+	dataType string,
+	keyField string,
+	key interface{},
+	filter *Filter,
+	data interface{}) (err error) {
+	defer observeStorage("data", "RetrieveOne", time.Now(), &err)
+	return ms.DataStorage.RetrieveOne(
+		gtx, dataType, keyField, key, filter, data)
+}
+
+func (ms *metricDataStorage) Retrieve(
+	gtx context.Context,
+	dtype string,
+	sortFiled string,
+	offset int64,
+	limit int64,
+	filter *Filter,
+	out interface{}) (err error) {
+	defer observeStorage("data", "Retrieve", time.Now(), &err)
+	return ms.DataStorage.Retrieve(
+		gtx, dtype, sortFiled, offset, limit, filter, out)
+}
+
+func (ms *metricDataStorage) RetrieveWithCount(
+	gtx context.Context,
+	dtype string,
+	sortFiled string,
+	offset int64,
+	limit int64,
+	filter *Filter,
+	out interface{}) (count int64, err error) {
+	defer observeStorage("data", "RetrieveWithCount", time.Now(), &err)
+	return ms.DataStorage.RetrieveWithCount(
+		gtx, dtype, sortFiled, offset, limit, filter, out)
+}
+
+func (ms *metricDataStorage) GetFilterValues(
+	gtx context.Context, dtype string, specs FilterSpecList) (
+	values M, err error) {
+	defer observeStorage("data", "GetFilterValues", time.Now(), &err)
+	return ms.DataStorage.GetFilterValues(gtx, dtype, specs)
+}
+
+func (ms *metricDataStorage) GetFilterValuesX(
+	gtx context.Context,
+	dtype string,
+	field string,
+	specs FilterSpecList,
+	filter *Filter) (values M, err error) {
+	defer observeStorage("data", "GetFilterValuesX", time.Now(), &err)
+	return ms.DataStorage.GetFilterValuesX(gtx, dtype, field, specs, filter)
+}
+
+func (ms *metricDataStorage) IsSetup(
+	gtx context.Context) (yes bool, err error) {
+	defer observeStorage("data", "IsSetup", time.Now(), &err)
+	return ms.DataStorage.IsSetup(gtx)
+}
+
+func (ms *metricDataStorage) Setup(
+	gtx context.Context, admin *User, adminPass string, param M) (err error) {
+	defer observeStorage("data", "Setup", time.Now(), &err)
+	return ms.DataStorage.Setup(gtx, admin, adminPass, param)
+}
+
+func (ms *metricDataStorage) Init(gtx context.Context, params M) (err error) {
+	defer observeStorage("data", "Init", time.Now(), &err)
+	return ms.DataStorage.Init(gtx, params)
+}
+
+func (ms *metricDataStorage) Reset(gtx context.Context) (err error) {
+	defer observeStorage("data", "Reset", time.Now(), &err)
+	return ms.DataStorage.Reset(gtx)
+}
+
+func (ms *metricDataStorage) Destroy(gtx context.Context) (err error) {
+	defer observeStorage("data", "Destroy", time.Now(), &err)
+	return ms.DataStorage.Destroy(gtx)
+}
+
+func (ms *metricDataStorage) Close(gtx context.Context) (err error) {
+	defer observeStorage("data", "Close", time.Now(), &err)
+	return ms.DataStorage.Close(gtx)
+}
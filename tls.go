@@ -0,0 +1,216 @@
+package teak
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+//certReloader - gives the server certificate and the client CA pool for TLS
+//handshakes. Files are checked for changes at most once in the check
+//interval, so that certificates can be rotated without restarting
+type certReloader struct {
+	sync.Mutex
+	certFile string
+	keyFile  string
+	caFile   string
+	interval time.Duration
+	cert     *tls.Certificate
+	caPool   *x509.CertPool
+	modTimes [3]time.Time
+	checked  time.Time
+}
+
+//newCertReloader - creates a reloader after loading the files, so that
+//invalid files are reported before the server starts
+func newCertReloader(sc *ServerConfig) (cr *certReloader, err error) {
+	cr = &certReloader{
+		certFile: sc.CertFile,
+		keyFile:  sc.KeyFile,
+		caFile:   sc.ClientCAFile,
+		interval: time.Duration(sc.CertCheckSecs) * time.Second,
+	}
+	err = cr.load()
+	return cr, err
+}
+
+//fileModTimes - gives the modification times of the certificate, key and CA
+//files
+func (cr *certReloader) fileModTimes() (times [3]time.Time, err error) {
+	for i, path := range []string{cr.certFile, cr.keyFile, cr.caFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return times, err
+		}
+		times[i] = info.ModTime()
+	}
+	return times, err
+}
+
+//load - reads the files, caller should hold the lock
+func (cr *certReloader) load() (err error) {
+	times, err := cr.fileModTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if cr.caFile != "" {
+		pem, err := ioutil.ReadFile(cr.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificates found in '%s'", cr.caFile)
+		}
+	}
+	cr.cert, cr.caPool, cr.modTimes = &cert, pool, times
+	cr.checked = time.Now()
+	return err
+}
+
+//current - gives the certificate and the CA pool, reloads them if the files
+//have changed. If reload fails the earlier ones are kept, since the files
+//could be in the middle of being replaced
+func (cr *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+	cr.Lock()
+	defer cr.Unlock()
+	if time.Since(cr.checked) < cr.interval {
+		return cr.cert, cr.caPool
+	}
+	cr.checked = time.Now()
+	times, err := cr.fileModTimes()
+	if err == nil && times != cr.modTimes {
+		if err = cr.load(); err == nil {
+			Info("t.server.tls", "Reloaded TLS certificates")
+		}
+	}
+	if err != nil {
+		LogErrorX("t.server.tls", "Failed to reload TLS certificates", err)
+	}
+	return cr.cert, cr.caPool
+}
+
+//serverTLSConfig - gives TLS configuration for the server. The certificates
+//are taken from the reloader for each handshake
+func serverTLSConfig(sc *ServerConfig, http2 bool) (
+	cfg *tls.Config, err error) {
+	if sc.CertFile == "" || sc.KeyFile == "" {
+		return cfg, errors.New("Both certificate and key files are needed")
+	}
+	var clientAuth tls.ClientAuthType
+	switch sc.ClientAuth {
+	case "", "none":
+		clientAuth = tls.NoClientCert
+	case "optional":
+		clientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return cfg, fmt.Errorf("Invalid client auth mode '%s'", sc.ClientAuth)
+	}
+	if clientAuth != tls.NoClientCert && sc.ClientCAFile == "" {
+		return cfg, errors.New("Client CA file is needed to verify clients")
+	}
+	reloader, err := newCertReloader(sc)
+	if err != nil {
+		return cfg, err
+	}
+	cfg = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"http/1.1"},
+		ClientAuth: clientAuth,
+	}
+	if http2 {
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+	base := cfg.Clone()
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cert, pool := reloader.current()
+		hcfg := base.Clone()
+		hcfg.Certificates = []tls.Certificate{*cert}
+		hcfg.ClientCAs = pool
+		return hcfg, nil
+	}
+	return cfg, err
+}
+
+//redirectHandler - redirects plain HTTP requests to the HTTPS port
+func redirectHandler(tlsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if tlsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(tlsPort))
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(),
+			http.StatusPermanentRedirect)
+	})
+}
+
+//clientCertToken - gives a token with the claims of the user identified by
+//the verified client certificate, the common name of the certificate is used
+//as user ID. Like API keys, rest of the request handling does not have to
+//know about certificates
+func clientCertToken(gtx context.Context, cert *x509.Certificate) (
+	token *jwt.Token, err error) {
+	userID := cert.Subject.CommonName
+	if userID == "" {
+		return token, errors.New("Client certificate has no common name")
+	}
+	storage := GetUserStorage()
+	user, err := storage.GetUser(gtx, ResolveUserID(gtx, userID))
+	if err != nil {
+		return token, err
+	}
+	if user.State != Active {
+		return token, errors.New("User of the client certificate is not active")
+	}
+	groups, err := userGroups(gtx, user.UserID)
+	if err != nil {
+		return token, err
+	}
+	token = &jwt.Token{
+		Header: map[string]interface{}{},
+		Claims: jwt.MapClaims{
+			"userID": user.UserID,
+			"userName": fmt.Sprintf("%s %s [client cert %s]",
+				user.FirstName, user.LastName, cert.SerialNumber),
+			"userType": "cert",
+			"access":   float64(user.Auth),
+			"groups":   groups,
+		},
+		Valid: true,
+	}
+	return token, err
+}
+
+//verifiedClientCert - gives the verified client certificate of the request,
+//nil if there is none
+func verifiedClientCert(req *http.Request) *x509.Certificate {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 ||
+		len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return req.TLS.VerifiedChains[0][0]
+}
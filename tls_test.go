@@ -0,0 +1,264 @@
+package teak
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//testCert - certificate with its key, written to files in PEM format
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+//newTestCert - creates a certificate with given common name, signed by the
+//parent. The certificate is a CA if parent is nil
+func newTestCert(t *testing.T, dir, cn string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth,
+		},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(
+		rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	tc := &testCert{
+		key:      key,
+		certFile: filepath.Join(dir, cn+".crt"),
+		keyFile:  filepath.Join(dir, cn+".key"),
+	}
+	tc.cert, _ = x509.ParseCertificate(der)
+	ioutil.WriteFile(tc.certFile, pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(tc.keyFile, pem.EncodeToMemory(
+		&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return tc
+}
+
+//tlsPair - gives the certificate as used by TLS clients
+func (tc *testCert) tlsPair(t *testing.T) tls.Certificate {
+	pair, err := tls.LoadX509KeyPair(tc.certFile, tc.keyFile)
+	if err != nil {
+		t.Fatalf("Failed to load certificate: %v", err)
+	}
+	return pair
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "teak-tls")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, dir, "ca", nil)
+	server := newTestCert(t, dir, "server", ca)
+
+	invalid := []ServerConfig{
+		{CertFile: server.certFile},
+		{CertFile: server.certFile, KeyFile: server.keyFile,
+			ClientAuth: "maybe"},
+		{CertFile: server.certFile, KeyFile: server.keyFile,
+			ClientAuth: "require"},
+		{CertFile: server.certFile, KeyFile: ca.certFile},
+	}
+	for _, sc := range invalid {
+		if _, err = serverTLSConfig(&sc, false); err == nil {
+			t.Errorf("Expected TLS config %+v to be rejected", sc)
+		}
+	}
+
+	sc := &ServerConfig{
+		CertFile:     server.certFile,
+		KeyFile:      server.keyFile,
+		ClientCAFile: ca.certFile,
+		ClientAuth:   "require",
+	}
+	cfg, err := serverTLSConfig(sc, true)
+	if err != nil {
+		t.Fatalf("Failed to create TLS config: %v", err)
+	}
+	if cfg.MinVersion != tls.VersionTLS12 || cfg.NextProtos[0] != "h2" {
+		t.Errorf("Expected TLS 1.2 or later with HTTP/2")
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(verifiedClientCert(r).Subject.CommonName))
+		}))
+	srv.TLS = cfg
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+	call := func(certs ...tls.Certificate) (cn string, err error) {
+		pool := x509.NewCertPool()
+		pool.AddCert(ca.cert)
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs:      pool,
+				Certificates: certs,
+			},
+		}}
+		res, err := client.Get(srv.URL)
+		if err != nil {
+			return cn, err
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		return string(body), err
+	}
+	client := newTestCert(t, dir, "client", ca)
+	if cn, err := call(client.tlsPair(t)); err != nil || cn != "client" {
+		t.Errorf("Expected verified client certificate, got '%s': %v",
+			cn, err)
+	}
+	if _, err = call(); err == nil {
+		t.Errorf("Expected request without client certificate to fail")
+	}
+	other := newTestCert(t, dir, "other-ca", nil)
+	stranger := newTestCert(t, dir, "stranger", other)
+	if _, err = call(stranger.tlsPair(t)); err == nil {
+		t.Errorf("Expected certificate of unknown CA to be rejected")
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "teak-tls")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, dir, "ca", nil)
+	first := newTestCert(t, dir, "server", ca)
+	cr, err := newCertReloader(&ServerConfig{
+		CertFile: first.certFile,
+		KeyFile:  first.keyFile,
+	})
+	if err != nil {
+		t.Fatalf("Failed to load certificate: %v", err)
+	}
+
+	//Files are replaced, modification time is moved ahead since the file
+	//system may not have the precision to tell the writes apart
+	second := newTestCert(t, dir, "server", ca)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(second.certFile, later, later)
+	os.Chtimes(second.keyFile, later, later)
+	leaf := func() *x509.Certificate {
+		cert, _ := cr.current()
+		parsed, _ := x509.ParseCertificate(cert.Certificate[0])
+		return parsed
+	}
+	if !leaf().Equal(second.cert) {
+		t.Errorf("Expected replaced certificate to be loaded")
+	}
+
+	//Broken files do not replace a working certificate
+	ioutil.WriteFile(second.keyFile, []byte("broken"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(second.keyFile, later, later)
+	if !leaf().Equal(second.cert) {
+		t.Errorf("Expected last working certificate to be kept")
+	}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	storage, restore := useTestStorage(nil)
+	defer restore()
+	dir, err := ioutil.TempDir("", "teak-tls")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, dir, "ca", nil)
+	userID := createTestUser(t, storage, "service", Admin)
+	storage.CreateGroup(context.Background(), &Group{
+		Name:  "ops",
+		Users: []string{userID},
+	})
+
+	//TLS handshake has already verified the certificate
+	requestWith := func(cert *x509.Certificate) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.TLS = &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{cert, ca.cert}},
+		}
+		return req
+	}
+	client := newTestCert(t, dir, "service", ca)
+	session, status := callAuthenticated(requestWith(client.cert))
+	if status != http.StatusOK {
+		t.Fatalf("Expected client certificate to be accepted, status %d",
+			status)
+	}
+	if session.UserID != userID || session.UserType != "cert" ||
+		session.Role != Admin || !session.InGroup("ops") ||
+		!strings.Contains(session.UserName, client.cert.SerialNumber.String()) {
+		t.Errorf("Unexpected session for client certificate %+v", session)
+	}
+
+	unknown := newTestCert(t, dir, "unknown", ca)
+	if _, status = callAuthenticated(requestWith(unknown.cert)); status !=
+		http.StatusUnauthorized {
+		t.Errorf("Expected certificate of unknown user to be rejected, "+
+			"status %d", status)
+	}
+	storage.users[userID].State = Disabled
+	if _, status = callAuthenticated(requestWith(client.cert)); status !=
+		http.StatusUnauthorized {
+		t.Errorf("Expected certificate of disabled user to be rejected, "+
+			"status %d", status)
+	}
+	//Bearer token takes precedence over the client certificate
+	req := requestWith(client.cert)
+	req.Header.Set("Authorization", "Bearer invalid")
+	if session, _ = callAuthenticated(req); session.UserType == "cert" {
+		t.Errorf("Expected bearer token to be used instead of certificate")
+	}
+	if verifiedClientCert(httptest.NewRequest(http.MethodGet, "/", nil)) !=
+		nil {
+		t.Errorf("Expected no client certificate for plain request")
+	}
+}
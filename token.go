@@ -0,0 +1,402 @@
+package teak
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	echo "github.com/labstack/echo/v4"
+	uuid "github.com/satori/go.uuid"
+)
+
+//TokenConfig - configuration for access and refresh tokens, read from
+//'tokenConfig' key of the app config
+type TokenConfig struct {
+	AccessTTLMins   int `json:"accessTTLMins"`
+	RefreshTTLHours int `json:"refreshTTLHours"`
+}
+
+//RefreshToken - a refresh token issued to an user. Only the hash of the token
+//is stored. Every refresh token belongs to a family that starts at login, the
+//family is revoked when an already used token is presented again
+type RefreshToken struct {
+	ID        string    `json:"id" db:"id"`
+	UserID    string    `json:"userID" db:"user_id"`
+	Family    string    `json:"family" db:"family"`
+	Used      bool      `json:"used" db:"used"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+	ExpiresAt time.Time `json:"expiresAt" db:"expires_at"`
+}
+
+//ErrTokenUsed - returned by user storage when a refresh token that is
+//already used is being used again
+var ErrTokenUsed = errors.New("Refresh token is already used")
+
+//TokenStorage - optional interface of user storages that store refresh tokens
+//and revoked access tokens. Without it refresh tokens are not issued and
+//access tokens can not be revoked
+type TokenStorage interface {
+	//SaveRefreshToken - stores a refresh token
+	SaveRefreshToken(gtx context.Context, token *RefreshToken) (err error)
+
+	//GetRefreshToken - gets the refresh token with given ID
+	GetRefreshToken(gtx context.Context, tokenID string) (
+		token *RefreshToken, err error)
+
+	//UseRefreshToken - marks the refresh token as used. If the token is
+	//already used ErrTokenUsed is returned
+	UseRefreshToken(gtx context.Context, tokenID string) (err error)
+
+	//RevokeRefreshTokens - removes refresh tokens of the given family of the
+	//user, if family is empty all the refresh tokens of the user are removed
+	RevokeRefreshTokens(gtx context.Context, userID, family string) (err error)
+
+	//RevokeToken - adds the access token ID to revocation list till expiry
+	RevokeToken(gtx context.Context, tokenID string, expiry time.Time) (
+		err error)
+
+	//IsTokenRevoked - checks if the access token with given ID is revoked
+	IsTokenRevoked(gtx context.Context, tokenID string) (
+		revoked bool, err error)
+}
+
+//GetTokenStorage - gives the user storage if it supports refresh tokens
+func GetTokenStorage() (storage TokenStorage, err error) {
+	storage, ok := unwrapUserStorage(GetUserStorage()).(TokenStorage)
+	if !ok {
+		return storage, errors.New(
+			"User storage does not support refresh tokens")
+	}
+	return &metricTokenStorage{storage}, err
+}
+
+//GetTokenConfig - gives the token configuration, defaults are used for the
+//values that are not configured
+func GetTokenConfig() (tc TokenConfig) {
+	GetConfig("tokenConfig", &tc)
+	if tc.AccessTTLMins <= 0 {
+		tc.AccessTTLMins = 15
+	}
+	if tc.RefreshTTLHours <= 0 {
+		tc.RefreshTTLHours = 24 * 7
+	}
+	return tc
+}
+
+//HashToken - gives the hash of a token that is used for storing the token
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+//randomToken - creates a random URL safe token
+func randomToken() (token string, err error) {
+	buf := make([]byte, 32)
+	if _, err = rand.Read(buf); err == nil {
+		token = base64.RawURLEncoding.EncodeToString(buf)
+	}
+	return token, err
+}
+
+//accessClaims - gives the claims of an access token for the user that
+//expires at given time
+func accessClaims(gtx context.Context, user *User, expiry time.Time) (
+	claims jwt.MapClaims, err error) {
+	groups, err := userGroups(gtx, user.UserID)
+	if err != nil {
+		return claims, err
+	}
+	claims = jwt.MapClaims{}
+	claims["jti"] = uuid.NewV4().String()
+	claims["iat"] = time.Now().Unix()
+	claims["exp"] = expiry.Unix()
+	claims["userID"] = user.UserID
+	claims["access"] = user.Auth
+	claims["userName"] = user.FirstName + " " + user.LastName
+	claims["userType"] = "normal"
+	claims["groups"] = groups
+	return claims, err
+}
+
+//issueTokens - creates a signed access token and a refresh token for the
+//user. If family is empty a new refresh token family is started. Only the
+//access token is issued if the user storage does not support refresh tokens
+func issueTokens(gtx context.Context, user *User, family string) (
+	data M, err error) {
+	tc := GetTokenConfig()
+	expiry := time.Now().Add(time.Duration(tc.AccessTTLMins) * time.Minute)
+	claims, err := accessClaims(gtx, user, expiry)
+	if err != nil {
+		return data, err
+	}
+	signed, err := SignToken(claims)
+	if err != nil {
+		return data, err
+	}
+	data = M{
+		"token":     signed,
+		"expiresAt": expiry,
+		"user":      user,
+	}
+	storage, serr := GetTokenStorage()
+	if serr != nil {
+		return data, err
+	}
+	refresh, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	if family == "" {
+		family = uuid.NewV4().String()
+	}
+	err = storage.SaveRefreshToken(gtx, &RefreshToken{
+		ID:        HashToken(refresh),
+		UserID:    user.UserID,
+		Family:    family,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(
+			time.Duration(tc.RefreshTTLHours) * time.Hour),
+	})
+	if err != nil {
+		return nil, err
+	}
+	data["refreshToken"] = refresh
+	return data, err
+}
+
+//pwdResetPurpose - purpose of the token given at login when the password is
+//expired, it can only be used to reset the password
+const pwdResetPurpose = "pwd_reset"
+
+//sessionTokens - gives the tokens for an authenticated user. If the password
+//of the user is expired only a token that allows password reset is given
+func sessionTokens(gtx context.Context, user *User) (
+	data M, expired bool, err error) {
+	if !IsPasswordExpired(user) {
+		data, err = issueTokens(gtx, user, "")
+		return data, expired, err
+	}
+	tc := GetTokenConfig()
+	expiry := time.Now().Add(time.Duration(tc.AccessTTLMins) * time.Minute)
+	claims := jwt.MapClaims{}
+	claims["jti"] = uuid.NewV4().String()
+	claims["iat"] = time.Now().Unix()
+	claims["exp"] = expiry.Unix()
+	claims["userID"] = user.UserID
+	claims["access"] = user.Auth
+	claims["userName"] = user.FirstName + " " + user.LastName
+	claims["userType"] = "normal"
+	claims["purpose"] = pwdResetPurpose
+	signed, err := SignToken(claims)
+	if err == nil {
+		data = M{
+			"passwordExpired": true,
+			"token":           signed,
+			"expiresAt":       expiry,
+			"user":            user,
+		}
+	}
+	return data, true, err
+}
+
+//tokenPurpose - gives the purpose of the token, empty for access tokens
+func tokenPurpose(token *jwt.Token) (purpose string) {
+	if claims, ok := token.Claims.(jwt.MapClaims); ok {
+		purpose, _ = claims["purpose"].(string)
+	}
+	return purpose
+}
+
+//tokenAllowed - tells if the token can be used for the request. Tokens issued
+//for a purpose, such as 2FA challenge, can not be used as access tokens
+func tokenAllowed(ctx echo.Context, token *jwt.Token) bool {
+	switch tokenPurpose(token) {
+	case "":
+		return true
+	case pwdResetPurpose:
+		return ctx.Request().Method == echo.PUT &&
+			strings.HasSuffix(ctx.Path(), "/uman/user/password")
+	}
+	return false
+}
+
+//tokenIDAndExpiry - gives the ID and expiry time of a JWT token
+func tokenIDAndExpiry(token *jwt.Token) (id string, exp time.Time) {
+	if claims, ok := token.Claims.(jwt.MapClaims); ok {
+		id, _ = claims["jti"].(string)
+		if expUnix, ok := claims["exp"].(float64); ok {
+			exp = time.Unix(int64(expUnix), 0)
+		}
+	}
+	return id, exp
+}
+
+//isRevoked - checks if the token from the request is revoked, tokens are
+//never revoked if the user storage does not support it
+func isRevoked(ctx echo.Context) (yes bool, err error) {
+	storage, serr := GetTokenStorage()
+	if serr != nil {
+		return yes, err
+	}
+	token, err := GetToken(ctx)
+	if err != nil {
+		return yes, err
+	}
+	if id, _ := tokenIDAndExpiry(token); id != "" {
+		yes, err = storage.IsTokenRevoked(ctx.Request().Context(), id)
+	}
+	return yes, err
+}
+
+//revokeToken - adds the access token ID to the revocation list, nothing is
+//done if the user storage does not support revocation
+func revokeToken(gtx context.Context, tokenID string, expiry time.Time) (
+	err error) {
+	if storage, serr := GetTokenStorage(); serr == nil {
+		err = storage.RevokeToken(gtx, tokenID, expiry)
+	}
+	return err
+}
+
+//revokeRefreshTokens - removes refresh tokens of the given family of the user,
+//nothing is done if the user storage does not support refresh tokens
+func revokeRefreshTokens(gtx context.Context, userID, family string) (
+	err error) {
+	if storage, serr := GetTokenStorage(); serr == nil {
+		err = storage.RevokeRefreshTokens(gtx, userID, family)
+	}
+	return err
+}
+
+func refreshToken(ctx echo.Context) (err error) {
+	status, msg := DefMS("Refresh token")
+	var data M
+	var user *User
+	creds := make(map[string]string)
+	err = ctx.Bind(&creds)
+	defer func() {
+		if user != nil {
+			ctx.Set("userID", user.UserID)
+			ctx.Set("userName", user.FirstName+" "+user.LastName)
+		}
+		AuditedSendSecret(ctx, &Result{
+			Status: status,
+			Op:     "token_refresh",
+			Msg:    msg,
+			OK:     err == nil,
+			Data:   data,
+			Err:    ErrString(err),
+		})
+		LogError("t.auth.token", err)
+	}()
+	if err != nil || creds["refreshToken"] == "" {
+		msg = "Failed to read refresh token from request"
+		status = http.StatusBadRequest
+		err = errors.New(msg)
+		return err
+	}
+
+	gtx := ctx.Request().Context()
+	var rt *RefreshToken
+	storage, err := GetTokenStorage()
+	if err == nil {
+		rt, err = storage.GetRefreshToken(gtx, HashToken(creds["refreshToken"]))
+	}
+	if err == nil && time.Now().After(rt.ExpiresAt) {
+		err = errors.New("Refresh token expired")
+	}
+	if err == nil {
+		err = storage.UseRefreshToken(gtx, rt.ID)
+		if err == ErrTokenUsed {
+			//The token is being replayed, the whole family is not trustable
+			storage.RevokeRefreshTokens(gtx, rt.UserID, rt.Family)
+		}
+	}
+	if err == nil {
+		user, err = GetUserStorage().GetUser(gtx, rt.UserID)
+		if err == nil && user.State != Active {
+			err = errors.New("User is not active")
+		}
+	}
+	if err != nil {
+		msg = "Invalid refresh token"
+		status = http.StatusUnauthorized
+		return err
+	}
+	//Otherwise a session started before the expiry would never end
+	if IsPasswordExpired(user) {
+		storage.RevokeRefreshTokens(gtx, user.UserID, rt.Family)
+		err = errors.New("Password expired")
+		msg = "Password expired, login to reset the password"
+		status = http.StatusUnauthorized
+		return err
+	}
+	data, err = issueTokens(gtx, user, rt.Family)
+	if err != nil {
+		msg = "Failed to issue tokens"
+		status = http.StatusInternalServerError
+	}
+	return err
+}
+
+func logout(ctx echo.Context) (err error) {
+	status, msg := DefMS("Logout")
+	params := struct {
+		RefreshToken string `json:"refreshToken"`
+		All          bool   `json:"all"`
+	}{}
+	err = ctx.Bind(&params)
+	if err != nil {
+		msg = "Failed to read logout parameters"
+		status = http.StatusBadRequest
+	}
+	gtx := ctx.Request().Context()
+	userID := GetString(ctx, "userID")
+	if err == nil {
+		var token *jwt.Token
+		token, err = GetToken(ctx)
+		if err == nil {
+			id, exp := tokenIDAndExpiry(token)
+			if id != "" {
+				err = revokeToken(gtx, id, exp)
+			}
+		}
+	}
+	if err == nil {
+		if params.All {
+			err = revokeRefreshTokens(gtx, userID, "")
+		} else if params.RefreshToken != "" {
+			storage, serr := GetTokenStorage()
+			if serr == nil {
+				var rt *RefreshToken
+				rt, err = storage.GetRefreshToken(
+					gtx, HashToken(params.RefreshToken))
+				if err == nil && rt.UserID == userID {
+					err = storage.RevokeRefreshTokens(gtx, userID, rt.Family)
+				}
+			}
+		}
+		if err != nil {
+			msg = "Failed to revoke tokens"
+			status = http.StatusInternalServerError
+		}
+	}
+	err = AuditedSend(ctx, &Result{
+		Status: status,
+		Op:     "logout",
+		Msg:    msg,
+		OK:     err == nil,
+		Data: M{
+			"all": params.All,
+		},
+		Err: ErrString(err),
+	})
+	return LogError("t.auth.token", err)
+}
@@ -0,0 +1,82 @@
+package teak
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	echo "github.com/labstack/echo/v4"
+)
+
+//callRefresh - calls the refresh endpoint handler with the refresh token,
+//gives the response status and the new refresh token if any
+func callRefresh(t *testing.T, refresh string) (status int, next string) {
+	body, _ := json.Marshal(map[string]string{"refreshToken": refresh})
+	req := httptest.NewRequest(
+		http.MethodPost, "/api/v1/token/refresh", bytes.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	ctx := echo.New().NewContext(req, rec)
+	refreshToken(ctx)
+	res := struct {
+		Data struct {
+			RefreshToken string `json:"refreshToken"`
+		} `json:"data"`
+	}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("Invalid refresh response '%s': %v", rec.Body.String(), err)
+	}
+	return rec.Code, res.Data.RefreshToken
+}
+
+func TestRefreshTokenReuse(t *testing.T) {
+	storage, restore := useTestStorage(nil)
+	defer restore()
+	gtx := context.Background()
+	userID, err := storage.CreateUser(gtx, &User{
+		UserID: "tester",
+		Email:  "tester@example.com",
+		Auth:   Normal,
+		State:  Active,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	user, _ := storage.GetUser(gtx, userID)
+	data, err := issueTokens(gtx, user, "")
+	if err != nil {
+		t.Fatalf("Failed to issue tokens: %v", err)
+	}
+	first, _ := data["refreshToken"].(string)
+	if first == "" {
+		t.Fatalf("Expected a refresh token to be issued")
+	}
+
+	status, second := callRefresh(t, first)
+	if status != http.StatusOK || second == "" || second == first {
+		t.Fatalf("Expected a new refresh token, status %d", status)
+	}
+	rt, err := storage.GetRefreshToken(gtx, HashToken(second))
+	if err != nil {
+		t.Fatalf("Failed to get new refresh token: %v", err)
+	}
+	family := rt.Family
+
+	//Replaying the used token revokes the whole family, including the token
+	//issued by the legitimate refresh
+	if status, _ = callRefresh(t, first); status != http.StatusUnauthorized {
+		t.Errorf("Expected reused token to be rejected, status %d", status)
+	}
+	for _, token := range storage.refresh {
+		if token.Family == family {
+			t.Errorf("Expected token family to be revoked")
+		}
+	}
+	if status, _ = callRefresh(t, second); status != http.StatusUnauthorized {
+		t.Errorf("Expected token of revoked family to be rejected, "+
+			"status %d", status)
+	}
+}
@@ -0,0 +1,935 @@
+package teak
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	echo "github.com/labstack/echo/v4"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/urfave/cli.v1"
+)
+
+//TwoFactor - TOTP (RFC 6238) two factor authentication details of an user. The
+//secret is stored encrypted and only the hashes of recovery codes are stored.
+//A secret that is not yet enabled belongs to an unfinished enrolment
+type TwoFactor struct {
+	UserID        string   `json:"userID"`
+	Secret        string   `json:"-"`
+	Enabled       bool     `json:"enabled"`
+	LastStep      int64    `json:"-"`
+	RecoveryCodes []string `json:"-"`
+}
+
+//TwoFactorConfig - configuration for two factor authentication, read from
+//'twoFactor' key of the app config. Users with RequiredFor or a more
+//privileged auth level can not login without 2FA, for example 'Admin' makes
+//it mandatory for Super and Admin users. TOTP secrets are encrypted with
+//SecretKey, if it is not given they are encrypted with the email keys and
+//re-encrypted along with the emails when the email key is rotated
+type TwoFactorConfig struct {
+	Issuer           string `json:"issuer"`
+	SecretKey        string `json:"secretKey"`
+	RequiredFor      string `json:"requiredFor"`
+	ChallengeTTLMins int    `json:"challengeTTLMins"`
+}
+
+//ErrCodeUsed - returned by user storage when a TOTP time step or a recovery
+//code is used again
+var ErrCodeUsed = errors.New("Code is already used")
+
+//TwoFactorStorage - optional interface of user storages that store TOTP
+//secrets. Without it users can not enroll for two factor authentication
+type TwoFactorStorage interface {
+	//SaveTwoFactor - stores the TOTP secret, state and recovery code hashes
+	//of the user
+	SaveTwoFactor(gtx context.Context, tf *TwoFactor) (err error)
+
+	//GetTwoFactor - gets the 2FA details of the user, the secret is empty if
+	//the user has not enrolled
+	GetTwoFactor(gtx context.Context, userID string) (
+		tf *TwoFactor, err error)
+
+	//UseTOTPStep - records the time step of a verified TOTP code. If the step
+	//is not after the last used step ErrCodeUsed is returned
+	UseTOTPStep(gtx context.Context, userID string, step int64) (err error)
+
+	//UseRecoveryCode - removes the recovery code with given hash. If the user
+	//does not have such code ErrCodeUsed is returned
+	UseRecoveryCode(gtx context.Context, userID, codeHash string) (err error)
+
+	//DeleteTwoFactor - removes 2FA details of the user
+	DeleteTwoFactor(gtx context.Context, userID string) (err error)
+}
+
+//GetTwoFactorStorage - gives the user storage if it supports two factor
+//authentication
+func GetTwoFactorStorage() (storage TwoFactorStorage, err error) {
+	storage, ok := unwrapUserStorage(GetUserStorage()).(TwoFactorStorage)
+	if !ok {
+		return storage, errors.New(
+			"User storage does not support two factor authentication")
+	}
+	return &metricTwoFactorStorage{storage}, err
+}
+
+const (
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkew          = 1
+	numRecoveryCodes  = 10
+	challengePurpose  = "2fa"
+	recoveryCodeChars = "abcdefghjkmnpqrstuvwxyz23456789"
+)
+
+//GetTwoFactorConfig - gives the two factor authentication configuration,
+//defaults are used for the values that are not configured
+func GetTwoFactorConfig() (cfg TwoFactorConfig) {
+	GetConfig("twoFactor", &cfg)
+	if cfg.Issuer == "" {
+		cfg.Issuer = "teak"
+	}
+	if cfg.ChallengeTTLMins <= 0 {
+		cfg.ChallengeTTLMins = 5
+	}
+	return cfg
+}
+
+//IsRequired - tells if the policy requires 2FA for users of given auth level
+func (cfg *TwoFactorConfig) IsRequired(level AuthLevel) bool {
+	if cfg.RequiredFor == "" {
+		return false
+	}
+	required, err := ParseAuthLevel(cfg.RequiredFor)
+	if err != nil {
+		//A broken policy should not silently turn 2FA off for admins
+		Warn("t.auth.2fa", "Invalid 'requiredFor' in 2FA config, "+
+			"requiring 2FA for Super and Admin")
+		required = Admin
+	}
+	return level <= required
+}
+
+//encryptSecret - encrypts the TOTP secret with the secret key, or with the
+//current email key if secret key is not configured
+func (cfg *TwoFactorConfig) encryptSecret(secret string) (
+	encrypted string, err error) {
+	if cfg.SecretKey != "" {
+		return EncryptStr(cfg.SecretKey, secret)
+	}
+	ek, err := GetEmailKeys()
+	if err != nil {
+		return encrypted, fmt.Errorf(
+			"No key configured for encrypting 2FA secrets: %v", err)
+	}
+	return ek.Encrypt(secret)
+}
+
+//decryptSecret - decrypts the TOTP secret encrypted by encryptSecret
+func (cfg *TwoFactorConfig) decryptSecret(encrypted string) (
+	secret string, err error) {
+	if cfg.SecretKey != "" {
+		return DecryptStr(cfg.SecretKey, encrypted)
+	}
+	ek, err := GetEmailKeys()
+	if err != nil {
+		return secret, fmt.Errorf(
+			"No key configured for decrypting 2FA secrets: %v", err)
+	}
+	return ek.Decrypt(encrypted)
+}
+
+//totpCode - gives the TOTP code for the time step
+func totpCode(secret []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+//newTOTPSecret - creates a new TOTP secret, gives the base32 encoded secret
+//and its encrypted form that goes to the storage
+func newTOTPSecret() (secret, encrypted string, err error) {
+	cfg := GetTwoFactorConfig()
+	buf := make([]byte, 20)
+	if _, err = rand.Read(buf); err != nil {
+		return secret, encrypted, err
+	}
+	secret = base32.StdEncoding.WithPadding(base32.NoPadding).
+		EncodeToString(buf)
+	encrypted, err = cfg.encryptSecret(secret)
+	return secret, encrypted, err
+}
+
+//provisioningURI - gives the 'otpauth' URI that authenticator apps read from
+//the QR code
+func provisioningURI(account, secret string) string {
+	issuer := GetTwoFactorConfig().Issuer
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	return (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: query.Encode(),
+	}).String()
+}
+
+//accountName - gives the name that identifies the user in authenticator apps,
+//the email if it can be decrypted, full name otherwise
+func accountName(user *User) string {
+	if email, err := DecryptEmail(user.Email); err == nil {
+		return email
+	}
+	return user.FirstName + " " + user.LastName
+}
+
+//verifyTOTP - verifies the code against the user's secret. The matched time
+//step is recorded so that a code can not be used twice
+func verifyTOTP(gtx context.Context, tf *TwoFactor, code string) (err error) {
+	cfg := GetTwoFactorConfig()
+	secretStr, err := cfg.decryptSecret(tf.Secret)
+	if err != nil {
+		return err
+	}
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).
+		DecodeString(secretStr)
+	if err != nil {
+		return err
+	}
+	code = strings.Replace(code, " ", "", -1)
+	now := time.Now().Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if subtle.ConstantTimeCompare(
+			[]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			storage, err := GetTwoFactorStorage()
+			if err == nil {
+				err = storage.UseTOTPStep(gtx, tf.UserID, step)
+			}
+			if err == nil {
+				tf.LastStep = step
+			}
+			return err
+		}
+	}
+	return errors.New("Invalid TOTP code")
+}
+
+//verifySecondFactor - verifies either the TOTP code or a recovery code
+func verifySecondFactor(
+	gtx context.Context, tf *TwoFactor, code, recoveryCode string) error {
+	if recoveryCode != "" {
+		storage, err := GetTwoFactorStorage()
+		if err != nil {
+			return err
+		}
+		return storage.UseRecoveryCode(
+			gtx, tf.UserID, HashToken(normalizeRecoveryCode(recoveryCode)))
+	}
+	if code != "" {
+		return verifyTOTP(gtx, tf, code)
+	}
+	return errors.New("TOTP code or recovery code is required")
+}
+
+//newRecoveryCodes - creates recovery codes, gives the codes to be shown to the
+//user and their hashes to be stored
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	codes = make([]string, 0, numRecoveryCodes)
+	hashes = make([]string, 0, numRecoveryCodes)
+	buf := make([]byte, 10)
+	for i := 0; i < numRecoveryCodes; i++ {
+		if _, err = rand.Read(buf); err != nil {
+			return codes, hashes, err
+		}
+		var sb strings.Builder
+		for j, b := range buf {
+			if j == 5 {
+				sb.WriteByte('-')
+			}
+			sb.WriteByte(recoveryCodeChars[int(b)%len(recoveryCodeChars)])
+		}
+		codes = append(codes, sb.String())
+		hashes = append(hashes, HashToken(normalizeRecoveryCode(sb.String())))
+	}
+	return codes, hashes, err
+}
+
+//normalizeRecoveryCode - removes formatting from the recovery code given by
+//the user
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.Replace(strings.Replace(code, "-", "", -1), " ", "", -1)
+}
+
+//enableTwoFactor - enables the enrolment after the first code is verified and
+//gives new recovery codes
+func enableTwoFactor(gtx context.Context, tf *TwoFactor) (
+	codes []string, err error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return codes, err
+	}
+	tf.Enabled = true
+	tf.RecoveryCodes = hashes
+	err = saveTwoFactor(gtx, tf)
+	return codes, err
+}
+
+//startEnrolment - creates a new secret for the user that needs to be confirmed
+//with a code before it is enabled
+func startEnrolment(gtx context.Context, user *User) (data M, err error) {
+	tf, err := getTwoFactor(gtx, user.UserID)
+	if err != nil {
+		return data, err
+	}
+	if tf.Enabled {
+		return data, errors.New("2FA is already enabled for the user")
+	}
+	secret, encrypted, err := newTOTPSecret()
+	if err != nil {
+		return data, err
+	}
+	err = saveTwoFactor(gtx, &TwoFactor{
+		UserID: user.UserID,
+		Secret: encrypted,
+	})
+	if err == nil {
+		data = M{
+			"secret": secret,
+			"uri":    provisioningURI(accountName(user), secret),
+		}
+	}
+	return data, err
+}
+
+//getTwoFactor - gets the 2FA details of the user
+func getTwoFactor(gtx context.Context, userID string) (
+	tf *TwoFactor, err error) {
+	storage, err := GetTwoFactorStorage()
+	if err == nil {
+		tf, err = storage.GetTwoFactor(gtx, userID)
+	}
+	return tf, err
+}
+
+//saveTwoFactor - stores the 2FA details of the user
+func saveTwoFactor(gtx context.Context, tf *TwoFactor) (err error) {
+	storage, err := GetTwoFactorStorage()
+	if err == nil {
+		err = storage.SaveTwoFactor(gtx, tf)
+	}
+	return err
+}
+
+//deleteTwoFactor - removes 2FA details of the user
+func deleteTwoFactor(gtx context.Context, userID string) (err error) {
+	storage, err := GetTwoFactorStorage()
+	if err == nil {
+		err = storage.DeleteTwoFactor(gtx, userID)
+	}
+	return err
+}
+
+//needsTwoFactor - tells if the user has to complete the second step of login.
+//If the user storage does not support 2FA, it is not needed unless required
+//by the configuration, in which case the login fails
+func needsTwoFactor(gtx context.Context, user *User) (
+	tf *TwoFactor, yes bool, err error) {
+	cfg := GetTwoFactorConfig()
+	storage, err := GetTwoFactorStorage()
+	if err != nil {
+		if cfg.IsRequired(user.Auth) {
+			return tf, yes, err
+		}
+		return &TwoFactor{UserID: user.UserID}, yes, nil
+	}
+	tf, err = storage.GetTwoFactor(gtx, user.UserID)
+	if err != nil {
+		return tf, yes, err
+	}
+	yes = tf.Enabled || cfg.IsRequired(user.Auth)
+	return tf, yes, err
+}
+
+//newChallenge - creates the short lived token that links the two steps of
+//login. It can not be used as an access token
+func newChallenge(user *User, enrolled bool) (data M, err error) {
+	cfg := GetTwoFactorConfig()
+	expiry := time.Now().Add(time.Duration(cfg.ChallengeTTLMins) * time.Minute)
+	claims := jwt.MapClaims{}
+	claims["jti"] = uuid.NewV4().String()
+	claims["iat"] = time.Now().Unix()
+	claims["exp"] = expiry.Unix()
+	claims["userID"] = user.UserID
+	claims["purpose"] = challengePurpose
+	signed, err := SignToken(claims)
+	if err == nil {
+		data = M{
+			"twoFactor": true,
+			"enrolled":  enrolled,
+			"challenge": signed,
+			"expiresAt": expiry,
+		}
+	}
+	return data, err
+}
+
+//challengeUser - verifies the challenge token and gives the user it is issued
+//for along with the token
+func challengeUser(gtx context.Context, challenge string) (
+	user *User, token *jwt.Token, err error) {
+	token, err = ParseToken(challenge)
+	if err != nil || !token.Valid {
+		return user, token, errors.New("Invalid 2FA challenge")
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	if purpose, _ := claims["purpose"].(string); purpose != challengePurpose {
+		return user, token, errors.New("Invalid 2FA challenge")
+	}
+	//Challenges are made single use by revoking them
+	tokens, err := GetTokenStorage()
+	if err != nil {
+		return user, token, err
+	}
+	id, _ := tokenIDAndExpiry(token)
+	revoked, err := tokens.IsTokenRevoked(gtx, id)
+	if err != nil || revoked {
+		return user, token, errors.New("2FA challenge is already used")
+	}
+	userID, _ := claims["userID"].(string)
+	user, err = GetUserStorage().GetUser(gtx, userID)
+	if err == nil && authorizer != nil {
+		user.Auth, err = authorizer(gtx, user.UserID)
+	}
+	if err == nil && user.State != Active {
+		err = errors.New("User is not active")
+	}
+	return user, token, err
+}
+
+//twoFactorUser - gives the logged in user, 2FA settings can not be changed
+//using an API key
+func twoFactorUser(ctx echo.Context) (user *User, err error) {
+	session, err := RetrieveSessionInfo(ctx)
+	if err != nil {
+		return user, err
+	}
+	if session.UserType != "normal" {
+		err = errors.New("2FA can only be managed by users logged in " +
+			"with password")
+		return user, err
+	}
+	return GetUserStorage().GetUser(ctx.Request().Context(), session.UserID)
+}
+
+type twoFactorParams struct {
+	Challenge    string `json:"challenge"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+func loginTwoFactor(ctx echo.Context) (err error) {
+	status, msg := DefMS("Two factor login")
+	var data M
+	var user *User
+	var params twoFactorParams
+	gtx := ctx.Request().Context()
+	defer func() {
+		if user != nil {
+			ctx.Set("userID", user.UserID)
+			ctx.Set("userName", user.FirstName+" "+user.LastName)
+		}
+		countLogin("login_2fa", err)
+		AuditedSendSecret(ctx, &Result{
+			Status: status,
+			Op:     "login_2fa",
+			Msg:    msg,
+			OK:     err == nil,
+			Data:   data,
+			Err:    ErrString(err),
+		})
+		LogError("t.auth.2fa", err)
+	}()
+	if err = ctx.Bind(&params); err != nil {
+		msg = "Failed to read 2FA parameters"
+		status = http.StatusBadRequest
+		return err
+	}
+	user, token, err := challengeUser(gtx, params.Challenge)
+	if err != nil {
+		msg = "Invalid 2FA challenge"
+		status = http.StatusUnauthorized
+		return err
+	}
+	if wait, cerr := checkAttempt(
+		gtx, user.UserID, ctx.RealIP()); cerr == ErrTooManyAttempts {
+		ctx.Response().Header().Set(
+			"Retry-After", fmt.Sprint(int(wait/time.Second)+1))
+		err = cerr
+		msg = err.Error()
+		status = http.StatusTooManyRequests
+		return err
+	}
+	tf, err := getTwoFactor(gtx, user.UserID)
+	var codes []string
+	if err == nil {
+		if tf.Enabled {
+			err = verifySecondFactor(
+				gtx, tf, params.Code, params.RecoveryCode)
+		} else if tf.Secret != "" {
+			//Policy forced enrolment started with 'login/2fa/enroll'
+			if err = verifyTOTP(gtx, tf, params.Code); err == nil {
+				codes, err = enableTwoFactor(gtx, tf)
+			}
+		} else {
+			err = errors.New("2FA is not set up for the user")
+		}
+	}
+	if err != nil {
+		loginFailed(gtx, user.UserID, ctx.RealIP())
+		msg = "Two factor authentication failed"
+		status = http.StatusUnauthorized
+		return err
+	}
+	loginSucceeded(gtx, user.UserID)
+	id, exp := tokenIDAndExpiry(token)
+	if err = revokeToken(gtx, id, exp); err != nil {
+		msg = "Failed to complete 2FA challenge"
+		status = http.StatusInternalServerError
+		return err
+	}
+	var expired bool
+	data, expired, err = sessionTokens(gtx, user)
+	if err != nil {
+		msg = "Failed to issue tokens"
+		status = http.StatusInternalServerError
+		return err
+	}
+	if expired {
+		msg = "Password expired, reset the password to continue"
+	}
+	if codes != nil {
+		data["recoveryCodes"] = codes
+	}
+	return err
+}
+
+func loginEnrollTwoFactor(ctx echo.Context) (err error) {
+	status, msg := DefMS("Two factor enrolment")
+	var data M
+	var params twoFactorParams
+	gtx := ctx.Request().Context()
+	err = ctx.Bind(&params)
+	if err != nil {
+		msg = "Failed to read 2FA parameters"
+		status = http.StatusBadRequest
+	}
+	var user *User
+	if err == nil {
+		user, _, err = challengeUser(gtx, params.Challenge)
+		if err != nil {
+			msg = "Invalid 2FA challenge"
+			status = http.StatusUnauthorized
+		}
+	}
+	if err == nil {
+		ctx.Set("userID", user.UserID)
+		ctx.Set("userName", user.FirstName+" "+user.LastName)
+		cfg := GetTwoFactorConfig()
+		if !cfg.IsRequired(user.Auth) {
+			//Otherwise password alone would be enough to enrol, voluntary
+			//enrolment happens after login
+			err = errors.New("2FA is not required for the user")
+			msg = err.Error()
+			status = http.StatusForbidden
+		} else if data, err = startEnrolment(gtx, user); err != nil {
+			msg = "Failed to start 2FA enrolment"
+			status = http.StatusBadRequest
+		}
+	}
+	err = AuditedSendSecret(ctx, &Result{
+		Status: status,
+		Op:     "2fa_enroll",
+		Msg:    msg,
+		OK:     err == nil,
+		Data:   data,
+		Err:    ErrString(err),
+	})
+	return LogError("t.auth.2fa", err)
+}
+
+func enrollTwoFactor(ctx echo.Context) (err error) {
+	status, msg := DefMS("Two factor enrolment")
+	var data M
+	user, err := twoFactorUser(ctx)
+	if err != nil {
+		msg = "Not allowed to enrol for 2FA"
+		status = http.StatusForbidden
+	} else {
+		data, err = startEnrolment(ctx.Request().Context(), user)
+		if err != nil {
+			msg = "Failed to start 2FA enrolment"
+			status = http.StatusBadRequest
+		}
+	}
+	err = AuditedSendSecret(ctx, &Result{
+		Status: status,
+		Op:     "2fa_enroll",
+		Msg:    msg,
+		OK:     err == nil,
+		Data:   data,
+		Err:    ErrString(err),
+	})
+	return LogError("t.auth.2fa", err)
+}
+
+func confirmTwoFactor(ctx echo.Context) (err error) {
+	status, msg := DefMS("Two factor confirmation")
+	var data M
+	var params twoFactorParams
+	gtx := ctx.Request().Context()
+	user, err := twoFactorUser(ctx)
+	if err != nil {
+		msg = "Not allowed to enrol for 2FA"
+		status = http.StatusForbidden
+	} else if err = ctx.Bind(&params); err != nil {
+		msg = "Failed to read 2FA parameters"
+		status = http.StatusBadRequest
+	}
+	var tf *TwoFactor
+	if err == nil {
+		tf, err = getTwoFactor(gtx, user.UserID)
+		if err == nil && (tf.Enabled || tf.Secret == "") {
+			err = errors.New("No pending 2FA enrolment")
+		}
+		if err == nil {
+			err = verifyTOTP(gtx, tf, params.Code)
+		}
+		if err != nil {
+			msg = "Failed to verify 2FA code"
+			status = http.StatusBadRequest
+		}
+	}
+	if err == nil {
+		var codes []string
+		codes, err = enableTwoFactor(gtx, tf)
+		if err != nil {
+			msg = "Failed to enable 2FA"
+			status = http.StatusInternalServerError
+		} else {
+			data = M{"recoveryCodes": codes}
+		}
+	}
+	err = AuditedSendSecret(ctx, &Result{
+		Status: status,
+		Op:     "2fa_confirm",
+		Msg:    msg,
+		OK:     err == nil,
+		Data:   data,
+		Err:    ErrString(err),
+	})
+	return LogError("t.auth.2fa", err)
+}
+
+func disableTwoFactor(ctx echo.Context) (err error) {
+	status, msg := DefMS("Disable two factor authentication")
+	var params twoFactorParams
+	gtx := ctx.Request().Context()
+	user, err := twoFactorUser(ctx)
+	if err != nil {
+		msg = "Not allowed to disable 2FA"
+		status = http.StatusForbidden
+	} else if err = ctx.Bind(&params); err != nil {
+		msg = "Failed to read 2FA parameters"
+		status = http.StatusBadRequest
+	}
+	if err == nil {
+		cfg := GetTwoFactorConfig()
+		if cfg.IsRequired(user.Auth) {
+			err = errors.New("2FA is mandatory for the user")
+			msg = err.Error()
+			status = http.StatusForbidden
+		}
+	}
+	if err == nil {
+		var tf *TwoFactor
+		tf, err = getTwoFactor(gtx, user.UserID)
+		if err == nil && tf.Enabled {
+			err = verifySecondFactor(
+				gtx, tf, params.Code, params.RecoveryCode)
+		}
+		if err != nil {
+			msg = "Failed to verify 2FA code"
+			status = http.StatusBadRequest
+		}
+	}
+	if err == nil {
+		err = deleteTwoFactor(gtx, user.UserID)
+		if err != nil {
+			msg = "Failed to disable 2FA"
+			status = http.StatusInternalServerError
+		}
+	}
+	err = AuditedSend(ctx, &Result{
+		Status: status,
+		Op:     "2fa_disable",
+		Msg:    msg,
+		OK:     err == nil,
+		Err:    ErrString(err),
+	})
+	return LogError("t.auth.2fa", err)
+}
+
+func regenerateRecoveryCodes(ctx echo.Context) (err error) {
+	status, msg := DefMS("Regenerate recovery codes")
+	var data M
+	var params twoFactorParams
+	gtx := ctx.Request().Context()
+	user, err := twoFactorUser(ctx)
+	if err != nil {
+		msg = "Not allowed to regenerate recovery codes"
+		status = http.StatusForbidden
+	} else if err = ctx.Bind(&params); err != nil {
+		msg = "Failed to read 2FA parameters"
+		status = http.StatusBadRequest
+	}
+	var tf *TwoFactor
+	if err == nil {
+		tf, err = getTwoFactor(gtx, user.UserID)
+		if err == nil && !tf.Enabled {
+			err = errors.New("2FA is not enabled for the user")
+		}
+		if err == nil {
+			err = verifyTOTP(gtx, tf, params.Code)
+		}
+		if err != nil {
+			msg = "Failed to verify 2FA code"
+			status = http.StatusBadRequest
+		}
+	}
+	if err == nil {
+		var codes []string
+		codes, err = enableTwoFactor(gtx, tf)
+		if err != nil {
+			msg = "Failed to regenerate recovery codes"
+			status = http.StatusInternalServerError
+		} else {
+			data = M{"recoveryCodes": codes}
+		}
+	}
+	err = AuditedSendSecret(ctx, &Result{
+		Status: status,
+		Op:     "2fa_recovery_codes",
+		Msg:    msg,
+		OK:     err == nil,
+		Data:   data,
+		Err:    ErrString(err),
+	})
+	return LogError("t.auth.2fa", err)
+}
+
+func getTwoFactorStatus(ctx echo.Context) (err error) {
+	status, msg := DefMS("Get two factor status")
+	var data M
+	gtx := ctx.Request().Context()
+	userID := ctx.Param("userID")
+	if userID == "" {
+		userID = GetString(ctx, "userID")
+	}
+	user, err := GetUserStorage().GetUser(gtx, userID)
+	var tf *TwoFactor
+	if err == nil {
+		tf, err = getTwoFactor(gtx, userID)
+	}
+	if err != nil {
+		msg = "Failed to retrieve 2FA status"
+		status = http.StatusInternalServerError
+	} else {
+		cfg := GetTwoFactorConfig()
+		data = M{
+			"enabled":       tf.Enabled,
+			"required":      cfg.IsRequired(user.Auth),
+			"recoveryCodes": len(tf.RecoveryCodes),
+		}
+	}
+	err = SendAndAuditOnErr(ctx, &Result{
+		Status: status,
+		Op:     "2fa_status",
+		Msg:    msg,
+		OK:     err == nil,
+		Data:   data,
+		Err:    ErrString(err),
+	})
+	return LogError("t.auth.2fa", err)
+}
+
+func resetTwoFactor(ctx echo.Context) (err error) {
+	status, msg := DefMS("Reset two factor authentication")
+	gtx := ctx.Request().Context()
+	userID := ctx.Param("userID")
+	session, err := RetrieveSessionInfo(ctx)
+	var user *User
+	if err == nil {
+		user, err = GetUserStorage().GetUser(gtx, userID)
+	}
+	if err != nil {
+		msg = "Failed to find the user"
+		status = http.StatusBadRequest
+	} else if user.Auth < session.Role {
+		err = errors.New("Can not reset 2FA of a more privileged user")
+		msg = err.Error()
+		status = http.StatusForbidden
+	} else {
+		err = deleteTwoFactor(gtx, userID)
+		if err != nil {
+			msg = "Failed to reset 2FA"
+			status = http.StatusInternalServerError
+		}
+	}
+	err = AuditedSend(ctx, &Result{
+		Status: status,
+		Op:     "2fa_reset",
+		Msg:    msg,
+		OK:     err == nil,
+		Data: M{
+			"userID": userID,
+		},
+		Err: ErrString(err),
+	})
+	return LogError("t.auth.2fa", err)
+}
+
+func getTwoFactorEndpoints() []*Endpoint {
+	return []*Endpoint{
+		{
+			Method:   echo.POST,
+			URL:      "login/2fa",
+			Access:   Public,
+			Category: "security",
+			Func:     loginTwoFactor,
+			Comment:  "Complete login with TOTP code or recovery code",
+		},
+		{
+			Method:   echo.POST,
+			URL:      "login/2fa/enroll",
+			Access:   Public,
+			Category: "security",
+			Func:     loginEnrollTwoFactor,
+			Comment:  "Enrol for 2FA during login when policy requires it",
+		},
+		{
+			Method:   echo.GET,
+			URL:      "2fa",
+			Access:   Monitor,
+			Category: "security",
+			Func:     getTwoFactorStatus,
+			Comment:  "Get 2FA status of the logged in user",
+		},
+		{
+			Method:    echo.POST,
+			URL:       "2fa/enroll",
+			Access:    Monitor,
+			Category:  "security",
+			Func:      enrollTwoFactor,
+			Sensitive: true,
+			Comment:   "Start 2FA enrolment, gives the provisioning URI",
+		},
+		{
+			Method:    echo.POST,
+			URL:       "2fa/confirm",
+			Access:    Monitor,
+			Category:  "security",
+			Func:      confirmTwoFactor,
+			Sensitive: true,
+			Comment:   "Enable 2FA after verifying the first code",
+		},
+		{
+			Method:    echo.POST,
+			URL:       "2fa/disable",
+			Access:    Monitor,
+			Category:  "security",
+			Func:      disableTwoFactor,
+			Sensitive: true,
+			Comment:   "Disable 2FA of the logged in user",
+		},
+		{
+			Method:    echo.POST,
+			URL:       "2fa/recovery",
+			Access:    Monitor,
+			Category:  "security",
+			Func:      regenerateRecoveryCodes,
+			Sensitive: true,
+			Comment:   "Create new set of recovery codes",
+		},
+		{
+			Method:   echo.GET,
+			URL:      "uman/user/:userID/2fa",
+			Access:   Admin,
+			Category: "user management",
+			Func:     getTwoFactorStatus,
+			Comment:  "Get 2FA status of an user",
+		},
+		{
+			Method:    echo.DELETE,
+			URL:       "uman/user/:userID/2fa",
+			Access:    Admin,
+			Category:  "user management",
+			Func:      resetTwoFactor,
+			Sensitive: true,
+			Comment:   "Reset 2FA of an user who lost the device",
+		},
+	}
+}
+
+func twoFactorCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "2fa",
+		Usage: "Manage two factor authentication of users",
+		Subcommands: []cli.Command{
+			{
+				Name:  "reset",
+				Usage: "Reset 2FA of an user who lost the device",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "user",
+						Usage: "ID of the user",
+					},
+				},
+				Action: func(ctx *cli.Context) (err error) {
+					ag := NewArgGetter(ctx)
+					userID := ResolveUserID(context.TODO(),
+						ag.GetRequiredString("user"))
+					if err = ag.Err; err != nil {
+						return err
+					}
+					err = deleteTwoFactor(
+						context.TODO(), userID)
+					if err == nil {
+						Info("t.auth.2fa", "2FA reset for the user")
+					}
+					return err
+				},
+			},
+		},
+	}
+}
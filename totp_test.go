@@ -0,0 +1,64 @@
+package teak
+
+import (
+	"context"
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	//Test vectors for SHA1 from RFC 6238, the codes are the last 6 digits
+	secret := []byte("12345678901234567890")
+	cases := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, c := range cases {
+		if code := totpCode(secret, c.time/totpPeriod); code != c.code {
+			t.Errorf("At %d: expected code %s, got %s", c.time, c.code, code)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	storage, restore := useTestStorage(M{
+		"twoFactor": M{"secretKey": "fedcba9876543210fedcba9876543210"},
+	})
+	defer restore()
+	gtx := context.Background()
+	secret, encrypted, err := newTOTPSecret()
+	if err != nil {
+		t.Fatalf("Failed to create TOTP secret: %v", err)
+	}
+	tf := &TwoFactor{UserID: "u1", Secret: encrypted, Enabled: true}
+	storage.SaveTwoFactor(gtx, tf)
+	raw, _ := base32.StdEncoding.WithPadding(base32.NoPadding).
+		DecodeString(secret)
+	code := totpCode(raw, time.Now().Unix()/totpPeriod)
+
+	if err = verifyTOTP(gtx, tf, "000000"+code); err == nil {
+		t.Errorf("Expected malformed code to be rejected")
+	}
+	if err = verifyTOTP(gtx, tf, code[:3]+" "+code[3:]); err != nil {
+		t.Fatalf("Expected valid code to be accepted, got %v", err)
+	}
+	if tf.LastStep == 0 {
+		t.Errorf("Expected the used time step to be recorded")
+	}
+	if err = verifyTOTP(gtx, tf, code); err != ErrCodeUsed {
+		t.Errorf("Expected ErrCodeUsed on reuse, got %v", err)
+	}
+	old := totpCode(raw, time.Now().Unix()/totpPeriod-totpSkew-1)
+	if err = verifyTOTP(gtx, tf, old); err == nil || err == ErrCodeUsed {
+		t.Errorf("Expected code outside the window to be invalid, got %v",
+			err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	echo "github.com/labstack/echo/v4"
@@ -33,12 +34,13 @@ func getUserManagementEndpoints() []*Endpoint {
 			Comment:  "Update an user",
 		},
 		{
-			Method:   echo.DELETE,
-			URL:      "uman/user/:userID",
-			Access:   Admin,
-			Category: "user management",
-			Func:     deleteUser,
-			Comment:  "Delete an user",
+			Method:    echo.DELETE,
+			URL:       "uman/user/:userID",
+			Access:    Admin,
+			Category:  "user management",
+			Func:      deleteUser,
+			Sensitive: true,
+			Comment:   "Delete an user",
 		},
 		{
 			Method:   echo.GET,
@@ -57,20 +59,22 @@ func getUserManagementEndpoints() []*Endpoint {
 			Comment:  "Get list of user & their details",
 		},
 		{
-			Method:   echo.POST,
-			URL:      "uman/user/password",
-			Access:   Admin,
-			Category: "user management",
-			Func:     setPassword,
-			Comment:  "Set password for an user",
+			Method:    echo.POST,
+			URL:       "uman/user/password",
+			Access:    Admin,
+			Category:  "user management",
+			Func:      setPassword,
+			Sensitive: true,
+			Comment:   "Set password for an user",
 		},
 		{
-			Method:   echo.PUT,
-			URL:      "uman/user/password",
-			Access:   Monitor,
-			Category: "user management",
-			Func:     resetPassword,
-			Comment:  "Reset password",
+			Method:    echo.PUT,
+			URL:       "uman/user/password",
+			Access:    Monitor,
+			Category:  "user management",
+			Func:      resetPassword,
+			Sensitive: true,
+			Comment:   "Reset password",
 		},
 		{
 			Method:   echo.POST,
@@ -104,15 +108,10 @@ func SendVerificationMail(user *User) (err error) {
 	content := "Hi!,\n Verify your account by clicking on " +
 		"below link\n" + getVerificationLink(user)
 	subject := "Verification for Sparrow"
-	var emailKey string
-	if GetConfig("emailKey", &emailKey) {
-		var email string
-		email, err = DecryptStr(emailKey, user.Email)
-		if err == nil {
-			err = SendEmail(email, subject, content)
-		}
-	} else {
-		err = errors.New("Failed read EMail configuration")
+	var email string
+	email, err = DecryptEmail(user.Email)
+	if err == nil {
+		err = SendEmail(email, subject, content)
 	}
 	// fmt.Println(content)
 	return LogError("t.uman", err)
@@ -150,7 +149,7 @@ func getVerificationLink(user *User) (link string) {
 
 //SetUserStorage - sets the user storage strategu
 func SetUserStorage(storage UserStorage) {
-	userStorage = storage
+	userStorage = withUserMetrics(storage)
 }
 
 //GetUserStorage - get the configured user storage
@@ -161,10 +160,9 @@ func GetUserStorage() UserStorage {
 //UpdateUserInfo - updates common user fields
 func UpdateUserInfo(user *User) (err error) {
 	if len(user.UserID) == 0 {
-		// @TODO - store hash of user ID
-		user.UserID = Hash(user.Email)
+		user.UserID = UserIDHash(user.Email)
 	} else {
-		user.UserID = Hash(user.UserID)
+		user.UserID = UserIDHash(user.UserID)
 	}
 	user.VerID = uuid.NewV4().String()
 	user.CreatedAt = time.Now()
@@ -172,11 +170,32 @@ func UpdateUserInfo(user *User) (err error) {
 	// user.State = Disabled
 	user.FullName = user.FirstName + " " + user.LastName
 	// @TODO create a key retrieving strategy -- local | remote etc
-	var emailKey string
-	if GetConfig("emailKey", &emailKey) {
-		user.Email, err = EncryptStr(emailKey, user.Email)
+	ek, err := GetEmailKeys()
+	if err == nil {
+		user.EmailIndex, err = ek.Index(user.Email)
+	}
+	if err == nil {
+		user.Email, err = ek.Encrypt(user.Email)
+	}
+	return err
+}
+
+//prepareEmail - makes sure that the email of an user being updated is
+//encrypted and indexed. Clients send either the encrypted email they have
+//read or a new email in plain text, which unlike the encrypted one has '@'
+func prepareEmail(user *User) (err error) {
+	ek, err := GetEmailKeys()
+	if err != nil {
+		return err
+	}
+	email := user.Email
+	if strings.Contains(email, "@") {
+		user.Email, err = ek.Encrypt(email)
 	} else {
-		err = errors.New("Failed to read email configuration")
+		email, err = ek.Decrypt(user.Email)
+	}
+	if err == nil {
+		user.EmailIndex, err = ek.Index(email)
 	}
 	return err
 }
@@ -190,7 +209,10 @@ func createUser(ctx echo.Context) (err error) {
 			"creationMode": "admin",
 		}
 		_, err = userStorage.CreateUser(ctx.Request().Context(), &user)
-		if err != nil {
+		if err == ErrEmailExists {
+			msg = "Email is used by another user"
+			status = http.StatusBadRequest
+		} else if err != nil {
 			msg = "Failed to create user in database"
 			status = http.StatusInternalServerError
 		} else {
@@ -223,6 +245,16 @@ func registerUser(ctx echo.Context) (err error) {
 		User     User   `json:"user"`
 		Password string `json:"password"`
 	}{}
+	if GetRegistrationConfig().Disabled {
+		ctx.Set("userName", "N/A")
+		return AuditedSendX(ctx, nil, &Result{
+			Status: http.StatusForbidden,
+			Op:     "user_register",
+			Msg:    "Registration is by invitation only",
+			OK:     false,
+			Err:    "Open registration is disabled",
+		})
+	}
 	err = ctx.Bind(&upw)
 	if err == nil {
 		upw.User.Auth = Normal
@@ -267,9 +299,15 @@ func updateUser(ctx echo.Context) (err error) {
 	status, msg := DefMS("Update User")
 	var user User
 	err = ctx.Bind(&user)
+	if err == nil {
+		err = prepareEmail(&user)
+	}
 	if err == nil {
 		err = userStorage.UpdateUser(ctx.Request().Context(), &user)
-		if err != nil {
+		if err == ErrEmailExists {
+			msg = "Email is used by another user"
+			status = http.StatusBadRequest
+		} else if err != nil {
 			msg = "Failed to update user in database"
 			status = http.StatusInternalServerError
 		}
@@ -396,11 +434,12 @@ func setPassword(ctx echo.Context) (err error) {
 	err = ctx.Bind(&pinfo)
 	userID, ok1 := pinfo["userID"]
 	password, ok2 := pinfo["password"]
+	var data interface{}
 	if err == nil && ok1 && ok2 {
 		err = userStorage.SetPassword(ctx.Request().Context(), userID, password)
 		if err != nil {
-			msg = "Failed to set password in database"
-			status = http.StatusInternalServerError
+			status, msg, data = passwordFailure(
+				err, "Failed to set password in database")
 		}
 	} else {
 		status = http.StatusBadRequest
@@ -411,7 +450,7 @@ func setPassword(ctx echo.Context) (err error) {
 		Op:     "user_password_set",
 		Msg:    msg,
 		OK:     err == nil,
-		Data:   nil,
+		Data:   data,
 		Err:    ErrString(err),
 	})
 	return LogError("t.uman", err)
@@ -424,12 +463,26 @@ func resetPassword(ctx echo.Context) (err error) {
 	userID := GetString(ctx, "userID")
 	oldPassword, ok2 := pinfo["oldPassword"]
 	newPassword, ok3 := pinfo["newPassword"]
+	var data interface{}
+	gtx := ctx.Request().Context()
 	if err == nil && ok2 && ok3 && len(userID) != 0 {
-		err = userStorage.ResetPassword(
-			ctx.Request().Context(), userID, oldPassword, newPassword)
+		if oldPassword == newPassword {
+			err = &PasswordPolicyError{Violations: []PolicyViolation{{
+				Rule: "different",
+				Msg:  "must be different from the current password",
+			}}}
+		} else {
+			err = userStorage.ResetPassword(
+				gtx, userID, oldPassword, newPassword)
+		}
 		if err != nil {
-			msg = "Failed to reset password in database"
-			status = http.StatusInternalServerError
+			status, msg, data = passwordFailure(
+				err, "Failed to reset password in database")
+		} else if token, terr := GetToken(ctx); terr == nil &&
+			tokenPurpose(token) == pwdResetPurpose {
+			//Token given for expired password is good for one reset
+			id, exp := tokenIDAndExpiry(token)
+			err = revokeToken(gtx, id, exp)
 		}
 	} else {
 		status = http.StatusBadRequest
@@ -440,7 +493,7 @@ func resetPassword(ctx echo.Context) (err error) {
 		Op:     "user_password_reset",
 		Msg:    msg,
 		OK:     err == nil,
-		Data:   nil,
+		Data:   data,
 		Err:    ErrString(err),
 	})
 	return LogError("t.uman", err)
@@ -452,18 +505,28 @@ func verify(ctx echo.Context) (err error) {
 	userID := ctx.Param("userID")
 	verID := ctx.Param("verID")
 	err = ctx.Bind(&params)
+	var data interface{}
 	if len(userID) > 0 && len(verID) > 0 && err == nil {
-		err = userStorage.VerifyUser(ctx.Request().Context(), userID, verID)
+		//Policy is checked before verifying, otherwise an user could end up
+		//verified without a password
+		policy := GetPasswordPolicy()
+		err = policy.Check(params["password"], nil)
 		if err == nil {
-			err = userStorage.SetPassword(
-				ctx.Request().Context(), userID, params["password"])
+			err = userStorage.VerifyUser(ctx.Request().Context(), userID, verID)
 			if err != nil {
-				msg = "Failed to set password"
+				msg = "Failed to verify user"
 				status = http.StatusInternalServerError
 			}
 		} else {
-			msg = "Failed to verify user"
-			status = http.StatusInternalServerError
+			status, msg, data = passwordFailure(err, "")
+		}
+		if err == nil {
+			err = userStorage.SetPassword(
+				ctx.Request().Context(), userID, params["password"])
+			if err != nil {
+				status, msg, data = passwordFailure(
+					err, "Failed to set password")
+			}
 		}
 	} else {
 		status = http.StatusBadRequest
@@ -479,6 +542,7 @@ func verify(ctx echo.Context) (err error) {
 		Data: M{
 			"userID":         hash,
 			"verificationID": verID,
+			"violations":     data,
 		},
 		Err: ErrString(err),
 	})
@@ -490,9 +554,15 @@ func updateProfile(ctx echo.Context) (err error) {
 	var user User
 	sessionUserID := GetString(ctx, "userID")
 	err = ctx.Bind(&user)
+	if err == nil {
+		err = prepareEmail(&user)
+	}
 	if err == nil && sessionUserID == user.UserID {
 		err = userStorage.UpdateProfile(ctx.Request().Context(), &user)
-		if err != nil {
+		if err == ErrEmailExists {
+			msg = "Email is used by another user"
+			status = http.StatusBadRequest
+		} else if err != nil {
 			msg = "Failed to update profile in database"
 			status = http.StatusInternalServerError
 		}
@@ -523,6 +593,19 @@ func (uh *UserHandler) DataType() string {
 	return "teakUser"
 }
 
+//Permissions - users are managed through user management endpoints, so only
+//admins can read them and only super users can modify them through the generic
+//endpoints
+func (uh *UserHandler) Permissions() map[Operation]Permission {
+	return map[Operation]Permission{
+		OpCreate: {Access: Super},
+		OpRead:   {Access: Admin},
+		OpUpdate: {Access: Super},
+		OpDelete: {Access: Super},
+		OpList:   {Access: Admin},
+	}
+}
+
 //UniqueKeyField - gives the field which uniquely identifies the user
 func (uh *UserHandler) UniqueKeyField() string {
 	return "id"
@@ -0,0 +1,82 @@
+package teak
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	echo "github.com/labstack/echo/v4"
+)
+
+func TestPrepareEmail(t *testing.T) {
+	_, restore := useTestStorage(nil)
+	defer restore()
+	index, _ := EmailIndex("someone@example.com")
+
+	user := &User{Email: "someone@example.com"}
+	if err := prepareEmail(user); err != nil {
+		t.Fatalf("Failed to prepare email: %v", err)
+	}
+	if strings.Contains(user.Email, "@") || user.EmailIndex != index {
+		t.Errorf("Expected plain email to be encrypted and indexed")
+	}
+	//Clients send back the encrypted email they have read
+	encrypted := user.Email
+	user = &User{Email: encrypted}
+	if err := prepareEmail(user); err != nil || user.Email != encrypted ||
+		user.EmailIndex != index {
+		t.Errorf("Expected encrypted email to be kept and indexed: %v", err)
+	}
+	if err := prepareEmail(&User{Email: "garbage"}); err == nil {
+		t.Errorf("Expected invalid encrypted email to be rejected")
+	}
+}
+
+func TestFindUserByEmail(t *testing.T) {
+	storage, restore := useTestStorage(nil)
+	defer restore()
+	gtx := context.Background()
+	userID := createTestUser(t, storage, "alice", Normal)
+
+	emails, err := GetEmailStorage()
+	if err != nil {
+		t.Fatalf("Expected test storage to support email index: %v", err)
+	}
+	user, err := emails.GetUserByEmail(gtx, " Alice@Example.COM")
+	if err != nil || user.UserID != userID {
+		t.Errorf("Expected user to be found by email: %v", err)
+	}
+	//Users can login with their email even if they have another user ID
+	if id := ResolveUserID(gtx, "alice@example.com"); id != userID {
+		t.Errorf("Expected user ID to be resolved from email")
+	}
+	if id := ResolveUserID(gtx, "bob@example.com"); id !=
+		UserIDHash("bob@example.com") {
+		t.Errorf("Expected unknown email to give identifier of the email")
+	}
+}
+
+func TestCreateUserWithUsedEmail(t *testing.T) {
+	storage, restore := useTestStorage(nil)
+	defer restore()
+	createTestUser(t, storage, "alice", Normal)
+
+	body, _ := json.Marshal(M{
+		"userID":    "alice2",
+		"email":     "ALICE@example.com",
+		"firstName": "Other",
+		"lastName":  "Alice",
+	})
+	req := httptest.NewRequest(http.MethodPost, "/",
+		strings.NewReader(string(body)))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	createUser(echo.New().NewContext(req, rec))
+	if rec.Code != http.StatusBadRequest || len(storage.users) != 1 {
+		t.Errorf("Expected user with used email to be rejected, status %d",
+			rec.Code)
+	}
+}
@@ -0,0 +1,327 @@
+package teak
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"gopkg.in/urfave/cli.v1"
+)
+
+//UserIDScheme - derives the identifier that is stored for an user from the ID
+//the user logs in with. Identifiers of different schemes should be
+//distinguishable so that the scheme of a stored identifier can be found
+type UserIDScheme interface {
+	//Name - unique name of the scheme
+	Name() string
+
+	//Derive - gives the identifier for given user ID
+	Derive(userID string) string
+
+	//Owns - tells if the identifier is derived using this scheme
+	Owns(id string) bool
+}
+
+//UserIDConfig - configuration of user identifiers, read from 'userID' key of
+//the app config. Scheme is the name of the scheme used for new identifiers,
+//'hmac-sha256' by default. Key is the secret of keyed schemes
+type UserIDConfig struct {
+	Scheme string `json:"scheme"`
+	Key    string `json:"key"`
+}
+
+var hexRx = regexp.MustCompile(`^[0-9a-f]+$`)
+
+//sha1IDScheme - unsalted SHA-1 of the user ID, identifiers created before
+//keyed schemes were introduced use this
+type sha1IDScheme struct{}
+
+func (s sha1IDScheme) Name() string { return "sha1" }
+
+func (s sha1IDScheme) Derive(userID string) string { return Hash(userID) }
+
+func (s sha1IDScheme) Owns(id string) bool {
+	return len(id) == 40 && hexRx.MatchString(id)
+}
+
+//HMACIDScheme - HMAC-SHA256 of the user ID with a secret key, identifiers can
+//not be derived from known emails without the key
+type HMACIDScheme struct {
+	Key []byte
+}
+
+//Name - name of the scheme
+func (s *HMACIDScheme) Name() string { return "hmac-sha256" }
+
+//Derive - gives hex encoded HMAC of the user ID
+func (s *HMACIDScheme) Derive(userID string) string {
+	mac := hmac.New(sha256.New, s.Key)
+	mac.Write([]byte(userID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//Owns - tells if the identifier has the form of a HMAC-SHA256 identifier
+func (s *HMACIDScheme) Owns(id string) bool {
+	return len(id) == 64 && hexRx.MatchString(id)
+}
+
+//SHA1IDScheme - gives the legacy scheme, useful for listing it among the
+//older schemes when setting custom schemes
+func SHA1IDScheme() UserIDScheme {
+	return sha1IDScheme{}
+}
+
+var userIDSchemes struct {
+	sync.RWMutex
+	current UserIDScheme
+	legacy  []UserIDScheme
+}
+
+//SetUserIDSchemes - sets the scheme used for new identifiers and the older
+//schemes whose identifiers are still accepted. The schemes from the config are
+//used if this is not called
+func SetUserIDSchemes(current UserIDScheme, legacy ...UserIDScheme) {
+	userIDSchemes.Lock()
+	defer userIDSchemes.Unlock()
+	userIDSchemes.current = current
+	userIDSchemes.legacy = legacy
+}
+
+//getUserIDSchemes - gives the current scheme and the legacy schemes, loads
+//them from config on first use. Without a key HMAC can not be used, SHA-1 is
+//used so that existing installations keep working
+func getUserIDSchemes() (current UserIDScheme, legacy []UserIDScheme) {
+	userIDSchemes.RLock()
+	current, legacy = userIDSchemes.current, userIDSchemes.legacy
+	userIDSchemes.RUnlock()
+	if current != nil {
+		return current, legacy
+	}
+	var cfg UserIDConfig
+	GetConfig("userID", &cfg)
+	switch {
+	case cfg.Scheme == "sha1":
+		current = sha1IDScheme{}
+	case cfg.Key == "":
+		Warn("t.uman.userid", "No key configured for user IDs, "+
+			"falling back to SHA-1 based user IDs")
+		current = sha1IDScheme{}
+	default:
+		current = &HMACIDScheme{Key: []byte(cfg.Key)}
+		legacy = []UserIDScheme{sha1IDScheme{}}
+	}
+	SetUserIDSchemes(current, legacy...)
+	return current, legacy
+}
+
+//UserIDHash - gives the identifier of the user ID using the current scheme,
+//this is the identifier for new users
+func UserIDHash(userID string) string {
+	current, _ := getUserIDSchemes()
+	return current.Derive(userID)
+}
+
+//IsLegacyUserID - tells if the identifier was derived with an older scheme
+func IsLegacyUserID(id string) bool {
+	current, _ := getUserIDSchemes()
+	return !current.Owns(id)
+}
+
+//ResolveUserID - gives the stored identifier of the user with given user ID.
+//Users created with an older scheme are found by the identifier of that scheme
+//until they are migrated. If the user ID is an email that is not used as user
+//ID, the user with that email is found using the email index. If there is no
+//such user, the identifier of the current scheme is given
+func ResolveUserID(gtx context.Context, userID string) (id string) {
+	current, legacy := getUserIDSchemes()
+	id = current.Derive(userID)
+	storage := GetUserStorage()
+	isEmail := strings.Contains(userID, "@")
+	if storage == nil || (len(legacy) == 0 && !isEmail) {
+		return id
+	}
+	if _, err := storage.GetUser(gtx, id); err == nil {
+		return id
+	}
+	for _, scheme := range legacy {
+		old := scheme.Derive(userID)
+		if _, err := storage.GetUser(gtx, old); err == nil {
+			return old
+		}
+	}
+	if emails, err := GetEmailStorage(); err == nil && isEmail {
+		if user, err := emails.GetUserByEmail(gtx, userID); err == nil {
+			return user.UserID
+		}
+	}
+	return id
+}
+
+//UserRenamer - optional interface of user storages that can change the
+//identifier of an user, needed for migrating user IDs
+type UserRenamer interface {
+	//RenameUser - changes the identifier of an user along with the secrets,
+	//tokens, keys, group memberships and events that refer to it
+	RenameUser(gtx context.Context, oldID, newID string) (err error)
+}
+
+//GetUserRenamer - gives the user storage if it supports renaming users
+func GetUserRenamer() (storage UserRenamer, err error) {
+	storage, ok := unwrapUserStorage(GetUserStorage()).(UserRenamer)
+	if !ok {
+		return storage, errors.New(
+			"User storage does not support renaming users")
+	}
+	return &metricUserRenamer{storage}, err
+}
+
+//MigrateUserID - moves the user with a legacy identifier to the identifier
+//given by the current scheme. The plain user ID is needed since identifiers
+//can not be reversed
+func MigrateUserID(gtx context.Context, oldID, userID string) (
+	newID string, err error) {
+	current, legacy := getUserIDSchemes()
+	newID = current.Derive(userID)
+	if oldID == newID {
+		return newID, err
+	}
+	derived := false
+	for _, scheme := range legacy {
+		if scheme.Derive(userID) == oldID {
+			derived = true
+			break
+		}
+	}
+	if !derived {
+		return oldID, fmt.Errorf(
+			"User ID does not match the identifier '%s'", oldID)
+	}
+	renamer, err := GetUserRenamer()
+	if err == nil {
+		err = renamer.RenameUser(gtx, oldID, newID)
+	}
+	if err != nil {
+		return oldID, LogErrorX("t.uman.userid",
+			"Failed to migrate identifier of user %s", err, oldID)
+	}
+	Info("t.uman.userid", "Migrated user %s to %s identifier",
+		oldID, current.Name())
+	return newID, err
+}
+
+//migrateUserIDs - migrates the users with legacy identifiers. The email of
+//the user and the given user IDs are tried as the plain user ID. Users for
+//whom it is not found are migrated when they login next time
+func migrateUserIDs(gtx context.Context, userIDs []string, dryRun bool) (
+	migrated, pending int, err error) {
+	ek, err := GetEmailKeys()
+	if err != nil {
+		return migrated, pending, err
+	}
+	_, legacy := getUserIDSchemes()
+	//Maps legacy identifiers to the plain user IDs they are derived from
+	known := make(map[string]string)
+	for _, userID := range userIDs {
+		for _, scheme := range legacy {
+			known[scheme.Derive(userID)] = userID
+		}
+	}
+	//All users are read before renaming so that paging is not affected
+	storage := GetUserStorage()
+	users := make([]*User, 0, 100)
+	for offset := int64(0); ; offset += 100 {
+		page, err := storage.GetUsers(gtx, offset, 100, nil)
+		if err != nil {
+			return migrated, pending, err
+		}
+		users = append(users, page...)
+		if len(page) < 100 {
+			break
+		}
+	}
+	for _, user := range users {
+		if !IsLegacyUserID(user.UserID) {
+			continue
+		}
+		userID, found := known[user.UserID]
+		if !found {
+			email, derr := ek.Decrypt(user.Email)
+			for _, scheme := range legacy {
+				if derr == nil && scheme.Derive(email) == user.UserID {
+					userID, found = email, true
+				}
+			}
+		}
+		if !found {
+			pending++
+			continue
+		}
+		if !dryRun {
+			if _, err = MigrateUserID(gtx, user.UserID, userID); err != nil {
+				return migrated, pending, err
+			}
+		}
+		migrated++
+	}
+	return migrated, pending, err
+}
+
+func migrateUserIDsCmd() *cli.Command {
+	return &cli.Command{
+		Name: "migrate-ids",
+		Usage: "Move users with legacy identifiers to the current " +
+			"identifier scheme",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name: "ids",
+				Usage: "File with plain user IDs, one per line, for users " +
+					"whose ID is not their email",
+			},
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Only report the users that would be migrated",
+			},
+		},
+		Action: func(ctx *cli.Context) (err error) {
+			ag := NewArgGetter(ctx)
+			path := ag.GetOptionalString("ids")
+			dryRun := ctx.Bool("dry-run")
+			userIDs := make([]string, 0, 100)
+			if path != "" {
+				file, err := os.Open(path)
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+				scanner := bufio.NewScanner(file)
+				for scanner.Scan() {
+					if line := strings.TrimSpace(scanner.Text()); line != "" {
+						userIDs = append(userIDs, line)
+					}
+				}
+				if err = scanner.Err(); err != nil {
+					return err
+				}
+			}
+			migrated, pending, err := migrateUserIDs(
+				context.TODO(), userIDs, dryRun)
+			if err != nil {
+				return LogErrorX("t.uman.userid",
+					"Failed to migrate user identifiers", err)
+			}
+			fmt.Printf("Migrated: %d\nPending:  %d\n", migrated, pending)
+			if pending != 0 {
+				fmt.Println("Pending users are migrated when they login")
+			}
+			return err
+		},
+	}
+}
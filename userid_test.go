@@ -0,0 +1,98 @@
+package teak
+
+import (
+	"context"
+	"testing"
+)
+
+//useUserIDSchemes - sets the user ID schemes, the returned function restores
+//the previous ones. Nil current scheme makes them load from config
+func useUserIDSchemes(current UserIDScheme, legacy ...UserIDScheme) (
+	restore func()) {
+	prevCurrent, prevLegacy := getUserIDSchemes()
+	SetUserIDSchemes(current, legacy...)
+	return func() { SetUserIDSchemes(prevCurrent, prevLegacy...) }
+}
+
+func TestUserIDSchemes(t *testing.T) {
+	first := &HMACIDScheme{Key: []byte("first")}
+	second := &HMACIDScheme{Key: []byte("second")}
+	id := first.Derive("someone@example.com")
+	if !first.Owns(id) || SHA1IDScheme().Owns(id) {
+		t.Errorf("Expected HMAC identifier to be told apart from SHA-1")
+	}
+	if id == second.Derive("someone@example.com") {
+		t.Errorf("Expected identifiers to depend on the key")
+	}
+	legacy := SHA1IDScheme().Derive("someone@example.com")
+	if !SHA1IDScheme().Owns(legacy) || first.Owns(legacy) {
+		t.Errorf("Expected SHA-1 identifier to be told apart from HMAC")
+	}
+
+	cases := []struct {
+		cfg     M
+		current string
+		legacy  int
+	}{
+		{M{"key": "secret"}, "hmac-sha256", 1},
+		{M{}, "sha1", 0},
+		{M{"scheme": "sha1", "key": "secret"}, "sha1", 0},
+	}
+	for _, c := range cases {
+		_, restore := useTestStorage(M{"userID": c.cfg})
+		restoreSchemes := useUserIDSchemes(nil)
+		current, legacy := getUserIDSchemes()
+		if current.Name() != c.current || len(legacy) != c.legacy {
+			t.Errorf("Config %v: expected %s with %d legacy schemes, "+
+				"got %s with %d", c.cfg, c.current, c.legacy,
+				current.Name(), len(legacy))
+		}
+		restoreSchemes()
+		restore()
+	}
+}
+
+func TestLegacyUserIDs(t *testing.T) {
+	storage, restore := useTestStorage(nil)
+	defer restore()
+	defer useUserIDSchemes(
+		&HMACIDScheme{Key: []byte("secret")}, SHA1IDScheme())()
+	gtx := context.Background()
+	oldID := SHA1IDScheme().Derive("old@example.com")
+	storage.users[oldID] = &User{UserID: oldID, State: Active}
+	storage.pwds[oldID] = "password"
+	newID := createTestUser(t, storage, "new", Normal)
+
+	if !IsLegacyUserID(oldID) || IsLegacyUserID(newID) {
+		t.Errorf("Expected only the SHA-1 identifier to be legacy")
+	}
+	if id := ResolveUserID(gtx, "old@example.com"); id != oldID {
+		t.Errorf("Expected legacy user to be found before migration")
+	}
+	if id := ResolveUserID(gtx, "new"); id != newID {
+		t.Errorf("Expected new user to be found with current scheme")
+	}
+	if id := ResolveUserID(gtx, "missing"); id != UserIDHash("missing") {
+		t.Errorf("Expected current identifier for unknown user")
+	}
+
+	if _, err := MigrateUserID(gtx, oldID, "other@example.com"); err == nil {
+		t.Errorf("Expected migration with wrong user ID to fail")
+	}
+	migrated, err := MigrateUserID(gtx, oldID, "old@example.com")
+	if err != nil || migrated != UserIDHash("old@example.com") {
+		t.Fatalf("Failed to migrate legacy user: %v", err)
+	}
+	if storage.users[oldID] != nil || storage.users[migrated] == nil ||
+		storage.pwds[migrated] != "password" {
+		t.Errorf("Expected user and password to be moved to new identifier")
+	}
+	if id := ResolveUserID(gtx, "old@example.com"); id != migrated {
+		t.Errorf("Expected migrated user to be found with current scheme")
+	}
+	//Migrating again does nothing
+	if id, err := MigrateUserID(gtx, migrated, "old@example.com"); err !=
+		nil || id != migrated {
+		t.Errorf("Expected migrated user to be left as is: %v", err)
+	}
+}